@@ -0,0 +1,243 @@
+// Command netemctl loads a [netem.Scenario], creates the emulated network,
+// runs the measurements listed by the scenario, and writes a JSON summary.
+//
+// Usage:
+//
+//	netemctl -scenario FILE [-pcap-dir DIR] [-summary FILE]
+//	         [-socks5 ADDRESS -socks5-host NAME [-ca-file FILE]]
+//
+// The exit code is zero when all the measurements meet their expectations,
+// one when some expectations fail, and two in case of usage or setup errors.
+//
+// With -socks5, after running the measurements, netemctl keeps the emulated
+// network up and runs a [netem.SOCKS5Server] forwarding requests using the
+// given host until interrupted. Use -ca-file to save the PEM-encoded CA
+// certificate that programs using the proxy need to trust. For example:
+//
+//	netemctl -scenario scenario.yaml -socks5 127.0.0.1:1080 -socks5-host client -ca-file ca.pem
+//	curl --cacert ca.pem --socks5-hostname 127.0.0.1:1080 https://www.example.com/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/ooni/netem"
+)
+
+// Exit codes used by this program.
+const (
+	exitSuccess = 0
+	exitFailure = 1
+	exitSetup   = 2
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// summary is the JSON summary emitted by this program.
+type summary struct {
+	// Scenario is the scenario name.
+	Scenario string `json:"scenario"`
+
+	// Success indicates whether all measurements met their expectations.
+	Success bool `json:"success"`
+
+	// Measurements contains the measurement results.
+	Measurements []*result `json:"measurements"`
+}
+
+// run implements main using the given command line arguments and
+// output streams and returns the exit code. The context controls
+// for how long we run the SOCKS5 proxy.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	fset := flag.NewFlagSet("netemctl", flag.ContinueOnError)
+	fset.SetOutput(stderr)
+	scenarioFile := fset.String("scenario", "", "scenario file to load (YAML or JSON)")
+	pcapDir := fset.String("pcap-dir", "", "directory where to write a PCAP for each host and server")
+	summaryFile := fset.String("summary", "", "file where to write the JSON summary (default: stdout)")
+	socks5Address := fset.String("socks5", "", "host address where to run a SOCKS5 proxy (e.g., 127.0.0.1:1080)")
+	socks5Host := fset.String("socks5-host", "", "name of the host or server used by the SOCKS5 proxy")
+	caFile := fset.String("ca-file", "", "file where to write the PEM-encoded CA certificate")
+	if err := fset.Parse(args); err != nil {
+		return exitSetup
+	}
+	if *scenarioFile == "" || fset.NArg() > 0 || (*socks5Address == "") != (*socks5Host == "") {
+		fset.Usage()
+		return exitSetup
+	}
+
+	scenario, err := netem.LoadScenarioFile(*scenarioFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "netemctl: %s\n", err.Error())
+		return exitSetup
+	}
+	if *pcapDir != "" {
+		if err := os.MkdirAll(*pcapDir, 0755); err != nil {
+			fmt.Fprintf(stderr, "netemctl: %s\n", err.Error())
+			return exitSetup
+		}
+		setPCAPFiles(scenario, *pcapDir)
+	}
+
+	topology, err := netem.NewScenarioTopology(log.Log, scenario)
+	if err != nil {
+		fmt.Fprintf(stderr, "netemctl: %s\n", err.Error())
+		return exitSetup
+	}
+
+	// explicitly close the topology to await for PCAPDumper to finish
+	defer topology.Close()
+
+	if *caFile != "" {
+		if err := writeCAFile(topology, *caFile); err != nil {
+			fmt.Fprintf(stderr, "netemctl: %s\n", err.Error())
+			return exitSetup
+		}
+	}
+
+	sum, err := runMeasurements(topology, scenario)
+	if err != nil {
+		fmt.Fprintf(stderr, "netemctl: %s\n", err.Error())
+		return exitSetup
+	}
+
+	data, err := json.MarshalIndent(sum, "", "  ")
+	if err != nil {
+		fmt.Fprintf(stderr, "netemctl: %s\n", err.Error())
+		return exitSetup
+	}
+	data = append(data, '\n')
+	if *summaryFile != "" {
+		err = os.WriteFile(*summaryFile, data, 0644)
+	} else {
+		_, err = stdout.Write(data)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "netemctl: %s\n", err.Error())
+		return exitSetup
+	}
+
+	if *socks5Address != "" {
+		if err := serveSOCKS5(ctx, topology, *socks5Host, *socks5Address); err != nil {
+			fmt.Fprintf(stderr, "netemctl: %s\n", err.Error())
+			return exitSetup
+		}
+	}
+
+	if !sum.Success {
+		return exitFailure
+	}
+	return exitSuccess
+}
+
+// writeCAFile writes the PEM-encoded CA certificate, which is shared by all
+// the hosts and servers of the topology, to the given file.
+func writeCAFile(topology *netem.ScenarioTopology, filename string) error {
+	var ca netem.CertificationAuthority
+	for _, stack := range topology.Hosts {
+		ca = stack
+	}
+	for _, server := range topology.Servers {
+		ca = server.Stack()
+	}
+	if ca == nil {
+		return errors.New("the scenario contains no hosts or servers")
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.CACert().Raw})
+	return os.WriteFile(filename, data, 0644)
+}
+
+// serveSOCKS5 runs a SOCKS5 proxy using the given host until the context is done.
+func serveSOCKS5(ctx context.Context, topology *netem.ScenarioTopology, host, address string) error {
+	stack := stackByName(topology, host)
+	if stack == nil {
+		return fmt.Errorf("unknown SOCKS5 host %q", host)
+	}
+	srv, err := netem.NewSOCKS5Server(log.Log, stack, address)
+	if err != nil {
+		return err
+	}
+	defer srv.Close()
+	log.Infof("netemctl: SOCKS5 proxy listening at %s using %s; interrupt to stop", srv.Addr().String(), host)
+	<-ctx.Done()
+	return nil
+}
+
+// setPCAPFiles configures the links of hosts and servers to write PCAP
+// files inside the given directory, named after the host or server.
+func setPCAPFiles(scenario *netem.Scenario, dir string) {
+	for _, host := range scenario.Hosts {
+		name := nameOrAddress(host.Name, host.Address)
+		host.Link.PCAP = filepath.Join(dir, name+".pcap")
+		for _, iface := range host.Interfaces {
+			iface.Link.PCAP = filepath.Join(dir, name+"_"+iface.Address+".pcap")
+		}
+	}
+	for _, server := range scenario.Servers {
+		server.Link.PCAP = filepath.Join(dir, nameOrAddress(server.Name, server.Address)+".pcap")
+	}
+}
+
+// nameOrAddress returns the name, if not empty, or the address.
+func nameOrAddress(name, address string) string {
+	if name != "" {
+		return name
+	}
+	return address
+}
+
+// runMeasurements runs the measurements listed by the scenario.
+func runMeasurements(topology *netem.ScenarioTopology, scenario *netem.Scenario) (*summary, error) {
+	sum := &summary{
+		Scenario:     scenario.Name,
+		Success:      true,
+		Measurements: []*result{},
+	}
+	for idx, sm := range scenario.Measurements {
+		if sm.Name == "" {
+			sm.Name = fmt.Sprintf("%s#%d", sm.Type, idx)
+		}
+		log.Infof("netemctl: running %s", sm.Name)
+		res, err := measure(topology, sm)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", sm.Name, err)
+		}
+		res.Failures = check(sm.Expect, res)
+		if len(res.Failures) > 0 {
+			log.Warnf("netemctl: %s: failed expectations: %v", sm.Name, res.Failures)
+			sum.Success = false
+		}
+		sum.Measurements = append(sum.Measurements, res)
+	}
+	return sum, nil
+}
+
+// errMeasurement indicates an invalid measurement.
+var errMeasurement = errors.New("invalid measurement")
+
+// parseDuration parses an optional duration with the given default value.
+func parseDuration(value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", errMeasurement, err.Error())
+	}
+	return duration, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	t.Run("we run the measurements and write PCAPs", func(t *testing.T) {
+		dir := t.TempDir()
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		code := run(context.Background(), []string{"-scenario", "testdata/example.yaml", "-pcap-dir", dir}, stdout, stderr)
+		if code != exitSuccess {
+			t.Fatal("unexpected exit code", code, stdout.String(), stderr.String())
+		}
+		var sum summary
+		if err := json.Unmarshal(stdout.Bytes(), &sum); err != nil {
+			t.Fatal(err)
+		}
+		if !sum.Success || len(sum.Measurements) != 4 {
+			t.Fatal("unexpected summary", stdout.String())
+		}
+		if m := sum.Measurements[2]; m.Name != "http#2" || m.Protocol != "HTTP/3.0" {
+			t.Fatal("unexpected measurement", stdout.String())
+		}
+		for _, name := range []string{"client", "resolver", "web"} {
+			if _, err := os.Stat(filepath.Join(dir, name+".pcap")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("we fail when expectations are not met", func(t *testing.T) {
+		scenario := filepath.Join(t.TempDir(), "scenario.json")
+		data := []byte(`{"hosts": [{"name": "client", "address": "10.0.0.1", "resolver": "8.8.8.8"}],
+			"servers": [{"type": "dns", "address": "8.8.8.8"}],
+			"measurements": [{"type": "dns", "host": "client", "domain": "www.example.com",
+				"timeout": "1s", "expect": {"success": true}}]}`)
+		if err := os.WriteFile(scenario, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		summaryFile := filepath.Join(t.TempDir(), "summary.json")
+		code := run(context.Background(), []string{"-scenario", scenario, "-summary", summaryFile}, &bytes.Buffer{}, &bytes.Buffer{})
+		if code != exitFailure {
+			t.Fatal("unexpected exit code", code)
+		}
+		var sum summary
+		data, err := os.ReadFile(summaryFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &sum); err != nil {
+			t.Fatal(err)
+		}
+		if sum.Success || len(sum.Measurements[0].Failures) != 1 || sum.Measurements[0].Error == "" {
+			t.Fatal("unexpected summary", string(data))
+		}
+	})
+
+	t.Run("we fail with invalid inputs", func(t *testing.T) {
+		inputs := [][]string{
+			{},
+			{"-scenario", "testdata/nonexistent.yaml"},
+			{"-scenario", "testdata/example.yaml", "extra"},
+			{"-nonexistent-flag"},
+			{"-scenario", "testdata/example.yaml", "-socks5", "127.0.0.1:0"},
+		}
+		for _, args := range inputs {
+			if code := run(context.Background(), args, &bytes.Buffer{}, &bytes.Buffer{}); code != exitSetup {
+				t.Fatal("unexpected exit code", args, code)
+			}
+		}
+	})
+
+	t.Run("we run a SOCKS5 proxy until the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		args := []string{"-scenario", "testdata/example.yaml", "-socks5", "127.0.0.1:0",
+			"-socks5-host", "client", "-ca-file", caFile}
+		if code := run(ctx, args, &bytes.Buffer{}, &bytes.Buffer{}); code != exitSuccess {
+			t.Fatal("unexpected exit code", code)
+		}
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			t.Fatal("cannot decode PEM")
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
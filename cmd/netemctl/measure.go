@@ -0,0 +1,278 @@
+package main
+
+//
+// Measurements and expectations
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/ooni/netem"
+)
+
+// Default values used by the measurements.
+const (
+	defaultNDT0Duration = 5 * time.Second
+	defaultNDT0Port     = 54321
+	defaultTimeout      = 10 * time.Second
+	maxBodySize         = 1 << 20
+)
+
+// result is the result of a measurement.
+type result struct {
+	// Name is the measurement name.
+	Name string `json:"name"`
+
+	// Type is the measurement type.
+	Type string `json:"type"`
+
+	// Host is the host running the measurement.
+	Host string `json:"host"`
+
+	// T0 is when the measurement started.
+	T0 time.Time `json:"t0"`
+
+	// Elapsed is the measurement runtime in seconds.
+	Elapsed float64 `json:"elapsed"`
+
+	// Error is the error that occurred, if any.
+	Error string `json:"error,omitempty"`
+
+	// Addresses contains the addresses resolved by "dns".
+	Addresses []string `json:"addresses,omitempty"`
+
+	// Status is the status code returned to "http".
+	Status int `json:"status,omitempty"`
+
+	// Protocol is the protocol used by "http" (e.g., "HTTP/2.0").
+	Protocol string `json:"protocol,omitempty"`
+
+	// BodyLength is the length of the body received by "http".
+	BodyLength int `json:"body_length,omitempty"`
+
+	// Goodput is the goodput measured by "ndt0" in Mbit/s.
+	Goodput float64 `json:"goodput,omitempty"`
+
+	// Failures contains the failed expectations.
+	Failures []string `json:"failures,omitempty"`
+
+	// body is the body received by "http".
+	body string
+}
+
+// measure runs the given measurement. The returned error wraps [errMeasurement]
+// when the measurement is invalid, while measurement failures end up in the result.
+func measure(topology *netem.ScenarioTopology, sm *netem.ScenarioMeasurement) (*result, error) {
+	stack := stackByName(topology, sm.Host)
+	if stack == nil {
+		return nil, fmt.Errorf("%w: unknown host %q", errMeasurement, sm.Host)
+	}
+	res := &result{
+		Name: sm.Name,
+		Type: sm.Type,
+		Host: sm.Host,
+		T0:   time.Now(),
+	}
+	var err error
+	switch sm.Type {
+	case "dns":
+		err = measureDNS(stack, sm, res)
+	case "http":
+		err = measureHTTP(stack, sm, res)
+	case "ndt0":
+		err = measureNDT0(topology, stack, sm, res)
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q", errMeasurement, sm.Type)
+	}
+	res.Elapsed = time.Since(res.T0).Seconds()
+	if err != nil {
+		if errors.Is(err, errMeasurement) {
+			return nil, err
+		}
+		res.Error = err.Error()
+	}
+	return res, nil
+}
+
+// stackByName returns the stack of the host or server with the given name.
+func stackByName(topology *netem.ScenarioTopology, name string) *netem.UNetStack {
+	if stack := topology.Hosts[name]; stack != nil {
+		return stack
+	}
+	if server := topology.Servers[name]; server != nil {
+		return server.Stack()
+	}
+	return nil
+}
+
+// measureDNS implements the "dns" measurement.
+func measureDNS(stack *netem.UNetStack, sm *netem.ScenarioMeasurement, res *result) error {
+	timeout, err := parseDuration(sm.Timeout, defaultTimeout)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	addrs, err := (&netem.Net{Stack: stack}).LookupHost(ctx, sm.Domain)
+	res.Addresses = addrs
+	return err
+}
+
+// measureHTTP implements the "http" measurement.
+func measureHTTP(stack *netem.UNetStack, sm *netem.ScenarioMeasurement, res *result) error {
+	timeout, err := parseDuration(sm.Timeout, defaultTimeout)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", sm.URL, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errMeasurement, err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	var txp http.RoundTripper
+	if sm.HTTP3 {
+		h3txp := netem.NewHTTP3Transport(stack)
+		defer h3txp.Close()
+		txp = h3txp
+	} else {
+		h2txp := netem.NewHTTPTransport(stack)
+		defer h2txp.CloseIdleConnections()
+		txp = h2txp
+	}
+
+	resp, err := txp.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	res.Status = resp.StatusCode
+	res.Protocol = resp.Proto
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	res.BodyLength = len(body)
+	res.body = string(body)
+	return err
+}
+
+// measureNDT0 implements the "ndt0" measurement.
+func measureNDT0(
+	topology *netem.ScenarioTopology,
+	stack *netem.UNetStack,
+	sm *netem.ScenarioMeasurement,
+	res *result,
+) error {
+	serverStack := stackByName(topology, sm.Server)
+	if serverStack == nil {
+		return fmt.Errorf("%w: unknown server %q", errMeasurement, sm.Server)
+	}
+	duration, err := parseDuration(sm.Duration, defaultNDT0Duration)
+	if err != nil {
+		return err
+	}
+	port := int(sm.Port)
+	if port == 0 {
+		port = defaultNDT0Port
+	}
+
+	// the client may connect using a domain name, which we add to the certificate
+	address := sm.Address
+	if address == "" {
+		address = serverStack.IPAddress()
+	}
+	var serverNames []string
+	if net.ParseIP(address) == nil {
+		serverNames = append(serverNames, address)
+	}
+	endpoint := net.JoinHostPort(address, strconv.Itoa(port))
+
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	// start the server and wait for it to listen
+	ready, serverErrch := make(chan net.Listener, 1), make(chan error, 1)
+	go netem.RunNDT0Server(
+		ctx,
+		serverStack,
+		net.ParseIP(serverStack.IPAddress()),
+		port,
+		log.Log,
+		ready,
+		serverErrch,
+		sm.TLS,
+		serverNames...,
+	)
+	var listener net.Listener
+	select {
+	case listener = <-ready:
+	case err := <-serverErrch:
+		return err
+	}
+	defer listener.Close()
+
+	// run the client until it stops emitting samples
+	clientErrch := make(chan error, 1)
+	perfch := make(chan *netem.NDT0PerformanceSample)
+	go netem.RunNDT0Client(ctx, stack, endpoint, log.Log, sm.TLS, clientErrch, perfch)
+	var last *netem.NDT0PerformanceSample
+	for sample := range perfch {
+		last = sample
+	}
+	if err := <-clientErrch; err != nil {
+		return err
+	}
+	if last == nil || last.ReceivedTotal <= 0 {
+		return fmt.Errorf("ndt0: no data received")
+	}
+	res.Goodput = last.AvgSpeedMbps()
+	return nil
+}
+
+// check returns the expectations that the given result does not meet.
+func check(expect *netem.ScenarioExpectation, res *result) (failures []string) {
+	if expect == nil {
+		return
+	}
+	success := res.Error == ""
+	if expect.Success != nil && *expect.Success != success {
+		failures = append(failures, fmt.Sprintf("expected success=%v, got error %q", *expect.Success, res.Error))
+	}
+	if expect.Error != "" && !strings.Contains(res.Error, expect.Error) {
+		failures = append(failures, fmt.Sprintf("expected error containing %q, got %q", expect.Error, res.Error))
+	}
+	if len(expect.Addresses) > 0 && !sameAddresses(expect.Addresses, res.Addresses) {
+		failures = append(failures, fmt.Sprintf("expected addresses %v, got %v", expect.Addresses, res.Addresses))
+	}
+	if expect.Status != 0 && expect.Status != res.Status {
+		failures = append(failures, fmt.Sprintf("expected status %d, got %d", expect.Status, res.Status))
+	}
+	if expect.BodyContains != "" && !strings.Contains(res.body, expect.BodyContains) {
+		failures = append(failures, fmt.Sprintf("expected body containing %q", expect.BodyContains))
+	}
+	if expect.MinGoodput > 0 && res.Goodput < expect.MinGoodput {
+		failures = append(failures, fmt.Sprintf("expected goodput >= %f Mbit/s, got %f", expect.MinGoodput, res.Goodput))
+	}
+	if expect.MaxGoodput > 0 && res.Goodput > expect.MaxGoodput {
+		failures = append(failures, fmt.Sprintf("expected goodput <= %f Mbit/s, got %f", expect.MaxGoodput, res.Goodput))
+	}
+	return
+}
+
+// sameAddresses returns whether the two lists contain the same addresses in any order.
+func sameAddresses(expected, got []string) bool {
+	a, b := slices.Clone(expected), slices.Clone(got)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
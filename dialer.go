@@ -0,0 +1,204 @@
+package netem
+
+//
+// Replacement for [net.Dialer]
+//
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// DialerUnderlyingNetwork is the [UnderlyingNetwork] used by a [Dialer]
+// when it needs to bind the local address before dialing.
+type DialerUnderlyingNetwork interface {
+	UnderlyingNetwork
+
+	// DialContextBind is like DialContext but binds the socket to
+	// the given local address before dialing.
+	DialContextBind(ctx context.Context, network, localAddress, address string) (net.Conn, error)
+}
+
+var _ DialerUnderlyingNetwork = &UNetStack{}
+
+// Dialer is a drop-in replacement for [net.Dialer] using an [UnderlyingNetwork].
+// The zero value is invalid; please, init all the MANDATORY fields.
+type Dialer struct {
+	// Stack is the MANDATORY underlying stack.
+	Stack UnderlyingNetwork
+
+	// Control is the OPTIONAL function called after creating the network
+	// connection but before actually dialing. Because there is no socket
+	// when using a [UNetStack], the methods of the [syscall.RawConn] it
+	// receives fail with [syscall.EOPNOTSUPP] without invoking their
+	// argument, hence you cannot use it to set socket options. Yet, returning
+	// an error from this function aborts dialing, which is useful to
+	// inject errors.
+	Control func(network, address string, c syscall.RawConn) error
+
+	// ControlContext is like Control but also receives the context. If
+	// both fields are set, we ignore Control like [net.Dialer] does.
+	ControlContext func(ctx context.Context, network, address string, c syscall.RawConn) error
+
+	// Deadline is the OPTIONAL absolute time after which dialing fails.
+	Deadline time.Time
+
+	// KeepAlive is the OPTIONAL TCP keep-alive period. Like for [net.Dialer],
+	// zero means using the default period (i.e., 15 seconds) and a negative
+	// value means disabling keep-alives.
+	KeepAlive time.Duration
+
+	// LocalAddr is the OPTIONAL local address to use when dialing, which
+	// MUST be a [*net.TCPAddr] or a [*net.UDPAddr]. When this field is set,
+	// the Stack MUST implement [DialerUnderlyingNetwork].
+	LocalAddr net.Addr
+
+	// Timeout is the OPTIONAL maximum amount of time dialing could take.
+	Timeout time.Duration
+}
+
+// dialerDefaultKeepAlive is the default keep-alive period used by [Dialer].
+const dialerDefaultKeepAlive = 15 * time.Second
+
+// Dial is like [Dialer.DialContext] but uses a background context.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is a drop-in replacement for [net.Dialer.DialContext].
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	// honour the configured timeout and deadline
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	if !d.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, d.Deadline)
+		defer cancel()
+	}
+
+	ns := &Net{d.Stack}
+	return ns.dialContextWith(ctx, network, address, d.dialEndpoint)
+}
+
+// dialEndpoint dials a specific endpoint.
+func (d *Dialer) dialEndpoint(ctx context.Context, network, endpoint string) (net.Conn, error) {
+	// give the control functions a chance to abort dialing
+	if err := d.control(ctx, network, endpoint); err != nil {
+		return nil, err
+	}
+
+	// dial binding the local address if needed
+	conn, err := d.dialMaybeBind(ctx, network, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// configure keep-alives like [net.Dialer] does
+	if err := d.maybeSetKeepAlive(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// control invokes the control functions, if configured.
+func (d *Dialer) control(ctx context.Context, network, endpoint string) error {
+	switch {
+	case d.ControlContext != nil:
+		return d.ControlContext(ctx, network, endpoint, &dialerRawConn{})
+	case d.Control != nil:
+		return d.Control(network, endpoint, &dialerRawConn{})
+	default:
+		return nil
+	}
+}
+
+// dialMaybeBind dials binding the local address if needed.
+func (d *Dialer) dialMaybeBind(ctx context.Context, network, endpoint string) (net.Conn, error) {
+	if d.LocalAddr == nil {
+		return d.Stack.DialContext(ctx, network, endpoint)
+	}
+	stack, good := d.Stack.(DialerUnderlyingNetwork)
+	if !good {
+		return nil, syscall.EOPNOTSUPP
+	}
+	localAddress, err := dialerLocalAddress(d.LocalAddr)
+	if err != nil {
+		return nil, err
+	}
+	return stack.DialContextBind(ctx, network, localAddress, endpoint)
+}
+
+// dialerLocalAddress converts the local address to a string suitable
+// for [DialerUnderlyingNetwork.DialContextBind].
+func dialerLocalAddress(addr net.Addr) (string, error) {
+	var (
+		ip   net.IP
+		port int
+	)
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = v.IP, v.Port
+	case *net.UDPAddr:
+		ip, port = v.IP, v.Port
+	default:
+		return "", syscall.EAFNOSUPPORT
+	}
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
+
+// dialerKeepAliveConn is a [net.Conn] supporting keep-alives.
+type dialerKeepAliveConn interface {
+	net.Conn
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// maybeSetKeepAlive configures keep-alives for TCP conns.
+func (d *Dialer) maybeSetKeepAlive(conn net.Conn) error {
+	kac, good := conn.(dialerKeepAliveConn)
+	if !good || conn.LocalAddr().Network() != "tcp" {
+		return nil
+	}
+	if d.KeepAlive < 0 {
+		return kac.SetKeepAlive(false)
+	}
+	period := d.KeepAlive
+	if period == 0 {
+		period = dialerDefaultKeepAlive
+	}
+	if err := kac.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return kac.SetKeepAlivePeriod(period)
+}
+
+// dialerRawConn is the [syscall.RawConn] passed to control functions. Because
+// there is no file descriptor, all its methods fail with [syscall.EOPNOTSUPP].
+type dialerRawConn struct{}
+
+var _ syscall.RawConn = &dialerRawConn{}
+
+// Control implements syscall.RawConn
+func (rc *dialerRawConn) Control(f func(fd uintptr)) error {
+	return syscall.EOPNOTSUPP
+}
+
+// Read implements syscall.RawConn
+func (rc *dialerRawConn) Read(f func(fd uintptr) (done bool)) error {
+	return syscall.EOPNOTSUPP
+}
+
+// Write implements syscall.RawConn
+func (rc *dialerRawConn) Write(f func(fd uintptr) (done bool)) error {
+	return syscall.EOPNOTSUPP
+}
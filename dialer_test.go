@@ -0,0 +1,127 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDialer(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+
+	listener, err := topology.Server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	t.Run("we can bind the local address and port", func(t *testing.T) {
+		for _, network := range []string{"tcp", "udp"} {
+			t.Run(network, func(t *testing.T) {
+				var laddr net.Addr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 54321}
+				if network == "udp" {
+					laddr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 54321}
+				}
+				d := &Dialer{Stack: topology.Client, LocalAddr: laddr}
+				conn, err := d.DialContext(context.Background(), network, "10.0.0.1:80")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				if got := conn.LocalAddr().String(); got != "10.0.0.2:54321" {
+					t.Fatal("unexpected local address", got)
+				}
+			})
+		}
+	})
+
+	t.Run("we can bind only the local port", func(t *testing.T) {
+		d := &Dialer{Stack: topology.Client, LocalAddr: &net.TCPAddr{Port: 54322}}
+		conn, err := d.DialContext(context.Background(), "tcp", "10.0.0.1:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if got := conn.LocalAddr().String(); got != "10.0.0.2:54322" {
+			t.Fatal("unexpected local address", got)
+		}
+	})
+
+	t.Run("binding fails if the stack does not support it", func(t *testing.T) {
+		d := &Dialer{
+			Stack:     struct{ UnderlyingNetwork }{topology.Client},
+			LocalAddr: &net.TCPAddr{Port: 54323},
+		}
+		conn, err := d.DialContext(context.Background(), "tcp", "10.0.0.1:80")
+		if !errors.Is(err, syscall.EOPNOTSUPP) {
+			t.Fatal("unexpected error", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("the control function can abort dialing", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		var called []string
+		d := &Dialer{
+			Stack: topology.Client,
+			Control: func(network, address string, c syscall.RawConn) error {
+				called = append(called, network, address)
+				if err := c.Control(func(fd uintptr) {}); !errors.Is(err, syscall.EOPNOTSUPP) {
+					t.Fatal("expected the raw conn not to support Control", err)
+				}
+				return expected
+			},
+		}
+		conn, err := d.DialContext(context.Background(), "tcp", "10.0.0.1:80")
+		if !errors.Is(err, expected) {
+			t.Fatal("unexpected error", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+		if len(called) != 2 || called[0] != "tcp" || called[1] != "10.0.0.1:80" {
+			t.Fatal("unexpected control arguments", called)
+		}
+	})
+
+	t.Run("we honour the timeout", func(t *testing.T) {
+		d := &Dialer{Stack: topology.Client, Timeout: time.Nanosecond}
+		conn, err := d.DialContext(context.Background(), "tcp", "10.0.0.1:80")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("unexpected error", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("we configure keep-alives", func(t *testing.T) {
+		for _, keepAlive := range []time.Duration{-1, 0, time.Second} {
+			d := &Dialer{Stack: topology.Client, KeepAlive: keepAlive}
+			conn, err := d.DialContext(context.Background(), "tcp", "10.0.0.1:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ep := conn.(*unetConnWrapper).ep
+			if enabled := ep.SocketOptions().GetKeepAlive(); enabled != (keepAlive >= 0) {
+				t.Fatal("unexpected keep-alive setting", keepAlive, enabled)
+			}
+			conn.Close()
+		}
+	})
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
 )
 
 // DissectedPacket is a dissected IP packet. The zero-value is invalid; you
@@ -25,6 +26,38 @@ type DissectedPacket struct {
 
 	// UDP is the POSSIBLY NIL UDP layer.
 	UDP *layers.UDP
+
+	// ICMPv4 is the POSSIBLY NIL ICMPv4 layer.
+	ICMPv4 *layers.ICMPv4
+
+	// ICMPv6 is the POSSIBLY NIL ICMPv6 layer.
+	ICMPv6 *layers.ICMPv6
+
+	// TLSClientHello is the POSSIBLY NIL TLS ClientHello handshake message
+	// that the [DPIEngine] reassembled from the client-to-server TCP stream or
+	// from the CRYPTO frames of the client's QUIC Initial packets. The [DPIEngine]
+	// only sets this field for the packet completing the ClientHello.
+	TLSClientHello []byte
+
+	// HTTPRequest is the POSSIBLY NIL HTTP/1.x request that the [DPIEngine]
+	// reassembled from the client-to-server TCP stream. The [DPIEngine] only
+	// sets this field for the packet completing the request headers.
+	HTTPRequest *DPIHTTPRequest
+
+	// DNSQuery is the POSSIBLY NIL DNS query that the [DPIEngine] reassembled
+	// from a client-to-server TCP stream towards port 53 (i.e., DNS over TCP).
+	// The [DPIEngine] only sets this field for the packet completing the query.
+	DNSQuery *dns.Msg
+
+	// TLSCertificate is the POSSIBLY NIL TLS 1.2 Certificate handshake message
+	// that the [DPIEngine] reassembled from the server-to-client TCP stream. The
+	// [DPIEngine] only sets this field for the packet completing the Certificate.
+	TLSCertificate []byte
+
+	// HTTPResponse is the POSSIBLY NIL HTTP/1.x response that the [DPIEngine]
+	// reassembled from the server-to-client TCP stream. The [DPIEngine] only
+	// sets this field for the packet completing the response.
+	HTTPResponse *DPIHTTPResponse
 }
 
 // ErrDissectShortPacket indicates the packet is too short.
@@ -77,6 +110,20 @@ func DissectPacket(rawPacket []byte) (*DissectedPacket, error) {
 	case layers.IPProtocolUDP:
 		dp.UDP = dp.Packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
 
+	case layers.IPProtocolICMPv4:
+		icmpLayer := dp.Packet.Layer(layers.LayerTypeICMPv4)
+		if icmpLayer == nil {
+			return nil, ErrDissectTransport
+		}
+		dp.ICMPv4 = icmpLayer.(*layers.ICMPv4)
+
+	case layers.IPProtocolICMPv6:
+		icmpLayer := dp.Packet.Layer(layers.LayerTypeICMPv6)
+		if icmpLayer == nil {
+			return nil, ErrDissectTransport
+		}
+		dp.ICMPv6 = icmpLayer.(*layers.ICMPv6)
+
 	default:
 		return nil, ErrDissectTransport
 	}
@@ -124,13 +171,16 @@ func (dp *DissectedPacket) DestinationIPAddress() string {
 	}
 }
 
-// DestinationPort returns the packet's destination port.
+// DestinationPort returns the packet's destination port or
+// zero when the packet is an ICMP packet.
 func (dp *DissectedPacket) DestinationPort() uint16 {
 	switch {
 	case dp.TCP != nil:
 		return uint16(dp.TCP.DstPort)
 	case dp.UDP != nil:
 		return uint16(dp.UDP.DstPort)
+	case dp.isICMP():
+		return 0
 	default:
 		panic(ErrDissectTransport)
 	}
@@ -148,18 +198,26 @@ func (dp *DissectedPacket) SourceIPAddress() string {
 	}
 }
 
-// SourcePort returns the packet's source port.
+// SourcePort returns the packet's source port or zero
+// when the packet is an ICMP packet.
 func (dp *DissectedPacket) SourcePort() uint16 {
 	switch {
 	case dp.TCP != nil:
 		return uint16(dp.TCP.SrcPort)
 	case dp.UDP != nil:
 		return uint16(dp.UDP.SrcPort)
+	case dp.isICMP():
+		return 0
 	default:
 		panic(ErrDissectTransport)
 	}
 }
 
+// isICMP returns whether this is an ICMPv4 or ICMPv6 packet.
+func (dp *DissectedPacket) isICMP() bool {
+	return dp.ICMPv4 != nil || dp.ICMPv6 != nil
+}
+
 // TransportProtocol returns the packet's transport protocol.
 func (dp *DissectedPacket) TransportProtocol() layers.IPProtocol {
 	switch v := dp.IP.(type) {
@@ -179,6 +237,10 @@ func (dp *DissectedPacket) Serialize() ([]byte, error) {
 		dp.TCP.SetNetworkLayerForChecksum(dp.IP)
 	case dp.UDP != nil:
 		dp.UDP.SetNetworkLayerForChecksum(dp.IP)
+	case dp.ICMPv4 != nil:
+		// nothing to do
+	case dp.ICMPv6 != nil:
+		dp.ICMPv6.SetNetworkLayerForChecksum(dp.IP)
 	default:
 		return nil, ErrDissectTransport
 	}
@@ -194,7 +256,8 @@ func (dp *DissectedPacket) Serialize() ([]byte, error) {
 }
 
 // MatchesDestination returns true when the given IPv4 packet has the
-// expected protocol, destination address, and port.
+// expected protocol, destination address, and port. Because ICMP does
+// not have ports, we ignore the port when matching ICMP packets.
 func (dp *DissectedPacket) MatchesDestination(proto layers.IPProtocol, address string, port uint16) bool {
 	if dp.TransportProtocol() != proto {
 		return false
@@ -204,13 +267,16 @@ func (dp *DissectedPacket) MatchesDestination(proto layers.IPProtocol, address s
 		return dp.DestinationIPAddress() == address && dp.TCP.DstPort == layers.TCPPort(port)
 	case dp.UDP != nil:
 		return dp.DestinationIPAddress() == address && dp.UDP.DstPort == layers.UDPPort(port)
+	case dp.isICMP():
+		return dp.DestinationIPAddress() == address
 	default:
 		return false
 	}
 }
 
 // MatchesSource returns true when the given IPv4 packet has the
-// expected protocol, source address, and port.
+// expected protocol, source address, and port. Because ICMP does
+// not have ports, we ignore the port when matching ICMP packets.
 func (dp *DissectedPacket) MatchesSource(proto layers.IPProtocol, address string, port uint16) bool {
 	if dp.TransportProtocol() != proto {
 		return false
@@ -220,40 +286,33 @@ func (dp *DissectedPacket) MatchesSource(proto layers.IPProtocol, address string
 		return dp.SourceIPAddress() == address && dp.TCP.SrcPort == layers.TCPPort(port)
 	case dp.UDP != nil:
 		return dp.SourceIPAddress() == address && dp.UDP.SrcPort == layers.UDPPort(port)
+	case dp.isICMP():
+		return dp.SourceIPAddress() == address
 	default:
 		return false
 	}
 }
 
 // FlowHash returns the hash uniquely identifying the transport flow. Both
-// directions of a flow will have the same hash.
+// directions of a flow will have the same hash. For ICMP packets, we consider
+// all the ICMP packets between two hosts as belonging to the same flow.
 func (dp *DissectedPacket) FlowHash() uint64 {
 	switch {
 	case dp.TCP != nil:
 		return dp.TCP.TransportFlow().FastHash()
 	case dp.UDP != nil:
 		return dp.UDP.TransportFlow().FastHash()
+	case dp.isICMP():
+		return dp.IP.NetworkFlow().FastHash()
 	default:
 		panic(ErrDissectTransport)
 	}
 }
 
-// extractTLSHandshake
-func (dp *DissectedPacket) extractTLSHandshake(collected []byte, length uint16) ([]byte, uint16, error) {
-	switch {
-	case dp.TCP != nil:
-		return ExtractTLSHandshake(dp.TCP.Payload, collected, length)
-	case dp.UDP != nil:
-		return ExtractTLSHandshake(dp.UDP.Payload, collected, length)
-	default:
-		return nil, 0, ErrDissectTransport
-	}
-}
-
-// parseTLSServerName attempts to parse this packet as
-// a TLS client hello and to return the SNI.
-func (dp *DissectedPacket) parseTLSServerName(collected []byte) (string, error) {
-	return ExtractTLServerName(collected)
+// parseTLSServerName attempts to parse the reassembled
+// TLS client hello and to return the SNI.
+func (dp *DissectedPacket) parseTLSServerName() (string, error) {
+	return ExtractTLServerName(dp.TLSClientHello)
 }
 
 // reflectDissectedTCPSegmentWithRSTFlag assumes that packet is an IPv4 packet
@@ -265,6 +324,21 @@ func reflectDissectedTCPSegmentWithRSTFlag(packet *DissectedPacket) ([]byte, err
 	})
 }
 
+// reflectDissectedTCPSegmentWithRSTACKFlags assumes that packet is an IPv4 packet
+// containing a TCP segment, and constructs a new serialized packet where we
+// reflect incoming fields, set the RST|ACK flags, and acknowledge the segment,
+// which allows us to reset connections while they are being established.
+func reflectDissectedTCPSegmentWithRSTACKFlags(packet *DissectedPacket) ([]byte, error) {
+	return reflectDissectedTCPSegmentWithSetter(packet, func(tcp *layers.TCP) {
+		tcp.RST = true
+		tcp.ACK = true
+		tcp.Ack = packet.TCP.Seq + uint32(len(packet.TCP.Payload))
+		if packet.TCP.SYN {
+			tcp.Ack++ // the SYN flag consumes one sequence number
+		}
+	})
+}
+
 // reflectDissectedTCPSegmentWithFINACKFlag assumes that packet is an IPv4 packet
 // containing a TCP segment, and constructs a new serialized packet where
 // we reflect incoming fields and set the FIN|ACK flag.
@@ -29,6 +29,20 @@ func NewDNSServer(
 	stack UnderlyingNetwork,
 	ipAddress string,
 	config *DNSConfig,
+) (*DNSServer, error) {
+	return newDNSServer(logger, stack, ipAddress, config, nil)
+}
+
+// dnsServerObserver is an OPTIONAL function called for each incoming raw query.
+type dnsServerObserver func(addr net.Addr, rawQuery []byte)
+
+// newDNSServer is like [NewDNSServer] but also allows to observe queries.
+func newDNSServer(
+	logger Logger,
+	stack UnderlyingNetwork,
+	ipAddress string,
+	config *DNSConfig,
+	observer dnsServerObserver,
 ) (*DNSServer, error) {
 	parsedIP := net.ParseIP(ipAddress)
 	if parsedIP == nil {
@@ -49,7 +63,7 @@ func NewDNSServer(
 	// spawn a single worker
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
-	go dnsServerWorker(logger, ipAddress, config, pconn, wg)
+	go dnsServerWorker(logger, ipAddress, config, observer, pconn, wg)
 
 	ds := &DNSServer{
 		once:  sync.Once{},
@@ -166,6 +180,7 @@ func dnsServerWorker(
 	logger Logger,
 	ipAddress string,
 	config *DNSConfig,
+	observer dnsServerObserver,
 	pconn UDPLikeConn,
 	wg *sync.WaitGroup,
 ) {
@@ -184,6 +199,9 @@ func dnsServerWorker(
 			return
 		}
 		rawQuery := buffer[:count]
+		if observer != nil {
+			observer(addr, rawQuery)
+		}
 
 		rawResponse, err := DNSServerRoundTrip(dnsConfigWithWhoami(config, addr), rawQuery)
 		if err != nil {
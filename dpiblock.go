@@ -29,14 +29,6 @@ type DPIResetTrafficForTLSSNI struct {
 
 	// SNI is the MANDATORY offending SNI.
 	SNI string
-
-	// TLSHandshake
-	TLSHandshake []byte
-
-	// TLSHandshakeSize
-	TlSHandshakeSize uint16
-
-	done bool
 }
 
 var _ DPIRule = &DPIResetTrafficForTLSSNI{}
@@ -59,74 +51,60 @@ func (r *DPIResetTrafficForTLSSNI) Filter(
 		return nil, false
 	}
 
-	// try to obtain the SNI
-	tlsHandshakeBytes, length, err := packet.extractTLSHandshake(r.TLSHandshake, r.TlSHandshakeSize)
-	if err != nil {
+	// wait for the DPIEngine to reassemble the ClientHello
+	if packet.TLSClientHello == nil {
 		return nil, false
 	}
-	if r.TlSHandshakeSize == 0 {
-		r.TlSHandshakeSize = length
-	}
-	r.TLSHandshake = tlsHandshakeBytes
-	if r.done {
-		return nil, false
-	}
-
-	if len(r.TLSHandshake) >= int(r.TlSHandshakeSize) {
-		sni, err := packet.parseTLSServerName(r.TLSHandshake[:int(r.TlSHandshakeSize)])
-		if err != nil {
-			r.Logger.Warnf(
-				"netem: dpi: failed to parse TLS server name for %s:%d %s:%d/%s because SNI==%s",
-				packet.SourceIPAddress(),
-				packet.SourcePort(),
-				packet.DestinationIPAddress(),
-				packet.DestinationPort(),
-				packet.TransportProtocol(),
-				sni,
-			)
-			r.TLSHandshake = []byte{}
-			r.TlSHandshakeSize = 0
-			return nil, false
-		}
-
-		r.TLSHandshake = []byte{}
-		r.TlSHandshakeSize = 0
-		r.done = true
 
-		// if the packet is not offending, accept it
-		if sni != r.SNI {
-			return nil, false
-		}
-
-		// generate the frame to spoof
-		spoofed, err := reflectDissectedTCPSegmentWithRSTFlag(packet)
-		if err != nil {
-			return nil, false
-		}
-
-		// tell the user we're asking the router to RST the flow.
-		r.Logger.Infof(
-			"netem: dpi: asking to send RST to flow %s:%d %s:%d/%s because SNI==%s",
+	// try to obtain the SNI
+	sni, err := packet.parseTLSServerName()
+	if err != nil {
+		r.Logger.Warnf(
+			"netem: dpi: failed to parse TLS server name for %s:%d %s:%d/%s: %s",
 			packet.SourceIPAddress(),
 			packet.SourcePort(),
 			packet.DestinationIPAddress(),
 			packet.DestinationPort(),
 			packet.TransportProtocol(),
-			sni,
+			err.Error(),
 		)
+		return nil, false
+	}
 
-		// make sure the router knows it should spoof
-		policy := &DPIPolicy{
-			Delay:   0,
-			Flags:   FrameFlagSpoof,
-			PLR:     0,
-			Spoofed: [][]byte{spoofed},
-		}
+	// if the packet is not offending, accept it
+	if sni != r.SNI {
+		return nil, false
+	}
 
-		return policy, true
+	// generate the frame to spoof
+	spoofed, err := reflectDissectedTCPSegmentWithRSTFlag(packet)
+	if err != nil {
+		return nil, false
 	}
 
-	return nil, false
+	// tell the user we're asking the router to RST the flow.
+	r.Logger.Infof(
+		"netem: dpi: asking to send RST to flow %s:%d %s:%d/%s because SNI==%s",
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+		sni,
+	)
+
+	// make sure the router knows it should spoof
+	policy := &DPIPolicy{
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagSpoof,
+		PLR:           0,
+		Spoofed:       [][]byte{spoofed},
+		SpoofedDelays: nil,
+		Trigger:       nil,
+	}
+
+	return policy, true
 }
 
 // DPIResetTrafficForString is a [DPIRule] that spoofs a RST TCP segment
@@ -203,10 +181,13 @@ func (r *DPIResetTrafficForString) Filter(
 
 	// make sure the router knows it should spoof
 	policy := &DPIPolicy{
-		Delay:   0,
-		Flags:   FrameFlagSpoof,
-		PLR:     0,
-		Spoofed: [][]byte{spoofed},
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagSpoof,
+		PLR:           0,
+		Spoofed:       [][]byte{spoofed},
+		SpoofedDelays: nil,
+		Trigger:       nil,
 	}
 
 	return policy, true
@@ -300,10 +281,13 @@ func (r *DPISpoofDNSResponse) Filter(
 
 	// make sure the router knows it should spoof
 	policy := &DPIPolicy{
-		Delay:   0,
-		Flags:   FrameFlagSpoof,
-		PLR:     0,
-		Spoofed: [][]byte{spoofed},
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagSpoof,
+		PLR:           0,
+		Spoofed:       [][]byte{spoofed},
+		SpoofedDelays: nil,
+		Trigger:       nil,
 	}
 
 	// tell the user we're asking the router to spoof a response
@@ -336,15 +320,6 @@ type DPICloseConnectionForTLSSNI struct {
 
 	// SNI is the MANDATORY offending SNI.
 	SNI string
-
-	// TLSHandshake
-	TLSHandshake []byte
-
-	// TLSHandshakeSize
-	TlSHandshakeSize uint16
-
-	// done
-	done bool
 }
 
 var _ DPIRule = &DPICloseConnectionForTLSSNI{}
@@ -367,75 +342,60 @@ func (r *DPICloseConnectionForTLSSNI) Filter(
 		return nil, false
 	}
 
-	// try to obtain the SNI
-	tlsHandshakeBytes, length, err := packet.extractTLSHandshake(r.TLSHandshake, r.TlSHandshakeSize)
-	if err != nil {
-		return nil, false
-	}
-	if r.TlSHandshakeSize == 0 {
-		r.TlSHandshakeSize = length
-	}
-	r.TLSHandshake = tlsHandshakeBytes
-	if r.done {
+	// wait for the DPIEngine to reassemble the ClientHello
+	if packet.TLSClientHello == nil {
 		return nil, false
 	}
 
-	if len(r.TLSHandshake) == int(r.TlSHandshakeSize) {
-		sni, err := packet.parseTLSServerName(r.TLSHandshake)
-		if err != nil {
-			r.Logger.Warnf(
-				"netem: dpi: failed to parse TLS server name for %s:%d %s:%d/%s because SNI==%s",
-				packet.SourceIPAddress(),
-				packet.SourcePort(),
-				packet.DestinationIPAddress(),
-				packet.DestinationPort(),
-				packet.TransportProtocol(),
-				sni,
-			)
-			r.TLSHandshake = []byte{}
-			r.TlSHandshakeSize = 0
-			return nil, false
-		}
-
-		r.TLSHandshake = []byte{}
-		r.TlSHandshakeSize = 0
-		r.done = true
-
-		// if the packet is not offending, accept it
-		if sni != r.SNI {
-			return nil, false
-		}
-
-		// generate the frame to spoof
-		spoofed, err := reflectDissectedTCPSegmentWithFINACKFlag(packet)
-		if err != nil {
-			return nil, false
-		}
-
-		// tell the user we're asking the router to FIN|ACK the flow.
-		r.Logger.Infof(
-			"netem: dpi: asking to send FIN|ACK to flow %s:%d %s:%d/%s because SNI==%s",
+	// try to obtain the SNI
+	sni, err := packet.parseTLSServerName()
+	if err != nil {
+		r.Logger.Warnf(
+			"netem: dpi: failed to parse TLS server name for %s:%d %s:%d/%s: %s",
 			packet.SourceIPAddress(),
 			packet.SourcePort(),
 			packet.DestinationIPAddress(),
 			packet.DestinationPort(),
 			packet.TransportProtocol(),
-			sni,
+			err.Error(),
 		)
+		return nil, false
+	}
 
-		// make sure the router knows it should spoof
-		policy := &DPIPolicy{
-			Delay:   0,
-			Flags:   FrameFlagSpoof,
-			PLR:     0,
-			Spoofed: [][]byte{spoofed},
-		}
+	// if the packet is not offending, accept it
+	if sni != r.SNI {
+		return nil, false
+	}
 
-		return policy, true
+	// generate the frame to spoof
+	spoofed, err := reflectDissectedTCPSegmentWithFINACKFlag(packet)
+	if err != nil {
+		return nil, false
 	}
 
-	return nil, false
+	// tell the user we're asking the router to FIN|ACK the flow.
+	r.Logger.Infof(
+		"netem: dpi: asking to send FIN|ACK to flow %s:%d %s:%d/%s because SNI==%s",
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+		sni,
+	)
+
+	// make sure the router knows it should spoof
+	policy := &DPIPolicy{
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagSpoof,
+		PLR:           0,
+		Spoofed:       [][]byte{spoofed},
+		SpoofedDelays: nil,
+		Trigger:       nil,
+	}
 
+	return policy, true
 }
 
 // DPICloseConnectionForServerEndpoint is a [DPIRule] that spoofs a FIN|ACK TCP segment
@@ -492,10 +452,13 @@ func (r *DPICloseConnectionForServerEndpoint) Filter(
 
 	// make sure the router knows it should spoof
 	policy := &DPIPolicy{
-		Delay:   0,
-		Flags:   FrameFlagSpoof,
-		PLR:     0,
-		Spoofed: [][]byte{spoofed},
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagSpoof,
+		PLR:           0,
+		Spoofed:       [][]byte{spoofed},
+		SpoofedDelays: nil,
+		Trigger:       nil,
 	}
 
 	return policy, true
@@ -574,10 +537,13 @@ func (r *DPICloseConnectionForString) Filter(
 
 	// make sure the router knows it should spoof
 	policy := &DPIPolicy{
-		Delay:   0,
-		Flags:   FrameFlagSpoof,
-		PLR:     0,
-		Spoofed: [][]byte{spoofed},
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagSpoof,
+		PLR:           0,
+		Spoofed:       [][]byte{spoofed},
+		SpoofedDelays: nil,
+		Trigger:       nil,
 	}
 
 	return policy, true
@@ -668,10 +634,13 @@ func (r *DPISpoofBlockpageForString) Filter(
 
 	// make sure the router knows it should spoof
 	policy := &DPIPolicy{
-		Delay:   0,
-		Flags:   FrameFlagSpoof,
-		PLR:     0,
-		Spoofed: [][]byte{spoofed},
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagSpoof,
+		PLR:           0,
+		Spoofed:       [][]byte{spoofed},
+		SpoofedDelays: nil,
+		Trigger:       nil,
 	}
 
 	return policy, true
@@ -683,3 +652,148 @@ func DPIFormatHTTPResponse(blockpage []byte) (output []byte) {
 	output = append(output, blockpage...)
 	return
 }
+
+// DPIResetTrafficForHTTPRequest is a [DPIRule] that spoofs RST TCP segments
+// towards the client and the server after it sees an HTTP/1.x request selected
+// by the Matcher, regardless of the destination. The zero value is invalid;
+// please, fill all the fields marked as MANDATORY.
+//
+// Note: this rule assumes that there is a router in the path that
+// can generate spoofed RST segments. If there is no router in the
+// path, no RST segment will ever be generated.
+type DPIResetTrafficForHTTPRequest struct {
+	// Logger is the MANDATORY logger.
+	Logger Logger
+
+	// Matcher is the MANDATORY matcher selecting the offending requests.
+	Matcher DPIHTTPRequestMatcher
+}
+
+var _ DPIRule = &DPIResetTrafficForHTTPRequest{}
+
+// Filter implements DPIRule
+func (r *DPIResetTrafficForHTTPRequest) Filter(
+	direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool) {
+	// short circuit for the return path
+	if direction != DPIDirectionClientToServer {
+		return nil, false
+	}
+
+	// if the packet is not offending, accept it
+	if !r.Matcher.Match(packet.HTTPRequest) {
+		return nil, false
+	}
+
+	// generate the frames to spoof
+	toClient, err := reflectDissectedTCPSegmentForHTTPRequest(packet, func(tcp *layers.TCP) {
+		tcp.RST = true
+	}, nil)
+	if err != nil {
+		return nil, false
+	}
+	toServer, err := resetDissectedTCPSegmentTowardsServer(packet)
+	if err != nil {
+		return nil, false
+	}
+
+	// tell the user we're asking the router to RST the flow.
+	r.Logger.Infof(
+		"netem: dpi: asking to send RST to flow %s:%d %s:%d/%s because HTTP request matches %s",
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+		r.Matcher.String(),
+	)
+
+	// make sure the router knows it should spoof
+	policy := &DPIPolicy{
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagSpoof,
+		PLR:           0,
+		Spoofed:       [][]byte{toServer, toClient},
+		SpoofedDelays: nil,
+		Trigger:       nil,
+	}
+
+	return policy, true
+}
+
+// DPISpoofHTTPResponseForHTTPRequest is a [DPIRule] that spoofs an HTTP
+// response (e.g., a blockpage or a redirect) towards the client and a RST
+// TCP segment towards the server after it sees an HTTP/1.x request selected
+// by the Matcher, regardless of the destination. The zero value is invalid;
+// please, fill all the fields marked as MANDATORY.
+//
+// Note: this rule assumes that there is a router in the path that
+// can generate spoofed segments. If there is no router in the
+// path, no segment will ever be generated.
+//
+// Note: this rule requires the response to fit into a single segment.
+type DPISpoofHTTPResponseForHTTPRequest struct {
+	// HTTPResponse is the MANDATORY response including the status line and
+	// the headers (use [DPIFormatHTTPResponse] or [DPIFormatHTTPRedirect]).
+	HTTPResponse []byte
+
+	// Logger is the MANDATORY logger.
+	Logger Logger
+
+	// Matcher is the MANDATORY matcher selecting the offending requests.
+	Matcher DPIHTTPRequestMatcher
+}
+
+var _ DPIRule = &DPISpoofHTTPResponseForHTTPRequest{}
+
+// Filter implements DPIRule
+func (r *DPISpoofHTTPResponseForHTTPRequest) Filter(
+	direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool) {
+	// short circuit for the return path
+	if direction != DPIDirectionClientToServer {
+		return nil, false
+	}
+
+	// if the packet is not offending, accept it
+	if !r.Matcher.Match(packet.HTTPRequest) {
+		return nil, false
+	}
+
+	// generate the frames to spoof
+	toClient, err := reflectDissectedTCPSegmentForHTTPRequest(packet, func(tcp *layers.TCP) {
+		tcp.ACK = true
+		tcp.FIN = true
+		tcp.PSH = true
+	}, r.HTTPResponse)
+	if err != nil {
+		return nil, false
+	}
+	toServer, err := resetDissectedTCPSegmentTowardsServer(packet)
+	if err != nil {
+		return nil, false
+	}
+
+	// tell the user we're asking the router to spoof a response.
+	r.Logger.Infof(
+		"netem: dpi: spoofing HTTP response to flow %s:%d %s:%d/%s because HTTP request matches %s",
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+		r.Matcher.String(),
+	)
+
+	// make sure the router knows it should spoof
+	policy := &DPIPolicy{
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagSpoof,
+		PLR:           0,
+		Spoofed:       [][]byte{toServer, toClient},
+		SpoofedDelays: nil,
+		Trigger:       nil,
+	}
+
+	return policy, true
+}
@@ -0,0 +1,438 @@
+package netem
+
+//
+// DPI: DNS over TCP and encrypted DNS
+//
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+)
+
+// errDPIDNSOverTCP indicates that the stream is not a DNS over TCP query.
+var errDPIDNSOverTCP = errors.New("netem: dpi: not a DNS over TCP query")
+
+// dpiParseDNSOverTCPQuery returns the first length-prefixed DNS message sent by
+// a DNS over TCP client, including the length prefix, or nil if we need more
+// bytes. We return an error when the stream does not start with a DNS query.
+func dpiParseDNSOverTCPQuery(stream []byte) ([]byte, error) {
+	if len(stream) < 2 {
+		return nil, nil
+	}
+	length := int(binary.BigEndian.Uint16(stream[:2]))
+	if length < 12 { // i.e., the size of the DNS header
+		return nil, fmt.Errorf("%w: message too short", errDPIDNSOverTCP)
+	}
+	if len(stream) < 2+length {
+		return nil, nil
+	}
+	message := stream[:2+length]
+	if _, err := dpiUnpackDNSOverTCPQuery(message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// dpiUnpackDNSOverTCPQuery parses a length-prefixed DNS query.
+func dpiUnpackDNSOverTCPQuery(message []byte) (*dns.Msg, error) {
+	if len(message) < 2 {
+		return nil, fmt.Errorf("%w: missing length prefix", errDPIDNSOverTCP)
+	}
+	query := &dns.Msg{}
+	if err := query.Unpack(message[2:]); err != nil {
+		return nil, fmt.Errorf("%w: %s", errDPIDNSOverTCP, err.Error())
+	}
+	if query.Response || len(query.Question) <= 0 {
+		return nil, fmt.Errorf("%w: not a query", errDPIDNSOverTCP)
+	}
+	return query, nil
+}
+
+// dpiMatchDNSQuery returns the first question of the given query whose name
+// matches the given domains (see [dpiMatchDomain]), if any.
+func dpiMatchDNSQuery(query *dns.Msg, domains []string) (dns.Question, bool) {
+	if query != nil {
+		for _, question := range query.Question {
+			if dpiMatchDomain(domains, question.Name) {
+				return question, true
+			}
+		}
+	}
+	return dns.Question{}, false
+}
+
+// DPIResetTrafficForDNSOverTCP is a [DPIRule] that spoofs a RST TCP segment
+// after it sees a DNS over TCP query for any of the given domains. The zero
+// value is invalid; please, fill all the fields marked as MANDATORY.
+//
+// Note: this rule assumes that there is a router in the path that
+// can generate a spoofed RST segment. If there is no router in the
+// path, no RST segment will ever be generated.
+//
+// Note: this rule relies on a race condition. For consistent results
+// you MUST set some delay in the router<->server link.
+type DPIResetTrafficForDNSOverTCP struct {
+	// Domains contains the MANDATORY offending domains using
+	// the syntax described by [DPIInjectDNSResponses].
+	Domains []string
+
+	// Logger is the MANDATORY logger.
+	Logger Logger
+}
+
+var _ DPIRule = &DPIResetTrafficForDNSOverTCP{}
+
+// Filter implements DPIRule
+func (r *DPIResetTrafficForDNSOverTCP) Filter(
+	direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool) {
+	// short circuit for the return path
+	if direction != DPIDirectionClientToServer {
+		return nil, false
+	}
+
+	// if the packet is not offending, accept it
+	question, found := dpiMatchDNSQuery(packet.DNSQuery, r.Domains)
+	if !found {
+		return nil, false
+	}
+
+	// generate the frame to spoof
+	spoofed, err := reflectDissectedTCPSegmentWithRSTFlag(packet)
+	if err != nil {
+		return nil, false
+	}
+
+	// tell the user we're asking the router to RST the flow.
+	r.Logger.Infof(
+		"netem: dpi: asking to send RST to flow %s:%d %s:%d/%s because domain==%s",
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+		question.Name,
+	)
+
+	// make sure the router knows it should spoof
+	policy := &DPIPolicy{
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagSpoof,
+		PLR:           0,
+		Spoofed:       [][]byte{spoofed},
+		SpoofedDelays: nil,
+		Trigger:       nil,
+	}
+
+	return policy, true
+}
+
+// DPIDropTrafficForDNSOverTCP is a [DPIRule] that drops all the traffic
+// after it sees a DNS over TCP query for any of the given domains. The zero
+// value is invalid; please fill all the fields marked as MANDATORY.
+type DPIDropTrafficForDNSOverTCP struct {
+	// Domains contains the MANDATORY offending domains using
+	// the syntax described by [DPIInjectDNSResponses].
+	Domains []string
+
+	// Logger is the MANDATORY logger.
+	Logger Logger
+}
+
+var _ DPIRule = &DPIDropTrafficForDNSOverTCP{}
+
+// Filter implements DPIRule
+func (r *DPIDropTrafficForDNSOverTCP) Filter(
+	direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool) {
+	// short circuit for the return path
+	if direction != DPIDirectionClientToServer {
+		return nil, false
+	}
+
+	// if the packet is not offending, accept it
+	question, found := dpiMatchDNSQuery(packet.DNSQuery, r.Domains)
+	if !found {
+		return nil, false
+	}
+
+	r.Logger.Infof(
+		"netem: dpi: dropping traffic for flow %s:%d %s:%d/%s because domain==%s",
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+		question.Name,
+	)
+
+	policy := &DPIPolicy{
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagDrop,
+		PLR:           0,
+		Spoofed:       nil,
+		SpoofedDelays: nil,
+		Trigger:       nil,
+	}
+	return policy, true
+}
+
+// DPISpoofDNSOverTCPResponse is a [DPIRule] that spoofs a DNS over TCP response
+// after it sees a DNS over TCP query for any of the given domains. The rule also
+// resets the connection towards the server, such that the client does not see
+// the legitimate response. The zero value is invalid; please, fill all the
+// fields marked as MANDATORY.
+//
+// Note: this rule assumes that there is a router in the path that
+// can generate spoofed segments. If there is no router in the
+// path, no segment will ever be generated.
+//
+// Note: this rule relies on a race condition. For consistent results
+// you MUST set some delay in the router<->server link.
+type DPISpoofDNSOverTCPResponse struct {
+	// Addresses contains the OPTIONAL addresses to include
+	// in the spoofed response. If this field is empty, we
+	// will return a NXDOMAIN response to the user.
+	Addresses []string
+
+	// Domains contains the MANDATORY offending domains using
+	// the syntax described by [DPIInjectDNSResponses].
+	Domains []string
+
+	// Logger is the MANDATORY logger.
+	Logger Logger
+}
+
+var _ DPIRule = &DPISpoofDNSOverTCPResponse{}
+
+// Filter implements DPIRule
+func (r *DPISpoofDNSOverTCPResponse) Filter(
+	direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool) {
+	// short circuit for the return path
+	if direction != DPIDirectionClientToServer {
+		return nil, false
+	}
+
+	// if the packet is not offending, accept it
+	question, found := dpiMatchDNSQuery(packet.DNSQuery, r.Domains)
+	if !found {
+		return nil, false
+	}
+
+	// create a DNS record for preparing a response
+	dnsRecord := &DNSRecord{
+		A:     []net.IP{},
+		CNAME: "",
+	}
+	for _, addr := range r.Addresses {
+		if ip := net.ParseIP(addr); ip != nil {
+			dnsRecord.A = append(dnsRecord.A, ip)
+		}
+	}
+
+	// generate the length-prefixed raw DNS response
+	rawResponse, err := dnsServerNewResponse(packet.DNSQuery, question, len(dnsRecord.A) > 0, dnsRecord)
+	if err != nil {
+		return nil, false
+	}
+	payload := binary.BigEndian.AppendUint16(nil, uint16(len(rawResponse)))
+	payload = append(payload, rawResponse...)
+
+	// generate the frames to spoof
+	toClient, err := reflectDissectedTCPSegmentForHTTPRequest(packet, func(tcp *layers.TCP) {
+		tcp.ACK = true
+		tcp.PSH = true
+	}, payload)
+	if err != nil {
+		return nil, false
+	}
+	toServer, err := resetDissectedTCPSegmentTowardsServer(packet)
+	if err != nil {
+		return nil, false
+	}
+
+	// tell the user we're asking the router to spoof a response
+	r.Logger.Infof(
+		"netem: dpi: asking to spoof DNS over TCP reply for flow %s:%d %s:%d/%s because domain==%s",
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+		question.Name,
+	)
+
+	// make sure the router knows it should spoof
+	policy := &DPIPolicy{
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagSpoof,
+		PLR:           0,
+		Spoofed:       [][]byte{toServer, toClient},
+		SpoofedDelays: nil,
+		Trigger:       nil,
+	}
+
+	return policy, true
+}
+
+// DPIWellKnownDoHServerNames contains the names of well-known
+// DNS over HTTPS servers that [DPIBlockEncryptedDNS] blocks by default.
+var DPIWellKnownDoHServerNames = []string{
+	"cloudflare-dns.com",
+	"mozilla.cloudflare-dns.com",
+	"one.one.one.one",
+	"dns.google",
+	"dns.google.com",
+	"dns.quad9.net",
+	"doh.opendns.com",
+	"dns.adguard-dns.com",
+	"dns.nextdns.io",
+}
+
+// DPIWellKnownDoHServerAddresses contains the IP addresses of well-known
+// DNS over HTTPS servers that [DPIBlockEncryptedDNS] blocks by default.
+var DPIWellKnownDoHServerAddresses = []string{
+	"1.1.1.1",
+	"1.0.0.1",
+	"8.8.8.8",
+	"8.8.4.4",
+	"9.9.9.9",
+	"149.112.112.112",
+	"208.67.222.222",
+	"208.67.220.220",
+	"94.140.14.14",
+	"94.140.15.15",
+	"2606:4700:4700::1111",
+	"2606:4700:4700::1001",
+	"2001:4860:4860::8888",
+	"2001:4860:4860::8844",
+}
+
+// DPIBlockEncryptedDNS is a [DPIRule] that blocks the fallback paths that
+// resolvers use when DNS over UDP is tampered with. It blocks the TCP and UDP
+// traffic towards port 853 (i.e., DNS over TLS and DNS over QUIC), the traffic
+// towards port 443 of the given DoH server addresses, and the TLS and QUIC
+// flows whose SNI matches the given DoH server names. The zero value is
+// invalid; please, fill all the fields marked as MANDATORY.
+//
+// Note: when Reset is true, this rule assumes that there is a router in
+// the path that can generate a spoofed RST segment. If there is no router
+// in the path, no RST segment will ever be generated.
+type DPIBlockEncryptedDNS struct {
+	// DoHServerAddresses contains the OPTIONAL IP addresses of the DoH
+	// servers to block. When nil, we use [DPIWellKnownDoHServerAddresses].
+	DoHServerAddresses []string
+
+	// DoHServerNames contains the OPTIONAL names of the DoH servers to
+	// block using the syntax described by [DPIInjectDNSResponses]. When
+	// nil, we use [DPIWellKnownDoHServerNames].
+	DoHServerNames []string
+
+	// Logger is the MANDATORY logger.
+	Logger Logger
+
+	// Reset OPTIONALLY resets the blocked TCP connections
+	// rather than dropping their packets.
+	Reset bool
+}
+
+var _ DPIRule = &DPIBlockEncryptedDNS{}
+
+// Filter implements DPIRule
+func (r *DPIBlockEncryptedDNS) Filter(
+	direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool) {
+	// short circuit for the return path
+	if direction != DPIDirectionClientToServer {
+		return nil, false
+	}
+
+	// short circuit for non TCP and non UDP packets
+	if packet.TCP == nil && packet.UDP == nil {
+		return nil, false
+	}
+
+	// if the packet is not offending, accept it
+	reason, found := r.match(packet)
+	if !found {
+		return nil, false
+	}
+
+	r.Logger.Infof(
+		"netem: dpi: blocking encrypted DNS flow %s:%d %s:%d/%s because %s",
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+		reason,
+	)
+
+	if r.Reset && packet.TCP != nil {
+		spoofed, err := reflectDissectedTCPSegmentWithRSTACKFlags(packet)
+		if err == nil {
+			policy := &DPIPolicy{
+				Bandwidth:     0,
+				Delay:         0,
+				Flags:         FrameFlagSpoof,
+				PLR:           0,
+				Spoofed:       [][]byte{spoofed},
+				SpoofedDelays: nil,
+				Trigger:       nil,
+			}
+			return policy, true
+		}
+	}
+
+	policy := &DPIPolicy{
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagDrop,
+		PLR:           0,
+		Spoofed:       nil,
+		SpoofedDelays: nil,
+		Trigger:       nil,
+	}
+	return policy, true
+}
+
+// match returns whether we should block the packet along with the reason.
+func (r *DPIBlockEncryptedDNS) match(packet *DissectedPacket) (string, bool) {
+	switch port := packet.DestinationPort(); port {
+	case 853:
+		return "port==853", true
+
+	case 443:
+		addresses := r.DoHServerAddresses
+		if addresses == nil {
+			addresses = DPIWellKnownDoHServerAddresses
+		}
+		for _, address := range addresses {
+			if ip := net.ParseIP(address); ip != nil && ip.String() == packet.DestinationIPAddress() {
+				return fmt.Sprintf("address==%s", address), true
+			}
+		}
+	}
+
+	// wait for the DPIEngine to reassemble the ClientHello
+	if packet.TLSClientHello == nil {
+		return "", false
+	}
+	sni, err := packet.parseTLSServerName()
+	if err != nil {
+		return "", false
+	}
+	names := r.DoHServerNames
+	if names == nil {
+		names = DPIWellKnownDoHServerNames
+	}
+	if dpiMatchDomain(names, sni) {
+		return fmt.Sprintf("SNI==%s", sni), true
+	}
+	return "", false
+}
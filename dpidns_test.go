@@ -0,0 +1,195 @@
+package netem
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDPIParseDNSOverTCPQuery(t *testing.T) {
+	query := &dns.Msg{}
+	query.SetQuestion("www.example.com.", dns.TypeA)
+	rawQuery := Must1(query.Pack())
+	message := append(binary.BigEndian.AppendUint16(nil, uint16(len(rawQuery))), rawQuery...)
+
+	t.Run("we wait for the whole message", func(t *testing.T) {
+		for _, size := range []int{0, 1, 2, len(message) - 1} {
+			output, err := dpiParseDNSOverTCPQuery(message[:size])
+			if output != nil || err != nil {
+				t.Fatal("expected nil message and nil error with", size, "bytes")
+			}
+		}
+		output, err := dpiParseDNSOverTCPQuery(append(message, 0, 12))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(output) != len(message) {
+			t.Fatal("unexpected message length", len(output))
+		}
+	})
+
+	t.Run("we reject streams not containing DNS queries", func(t *testing.T) {
+		response := &dns.Msg{}
+		response.SetReply(query)
+		rawResponse := Must1(response.Pack())
+		for _, input := range [][]byte{
+			{0, 12, 0, 1, 0, 0, 0, 5, 0, 0, 0, 0, 0, 0},
+			{0, 4, 1, 2, 3, 4},
+			append(binary.BigEndian.AppendUint16(nil, uint16(len(rawResponse))), rawResponse...),
+		} {
+			if _, err := dpiParseDNSOverTCPQuery(input); !errors.Is(err, errDPIDNSOverTCP) {
+				t.Fatal("unexpected error", err)
+			}
+		}
+	})
+}
+
+func TestDPIDNSOverTCPRules(t *testing.T) {
+	// inspect sends the SYN segment and the query split in two segments
+	// to a DPIEngine using the given rule and returns the policy for the
+	// first segment with a policy, as well as the number of segments
+	inspect := func(t *testing.T, rule DPIRule, domain string) (*DPIPolicy, int) {
+		dpi := NewDPIEngine(&NullLogger{})
+		dpi.AddRule(rule)
+		query := &dns.Msg{}
+		query.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+		rawQuery := Must1(query.Pack())
+		message := append(binary.BigEndian.AppendUint16(nil, uint16(len(rawQuery))), rawQuery...)
+		segments := [][]byte{
+			dpiSerializeTCPSegment(t, "10.0.0.2", 54321, "10.0.0.1", 53, 1000, true, nil),
+			dpiSerializeTCPSegment(t, "10.0.0.2", 54321, "10.0.0.1", 53, 1001, false, message[:10]),
+			dpiSerializeTCPSegment(t, "10.0.0.2", 54321, "10.0.0.1", 53, 1011, false, message[10:]),
+		}
+		for idx, segment := range segments {
+			if policy, match := dpi.inspect(segment); match {
+				return policy, idx
+			}
+		}
+		return nil, len(segments)
+	}
+
+	t.Run("we reset the connection", func(t *testing.T) {
+		rule := &DPIResetTrafficForDNSOverTCP{Domains: []string{".example.com"}, Logger: &NullLogger{}}
+		policy, idx := inspect(t, rule, "www.example.com")
+		if idx != 2 || policy.Flags != FrameFlagSpoof || len(policy.Spoofed) != 1 {
+			t.Fatal("unexpected policy", idx, policy)
+		}
+		if _, idx := inspect(t, rule, "www.example.org"); idx != 3 {
+			t.Fatal("expected no match for other domains")
+		}
+	})
+
+	t.Run("we drop the traffic", func(t *testing.T) {
+		rule := &DPIDropTrafficForDNSOverTCP{Domains: []string{"www.example.com"}, Logger: &NullLogger{}}
+		policy, idx := inspect(t, rule, "www.example.com")
+		if idx != 2 || policy.Flags != FrameFlagDrop {
+			t.Fatal("unexpected policy", idx, policy)
+		}
+	})
+
+	t.Run("we spoof a response", func(t *testing.T) {
+		rule := &DPISpoofDNSOverTCPResponse{
+			Addresses: []string{"10.10.34.35"},
+			Domains:   []string{"www.example.com"},
+			Logger:    &NullLogger{},
+		}
+		policy, idx := inspect(t, rule, "www.example.com")
+		if idx != 2 || policy.Flags != FrameFlagSpoof || len(policy.Spoofed) != 2 {
+			t.Fatal("unexpected policy", idx, policy)
+		}
+		packet, err := DissectPacket(policy.Spoofed[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload := packet.TCP.Payload
+		if packet.DestinationIPAddress() != "10.0.0.2" || len(payload) < 2 ||
+			int(binary.BigEndian.Uint16(payload)) != len(payload)-2 {
+			t.Fatal("unexpected spoofed segment")
+		}
+		resp := &dns.Msg{}
+		if err := resp.Unpack(payload[2:]); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.10.34.35" {
+			t.Fatal("unexpected response", resp)
+		}
+	})
+}
+
+func TestDPIBlockEncryptedDNS(t *testing.T) {
+	// filter runs the rule on a dissected client-to-server packet
+	filter := func(t *testing.T, rule DPIRule, rawPacket []byte, clientHello []byte) (*DPIPolicy, bool) {
+		packet, err := DissectPacket(rawPacket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet.TLSClientHello = clientHello
+		return rule.Filter(DPIDirectionClientToServer, packet)
+	}
+
+	syn := func(t *testing.T, dstIP string, dstPort uint16) []byte {
+		return dpiSerializeTCPSegment(t, "10.0.0.2", 54321, dstIP, dstPort, 1000, true, nil)
+	}
+
+	t.Run("we block DNS over TLS and DNS over QUIC", func(t *testing.T) {
+		rule := &DPIBlockEncryptedDNS{Logger: &NullLogger{}}
+		if policy, match := filter(t, rule, syn(t, "10.0.0.1", 853), nil); !match || policy.Flags != FrameFlagDrop {
+			t.Fatal("expected to drop DNS over TLS")
+		}
+		datagram := dpiSerializeUDPDatagram(t, "10.0.0.2", 54321, "10.0.0.1", 853, []byte("x"))
+		if _, match := filter(t, rule, datagram, nil); !match {
+			t.Fatal("expected to drop DNS over QUIC")
+		}
+	})
+
+	t.Run("we block DoH servers by address", func(t *testing.T) {
+		rule := &DPIBlockEncryptedDNS{Logger: &NullLogger{}, Reset: true}
+		policy, match := filter(t, rule, syn(t, "8.8.8.8", 443), nil)
+		if !match || policy.Flags != FrameFlagSpoof || len(policy.Spoofed) != 1 {
+			t.Fatal("expected to reset the connection")
+		}
+		packet, err := DissectPacket(policy.Spoofed[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !packet.TCP.RST || !packet.TCP.ACK || packet.TCP.Ack != 1001 {
+			t.Fatal("unexpected spoofed segment")
+		}
+		if _, match := filter(t, rule, syn(t, "8.8.8.8", 53), nil); match {
+			t.Fatal("expected no match for other ports")
+		}
+		if _, match := filter(t, rule, syn(t, "10.0.0.1", 443), nil); match {
+			t.Fatal("expected no match for other addresses")
+		}
+	})
+
+	t.Run("we block DoH servers by SNI", func(t *testing.T) {
+		rule := &DPIBlockEncryptedDNS{
+			DoHServerAddresses: []string{},
+			DoHServerNames:     []string{".ulfheim.net"},
+			Logger:             &NullLogger{},
+		}
+		clientHello := TLSHandshakeBytes13[5:]
+		rawPacket := dpiSerializeTCPSegment(t, "10.0.0.2", 54321, "10.0.0.1", 443, 1001, false, []byte("x"))
+		if _, match := filter(t, rule, rawPacket, clientHello); !match {
+			t.Fatal("expected to block the SNI")
+		}
+		rule.DoHServerNames = DPIWellKnownDoHServerNames
+		if _, match := filter(t, rule, rawPacket, clientHello); match {
+			t.Fatal("expected no match for other SNIs")
+		}
+	})
+
+	t.Run("we ignore the return path", func(t *testing.T) {
+		rule := &DPIBlockEncryptedDNS{Logger: &NullLogger{}}
+		packet, err := DissectPacket(syn(t, "10.0.0.1", 853))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, match := rule.Filter(DPIDirectionServerToClient, packet); match {
+			t.Fatal("expected no match on the return path")
+		}
+	})
+}
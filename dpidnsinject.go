@@ -0,0 +1,258 @@
+package netem
+
+//
+// DPI: DNS injection
+//
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+)
+
+// dpiDNSInjectDefaultTTL is the default TTL of the forged DNS records.
+const dpiDNSInjectDefaultTTL = 3600
+
+// DPIInjectDNSResponses is a [DPIRule] that emulates an on-path DNS injector
+// such as the one used by the Great Firewall of China. When it sees a DNS
+// query for one of the given domains, it spoofs one or more forged responses
+// and, by default, lets the query reach the server, such that the legitimate
+// response arrives later. The zero value is invalid; please, fill all the
+// fields marked as MANDATORY.
+//
+// Each forged response uses the next entry in AddressSets and TTLs in a
+// round-robin fashion. We include an A record for each IPv4 address and an
+// AAAA record for each IPv6 address regardless of the query type, which is
+// what the real injectors do. An empty set of addresses produces a NXDOMAIN
+// response.
+//
+// Unlike other rules, whose policy applies to the whole flow, we inspect each
+// query on its own and the forged responses reuse the query's ID and question.
+// Hence, we inject responses for retransmitted queries, and we do not interfere
+// with non-matching queries sent using the same socket (e.g., glibc sending the
+// A and AAAA queries using the same socket when we only match A queries).
+//
+// Note: this rule assumes that there is a router in the path that
+// can generate spoofed packets. If there is no router in the path,
+// no forged response will ever be generated.
+//
+// Note: unless DropQuery is set, this rule relies on a race condition. For
+// consistent results you MUST set some delay in the router<->server link.
+type DPIInjectDNSResponses struct {
+	// AddressSets contains the OPTIONAL addresses to include in each
+	// forged response. When empty, all the responses are NXDOMAIN.
+	AddressSets [][]string
+
+	// Count is the OPTIONAL number of forged responses to
+	// send. When zero or negative, we send one response.
+	Count int
+
+	// Delay is the OPTIONAL delay before sending the first forged response.
+	Delay time.Duration
+
+	// Domains contains the MANDATORY domains to match. An entry such
+	// as "example.com" only matches example.com, an entry such as
+	// "*.example.com" only matches the subdomains of example.com,
+	// and an entry such as ".example.com" matches example.com and
+	// all its subdomains. The matching is case insensitive.
+	Domains []string
+
+	// DropQuery OPTIONALLY prevents the query from reaching the
+	// server, such that the client only sees forged responses.
+	DropQuery bool
+
+	// Interval is the OPTIONAL interval between consecutive forged responses.
+	Interval time.Duration
+
+	// Logger is the MANDATORY logger.
+	Logger Logger
+
+	// QueryTypes contains the OPTIONAL query types to match (e.g.,
+	// [dns.TypeA]). When empty, we match all the query types.
+	QueryTypes []uint16
+
+	// TTLs contains the OPTIONAL TTLs of the records in each forged
+	// response. When empty, we use a one hour TTL.
+	TTLs []uint32
+}
+
+var (
+	_ DPIRule       = &DPIInjectDNSResponses{}
+	_ dpiPacketRule = &DPIInjectDNSResponses{}
+)
+
+// appliesToPacket implements dpiPacketRule.
+func (r *DPIInjectDNSResponses) appliesToPacket() {}
+
+// Filter implements DPIRule
+func (r *DPIInjectDNSResponses) Filter(
+	direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool) {
+	// short circuit for the return path
+	if direction != DPIDirectionClientToServer {
+		return nil, false
+	}
+
+	// short circuit for TCP packets
+	if packet.TransportProtocol() != layers.IPProtocolUDP {
+		return nil, false
+	}
+
+	// short circuit for non-DNS traffic
+	if packet.DestinationPort() != 53 {
+		return nil, false
+	}
+
+	// try to parse the DNS request
+	request := &dns.Msg{}
+	if err := request.Unpack(packet.UDP.Payload); err != nil {
+		return nil, false
+	}
+
+	// if the packet is not offending, accept it
+	if request.Response || len(request.Question) != 1 {
+		return nil, false
+	}
+	question := request.Question[0]
+	if !dpiMatchDomain(r.Domains, question.Name) || !r.matchQueryType(question.Qtype) {
+		return nil, false
+	}
+
+	// generate the forged responses and the corresponding frames to spoof
+	count := max(r.Count, 1)
+	spoofed := make([][]byte, 0, count)
+	delays := make([]time.Duration, 0, count)
+	for idx := 0; idx < count; idx++ {
+		rawResponse, err := r.newResponse(request, question, idx)
+		if err != nil {
+			return nil, false
+		}
+		frame, err := reflectDissectedUDPDatagramWithPayload(packet, rawResponse)
+		if err != nil {
+			return nil, false
+		}
+		spoofed = append(spoofed, frame)
+		delays = append(delays, r.Delay+time.Duration(idx)*r.Interval)
+	}
+
+	// make sure the router knows it should spoof
+	flags := int64(FrameFlagSpoof)
+	if r.DropQuery {
+		flags |= FrameFlagSpoofOnly
+	}
+	policy := &DPIPolicy{
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         flags,
+		PLR:           0,
+		Spoofed:       spoofed,
+		SpoofedDelays: delays,
+		Trigger:       nil,
+	}
+
+	// tell the user we're asking the router to inject responses
+	r.Logger.Infof(
+		"netem: dpi: asking to inject %d DNS replies for query %d in flow %s:%d %s:%d/%s because domain==%s",
+		count,
+		request.Id,
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+		question.Name,
+	)
+
+	return policy, true
+}
+
+// matchQueryType returns whether we should inject responses for the given query type.
+func (r *DPIInjectDNSResponses) matchQueryType(qtype uint16) bool {
+	if len(r.QueryTypes) <= 0 {
+		return true
+	}
+	for _, candidate := range r.QueryTypes {
+		if candidate == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// newResponse generates the forged response with the given index.
+func (r *DPIInjectDNSResponses) newResponse(query *dns.Msg, q0 dns.Question, idx int) ([]byte, error) {
+	var addresses []string
+	if len(r.AddressSets) > 0 {
+		addresses = r.AddressSets[idx%len(r.AddressSets)]
+	}
+	ttl := uint32(dpiDNSInjectDefaultTTL)
+	if len(r.TTLs) > 0 {
+		ttl = r.TTLs[idx%len(r.TTLs)]
+	}
+
+	// handle the NXDOMAIN case
+	resp := &dns.Msg{}
+	if len(addresses) <= 0 {
+		resp.SetRcode(query, dns.RcodeNameError)
+		return resp.Pack()
+	}
+
+	// insert A and AAAA entries
+	resp.SetReply(query)
+	for _, addr := range addresses {
+		ip := net.ParseIP(addr)
+		switch {
+		case ip == nil:
+			// nothing
+		case ip.To4() != nil:
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:     q0.Name,
+					Rrtype:   dns.TypeA,
+					Class:    dns.ClassINET,
+					Ttl:      ttl,
+					Rdlength: 0,
+				},
+				A: ip.To4(),
+			})
+		default:
+			resp.Answer = append(resp.Answer, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:     q0.Name,
+					Rrtype:   dns.TypeAAAA,
+					Class:    dns.ClassINET,
+					Ttl:      ttl,
+					Rdlength: 0,
+				},
+				AAAA: ip,
+			})
+		}
+	}
+	return resp.Pack()
+}
+
+// dpiMatchDomain returns whether the given domain matches any of the given
+// patterns. See [DPIInjectDNSResponses] for the pattern syntax.
+func dpiMatchDomain(patterns []string, domain string) bool {
+	domain = dns.CanonicalName(domain)
+	for _, pattern := range patterns {
+		switch {
+		case strings.HasPrefix(pattern, "*."):
+			if strings.HasSuffix(domain, dns.CanonicalName(pattern[1:])) {
+				return true
+			}
+		case strings.HasPrefix(pattern, "."):
+			suffix := dns.CanonicalName(pattern[1:])
+			if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+				return true
+			}
+		case pattern != "":
+			if domain == dns.CanonicalName(pattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+package netem
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+)
+
+// dpiSerializeUDPDatagram serializes an IPv4 packet containing a UDP datagram.
+func dpiSerializeUDPDatagram(
+	t *testing.T,
+	srcIP string,
+	srcPort uint16,
+	dstIP string,
+	dstPort uint16,
+	payload []byte,
+) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(srcIP).To4(),
+		DstIP:    net.ParseIP(dstIP).To4(),
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(srcPort),
+		DstPort: layers.UDPPort(dstPort),
+	}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, ip, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDPIMatchDomain(t *testing.T) {
+	patterns := []string{"www.example.com", "*.example.org", ".example.net"}
+
+	var testcases = map[string]bool{
+		"www.example.com.":  true,
+		"WWW.Example.COM":   true,
+		"example.com":       false,
+		"a.www.example.com": false,
+		"www.example.org":   true,
+		"a.b.example.org":   true,
+		"example.org":       false,
+		"badexample.org":    false,
+		"example.net":       true,
+		"www.example.net":   true,
+		"badexample.net":    false,
+	}
+
+	for domain, expect := range testcases {
+		if got := dpiMatchDomain(patterns, domain); got != expect {
+			t.Fatal("for", domain, "expected", expect, "got", got)
+		}
+	}
+}
+
+func TestDPIInjectDNSResponses(t *testing.T) {
+	// filter runs the rule on a query for the given domain and type
+	filter := func(t *testing.T, rule *DPIInjectDNSResponses, domain string, qtype uint16) (*DPIPolicy, bool) {
+		query := &dns.Msg{}
+		query.SetQuestion(dns.Fqdn(domain), qtype)
+		rawPacket := dpiSerializeUDPDatagram(t, "10.0.0.2", 54321, "8.8.8.8", 53, Must1(query.Pack()))
+		packet, err := DissectPacket(rawPacket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rule.Filter(DPIDirectionClientToServer, packet)
+	}
+
+	// responses parses the DNS responses inside the spoofed frames
+	responses := func(t *testing.T, policy *DPIPolicy) (output []*dns.Msg) {
+		for _, frame := range policy.Spoofed {
+			packet, err := DissectPacket(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if packet.SourceIPAddress() != "8.8.8.8" || packet.DestinationPort() != 54321 {
+				t.Fatal("unexpected spoofed packet")
+			}
+			resp := &dns.Msg{}
+			if err := resp.Unpack(packet.UDP.Payload); err != nil {
+				t.Fatal(err)
+			}
+			output = append(output, resp)
+		}
+		return
+	}
+
+	t.Run("we inject several responses with varying addresses, TTLs, and delays", func(t *testing.T) {
+		rule := &DPIInjectDNSResponses{
+			AddressSets: [][]string{{"10.10.34.35"}, {"10.10.34.36", "2001:db8::1"}, {}},
+			Count:       3,
+			Delay:       10 * time.Millisecond,
+			Domains:     []string{".example.com"},
+			Interval:    5 * time.Millisecond,
+			Logger:      &NullLogger{},
+			TTLs:        []uint32{60, 120},
+		}
+		policy, match := filter(t, rule, "www.example.com", dns.TypeA)
+		if !match {
+			t.Fatal("expected a match")
+		}
+		if policy.Flags != FrameFlagSpoof {
+			t.Fatal("unexpected flags", policy.Flags)
+		}
+		expectDelays := []time.Duration{10 * time.Millisecond, 15 * time.Millisecond, 20 * time.Millisecond}
+		if diff := cmp.Diff(expectDelays, policy.SpoofedDelays); diff != "" {
+			t.Fatal(diff)
+		}
+
+		resps := responses(t, policy)
+		if len(resps) != 3 {
+			t.Fatal("unexpected number of responses", len(resps))
+		}
+		if len(resps[0].Answer) != 1 || resps[0].Answer[0].(*dns.A).A.String() != "10.10.34.35" ||
+			resps[0].Answer[0].Header().Ttl != 60 {
+			t.Fatal("unexpected first response", resps[0])
+		}
+		if len(resps[1].Answer) != 2 || resps[1].Answer[1].(*dns.AAAA).AAAA.String() != "2001:db8::1" ||
+			resps[1].Answer[0].Header().Ttl != 120 {
+			t.Fatal("unexpected second response", resps[1])
+		}
+		if resps[2].Rcode != dns.RcodeNameError {
+			t.Fatal("expected the third response to be NXDOMAIN", resps[2])
+		}
+	})
+
+	t.Run("we can drop the query", func(t *testing.T) {
+		rule := &DPIInjectDNSResponses{
+			Domains:   []string{"www.example.com"},
+			DropQuery: true,
+			Logger:    &NullLogger{},
+		}
+		policy, match := filter(t, rule, "www.example.com", dns.TypeA)
+		if !match {
+			t.Fatal("expected a match")
+		}
+		if policy.Flags != FrameFlagSpoof|FrameFlagSpoofOnly || len(policy.Spoofed) != 1 {
+			t.Fatal("unexpected policy", policy)
+		}
+	})
+
+	t.Run("we only match the configured domains and query types", func(t *testing.T) {
+		rule := &DPIInjectDNSResponses{
+			Domains:    []string{"*.example.com"},
+			Logger:     &NullLogger{},
+			QueryTypes: []uint16{dns.TypeA, dns.TypeAAAA},
+		}
+		if _, match := filter(t, rule, "www.example.com", dns.TypeAAAA); !match {
+			t.Fatal("expected a match")
+		}
+		if _, match := filter(t, rule, "www.example.com", dns.TypeHTTPS); match {
+			t.Fatal("expected no match for other query types")
+		}
+		if _, match := filter(t, rule, "example.com", dns.TypeA); match {
+			t.Fatal("expected no match for other domains")
+		}
+	})
+
+	t.Run("the engine inspects each query on its own", func(t *testing.T) {
+		dpi := NewDPIEngineWithConfig(&NullLogger{}, &DPIEngineConfig{MaxPackets: 2})
+		dpi.AddRule(&DPIInjectDNSResponses{
+			Domains:    []string{"www.example.com"},
+			DropQuery:  true,
+			Logger:     &NullLogger{},
+			QueryTypes: []uint16{dns.TypeA},
+		})
+
+		// inspect sends a query using the same socket and returns the policy
+		inspect := func(qtype uint16) (*DPIPolicy, bool) {
+			query := &dns.Msg{}
+			query.SetQuestion("www.example.com.", qtype)
+			return dpi.inspect(dpiSerializeUDPDatagram(t, "10.0.0.2", 54321, "8.8.8.8", 53, Must1(query.Pack())))
+		}
+
+		// we send more queries than MaxPackets, including retransmissions
+		for idx := 0; idx < 3; idx++ {
+			if policy, match := inspect(dns.TypeA); !match || len(policy.Spoofed) != 1 {
+				t.Fatal("expected to inject a response for each A query", idx)
+			}
+			if _, match := inspect(dns.TypeAAAA); match {
+				t.Fatal("expected not to interfere with the AAAA query", idx)
+			}
+		}
+
+		// the responses do not match either
+		response := &dns.Msg{}
+		response.SetQuestion("www.example.com.", dns.TypeAAAA)
+		response.Response = true
+		rawResponse := dpiSerializeUDPDatagram(t, "8.8.8.8", 53, "10.0.0.2", 54321, Must1(response.Pack()))
+		if _, match := dpi.inspect(rawResponse); match {
+			t.Fatal("expected not to interfere with the responses")
+		}
+	})
+}
@@ -20,7 +20,8 @@ type DPIDropTrafficForServerEndpoint struct {
 	// ServerIPAddress is the MANDATORY server endpoint IP address.
 	ServerIPAddress string
 
-	// ServerPort is the MANDATORY server endpoint port.
+	// ServerPort is the MANDATORY server endpoint port, which
+	// we ignore when the ServerProtocol is ICMPv4 or ICMPv6.
 	ServerPort uint16
 
 	// ServerProtocol is the MANDATORY server endpoint protocol.
@@ -47,10 +48,13 @@ func (r *DPIDropTrafficForServerEndpoint) Filter(
 		r.ServerProtocol,
 	)
 	policy := &DPIPolicy{
-		Delay:   0,
-		Flags:   FrameFlagDrop,
-		PLR:     0,
-		Spoofed: nil,
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagDrop,
+		PLR:           0,
+		Spoofed:       nil,
+		SpoofedDelays: nil,
+		Trigger:       nil,
 	}
 	return policy, true
 }
@@ -64,15 +68,6 @@ type DPIDropTrafficForTLSSNI struct {
 
 	// SNI is the MANDATORY SNI
 	SNI string
-
-	// TLSHandshake
-	TLSHandshake []byte
-
-	// TLSHandshakeSize
-	TlSHandshakeSize uint16
-
-	// done
-	done bool
 }
 
 var _ DPIRule = &DPIDropTrafficForTLSSNI{}
@@ -90,64 +85,125 @@ func (r *DPIDropTrafficForTLSSNI) Filter(
 		return nil, false
 	}
 
-	tlsHandshakeBytes, length, err := packet.extractTLSHandshake(r.TLSHandshake, r.TlSHandshakeSize)
-	if err != nil {
+	// wait for the DPIEngine to reassemble the ClientHello
+	if packet.TLSClientHello == nil {
 		return nil, false
 	}
-	if r.TlSHandshakeSize == 0 {
-		r.TlSHandshakeSize = length
+
+	// try to obtain the SNI
+	sni, err := packet.parseTLSServerName()
+	if err != nil {
+		r.Logger.Warnf(
+			"netem: dpi: failed to parse TLS server name for %s:%d %s:%d/%s: %s",
+			packet.SourceIPAddress(),
+			packet.SourcePort(),
+			packet.DestinationIPAddress(),
+			packet.DestinationPort(),
+			packet.TransportProtocol(),
+			err.Error(),
+		)
+		return nil, false
 	}
-	r.TLSHandshake = tlsHandshakeBytes
-	if r.done {
+
+	// if the packet is not offending, accept it
+	if sni != r.SNI {
 		return nil, false
 	}
 
-	if len(r.TLSHandshake) == int(r.TlSHandshakeSize) {
-		sni, err := packet.parseTLSServerName(r.TLSHandshake)
-		if err != nil {
-			r.Logger.Warnf(
-				"netem: dpi: failed to parse TLS server name for %s:%d %s:%d/%s because SNI==%s",
-				packet.SourceIPAddress(),
-				packet.SourcePort(),
-				packet.DestinationIPAddress(),
-				packet.DestinationPort(),
-				packet.TransportProtocol(),
-				sni,
-			)
-			r.TLSHandshake = []byte{}
-			r.TlSHandshakeSize = 0
-			return nil, false
-		}
+	r.Logger.Infof(
+		"netem: dpi: dropping traffic for flow %s:%d %s:%d/%s because SNI==%s",
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+		sni,
+	)
+
+	policy := &DPIPolicy{
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagDrop,
+		PLR:           0,
+		Spoofed:       nil,
+		SpoofedDelays: nil,
+		Trigger:       nil,
+	}
+	return policy, true
+}
+
+// DPIDropTrafficForQUICSNI is a [DPIRule] that drops all the
+// traffic after it sees a given SNI inside the ClientHello carried
+// by the client's QUIC Initial packets. The zero value is
+// invalid; please fill all the fields marked as MANDATORY.
+type DPIDropTrafficForQUICSNI struct {
+	// Logger is the MANDATORY logger
+	Logger Logger
+
+	// SNI is the MANDATORY SNI
+	SNI string
+}
+
+var _ DPIRule = &DPIDropTrafficForQUICSNI{}
+
+// Filter implements DPIRule
+func (r *DPIDropTrafficForQUICSNI) Filter(
+	direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool) {
+	// short circuit for the return path
+	if direction != DPIDirectionClientToServer {
+		return nil, false
+	}
 
-		r.TLSHandshake = []byte{}
-		r.TlSHandshakeSize = 0
-		r.done = true
+	// short circuit for TCP packets
+	if packet.TransportProtocol() != layers.IPProtocolUDP {
+		return nil, false
+	}
 
-		// if the packet is not offending, accept it
-		if sni != r.SNI {
-			return nil, false
-		}
+	// wait for the DPIEngine to decrypt and reassemble the ClientHello
+	if packet.TLSClientHello == nil {
+		return nil, false
+	}
 
-		r.Logger.Infof(
-			"netem: dpi: dropping traffic for flow %s:%d %s:%d/%s because SNI==%s",
+	// try to obtain the SNI
+	sni, err := packet.parseTLSServerName()
+	if err != nil {
+		r.Logger.Warnf(
+			"netem: dpi: failed to parse TLS server name for %s:%d %s:%d/%s: %s",
 			packet.SourceIPAddress(),
 			packet.SourcePort(),
 			packet.DestinationIPAddress(),
 			packet.DestinationPort(),
 			packet.TransportProtocol(),
-			sni,
+			err.Error(),
 		)
+		return nil, false
+	}
 
-		policy := &DPIPolicy{
-			Delay:   0,
-			Flags:   FrameFlagDrop,
-			PLR:     0,
-			Spoofed: nil,
-		}
-		return policy, true
+	// if the packet is not offending, accept it
+	if sni != r.SNI {
+		return nil, false
 	}
 
-	return nil, false
+	r.Logger.Infof(
+		"netem: dpi: dropping traffic for flow %s:%d %s:%d/%s because QUIC SNI==%s",
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+		sni,
+	)
+
+	policy := &DPIPolicy{
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagDrop,
+		PLR:           0,
+		Spoofed:       nil,
+		SpoofedDelays: nil,
+		Trigger:       nil,
+	}
+	return policy, true
 }
 
 // DPIDropTrafficForString is a [DPIRule] that drops all
@@ -207,10 +263,182 @@ func (r *DPIDropTrafficForString) Filter(
 		r.String,
 	)
 	policy := &DPIPolicy{
-		Delay:   0,
-		Flags:   FrameFlagDrop,
-		PLR:     0,
-		Spoofed: nil,
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagDrop,
+		PLR:           0,
+		Spoofed:       nil,
+		SpoofedDelays: nil,
+		Trigger:       nil,
+	}
+	return policy, true
+}
+
+// DPIDropTrafficForHTTPRequest is a [DPIRule] that drops all the traffic
+// after it sees an HTTP/1.x request selected by the Matcher, regardless
+// of the destination. The zero value is invalid; please fill all the
+// fields marked as MANDATORY.
+type DPIDropTrafficForHTTPRequest struct {
+	// Logger is the MANDATORY logger
+	Logger Logger
+
+	// Matcher is the MANDATORY matcher selecting the offending requests.
+	Matcher DPIHTTPRequestMatcher
+}
+
+var _ DPIRule = &DPIDropTrafficForHTTPRequest{}
+
+// Filter implements DPIRule
+func (r *DPIDropTrafficForHTTPRequest) Filter(
+	direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool) {
+	// short circuit for the return path
+	if direction != DPIDirectionClientToServer {
+		return nil, false
+	}
+
+	// if the packet is not offending, accept it
+	if !r.Matcher.Match(packet.HTTPRequest) {
+		return nil, false
+	}
+
+	r.Logger.Infof(
+		"netem: dpi: dropping traffic for flow %s:%d %s:%d/%s because HTTP request matches %s",
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+		r.Matcher.String(),
+	)
+
+	policy := &DPIPolicy{
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagDrop,
+		PLR:           0,
+		Spoofed:       nil,
+		SpoofedDelays: nil,
+		Trigger:       nil,
+	}
+	return policy, true
+}
+
+// DPIDropTrafficForTLSCertificate is a [DPIRule] that drops all the traffic of a
+// flow, in both directions, after it sees a cleartext TLS 1.2 server certificate
+// for the given Name. We do not see TLS 1.3 certificates, which are encrypted.
+// The zero value is invalid; please fill all the fields marked as MANDATORY.
+type DPIDropTrafficForTLSCertificate struct {
+	// Logger is the MANDATORY logger
+	Logger Logger
+
+	// Name is the MANDATORY offending name, which matches when it is
+	// the subject common name of the server's certificate or when the
+	// server's certificate is valid for such a name.
+	Name string
+}
+
+var _ DPIRule = &DPIDropTrafficForTLSCertificate{}
+
+// Filter implements DPIRule
+func (r *DPIDropTrafficForTLSCertificate) Filter(
+	direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool) {
+	// short circuit for the forward path
+	if direction != DPIDirectionServerToClient {
+		return nil, false
+	}
+
+	// wait for the DPIEngine to reassemble the Certificate
+	if packet.TLSCertificate == nil {
+		return nil, false
+	}
+
+	// try to obtain the certificates
+	certs, err := packet.parseTLSCertificates()
+	if err != nil {
+		r.Logger.Warnf(
+			"netem: dpi: failed to parse TLS certificate for %s:%d %s:%d/%s: %s",
+			packet.SourceIPAddress(),
+			packet.SourcePort(),
+			packet.DestinationIPAddress(),
+			packet.DestinationPort(),
+			packet.TransportProtocol(),
+			err.Error(),
+		)
+		return nil, false
+	}
+
+	// if the packet is not offending, accept it
+	if !dpiCertificateMatchesName(certs[0], r.Name) {
+		return nil, false
+	}
+
+	r.Logger.Infof(
+		"netem: dpi: dropping traffic for flow %s:%d %s:%d/%s because TLS certificate matches %s",
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+		r.Name,
+	)
+
+	policy := &DPIPolicy{
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagDrop,
+		PLR:           0,
+		Spoofed:       nil,
+		SpoofedDelays: nil,
+		Trigger:       nil,
+	}
+	return policy, true
+}
+
+// DPIDropTrafficForHTTPResponse is a [DPIRule] that drops all the traffic of a
+// flow, in both directions, after it sees an HTTP/1.x response selected by the
+// Matcher, regardless of the source. The zero value is invalid; please fill all
+// the fields marked as MANDATORY.
+type DPIDropTrafficForHTTPResponse struct {
+	// Logger is the MANDATORY logger
+	Logger Logger
+
+	// Matcher is the MANDATORY matcher selecting the offending responses.
+	Matcher DPIHTTPResponseMatcher
+}
+
+var _ DPIRule = &DPIDropTrafficForHTTPResponse{}
+
+// Filter implements DPIRule
+func (r *DPIDropTrafficForHTTPResponse) Filter(
+	direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool) {
+	// short circuit for the forward path
+	if direction != DPIDirectionServerToClient {
+		return nil, false
+	}
+
+	// if the packet is not offending, accept it
+	if !r.Matcher.Match(packet.HTTPResponse) {
+		return nil, false
+	}
+
+	r.Logger.Infof(
+		"netem: dpi: dropping traffic for flow %s:%d %s:%d/%s because HTTP response matches %s",
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+		r.Matcher.String(),
+	)
+
+	policy := &DPIPolicy{
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagDrop,
+		PLR:           0,
+		Spoofed:       nil,
+		SpoofedDelays: nil,
+		Trigger:       nil,
 	}
 	return policy, true
 }
@@ -27,6 +27,12 @@ const DPIDirectionServerToClient = DPIDirection(1)
 
 // DPIPolicy tells the [DPIEngine] which policy to apply to a packet.
 type DPIPolicy struct {
+	// Bandwidth is the OPTIONAL per-flow bandwidth in bit/s. When set, the
+	// link shapes the flow's packets in each direction such that the flow
+	// does not exceed this rate regardless of the RTT. Only [LinkFwdFull]
+	// honours this setting.
+	Bandwidth int64
+
 	// Delay is the extra delay to add to the packet.
 	Delay time.Duration
 
@@ -40,6 +46,45 @@ type DPIPolicy struct {
 	// the [Frame] so that we emit spoofed packets in the
 	// router when the frame is being processed.
 	Spoofed [][]byte
+
+	// SpoofedDelays OPTIONALLY contains the delay after which
+	// the router should spoof each frame in Spoofed. See the
+	// [Frame] SpoofedDelays field for more details.
+	SpoofedDelays []time.Duration
+
+	// Trigger OPTIONALLY defers applying the policy until the
+	// flow has transferred enough bytes or packets or has been
+	// running for long enough. When nil, the policy applies
+	// as soon as a [DPIRule] returns it.
+	Trigger *DPITrigger
+}
+
+// DPITrigger tells the [DPIEngine] when to start applying a [DPIPolicy] to
+// a flow, which allows emulating censors that only throttle flows after they
+// have transferred some data (e.g., after the first 100 KB) or after some time.
+// The policy applies once the flow reaches any of the non-zero thresholds. We
+// keep counting a flow's bytes and packets after the [DPIEngine] has stopped
+// running the rules on its packets, so thresholds are not limited by the
+// number of packets that the rules inspect.
+type DPITrigger struct {
+	// Bytes is the OPTIONAL number of bytes of IP packets in both
+	// directions after which the policy applies.
+	Bytes int64
+
+	// Duration is the OPTIONAL time elapsed since the flow's first
+	// packet after which the policy applies.
+	Duration time.Duration
+
+	// Packets is the OPTIONAL number of IP packets in both
+	// directions after which the policy applies.
+	Packets int64
+}
+
+// reached returns whether the flow reached any of the non-zero thresholds.
+func (dt *DPITrigger) reached(bytes, packets int64, elapsed time.Duration) bool {
+	return (dt.Bytes > 0 && bytes >= dt.Bytes) ||
+		(dt.Duration > 0 && elapsed >= dt.Duration) ||
+		(dt.Packets > 0 && packets >= dt.Packets)
 }
 
 // DPIRule is a deep packet inspection rule.
@@ -47,34 +92,117 @@ type DPIRule interface {
 	Filter(direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool)
 }
 
+// DPIEngineConfig contains OPTIONAL settings for a [DPIEngine]. The
+// zero value is valid and means that we should use the defaults.
+type DPIEngineConfig struct {
+	// IdleTimeout is the OPTIONAL time after which we forget about
+	// a flow that did not send any packet. The default is 30 seconds.
+	IdleTimeout time.Duration
+
+	// MaxFlows is the OPTIONAL maximum number of flows that we track. When
+	// we need to track a new flow and the table is full, we forget about
+	// the least recently used flow. The default is 16384.
+	MaxFlows int
+
+	// MaxPackets is the OPTIONAL inspection depth: we stop running the
+	// rules once a flow has seen this number of packets in either direction
+	// without matching any rule. Small values emulate shallow inspection
+	// and large values emulate deep inspection. The default is 10. We
+	// always run [DPIInjectDNSResponses], which inspects each DNS query.
+	MaxPackets int64
+}
+
+// dpiClosedFlowTimeout is the time after which we forget about TCP flows
+// that have been closed by RST segments or FIN segments in both directions,
+// which allows us to see the last segments of the connection teardown.
+const dpiClosedFlowTimeout = time.Second
+
+// dpiEvictionInterval is the interval between sweeps of the flow
+// table removing idle flows and closed flows.
+const dpiEvictionInterval = time.Second
+
 // DPIEngine is a deep packet inspection engine. The zero
 // value is invalid; construct using [NewDPIEngine].
 type DPIEngine struct {
 	// flows contains information about flows.
 	flows map[uint64]*dpiFlow
 
+	// idleTimeout is the time after which we forget about idle flows.
+	idleTimeout time.Duration
+
+	// lastEviction is the last time we swept the flow table.
+	lastEviction time.Time
+
 	// logger is the logger.
 	logger Logger
 
+	// maxFlows is the maximum number of flows we track.
+	maxFlows int
+
+	// maxPackets is the inspection depth.
+	maxPackets int64
+
 	// mu provides mutual exclusion.
 	mu sync.Mutex
 
 	// rules contains the rules.
 	rules []DPIRule
+
+	// timeNow returns the current time and allows tests to control the clock.
+	timeNow func() time.Time
 }
 
-// NewDPIEngine creates a new [DPIEngine] instance.
+// NewDPIEngine creates a new [DPIEngine] instance. This function is
+// equivalent to calling [NewDPIEngineWithConfig] with an empty config.
 func NewDPIEngine(logger Logger) *DPIEngine {
-	return &DPIEngine{
-		flows:  map[uint64]*dpiFlow{},
-		logger: logger,
-		mu:     sync.Mutex{},
-		rules:  nil,
+	return NewDPIEngineWithConfig(logger, &DPIEngineConfig{})
+}
+
+// NewDPIEngineWithConfig is like [NewDPIEngine] but allows
+// you to configure the [DPIEngine] using a [DPIEngineConfig].
+func NewDPIEngineWithConfig(logger Logger, config *DPIEngineConfig) *DPIEngine {
+	de := &DPIEngine{
+		flows:        map[uint64]*dpiFlow{},
+		idleTimeout:  30 * time.Second,
+		lastEviction: time.Time{},
+		logger:       logger,
+		maxFlows:     1 << 14,
+		maxPackets:   10,
+		mu:           sync.Mutex{},
+		rules:        nil,
+		timeNow:      time.Now,
+	}
+	de.lastEviction = de.timeNow()
+	if config.IdleTimeout > 0 {
+		de.idleTimeout = config.IdleTimeout
 	}
+	if config.MaxFlows > 0 {
+		de.maxFlows = config.MaxFlows
+	}
+	if config.MaxPackets > 0 {
+		de.maxPackets = config.MaxPackets
+	}
+	return de
+}
+
+// dpiRuleWithClock is the optional interface implemented by the [DPIRule]
+// instances that need the current time and should use the [DPIEngine] clock.
+type dpiRuleWithClock interface {
+	setTimeNow(timeNow func() time.Time)
+}
+
+// dpiPacketRule is the optional interface implemented by the [DPIRule] instances
+// whose policy only applies to the packet they inspected rather than to the whole
+// flow. The [DPIEngine] runs them on each packet and does not remember their policy.
+type dpiPacketRule interface {
+	appliesToPacket()
 }
 
 // AddRule adds a [DPIRule] to the [DPIEngine].
 func (de *DPIEngine) AddRule(rule DPIRule) {
+	if r, ok := rule.(dpiRuleWithClock); ok {
+		r.setTimeNow(func() time.Time { return de.timeNow() })
+	}
 	defer de.mu.Unlock()
 	de.mu.Lock()
 	de.rules = append(de.rules, rule)
@@ -102,29 +230,55 @@ func (de *DPIEngine) inspect(rawPacket []byte) (*DPIPolicy, bool) {
 	defer flow.mu.Unlock()
 	flow.mu.Lock()
 
-	// increment number of seen packets
+	// increment number of seen packets and bytes
 	flow.numPackets++
+	flow.numBytes += int64(len(rawPacket))
+
+	// compute direction
+	direction := flow.directionLocked(packet)
+
+	// notice when the TCP connection is closed so we can forget about the flow
+	if packet.TCP != nil && flow.observeTeardownLocked(direction, packet.TCP) {
+		de.closeFlow(flow)
+	}
 
 	// if we have already computed a policy, just use it
 	if flow.policy != nil {
-		return flow.policy, true
+		return flow.triggeredPolicyLocked(de.timeNow())
 	}
 
-	// avoid inspecting too many flow packets
-	const maxPackets = 10
-	if flow.numPackets >= maxPackets {
-		return nil, false
+	// avoid inspecting too many flow packets, except for the rules that
+	// inspect each packet on its own (e.g., each DNS query)
+	inspectFlow := flow.numPackets < de.maxPackets
+
+	// reassemble the streams so rules can see the first messages
+	switch {
+	case !inspectFlow:
+		// nothing
+	case direction == DPIDirectionClientToServer && packet.TCP != nil:
+		packet.setTCPClientMessage(flow.stream.addTCPSegment(packet.TCP))
+	case direction == DPIDirectionClientToServer && packet.UDP != nil:
+		packet.TLSClientHello = flow.stream.addQUICDatagram(packet.UDP.Payload)
+	case direction == DPIDirectionServerToClient && packet.TCP != nil:
+		packet.setTCPServerMessage(flow.serverStream.addTCPSegment(packet.TCP))
 	}
 
-	// compute direction
-	direction := flow.directionLocked(packet)
-
 	// execute all the rules and stop at the first non-accept result
 	for _, rule := range de.getRulesShallowCopy() {
+		if _, perPacket := rule.(dpiPacketRule); perPacket {
+			// the policy only applies to this packet, so don't remember it
+			if policy, match := rule.Filter(direction, packet); match {
+				return policy, true
+			}
+			continue
+		}
+		if !inspectFlow {
+			continue
+		}
 		policy, match := rule.Filter(direction, packet)
 		if match {
 			flow.policy = policy // remember the policy
-			return policy, true
+			return flow.triggeredPolicyLocked(de.timeNow())
 		}
 	}
 
@@ -136,31 +290,106 @@ func (de *DPIEngine) getFlow(packet *DissectedPacket) *dpiFlow {
 	defer de.mu.Unlock()
 	de.mu.Lock()
 
-	// when a flow has not been modified in 30 seconds, we assume that
-	// the record is now stale and we create a new record
-	const maxSilence = 30 * time.Second
+	// periodically forget about idle and closed flows
+	now := de.timeNow()
+	if now.Sub(de.lastEviction) >= dpiEvictionInterval {
+		de.evictStaleFlowsLocked(now)
+	}
+
+	// create a new record when we don't know the flow, when the record is
+	// stale, or when a SYN segment reuses the ports of a closed flow
 	fh := packet.FlowHash()
 	flow := de.flows[fh]
-	if flow == nil || time.Since(flow.updated) > maxSilence {
-		flow = newDPIFlow(packet)
+	reused := flow != nil && !flow.closed.IsZero() && packet.TCP != nil && packet.TCP.SYN && !packet.TCP.ACK
+	if flow == nil || de.isStaleLocked(flow, now) || reused {
+		if flow == nil && len(de.flows) >= de.maxFlows {
+			de.evictFlowsLocked(now)
+		}
+		flow = newDPIFlow(packet, now)
 		de.flows[fh] = flow
 	}
-	flow.updated = time.Now()
+	flow.updated = now
 
 	return flow
 }
 
+// closeFlow records that the given flow has been closed.
+func (de *DPIEngine) closeFlow(flow *dpiFlow) {
+	defer de.mu.Unlock()
+	de.mu.Lock()
+	flow.closed = de.timeNow()
+}
+
+// isStaleLocked returns whether we should forget about the given flow.
+func (de *DPIEngine) isStaleLocked(flow *dpiFlow, now time.Time) bool {
+	return now.Sub(flow.updated) > de.idleTimeout ||
+		(!flow.closed.IsZero() && now.Sub(flow.closed) > dpiClosedFlowTimeout)
+}
+
+// evictStaleFlowsLocked removes the idle and closed flows from the flow table.
+func (de *DPIEngine) evictStaleFlowsLocked(now time.Time) {
+	for fh, flow := range de.flows {
+		if de.isStaleLocked(flow, now) {
+			delete(de.flows, fh)
+		}
+	}
+	de.lastEviction = now
+}
+
+// evictFlowsLocked makes room for a new flow in a full flow table by removing
+// the stale flows or, if there are none, the least recently used flow.
+func (de *DPIEngine) evictFlowsLocked(now time.Time) {
+	de.evictStaleFlowsLocked(now)
+	if len(de.flows) < de.maxFlows {
+		return
+	}
+	var (
+		oldestHash uint64
+		oldest     *dpiFlow
+	)
+	for fh, flow := range de.flows {
+		if oldest == nil || flow.updated.Before(oldest.updated) {
+			oldestHash, oldest = fh, flow
+		}
+	}
+	de.logger.Debugf(
+		"netem: dpi: flow table full; evicting %s:%d %s:%d/%s",
+		oldest.sourceIP,
+		oldest.sourcePort,
+		oldest.destIP,
+		oldest.destPort,
+		oldest.protocol,
+	)
+	delete(de.flows, oldestHash)
+}
+
 // dpiFlow is a TCP/UDP flow tracked by DPI.
 type dpiFlow struct {
+	// closed is when the TCP connection was closed or the zero value. This
+	// field is protected by the [DPIEngine] mutex, like updated.
+	closed time.Time
+
+	// created is when we created this flow.
+	created time.Time
+
 	// destIP is the dest IP address.
 	destIP string
 
 	// destPort is the dest port.
 	destPort uint16
 
+	// finClientToServer indicates that the client sent a FIN segment.
+	finClientToServer bool
+
+	// finServerToClient indicates that the server sent a FIN segment.
+	finServerToClient bool
+
 	// mu provides mutual exclusion.
 	mu sync.Mutex
 
+	// numBytes is the number of bytes of the packets we inspected in either direction.
+	numBytes int64
+
 	// numPackets is the number of packets we inspected in either direction.
 	numPackets int64
 
@@ -170,28 +399,53 @@ type dpiFlow struct {
 	// protocol is the protocol used by the flow.
 	protocol layers.IPProtocol
 
+	// serverStream reassembles the server-to-client TCP stream.
+	serverStream *dpiStream
+
 	// sourceIP is the source IP address.
 	sourceIP string
 
 	// sourcePort is the source port.
 	sourcePort uint16
 
-	// updated is the last time this flow was updated.
+	// stream reassembles the client-to-server TCP or QUIC crypto stream.
+	stream *dpiStream
+
+	// teardown indicates that we have seen the TCP connection being closed.
+	teardown bool
+
+	// updated is the last time this flow was updated. This field
+	// is protected by the [DPIEngine] mutex.
 	updated time.Time
 }
 
-// newDPIFlow creates a new [dpiFlow] instance.
-func newDPIFlow(packet *DissectedPacket) *dpiFlow {
+// newDPIFlow creates a new [dpiFlow] instance created at the given time.
+func newDPIFlow(packet *DissectedPacket, now time.Time) *dpiFlow {
+	parse := dpiParseTCPClientMessage
+	switch {
+	case packet.UDP != nil:
+		parse = dpiParseQUICClientHello
+	case packet.DestinationPort() == 53:
+		parse = dpiParseDNSOverTCPQuery
+	}
 	return &dpiFlow{
-		destIP:     packet.DestinationIPAddress(),
-		destPort:   packet.DestinationPort(),
-		mu:         sync.Mutex{},
-		numPackets: 0,
-		policy:     nil,
-		protocol:   packet.TransportProtocol(),
-		sourceIP:   packet.SourceIPAddress(),
-		sourcePort: packet.SourcePort(),
-		updated:    time.Now(),
+		closed:            time.Time{},
+		created:           now,
+		destIP:            packet.DestinationIPAddress(),
+		destPort:          packet.DestinationPort(),
+		finClientToServer: false,
+		finServerToClient: false,
+		mu:                sync.Mutex{},
+		numBytes:          0,
+		numPackets:        0,
+		policy:            nil,
+		protocol:          packet.TransportProtocol(),
+		serverStream:      newDPIStream(dpiParseTCPServerMessage),
+		sourceIP:          packet.SourceIPAddress(),
+		sourcePort:        packet.SourcePort(),
+		stream:            newDPIStream(parse),
+		teardown:          false,
+		updated:           now,
 	}
 }
 
@@ -202,3 +456,29 @@ func (df *dpiFlow) directionLocked(packet *DissectedPacket) DPIDirection {
 	}
 	return DPIDirectionServerToClient
 }
+
+// observeTeardownLocked tracks the RST and FIN segments of a TCP flow and
+// returns true when the connection has just been closed by a RST segment or
+// by FIN segments in both directions.
+func (df *dpiFlow) observeTeardownLocked(direction DPIDirection, tcp *layers.TCP) bool {
+	if df.teardown {
+		return false
+	}
+	if tcp.FIN && direction == DPIDirectionClientToServer {
+		df.finClientToServer = true
+	}
+	if tcp.FIN && direction == DPIDirectionServerToClient {
+		df.finServerToClient = true
+	}
+	df.teardown = tcp.RST || (df.finClientToServer && df.finServerToClient)
+	return df.teardown
+}
+
+// triggeredPolicyLocked returns the flow policy if its trigger, if any, fired.
+func (df *dpiFlow) triggeredPolicyLocked(now time.Time) (*DPIPolicy, bool) {
+	trigger := df.policy.Trigger
+	if trigger != nil && !trigger.reached(df.numBytes, df.numPackets, now.Sub(df.created)) {
+		return nil, false
+	}
+	return df.policy, true
+}
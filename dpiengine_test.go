@@ -0,0 +1,192 @@
+package netem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestDPIEngineTrigger(t *testing.T) {
+	// newEngine creates a DPIEngine throttling the 10.0.0.1:443 endpoint using the given trigger
+	newEngine := func(trigger *DPITrigger) *DPIEngine {
+		dpi := NewDPIEngine(&NullLogger{})
+		dpi.AddRule(&DPIThrottleTrafficForTCPEndpoint{
+			Delay:           time.Second,
+			Logger:          &NullLogger{},
+			ServerIPAddress: "10.0.0.1",
+			ServerPort:      443,
+			Trigger:         trigger,
+		})
+		return dpi
+	}
+
+	// send sends count packets with the given payload alternating the direction
+	// and returns the one-based index of the first packet to which the engine
+	// applied a policy or zero if the engine did not apply any policy.
+	send := func(t *testing.T, dpi *DPIEngine, count int, payload []byte) int {
+		for idx := 1; idx <= count; idx++ {
+			segment := dpiSerializeTCPSegment(t, "10.0.0.2", 54321, "10.0.0.1", 443, uint32(idx), false, payload)
+			if idx%2 == 0 {
+				segment = dpiSerializeTCPSegment(t, "10.0.0.1", 443, "10.0.0.2", 54321, uint32(idx), false, payload)
+			}
+			if _, match := dpi.inspect(segment); match {
+				return idx
+			}
+		}
+		return 0
+	}
+
+	t.Run("without a trigger we apply the policy immediately", func(t *testing.T) {
+		if first := send(t, newEngine(nil), 5, nil); first != 1 {
+			t.Fatal("unexpected first throttled packet", first)
+		}
+	})
+
+	t.Run("we count packets past the inspection window", func(t *testing.T) {
+		if first := send(t, newEngine(&DPITrigger{Packets: 25}), 30, nil); first != 25 {
+			t.Fatal("unexpected first throttled packet", first)
+		}
+	})
+
+	t.Run("we count bytes in both directions", func(t *testing.T) {
+		// each packet contains 20 bytes of IPv4 header, 20 bytes of TCP header, and the payload
+		payload := make([]byte, 960)
+		if first := send(t, newEngine(&DPITrigger{Bytes: 20000}), 30, payload); first != 20 {
+			t.Fatal("unexpected first throttled packet", first)
+		}
+	})
+
+	t.Run("we consider the flow duration", func(t *testing.T) {
+		dpi := newEngine(&DPITrigger{Duration: 100 * time.Millisecond})
+		now := time.Now()
+		dpi.timeNow = func() time.Time { return now }
+		if first := send(t, dpi, 15, nil); first != 0 {
+			t.Fatal("unexpected first throttled packet", first)
+		}
+		now = now.Add(100 * time.Millisecond)
+		if first := send(t, dpi, 1, nil); first != 1 {
+			t.Fatal("expected to throttle after the duration")
+		}
+	})
+}
+
+func TestDPIEngineFlowTable(t *testing.T) {
+	// segment serializes a client-to-server segment from the given client port using the given setter
+	segment := func(t *testing.T, clientPort uint16, setter func(tcp *layers.TCP)) []byte {
+		return dpiSerializeTCPSegmentWithSetter(t, "10.0.0.2", clientPort, "10.0.0.1", 80, 1, setter, nil)
+	}
+
+	// reply serializes a server-to-client segment towards the given client port using the given setter
+	reply := func(t *testing.T, clientPort uint16, setter func(tcp *layers.TCP)) []byte {
+		return dpiSerializeTCPSegmentWithSetter(t, "10.0.0.1", 80, "10.0.0.2", clientPort, 1, setter, nil)
+	}
+
+	syn := func(tcp *layers.TCP) { tcp.SYN = true }
+	ack := func(tcp *layers.TCP) { tcp.ACK = true }
+	fin := func(tcp *layers.TCP) { tcp.FIN, tcp.ACK = true, true }
+	rst := func(tcp *layers.TCP) { tcp.RST = true }
+
+	// flowFor returns the flow record for the given segment or nil
+	flowFor := func(t *testing.T, dpi *DPIEngine, rawPacket []byte) *dpiFlow {
+		packet, err := DissectPacket(rawPacket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dpi.mu.Unlock()
+		dpi.mu.Lock()
+		return dpi.flows[packet.FlowHash()]
+	}
+
+	t.Run("we honour the configured inspection depth", func(t *testing.T) {
+		for _, depth := range []int64{3, 10} {
+			dpi := NewDPIEngineWithConfig(&NullLogger{}, &DPIEngineConfig{MaxPackets: depth})
+			dpi.AddRule(&DPIDropTrafficForHTTPRequest{
+				Logger:  &NullLogger{},
+				Matcher: DPIHTTPRequestMatcher{Host: "www.example.com"},
+			})
+			dpi.inspect(segment(t, 1111, syn))
+			dpi.inspect(segment(t, 1111, ack))
+			dpi.inspect(segment(t, 1111, ack))
+			request := []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+			_, match := dpi.inspect(dpiSerializeTCPSegment(t, "10.0.0.2", 1111, "10.0.0.1", 80, 2, false, request))
+			if expect := depth > 4; match != expect {
+				t.Fatal("with depth", depth, "expected match", expect, "got", match)
+			}
+		}
+	})
+
+	t.Run("we evict the least recently used flow when the table is full", func(t *testing.T) {
+		dpi := NewDPIEngineWithConfig(&NullLogger{}, &DPIEngineConfig{MaxFlows: 2})
+		dpi.inspect(segment(t, 1111, syn))
+		dpi.inspect(segment(t, 2222, syn))
+		dpi.inspect(segment(t, 1111, ack))
+		dpi.inspect(segment(t, 3333, syn))
+		if len(dpi.flows) != 2 {
+			t.Fatal("unexpected number of flows", len(dpi.flows))
+		}
+		if flowFor(t, dpi, segment(t, 2222, ack)) != nil {
+			t.Fatal("expected the least recently used flow to be evicted")
+		}
+		if flowFor(t, dpi, segment(t, 1111, ack)) == nil || flowFor(t, dpi, segment(t, 3333, ack)) == nil {
+			t.Fatal("expected the other flows to be tracked")
+		}
+	})
+
+	t.Run("we periodically evict idle flows", func(t *testing.T) {
+		dpi := NewDPIEngineWithConfig(&NullLogger{}, &DPIEngineConfig{IdleTimeout: 50 * time.Millisecond})
+		now := time.Now()
+		dpi.timeNow = func() time.Time { return now }
+		dpi.lastEviction = now
+		dpi.inspect(segment(t, 1111, syn))
+		now = now.Add(dpiEvictionInterval) // makes the flow idle and forces the next sweep
+		dpi.inspect(segment(t, 2222, syn))
+		if flowFor(t, dpi, segment(t, 1111, ack)) != nil || len(dpi.flows) != 1 {
+			t.Fatal("expected the idle flow to be evicted")
+		}
+	})
+
+	t.Run("we notice when connections are closed", func(t *testing.T) {
+		dpi := NewDPIEngine(&NullLogger{})
+
+		// a RST segment closes the connection
+		dpi.inspect(segment(t, 1111, syn))
+		dpi.inspect(segment(t, 1111, rst))
+		if flowFor(t, dpi, segment(t, 1111, ack)).closed.IsZero() {
+			t.Fatal("expected RST to close the flow")
+		}
+
+		// a single FIN segment does not close the connection but FIN
+		// segments in both directions do
+		dpi.inspect(segment(t, 2222, syn))
+		dpi.inspect(segment(t, 2222, fin))
+		if !flowFor(t, dpi, segment(t, 2222, ack)).closed.IsZero() {
+			t.Fatal("expected a single FIN not to close the flow")
+		}
+		dpi.inspect(reply(t, 2222, fin))
+		closed := flowFor(t, dpi, segment(t, 2222, ack))
+		if closed.closed.IsZero() {
+			t.Fatal("expected FINs in both directions to close the flow")
+		}
+
+		// the last ACK still belongs to the closed flow
+		dpi.inspect(segment(t, 2222, ack))
+		if flowFor(t, dpi, segment(t, 2222, ack)) != closed {
+			t.Fatal("expected the last ACK to belong to the closed flow")
+		}
+
+		// a new SYN reusing the same ports creates a new flow
+		dpi.inspect(segment(t, 2222, syn))
+		if flow := flowFor(t, dpi, segment(t, 2222, ack)); flow == closed || !flow.closed.IsZero() {
+			t.Fatal("expected a new flow")
+		}
+
+		// we evict closed flows after a short timeout
+		flowFor(t, dpi, segment(t, 1111, ack)).closed = time.Now().Add(-2 * dpiClosedFlowTimeout)
+		dpi.lastEviction = time.Time{} // force the next sweep
+		dpi.inspect(segment(t, 3333, syn))
+		if flowFor(t, dpi, segment(t, 1111, ack)) != nil {
+			t.Fatal("expected the closed flow to be evicted")
+		}
+	})
+}
@@ -0,0 +1,202 @@
+package netem
+
+//
+// DPI: HTTP/1.x requests
+//
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// DPIHTTPRequest is an HTTP/1.x request that the [DPIEngine] reassembled
+// from the client-to-server TCP stream. We only parse the request line
+// and the headers, and we only consider the first request of a flow.
+type DPIHTTPRequest struct {
+	// Header contains the request headers.
+	Header http.Header
+
+	// Host is the value of the Host header or the host in the request
+	// target, when using the absolute form, without the port.
+	Host string
+
+	// Method is the request method.
+	Method string
+
+	// Path is the unescaped path of the request target.
+	Path string
+
+	// Target is the request target as it appears in the request line.
+	Target string
+}
+
+// errDPIHTTP indicates that the stream is not an HTTP/1.x request.
+var errDPIHTTP = errors.New("netem: dpi: not an HTTP request")
+
+// dpiParseHTTPRequest parses the head of an HTTP/1.x request.
+func dpiParseHTTPRequest(head []byte) (*DPIHTTPRequest, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errDPIHTTP, err.Error())
+	}
+	host := req.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	request := &DPIHTTPRequest{
+		Header: req.Header,
+		Host:   strings.ToLower(host),
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Target: req.RequestURI,
+	}
+	return request, nil
+}
+
+// dpiParseTCPClientMessage returns the first message sent by a TCP client,
+// which is either a TLS ClientHello handshake message (see [dpiParseTLSClientHello])
+// or the head of an HTTP/1.x request, or nil if we need more bytes. We return
+// an error when the stream does not start with one of these messages.
+func dpiParseTCPClientMessage(stream []byte) ([]byte, error) {
+	switch {
+	case len(stream) <= 0:
+		return nil, nil
+	case stream[0] == 22:
+		return dpiParseTLSClientHello(stream)
+	case stream[0] >= 'A' && stream[0] <= 'Z':
+		index := bytes.Index(stream, []byte("\r\n\r\n"))
+		if index < 0 {
+			return nil, nil
+		}
+		head := stream[:index+4]
+		if _, err := dpiParseHTTPRequest(head); err != nil {
+			return nil, err
+		}
+		return head, nil
+	default:
+		return nil, errDPIHTTP
+	}
+}
+
+// setTCPClientMessage sets the TLSClientHello, the HTTPRequest, or the DNSQuery
+// field using the message returned by [dpiParseTCPClientMessage] or, for
+// flows towards port 53, by [dpiParseDNSOverTCPQuery], if any.
+func (dp *DissectedPacket) setTCPClientMessage(message []byte) {
+	switch {
+	case len(message) <= 0:
+		// nothing
+	case dp.TCP != nil && dp.TCP.DstPort == 53:
+		dp.DNSQuery, _ = dpiUnpackDNSOverTCPQuery(message)
+	case message[0] == 1: // i.e., the ClientHello handshake type
+		dp.TLSClientHello = message
+	default:
+		dp.HTTPRequest, _ = dpiParseHTTPRequest(message)
+	}
+}
+
+// DPIHTTPRequestMatcher selects HTTP/1.x requests. A request matches when it
+// matches all the non-empty fields. A matcher with all fields empty is a
+// misconfiguration and does not match any request.
+type DPIHTTPRequestMatcher struct {
+	// Host is the OPTIONAL host to match, which we compare
+	// case-insensitively and ignoring the port.
+	Host string
+
+	// Method is the OPTIONAL method to match (e.g., "GET").
+	Method string
+
+	// PathPrefix is the OPTIONAL prefix of the request path to match.
+	PathPrefix string
+
+	// PathRegexp is the OPTIONAL regular expression matching the
+	// request target (i.e., the path and the query).
+	PathRegexp *regexp.Regexp
+}
+
+// Match returns whether the given request matches.
+func (m *DPIHTTPRequestMatcher) Match(request *DPIHTTPRequest) bool {
+	switch {
+	case request == nil:
+		return false
+	case m.Host == "" && m.Method == "" && m.PathPrefix == "" && m.PathRegexp == nil:
+		return false
+	case m.Host != "" && !strings.EqualFold(m.Host, request.Host):
+		return false
+	case m.Method != "" && m.Method != request.Method:
+		return false
+	case m.PathPrefix != "" && !strings.HasPrefix(request.Path, m.PathPrefix):
+		return false
+	case m.PathRegexp != nil && !m.PathRegexp.MatchString(request.Target):
+		return false
+	default:
+		return true
+	}
+}
+
+// String returns a description of the matched requests suitable for logging.
+func (m *DPIHTTPRequestMatcher) String() string {
+	var parts []string
+	if m.Method != "" {
+		parts = append(parts, "method="+m.Method)
+	}
+	if m.Host != "" {
+		parts = append(parts, "host="+m.Host)
+	}
+	if m.PathPrefix != "" {
+		parts = append(parts, "path_prefix="+m.PathPrefix)
+	}
+	if m.PathRegexp != nil {
+		parts = append(parts, "path_regexp="+m.PathRegexp.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// DPIFormatHTTPRedirect formats an HTTP response redirecting to the given location.
+func DPIFormatHTTPRedirect(location string) []byte {
+	return []byte(fmt.Sprintf(
+		"HTTP/1.1 302 Found\r\nLocation: %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+		location,
+	))
+}
+
+// reflectDissectedTCPSegmentForHTTPRequest assumes that packet is an IPv4 packet
+// containing the TCP segment completing an HTTP request and constructs a new
+// serialized packet where we reflect incoming fields, acknowledge the segment,
+// set the given flags, and use the given payload.
+func reflectDissectedTCPSegmentForHTTPRequest(
+	packet *DissectedPacket, setter func(tcp *layers.TCP), payload []byte) ([]byte, error) {
+	reflected, err := packet.reflectSegment()
+	if err != nil {
+		return nil, err
+	}
+	reflected.tcp.Ack = packet.TCP.Seq + uint32(len(packet.TCP.Payload))
+	setter(reflected.tcp)
+	return reflected.serialize(gopacket.Payload(payload))
+}
+
+// resetDissectedTCPSegmentTowardsServer assumes that packet is an IPv4 packet
+// containing a TCP segment and constructs a RST segment with the same source,
+// destination, and sequence number, which causes the server to reset the
+// connection before it receives the segment.
+func resetDissectedTCPSegmentTowardsServer(packet *DissectedPacket) ([]byte, error) {
+	reflected, err := packet.reflectSegment()
+	if err != nil {
+		return nil, err
+	}
+	ipv4 := reflected.ipv4
+	ipv4.SrcIP, ipv4.DstIP = ipv4.DstIP, ipv4.SrcIP
+	tcp := reflected.tcp
+	tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+	tcp.Seq, tcp.Ack = packet.TCP.Seq, 0
+	tcp.RST = true
+	return reflected.serialize()
+}
@@ -0,0 +1,132 @@
+package netem
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDPIParseTCPClientMessage(t *testing.T) {
+	t.Run("we parse HTTP requests", func(t *testing.T) {
+		request := "GET http://WWW.Example.com:8080/a%20b/c?d=e HTTP/1.1\r\nHost: www.example.com:8080\r\nX-Foo: bar\r\n\r\nbody"
+		head, err := dpiParseTCPClientMessage([]byte(request))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(head) != request[:len(request)-4] {
+			t.Fatal("unexpected head", string(head))
+		}
+		packet := &DissectedPacket{}
+		packet.setTCPClientMessage(head)
+		expect := &DPIHTTPRequest{
+			Header: map[string][]string{"X-Foo": {"bar"}},
+			Host:   "www.example.com",
+			Method: "GET",
+			Path:   "/a b/c",
+			Target: "http://WWW.Example.com:8080/a%20b/c?d=e",
+		}
+		if diff := cmp.Diff(expect, packet.HTTPRequest); diff != "" {
+			t.Fatal(diff)
+		}
+		if packet.TLSClientHello != nil {
+			t.Fatal("expected nil ClientHello")
+		}
+	})
+
+	t.Run("we wait for the end of the headers", func(t *testing.T) {
+		head, err := dpiParseTCPClientMessage([]byte("GET / HTTP/1.1\r\nHost: x.org\r\n"))
+		if head != nil || err != nil {
+			t.Fatal("expected nil head and nil error")
+		}
+	})
+
+	t.Run("we parse TLS ClientHellos", func(t *testing.T) {
+		hello, err := dpiParseTCPClientMessage(TLSHandshakeBytes13)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := &DissectedPacket{}
+		packet.setTCPClientMessage(hello)
+		if diff := cmp.Diff(TLSHandshakeBytes13[5:], packet.TLSClientHello); diff != "" {
+			t.Fatal(diff)
+		}
+		if packet.HTTPRequest != nil {
+			t.Fatal("expected nil HTTPRequest")
+		}
+	})
+
+	t.Run("we reject other protocols", func(t *testing.T) {
+		for _, input := range []string{"\x00\x01\x02", "SSH-2.0-OpenSSH_9.6\r\n\r\n"} {
+			_, err := dpiParseTCPClientMessage([]byte(input))
+			if err == nil {
+				t.Fatal("expected an error for", input)
+			}
+			if !errors.Is(err, errDPIHTTP) {
+				t.Fatal("unexpected error", err)
+			}
+		}
+	})
+}
+
+func TestDPIHTTPRequestMatcher(t *testing.T) {
+	request := &DPIHTTPRequest{
+		Host:   "www.example.com",
+		Method: "GET",
+		Path:   "/news/today",
+		Target: "/news/today?lang=en",
+	}
+
+	// testcase is a test case run by this func
+	type testcase struct {
+		name    string
+		matcher *DPIHTTPRequestMatcher
+		expect  bool
+	}
+
+	var testcases = []testcase{{
+		name:    "with an empty matcher",
+		matcher: &DPIHTTPRequestMatcher{},
+		expect:  false,
+	}, {
+		name:    "with a matching host using a different case",
+		matcher: &DPIHTTPRequestMatcher{Host: "WWW.example.COM"},
+		expect:  true,
+	}, {
+		name:    "with a different host",
+		matcher: &DPIHTTPRequestMatcher{Host: "example.com"},
+		expect:  false,
+	}, {
+		name:    "with a matching method and path prefix",
+		matcher: &DPIHTTPRequestMatcher{Method: "GET", PathPrefix: "/news/"},
+		expect:  true,
+	}, {
+		name:    "with a different method",
+		matcher: &DPIHTTPRequestMatcher{Method: "POST", PathPrefix: "/news/"},
+		expect:  false,
+	}, {
+		name:    "with a matching regexp",
+		matcher: &DPIHTTPRequestMatcher{PathRegexp: regexp.MustCompile(`lang=(en|fr)`)},
+		expect:  true,
+	}, {
+		name:    "with a different path prefix",
+		matcher: &DPIHTTPRequestMatcher{Host: "www.example.com", PathPrefix: "/sports"},
+		expect:  false,
+	}}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.matcher.Match(request); got != tc.expect {
+				t.Fatal("expected", tc.expect, "got", got)
+			}
+		})
+	}
+
+	t.Run("with a nil request", func(t *testing.T) {
+		matcher := &DPIHTTPRequestMatcher{Method: "GET"}
+		if matcher.Match(nil) {
+			t.Fatal("expected no match")
+		}
+	})
+}
@@ -0,0 +1,190 @@
+package netem
+
+//
+// DPI: residual censorship
+//
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// DPIResidualTuple selects the packet fields that [DPIResidualCensorship]
+// uses to decide whether a new flow is subject to residual censorship.
+type DPIResidualTuple int
+
+// DPIResidualTuple3 blocks new flows using the same server IP address,
+// server port, and transport protocol of the triggering flow, regardless
+// of the client IP address.
+const DPIResidualTuple3 = DPIResidualTuple(0)
+
+// DPIResidualTuple4 is like [DPIResidualTuple3] but only blocks new
+// flows using the same client IP address of the triggering flow.
+const DPIResidualTuple4 = DPIResidualTuple(1)
+
+// DPIResidualCensorship is a [DPIRule] that wraps another [DPIRule]. When the
+// wrapped rule matches, we use its policy for the flow and we block new flows
+// matching the same [DPIResidualTuple] for the given Duration, which emulates
+// the residual censorship of censors such as the GFW. The zero value is invalid;
+// please, fill all the fields marked as MANDATORY.
+//
+// Note: the residual block only applies to flows that start after the wrapped
+// rule has matched, because the [DPIEngine] remembers the policy of each flow.
+// We measure the Duration using the clock of the [DPIEngine] we're added to.
+type DPIResidualCensorship struct {
+	// Duration is the MANDATORY duration of the residual block.
+	Duration time.Duration
+
+	// Logger is the MANDATORY logger.
+	Logger Logger
+
+	// Reset OPTIONALLY indicates that we should respond to the TCP segments
+	// of blocked flows with spoofed RST segments rather than dropping
+	// them. Like [DPIResetTrafficForTLSSNI], this requires a router.
+	Reset bool
+
+	// Rule is the MANDATORY wrapped rule triggering the residual block.
+	Rule DPIRule
+
+	// Tuple is the OPTIONAL tuple to block. The default is [DPIResidualTuple3].
+	Tuple DPIResidualTuple
+
+	// blocked maps the blocked tuples to the time when the block expires.
+	blocked map[string]time.Time
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// timeNow is the OPTIONAL function returning the current time, which
+	// the [DPIEngine] sets to its own clock. When nil, we use [time.Now].
+	timeNow func() time.Time
+}
+
+var (
+	_ DPIRule          = &DPIResidualCensorship{}
+	_ dpiRuleWithClock = &DPIResidualCensorship{}
+)
+
+// Filter implements DPIRule
+func (r *DPIResidualCensorship) Filter(
+	direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool) {
+	// residual censorship only applies to TCP and UDP flows
+	if packet.TCP == nil && packet.UDP == nil {
+		return r.Rule.Filter(direction, packet)
+	}
+	key := r.tupleKey(direction, packet)
+
+	// block new flows while the residual block is active
+	if expiry, found := r.expiry(key); found && r.now().Before(expiry) {
+		return r.residualPolicy(packet, key)
+	}
+
+	// otherwise, see whether the wrapped rule triggers a residual block
+	policy, match := r.Rule.Filter(direction, packet)
+	if match {
+		r.Logger.Infof("netem: dpi: residual censorship for %s during %s", key, r.Duration)
+		now := r.now()
+		r.mu.Lock()
+		if r.blocked == nil {
+			r.blocked = map[string]time.Time{}
+		}
+		// forget about expired blocks, which we would otherwise only remove
+		// when a new flow uses the same tuple, so the map does not grow unbounded
+		for blockedKey, expiry := range r.blocked {
+			if !now.Before(expiry) {
+				delete(r.blocked, blockedKey)
+			}
+		}
+		r.blocked[key] = now.Add(r.Duration)
+		r.mu.Unlock()
+	}
+	return policy, match
+}
+
+// expiry returns when the residual block for the given key expires, if any,
+// and forgets about the residual block once it has expired.
+func (r *DPIResidualCensorship) expiry(key string) (time.Time, bool) {
+	now := r.now()
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	expiry, found := r.blocked[key]
+	if found && !now.Before(expiry) {
+		delete(r.blocked, key)
+	}
+	return expiry, found
+}
+
+// now returns the current time.
+func (r *DPIResidualCensorship) now() time.Time {
+	r.mu.Lock()
+	timeNow := r.timeNow
+	r.mu.Unlock()
+	if timeNow != nil {
+		return timeNow()
+	}
+	return time.Now()
+}
+
+// setTimeNow implements dpiRuleWithClock.
+func (r *DPIResidualCensorship) setTimeNow(timeNow func() time.Time) {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+	r.timeNow = timeNow
+}
+
+// tupleKey returns the key identifying the configured tuple for the packet.
+func (r *DPIResidualCensorship) tupleKey(direction DPIDirection, packet *DissectedPacket) string {
+	clientIP, serverIP, serverPort := packet.SourceIPAddress(), packet.DestinationIPAddress(), packet.DestinationPort()
+	if direction == DPIDirectionServerToClient {
+		clientIP, serverIP, serverPort = packet.DestinationIPAddress(), packet.SourceIPAddress(), packet.SourcePort()
+	}
+	switch r.Tuple {
+	case DPIResidualTuple4:
+		return fmt.Sprintf("%s %s:%d/%s", clientIP, serverIP, serverPort, packet.TransportProtocol())
+	default:
+		return fmt.Sprintf("%s:%d/%s", serverIP, serverPort, packet.TransportProtocol())
+	}
+}
+
+// residualPolicy returns the policy for flows subject to residual censorship.
+func (r *DPIResidualCensorship) residualPolicy(packet *DissectedPacket, key string) (*DPIPolicy, bool) {
+	r.Logger.Infof(
+		"netem: dpi: blocking flow %s:%d %s:%d/%s because of residual censorship for %s",
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+		key,
+	)
+
+	if r.Reset && packet.TransportProtocol() == layers.IPProtocolTCP {
+		spoofed, err := reflectDissectedTCPSegmentWithRSTACKFlags(packet)
+		if err == nil {
+			policy := &DPIPolicy{
+				Bandwidth:     0,
+				Delay:         0,
+				Flags:         FrameFlagSpoof,
+				PLR:           0,
+				Spoofed:       [][]byte{spoofed},
+				SpoofedDelays: nil,
+				Trigger:       nil,
+			}
+			return policy, true
+		}
+	}
+
+	policy := &DPIPolicy{
+		Bandwidth:     0,
+		Delay:         0,
+		Flags:         FrameFlagDrop,
+		PLR:           0,
+		Spoofed:       nil,
+		SpoofedDelays: nil,
+		Trigger:       nil,
+	}
+	return policy, true
+}
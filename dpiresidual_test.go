@@ -0,0 +1,115 @@
+package netem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestDPIResidualCensorship(t *testing.T) {
+	const duration = 200 * time.Millisecond
+
+	// now is the fake current time used by the engine
+	now := time.Now()
+
+	// newEngine creates a DPIEngine where a request for /blocked triggers residual censorship
+	newEngine := func(tuple DPIResidualTuple, reset bool) *DPIEngine {
+		dpi := NewDPIEngine(&NullLogger{})
+		dpi.timeNow = func() time.Time { return now }
+		dpi.AddRule(&DPIResidualCensorship{
+			Duration: duration,
+			Logger:   &NullLogger{},
+			Reset:    reset,
+			Rule: &DPIDropTrafficForHTTPRequest{
+				Logger:  &NullLogger{},
+				Matcher: DPIHTTPRequestMatcher{PathPrefix: "/blocked"},
+			},
+			Tuple: tuple,
+		})
+		return dpi
+	}
+
+	// trigger sends a request triggering residual censorship
+	trigger := func(t *testing.T, dpi *DPIEngine, clientIP string, clientPort uint16) {
+		request := []byte("GET /blocked HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+		if _, match := dpi.inspect(dpiSerializeTCPSegment(t, clientIP, clientPort, "10.0.0.1", 80, 100, true, nil)); match {
+			t.Fatal("expected no match for the SYN segment")
+		}
+		policy, match := dpi.inspect(dpiSerializeTCPSegment(t, clientIP, clientPort, "10.0.0.1", 80, 101, false, request))
+		if !match || policy.Flags != FrameFlagDrop {
+			t.Fatal("expected the wrapped rule to drop the request")
+		}
+	}
+
+	// connect returns the policy for the SYN segment of a new flow, if any
+	connect := func(t *testing.T, dpi *DPIEngine, clientIP string, clientPort, serverPort uint16) *DPIPolicy {
+		policy, match := dpi.inspect(dpiSerializeTCPSegment(t, clientIP, clientPort, "10.0.0.1", serverPort, 1000, true, nil))
+		if !match {
+			return nil
+		}
+		return policy
+	}
+
+	t.Run("with the 3-tuple we block new flows from any client", func(t *testing.T) {
+		dpi := newEngine(DPIResidualTuple3, false)
+		trigger(t, dpi, "10.0.0.2", 1111)
+		if policy := connect(t, dpi, "10.0.0.2", 2222, 80); policy == nil || policy.Flags != FrameFlagDrop {
+			t.Fatal("expected to drop a new flow from the same client")
+		}
+		if policy := connect(t, dpi, "10.0.0.3", 3333, 80); policy == nil || policy.Flags != FrameFlagDrop {
+			t.Fatal("expected to drop a new flow from another client")
+		}
+		if policy := connect(t, dpi, "10.0.0.2", 4444, 8080); policy != nil {
+			t.Fatal("expected not to block another server port")
+		}
+	})
+
+	t.Run("with the 4-tuple we only block new flows from the same client", func(t *testing.T) {
+		dpi := newEngine(DPIResidualTuple4, false)
+		trigger(t, dpi, "10.0.0.2", 1111)
+		if policy := connect(t, dpi, "10.0.0.2", 2222, 80); policy == nil || policy.Flags != FrameFlagDrop {
+			t.Fatal("expected to drop a new flow from the same client")
+		}
+		if policy := connect(t, dpi, "10.0.0.3", 3333, 80); policy != nil {
+			t.Fatal("expected not to block another client")
+		}
+	})
+
+	t.Run("we stop blocking after the configured duration", func(t *testing.T) {
+		dpi := newEngine(DPIResidualTuple3, false)
+		trigger(t, dpi, "10.0.0.2", 1111)
+		now = now.Add(duration)
+		if policy := connect(t, dpi, "10.0.0.2", 2222, 80); policy != nil {
+			t.Fatal("expected not to block after the residual block expired")
+		}
+	})
+
+	t.Run("we forget about expired blocks when adding new ones", func(t *testing.T) {
+		dpi := newEngine(DPIResidualTuple4, false)
+		trigger(t, dpi, "10.0.0.2", 1111)
+		now = now.Add(duration)
+		trigger(t, dpi, "10.0.0.3", 5555)
+		rule := dpi.rules[0].(*DPIResidualCensorship)
+		if len(rule.blocked) != 1 {
+			t.Fatal("expected to have removed the expired block", rule.blocked)
+		}
+	})
+
+	t.Run("we can reset new TCP flows", func(t *testing.T) {
+		dpi := newEngine(DPIResidualTuple3, true)
+		trigger(t, dpi, "10.0.0.2", 1111)
+		policy := connect(t, dpi, "10.0.0.2", 2222, 80)
+		if policy == nil || policy.Flags != FrameFlagSpoof || len(policy.Spoofed) != 1 {
+			t.Fatal("expected to spoof a segment")
+		}
+		spoofed, err := DissectPacket(policy.Spoofed[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcp := spoofed.TCP
+		if tcp == nil || !tcp.RST || !tcp.ACK || tcp.Ack != 1001 || tcp.DstPort != layers.TCPPort(2222) {
+			t.Fatal("unexpected spoofed segment", tcp)
+		}
+	})
+}
@@ -0,0 +1,221 @@
+package netem
+
+//
+// DPI: server-to-client messages
+//
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// dpiHTTPResponseMaxBody is the maximum number of HTTP response body
+// bytes that we reassemble and make available to the rules.
+const dpiHTTPResponseMaxBody = 1 << 14
+
+// DPIHTTPResponse is an HTTP/1.x response that the [DPIEngine] reassembled
+// from the server-to-client TCP stream. We only consider the first response of
+// a flow and at most the first 16 KiB of its body.
+type DPIHTTPResponse struct {
+	// Body contains the beginning of the raw response body, which
+	// is not decoded when using the chunked transfer encoding.
+	Body []byte
+
+	// Header contains the response headers.
+	Header http.Header
+
+	// StatusCode is the response status code.
+	StatusCode int
+}
+
+// errDPIHTTPResponse indicates that the stream is not an HTTP/1.x response.
+var errDPIHTTPResponse = errors.New("netem: dpi: not an HTTP response")
+
+// dpiParseHTTPResponse parses an HTTP/1.x response consisting of
+// the response head followed by the beginning of the body.
+func dpiParseHTTPResponse(message []byte) (*DPIHTTPResponse, error) {
+	index := bytes.Index(message, []byte("\r\n\r\n"))
+	if index < 0 {
+		return nil, fmt.Errorf("%w: incomplete head", errDPIHTTPResponse)
+	}
+	head := message[:index+4]
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errDPIHTTPResponse, err.Error())
+	}
+	response := &DPIHTTPResponse{
+		Body:       message[len(head):],
+		Header:     resp.Header,
+		StatusCode: resp.StatusCode,
+	}
+	return response, nil
+}
+
+// dpiParseTCPServerMessage returns the first interesting message sent by a TCP
+// server, which is either a TLS 1.2 Certificate handshake message (see
+// [dpiParseTLSCertificate]) or an HTTP/1.x response, or nil if we need more
+// bytes. We return an error when the stream does not contain these messages.
+func dpiParseTCPServerMessage(stream []byte) ([]byte, error) {
+	switch {
+	case len(stream) <= 0:
+		return nil, nil
+	case stream[0] == 22:
+		return dpiParseTLSCertificate(stream)
+	case stream[0] == 'H':
+		return dpiParseHTTPResponseStream(stream)
+	default:
+		return nil, errDPIHTTPResponse
+	}
+}
+
+// dpiParseHTTPResponseStream returns the head of the HTTP/1.x response at the
+// beginning of the stream followed by the beginning of the body, or nil if we
+// need more bytes. When the response has a Content-Length, we wait for the whole
+// body, up to dpiHTTPResponseMaxBody bytes. Otherwise, we use the body bytes
+// we have received along with the head.
+func dpiParseHTTPResponseStream(stream []byte) ([]byte, error) {
+	const prefix = "HTTP/"
+	if !bytes.HasPrefix(stream, []byte(prefix)) && !strings.HasPrefix(prefix, string(stream)) {
+		return nil, errDPIHTTPResponse
+	}
+	index := bytes.Index(stream, []byte("\r\n\r\n"))
+	if index < 0 {
+		return nil, nil
+	}
+	response, err := dpiParseHTTPResponse(stream[:index+4])
+	if err != nil {
+		return nil, err
+	}
+	want := len(stream)
+	if length, err := strconv.Atoi(response.Header.Get("Content-Length")); err == nil && length >= 0 {
+		want = index + 4 + min(length, dpiHTTPResponseMaxBody)
+	}
+	want = min(want, index+4+dpiHTTPResponseMaxBody)
+	if len(stream) < want {
+		return nil, nil
+	}
+	return stream[:want], nil
+}
+
+// dpiParseTLSCertificate walks the TLS records at the beginning of the given
+// server-to-client stream and returns the Certificate handshake message (i.e.,
+// the message type, the uint24 length, and the body), which follows the
+// ServerHello, or nil if we need more bytes. We return an error when the stream
+// does not contain a cleartext Certificate, which is the case for TLS 1.3.
+func dpiParseTLSCertificate(stream []byte) ([]byte, error) {
+	handshake := []byte{}
+	for len(stream) > 0 {
+		// the stream must only contain handshake records (i.e., content type 22)
+		// until the Certificate; TLS 1.3 continues with other records instead
+		if stream[0] != 22 {
+			return nil, newErrTLSParse("stream: not a handshake record")
+		}
+		if len(stream) < 5 {
+			return nil, nil
+		}
+		length := int(binary.BigEndian.Uint16(stream[3:5]))
+		if len(stream) < 5+length {
+			return nil, nil
+		}
+		handshake = append(handshake, stream[5:5+length]...)
+		stream = stream[5+length:]
+
+		// the handshake messages may span several records
+		if certificate, err := dpiFindTLSCertificate(handshake); certificate != nil || err != nil {
+			return certificate, err
+		}
+	}
+	return nil, nil
+}
+
+// dpiFindTLSCertificate returns the Certificate message following the ServerHello
+// in the given handshake messages, or nil if we need more bytes.
+func dpiFindTLSCertificate(handshake []byte) ([]byte, error) {
+	for len(handshake) >= 4 {
+		size := 4 + (int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3]))
+		if len(handshake) < size {
+			return nil, nil
+		}
+		switch handshake[0] {
+		case 2: // server_hello
+			handshake = handshake[size:]
+		case 11: // certificate
+			return handshake[:size], nil
+		default:
+			return nil, newErrTLSParse("stream: no cleartext certificate")
+		}
+	}
+	return nil, nil
+}
+
+// setTCPServerMessage sets the TLSCertificate or the HTTPResponse field
+// using the message returned by [dpiParseTCPServerMessage], if any.
+func (dp *DissectedPacket) setTCPServerMessage(message []byte) {
+	switch {
+	case len(message) <= 0:
+		// nothing
+	case message[0] == 11: // i.e., the Certificate handshake type
+		dp.TLSCertificate = message
+	default:
+		dp.HTTPResponse, _ = dpiParseHTTPResponse(message)
+	}
+}
+
+// parseTLSCertificates attempts to parse the reassembled Certificate message.
+func (dp *DissectedPacket) parseTLSCertificates() ([]*x509.Certificate, error) {
+	return ExtractTLSCertificates(dp.TLSCertificate)
+}
+
+// dpiCertificateMatchesName returns whether the given certificate's subject
+// common name is the given name or the certificate is valid for the given name.
+func dpiCertificateMatchesName(cert *x509.Certificate, name string) bool {
+	return strings.EqualFold(cert.Subject.CommonName, name) || cert.VerifyHostname(name) == nil
+}
+
+// DPIHTTPResponseMatcher selects HTTP/1.x responses. A response matches when it
+// matches all the non-empty fields. A matcher with all fields empty is a
+// misconfiguration and does not match any response.
+type DPIHTTPResponseMatcher struct {
+	// BodyRegexp is the OPTIONAL regular expression matching
+	// the beginning of the response body.
+	BodyRegexp *regexp.Regexp
+
+	// StatusCode is the OPTIONAL status code to match.
+	StatusCode int
+}
+
+// Match returns whether the given response matches.
+func (m *DPIHTTPResponseMatcher) Match(response *DPIHTTPResponse) bool {
+	switch {
+	case response == nil:
+		return false
+	case m.BodyRegexp == nil && m.StatusCode == 0:
+		return false
+	case m.BodyRegexp != nil && !m.BodyRegexp.Match(response.Body):
+		return false
+	case m.StatusCode != 0 && m.StatusCode != response.StatusCode:
+		return false
+	default:
+		return true
+	}
+}
+
+// String returns a description of the matched responses suitable for logging.
+func (m *DPIHTTPResponseMatcher) String() string {
+	var parts []string
+	if m.StatusCode != 0 {
+		parts = append(parts, "status_code="+strconv.Itoa(m.StatusCode))
+	}
+	if m.BodyRegexp != nil {
+		parts = append(parts, "body_regexp="+m.BodyRegexp.String())
+	}
+	return strings.Join(parts, " ")
+}
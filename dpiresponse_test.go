@@ -0,0 +1,162 @@
+package netem
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// dpiTLSRecord wraps the given handshake bytes into a TLS record with the given content type.
+func dpiTLSRecord(contentType byte, data []byte) []byte {
+	return append([]byte{contentType, 0x03, 0x03, byte(len(data) >> 8), byte(len(data))}, data...)
+}
+
+func TestDPIParseTCPServerMessage(t *testing.T) {
+	chain := MustNewCA().MustNewTLSCertificate("www.example.com").Certificate
+	serverHello := []byte{2, 0, 0, 4, 0x03, 0x03, 0xde, 0xad}
+	certificate := tlsMarshalCertificateMsg(chain...)
+
+	t.Run("we find the TLS 1.2 certificate across records", func(t *testing.T) {
+		handshake := append(append([]byte{}, serverHello...), certificate...)
+		stream := append(dpiTLSRecord(22, handshake[:100]), dpiTLSRecord(22, handshake[100:])...)
+
+		// we need all the records
+		for _, size := range []int{3, 50, len(stream) - 1} {
+			message, err := dpiParseTCPServerMessage(stream[:size])
+			if message != nil || err != nil {
+				t.Fatal("expected nil message and nil error with", size, "bytes")
+			}
+		}
+
+		message, err := dpiParseTCPServerMessage(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(certificate, message); diff != "" {
+			t.Fatal(diff)
+		}
+		packet := &DissectedPacket{}
+		packet.setTCPServerMessage(message)
+		certs, err := packet.parseTLSCertificates()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !dpiCertificateMatchesName(certs[0], "WWW.example.com") || dpiCertificateMatchesName(certs[0], "example.com") {
+			t.Fatal("unexpected certificate matching")
+		}
+	})
+
+	t.Run("we stop at the encrypted part of a TLS 1.3 handshake", func(t *testing.T) {
+		stream := append(dpiTLSRecord(22, serverHello), dpiTLSRecord(20, []byte{1})...)
+		_, err := dpiParseTCPServerMessage(stream)
+		if !errors.Is(err, ErrTLSParse) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("we wait for the body of HTTP responses with a Content-Length", func(t *testing.T) {
+		response := []byte("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nX-Foo: bar\r\n\r\nBlocked!")
+		for _, size := range []int{2, 20, len(response) - 1} {
+			message, err := dpiParseTCPServerMessage(response[:size])
+			if message != nil || err != nil {
+				t.Fatal("expected nil message and nil error with", size, "bytes")
+			}
+		}
+		message, err := dpiParseTCPServerMessage(append(response, "extra"...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := &DissectedPacket{}
+		packet.setTCPServerMessage(message)
+		expect := &DPIHTTPResponse{
+			Body:       []byte("Blocked!"),
+			Header:     map[string][]string{"Content-Length": {"8"}, "X-Foo": {"bar"}},
+			StatusCode: 200,
+		}
+		if diff := cmp.Diff(expect, packet.HTTPResponse); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("we limit the body of HTTP responses", func(t *testing.T) {
+		head := []byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n")
+		body := bytes.Repeat([]byte("x"), dpiHTTPResponseMaxBody+10)
+		message, err := dpiParseTCPServerMessage(append(head, body[:10]...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(message) != len(head)+10 {
+			t.Fatal("expected the available body bytes", len(message))
+		}
+		message, err = dpiParseTCPServerMessage(append(head, body...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(message) != len(head)+dpiHTTPResponseMaxBody {
+			t.Fatal("expected a truncated body", len(message))
+		}
+	})
+
+	t.Run("we reject other protocols", func(t *testing.T) {
+		for _, input := range []string{"\x00\x01\x02", "HELLO WORLD\r\n\r\n", "SSH-2.0-OpenSSH_9.6\r\n"} {
+			_, err := dpiParseTCPServerMessage([]byte(input))
+			if !errors.Is(err, errDPIHTTPResponse) {
+				t.Fatal("unexpected error for", input, err)
+			}
+		}
+	})
+}
+
+func TestDPIHTTPResponseMatcher(t *testing.T) {
+	response := &DPIHTTPResponse{
+		Body:       []byte("<html>Access denied</html>"),
+		StatusCode: 403,
+	}
+
+	// testcase is a test case run by this func
+	type testcase struct {
+		name    string
+		matcher *DPIHTTPResponseMatcher
+		expect  bool
+	}
+
+	var testcases = []testcase{{
+		name:    "with an empty matcher",
+		matcher: &DPIHTTPResponseMatcher{},
+		expect:  false,
+	}, {
+		name:    "with a matching status code",
+		matcher: &DPIHTTPResponseMatcher{StatusCode: 403},
+		expect:  true,
+	}, {
+		name:    "with a matching status code and body",
+		matcher: &DPIHTTPResponseMatcher{BodyRegexp: regexp.MustCompile(`Access (denied|forbidden)`), StatusCode: 403},
+		expect:  true,
+	}, {
+		name:    "with a different status code",
+		matcher: &DPIHTTPResponseMatcher{BodyRegexp: regexp.MustCompile(`denied`), StatusCode: 200},
+		expect:  false,
+	}, {
+		name:    "with a different body",
+		matcher: &DPIHTTPResponseMatcher{BodyRegexp: regexp.MustCompile(`Welcome`)},
+		expect:  false,
+	}}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.matcher.Match(response); got != tc.expect {
+				t.Fatal("expected", tc.expect, "got", got)
+			}
+		})
+	}
+
+	t.Run("with a nil response", func(t *testing.T) {
+		matcher := &DPIHTTPResponseMatcher{StatusCode: 200}
+		if matcher.Match(nil) {
+			t.Fatal("expected no match")
+		}
+	})
+}
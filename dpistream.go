@@ -0,0 +1,221 @@
+package netem
+
+//
+// DPI: stream reassembly
+//
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket/layers"
+)
+
+// dpiStreamMaxSize is the maximum number of bytes that we buffer,
+// including out-of-order segments, for each direction of a flow.
+const dpiStreamMaxSize = 1 << 16
+
+// dpiStream reassembles the client-to-server TCP stream or the QUIC crypto
+// stream of a flow until it contains the first client message (e.g., a TLS
+// ClientHello), or the server-to-client TCP stream until it contains the first
+// interesting server message (e.g., a TLS Certificate). The zero value is
+// invalid; construct using [newDPIStream].
+type dpiStream struct {
+	// buffered is the number of bytes in data and pending.
+	buffered int
+
+	// data contains the in-order stream bytes.
+	data []byte
+
+	// done indicates that we stopped reassembling.
+	done bool
+
+	// nextSeq is the sequence number of the next in-order byte.
+	nextSeq uint32
+
+	// parse extracts the first client message from the in-order stream bytes.
+	parse func(stream []byte) ([]byte, error)
+
+	// pending contains the out-of-order segments indexed by sequence number.
+	pending map[uint32][]byte
+
+	// started indicates whether we know the initial sequence number.
+	started bool
+}
+
+// newDPIStream creates a new [dpiStream] instance using the given
+// function to extract the first client message from the stream.
+func newDPIStream(parse func(stream []byte) ([]byte, error)) *dpiStream {
+	return &dpiStream{
+		buffered: 0,
+		data:     []byte{},
+		done:     false,
+		nextSeq:  0,
+		parse:    parse,
+		pending:  map[uint32][]byte{},
+		started:  false,
+	}
+}
+
+// addTCPSegment adds a TCP segment to the stream and returns the first
+// message, if the segment completes it, or nil. We tolerate
+// reordering and retransmissions, and we stop reassembling once we have the
+// message, the stream contains something else, or we buffered too much.
+func (ds *dpiStream) addTCPSegment(tcp *layers.TCP) []byte {
+	if ds.done {
+		return nil
+	}
+
+	// the SYN segment tells us the initial sequence number; otherwise, we
+	// assume the first segment carrying data is the first one.
+	if tcp.SYN {
+		ds.nextSeq, ds.started = tcp.Seq+1, true
+		return nil
+	}
+	if len(tcp.Payload) <= 0 {
+		return nil
+	}
+	if !ds.started {
+		ds.nextSeq, ds.started = tcp.Seq, true
+	}
+	return ds.add(tcp.Seq, tcp.Payload)
+}
+
+// addQUICDatagram adds the CRYPTO frames of the client Initial packets in the
+// given UDP datagram to the stream and returns the TLS ClientHello handshake
+// message, if the datagram completes it, or nil. Like addTCPSegment, we tolerate
+// reordering and retransmissions. We ignore datagrams we cannot decrypt, since
+// we stop inspecting the flow after a few packets anyway.
+func (ds *dpiStream) addQUICDatagram(datagram []byte) []byte {
+	if ds.done {
+		return nil
+	}
+	packets, err := DecryptQUICInitialPackets(datagram)
+	if err != nil {
+		return nil
+	}
+	ds.started = true // the crypto stream starts at offset zero
+	for _, packet := range packets {
+		frames, err := ExtractQUICCryptoFrames(packet.Payload)
+		if err != nil {
+			continue
+		}
+		for _, frame := range frames {
+			if frame.Offset > dpiStreamMaxSize {
+				continue
+			}
+			if clientHello := ds.add(uint32(frame.Offset), frame.Data); clientHello != nil || ds.done {
+				return clientHello
+			}
+		}
+	}
+	return nil
+}
+
+// add adds a segment starting at the given sequence number and returns
+// the first client message if the segment completes it, or nil.
+func (ds *dpiStream) add(seq uint32, payload []byte) []byte {
+	if len(payload) <= 0 {
+		return nil
+	}
+
+	// remember the segment unless we already have a longer copy of it
+	if len(payload) > len(ds.pending[seq]) {
+		ds.buffered += len(payload) - len(ds.pending[seq])
+		ds.pending[seq] = append([]byte{}, payload...)
+	}
+	if ds.buffered > dpiStreamMaxSize {
+		ds.stop()
+		return nil
+	}
+	ds.drain()
+
+	// see whether we now have a complete message
+	message, err := ds.parse(ds.data)
+	if err != nil {
+		ds.stop()
+		return nil
+	}
+	if message != nil {
+		ds.stop()
+	}
+	return message
+}
+
+// drain moves the pending segments that are now in order to data, discarding
+// the bytes we have already seen because of retransmissions.
+func (ds *dpiStream) drain() {
+	for progress := true; progress; {
+		progress = false
+		for seq, payload := range ds.pending {
+			// note: using int32 accounts for sequence number wraparound
+			offset := int32(ds.nextSeq - seq)
+			if offset < 0 {
+				continue // we're still missing previous bytes
+			}
+			delete(ds.pending, seq)
+			if int(offset) >= len(payload) {
+				ds.buffered -= len(payload) // this is a retransmission
+				continue
+			}
+			ds.buffered -= int(offset)
+			ds.data = append(ds.data, payload[offset:]...)
+			ds.nextSeq += uint32(len(payload) - int(offset))
+			progress = true
+		}
+	}
+}
+
+// stop stops reassembling and releases the buffered bytes.
+func (ds *dpiStream) stop() {
+	ds.buffered = 0
+	ds.data = nil
+	ds.done = true
+	ds.pending = nil
+}
+
+// dpiParseTLSClientHello walks the TLS records at the beginning of the given
+// stream and returns the ClientHello handshake message (i.e., the message type,
+// the uint24 length, and the body), or nil if we need more bytes. We return
+// an error when the stream does not start with a ClientHello.
+func dpiParseTLSClientHello(stream []byte) ([]byte, error) {
+	handshake := []byte{}
+	for len(stream) > 0 {
+		// the stream must only contain handshake records (i.e., content type 22)
+		if stream[0] != 22 {
+			return nil, newErrTLSParse("stream: not a handshake record")
+		}
+		if len(stream) < 5 {
+			return nil, nil
+		}
+		length := int(binary.BigEndian.Uint16(stream[3:5]))
+		if len(stream) < 5+length {
+			return nil, nil
+		}
+		handshake = append(handshake, stream[5:5+length]...)
+		stream = stream[5+length:]
+
+		// the handshake messages may span several records
+		if clientHello, err := dpiParseQUICClientHello(handshake); clientHello != nil || err != nil {
+			return clientHello, err
+		}
+	}
+	return nil, nil
+}
+
+// dpiParseQUICClientHello returns the ClientHello handshake message at the
+// beginning of the given QUIC crypto stream, which contains handshake messages
+// without TLS records, or nil if we need more bytes. We return an error when
+// the stream does not start with a ClientHello.
+func dpiParseQUICClientHello(stream []byte) ([]byte, error) {
+	if len(stream) < 4 {
+		return nil, nil
+	}
+	if stream[0] != 1 {
+		return nil, newErrTLSParse("stream: not a ClientHello")
+	}
+	size := 4 + (int(stream[1])<<16 | int(stream[2])<<8 | int(stream[3]))
+	if len(stream) < size {
+		return nil, nil
+	}
+	return stream[:size], nil
+}
@@ -0,0 +1,207 @@
+package netem
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestDPIStream(t *testing.T) {
+	// segment is a client-to-server TCP segment
+	type segment struct {
+		seq     uint32
+		payload []byte
+	}
+
+	// splitClientHello splits TLSHandshakeBytes13 into segments
+	// starting at the given initial sequence number.
+	splitClientHello := func(isn uint32, sizes ...int) (out []segment) {
+		data, seq := TLSHandshakeBytes13, isn+1
+		for _, size := range sizes {
+			out = append(out, segment{seq: seq, payload: data[:size]})
+			data, seq = data[size:], seq+uint32(size)
+		}
+		return append(out, segment{seq: seq, payload: data})
+	}
+
+	// testcase is a test case run by this func
+	type testcase struct {
+		// name is the test case name
+		name string
+
+		// isn is the initial sequence number
+		isn uint32
+
+		// segments contains the segments in the order we deliver them
+		segments []segment
+
+		// expectIndex is the index of the segment completing the
+		// ClientHello or -1 when we do not expect a ClientHello
+		expectIndex int
+	}
+
+	inOrder := splitClientHello(1000, 100, 100)
+	wrapping := splitClientHello(0xffffff80, 100, 100)
+	notTLS := []segment{{seq: 1001, payload: []byte("GET / HTTP/1.1\r\n\r\n")}}
+
+	var testcases = []testcase{{
+		name:        "with in order segments",
+		isn:         1000,
+		segments:    inOrder,
+		expectIndex: 2,
+	}, {
+		name:        "with reordered segments",
+		isn:         1000,
+		segments:    []segment{inOrder[2], inOrder[1], inOrder[0]},
+		expectIndex: 2,
+	}, {
+		name:        "with retransmitted segments",
+		isn:         1000,
+		segments:    []segment{inOrder[0], inOrder[0], inOrder[2], inOrder[2], inOrder[1]},
+		expectIndex: 4,
+	}, {
+		name: "with partially overlapping segments",
+		isn:  1000,
+		segments: []segment{
+			inOrder[0],
+			{seq: inOrder[0].seq + 50, payload: TLSHandshakeBytes13[50:150]},
+			{seq: inOrder[0].seq + 150, payload: TLSHandshakeBytes13[150:]},
+		},
+		expectIndex: 2,
+	}, {
+		name:        "with sequence numbers wrapping around",
+		isn:         0xffffff80,
+		segments:    []segment{wrapping[1], wrapping[2], wrapping[0]},
+		expectIndex: 2,
+	}, {
+		name:        "with a missing segment",
+		isn:         1000,
+		segments:    []segment{inOrder[0], inOrder[2]},
+		expectIndex: -1,
+	}, {
+		name:        "with a stream that is not TLS",
+		isn:         1000,
+		segments:    notTLS,
+		expectIndex: -1,
+	}}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ds := newDPIStream(dpiParseTLSClientHello)
+			if hello := ds.addTCPSegment(&layers.TCP{SYN: true, Seq: tc.isn}); hello != nil {
+				t.Fatal("expected nil ClientHello for the SYN segment")
+			}
+			for idx, seg := range tc.segments {
+				tcp := &layers.TCP{Seq: seg.seq}
+				tcp.Payload = seg.payload
+				hello := ds.addTCPSegment(tcp)
+				if idx != tc.expectIndex {
+					if hello != nil {
+						t.Fatal("unexpected ClientHello at index", idx)
+					}
+					continue
+				}
+				if diff := cmp.Diff(TLSHandshakeBytes13[5:], hello); diff != "" {
+					t.Fatal(diff)
+				}
+				sni, err := ExtractTLServerName(hello)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if sni != "example.ulfheim.net" {
+					t.Fatal("unexpected SNI", sni)
+				}
+			}
+		})
+	}
+}
+
+// dpiSerializeTCPSegment serializes an IPv4 packet containing a TCP segment.
+func dpiSerializeTCPSegment(
+	t *testing.T,
+	srcIP string,
+	srcPort uint16,
+	dstIP string,
+	dstPort uint16,
+	seq uint32,
+	syn bool,
+	payload []byte,
+) []byte {
+	setter := func(tcp *layers.TCP) {
+		tcp.SYN = syn
+		tcp.ACK = !syn
+	}
+	return dpiSerializeTCPSegmentWithSetter(t, srcIP, srcPort, dstIP, dstPort, seq, setter, payload)
+}
+
+// dpiSerializeTCPSegmentWithSetter is like dpiSerializeTCPSegment
+// but uses the given setter to set the TCP flags.
+func dpiSerializeTCPSegmentWithSetter(
+	t *testing.T,
+	srcIP string,
+	srcPort uint16,
+	dstIP string,
+	dstPort uint16,
+	seq uint32,
+	setter func(tcp *layers.TCP),
+	payload []byte,
+) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP(srcIP).To4(),
+		DstIP:    net.ParseIP(dstIP).To4(),
+	}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Seq:     seq,
+		Window:  65535,
+	}
+	setter(tcp)
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDPIEngineReassemblesTLSClientHelloForEachFlow(t *testing.T) {
+	dpi := NewDPIEngine(&NullLogger{})
+	dpi.AddRule(&DPIResetTrafficForTLSSNI{
+		Logger: &NullLogger{},
+		SNI:    "example.ulfheim.net",
+	})
+
+	// interleave two flows sending the ClientHello out of order
+	first, second := TLSHandshakeBytes13[:120], TLSHandshakeBytes13[120:]
+	packets := []struct {
+		raw         []byte
+		expectMatch bool
+	}{
+		{dpiSerializeTCPSegment(t, "10.0.0.2", 54321, "10.0.0.1", 443, 1000, true, nil), false},
+		{dpiSerializeTCPSegment(t, "10.0.0.2", 54322, "10.0.0.1", 443, 7000, true, nil), false},
+		{dpiSerializeTCPSegment(t, "10.0.0.2", 54321, "10.0.0.1", 443, 1001+120, false, second), false},
+		{dpiSerializeTCPSegment(t, "10.0.0.2", 54322, "10.0.0.1", 443, 7001, false, first), false},
+		{dpiSerializeTCPSegment(t, "10.0.0.2", 54321, "10.0.0.1", 443, 1001, false, first), true},
+		{dpiSerializeTCPSegment(t, "10.0.0.2", 54322, "10.0.0.1", 443, 7001+120, false, second), true},
+	}
+
+	for idx, packet := range packets {
+		policy, match := dpi.inspect(packet.raw)
+		if match != packet.expectMatch {
+			t.Fatal("packet", idx, "expected match", packet.expectMatch, "got", match)
+		}
+		if match && policy.Flags != FrameFlagSpoof {
+			t.Fatal("packet", idx, "expected spoof policy")
+		}
+	}
+}
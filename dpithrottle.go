@@ -14,6 +14,9 @@ import (
 // after it sees a given TLS SNI. The zero value is not valid. Make sure
 // you initialize all fields marked as MANDATORY.
 type DPIThrottleTrafficForTLSSNI struct {
+	// Bandwidth is the OPTIONAL per-flow bandwidth in bit/s.
+	Bandwidth int64
+
 	// Delay is the OPTIONAL extra delay to add to the flow.
 	Delay time.Duration
 
@@ -26,14 +29,9 @@ type DPIThrottleTrafficForTLSSNI struct {
 	// SNI is the OPTIONAL offending SNI
 	SNI string
 
-	// TLSHandshake
-	TLSHandshake []byte
-
-	// TLSHandshakeSize
-	TlSHandshakeSize uint16
-
-	// done
-	done bool
+	// Trigger OPTIONALLY defers throttling until the flow has
+	// transferred enough data or has been running long enough.
+	Trigger *DPITrigger
 }
 
 var _ DPIRule = &DPIThrottleTrafficForTLSSNI{}
@@ -51,72 +49,149 @@ func (r *DPIThrottleTrafficForTLSSNI) Filter(
 		return nil, false
 	}
 
+	// wait for the DPIEngine to reassemble the ClientHello
+	if packet.TLSClientHello == nil {
+		return nil, false
+	}
+
 	// try to obtain the SNI
-	tlsHandshakeBytes, length, err := packet.extractTLSHandshake(r.TLSHandshake, r.TlSHandshakeSize)
+	sni, err := packet.parseTLSServerName()
 	if err != nil {
+		r.Logger.Warnf(
+			"netem: dpi: failed to parse TLS server name for %s:%d %s:%d/%s: %s",
+			packet.SourceIPAddress(),
+			packet.SourcePort(),
+			packet.DestinationIPAddress(),
+			packet.DestinationPort(),
+			packet.TransportProtocol(),
+			err.Error(),
+		)
+		return nil, false
+	}
+
+	// if the packet is not offending, accept it
+	if sni != r.SNI {
+		return nil, false
+	}
+
+	r.Logger.Infof(
+		"netem: dpi: throttling flow %s:%d %s:%d/%s because SNI==%s",
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+		sni,
+	)
+
+	policy := &DPIPolicy{
+		Bandwidth:     r.Bandwidth,
+		Delay:         r.Delay,
+		Flags:         0,
+		PLR:           r.PLR,
+		Spoofed:       nil,
+		SpoofedDelays: nil,
+		Trigger:       r.Trigger,
+	}
+
+	return policy, true
+}
+
+// DPIThrottleTrafficForQUICSNI is a [DPIRule] that throttles traffic
+// after it sees a given SNI inside the ClientHello carried by the client's
+// QUIC Initial packets. The zero value is not valid. Make sure
+// you initialize all fields marked as MANDATORY.
+type DPIThrottleTrafficForQUICSNI struct {
+	// Bandwidth is the OPTIONAL per-flow bandwidth in bit/s.
+	Bandwidth int64
+
+	// Delay is the OPTIONAL extra delay to add to the flow.
+	Delay time.Duration
+
+	// Logger is the MANDATORY logger to use.
+	Logger Logger
+
+	// PLR is the OPTIONAL extra packet loss rate to apply to the packet.
+	PLR float64
+
+	// SNI is the OPTIONAL offending SNI
+	SNI string
+
+	// Trigger OPTIONALLY defers throttling until the flow has
+	// transferred enough data or has been running long enough.
+	Trigger *DPITrigger
+}
+
+var _ DPIRule = &DPIThrottleTrafficForQUICSNI{}
+
+// Filter implements DPIRule
+func (r *DPIThrottleTrafficForQUICSNI) Filter(
+	direction DPIDirection, packet *DissectedPacket) (*DPIPolicy, bool) {
+	// short circuit for the return path
+	if direction != DPIDirectionClientToServer {
 		return nil, false
 	}
-	if r.TlSHandshakeSize == 0 {
-		r.TlSHandshakeSize = length
+
+	// short circuit for TCP packets
+	if packet.TransportProtocol() != layers.IPProtocolUDP {
+		return nil, false
 	}
-	r.TLSHandshake = tlsHandshakeBytes
-	if r.done {
+
+	// wait for the DPIEngine to decrypt and reassemble the ClientHello
+	if packet.TLSClientHello == nil {
 		return nil, false
 	}
 
-	if len(r.TLSHandshake) == int(r.TlSHandshakeSize) {
-		sni, err := packet.parseTLSServerName(r.TLSHandshake)
-		if err != nil {
-			r.Logger.Warnf(
-				"netem: dpi: failed to parse TLS server name for %s:%d %s:%d/%s because SNI==%s",
-				packet.SourceIPAddress(),
-				packet.SourcePort(),
-				packet.DestinationIPAddress(),
-				packet.DestinationPort(),
-				packet.TransportProtocol(),
-				sni,
-			)
-			r.TLSHandshake = []byte{}
-			r.TlSHandshakeSize = 0
-			return nil, false
-		}
-
-		r.TLSHandshake = []byte{}
-		r.TlSHandshakeSize = 0
-		r.done = true
-
-		// if the packet is not offending, accept it
-		if sni != r.SNI {
-			return nil, false
-		}
-
-		r.Logger.Infof(
-			"netem: dpi: throttling flow %s:%d %s:%d/%s because SNI==%s",
+	// try to obtain the SNI
+	sni, err := packet.parseTLSServerName()
+	if err != nil {
+		r.Logger.Warnf(
+			"netem: dpi: failed to parse TLS server name for %s:%d %s:%d/%s: %s",
 			packet.SourceIPAddress(),
 			packet.SourcePort(),
 			packet.DestinationIPAddress(),
 			packet.DestinationPort(),
 			packet.TransportProtocol(),
-			sni,
+			err.Error(),
 		)
+		return nil, false
+	}
 
-		policy := &DPIPolicy{
-			Delay:   r.Delay,
-			Flags:   0,
-			PLR:     r.PLR,
-			Spoofed: nil,
-		}
+	// if the packet is not offending, accept it
+	if sni != r.SNI {
+		return nil, false
+	}
+
+	r.Logger.Infof(
+		"netem: dpi: throttling flow %s:%d %s:%d/%s because QUIC SNI==%s",
+		packet.SourceIPAddress(),
+		packet.SourcePort(),
+		packet.DestinationIPAddress(),
+		packet.DestinationPort(),
+		packet.TransportProtocol(),
+		sni,
+	)
 
-		return policy, true
+	policy := &DPIPolicy{
+		Bandwidth:     r.Bandwidth,
+		Delay:         r.Delay,
+		Flags:         0,
+		PLR:           r.PLR,
+		Spoofed:       nil,
+		SpoofedDelays: nil,
+		Trigger:       r.Trigger,
 	}
 
-	return nil, false
+	return policy, true
 }
 
 // DPIThrottleTrafficForTCPEndpoint is a [DPIRule] that throttles traffic
 // for a given TCP endpoint. The zero value is not valid. Make sure
 // you initialize all fields marked as MANDATORY.
 type DPIThrottleTrafficForTCPEndpoint struct {
+	// Bandwidth is the OPTIONAL per-flow bandwidth in bit/s.
+	Bandwidth int64
+
 	// Delay is the OPTIONAL extra delay to add to the flow.
 	Delay time.Duration
 
@@ -131,6 +206,10 @@ type DPIThrottleTrafficForTCPEndpoint struct {
 
 	// ServerPort is the MANDATORY server endpoint port.
 	ServerPort uint16
+
+	// Trigger OPTIONALLY defers throttling until the flow has
+	// transferred enough data or has been running long enough.
+	Trigger *DPITrigger
 }
 
 var _ DPIRule = &DPIThrottleTrafficForTCPEndpoint{}
@@ -157,10 +236,13 @@ func (r *DPIThrottleTrafficForTCPEndpoint) Filter(
 		packet.TransportProtocol(),
 	)
 	policy := &DPIPolicy{
-		Delay:   r.Delay,
-		Flags:   0,
-		PLR:     r.PLR,
-		Spoofed: nil,
+		Bandwidth:     r.Bandwidth,
+		Delay:         r.Delay,
+		Flags:         0,
+		PLR:           r.PLR,
+		Spoofed:       nil,
+		SpoofedDelays: nil,
+		Trigger:       r.Trigger,
 	}
 	return policy, true
 }
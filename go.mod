@@ -6,17 +6,21 @@ require (
 	github.com/apex/log v1.9.0
 	github.com/google/gopacket v1.1.19
 	github.com/miekg/dns v1.1.57
+	github.com/quic-go/quic-go v0.54.1
 	golang.org/x/crypto v0.28.0
+	golang.org/x/net v0.30.0
+	golang.org/x/sys v0.26.0
+	gopkg.in/yaml.v3 v3.0.1
 	gvisor.dev/gvisor v0.0.0-20250317184159-a24f13b091dc
 )
 
 require (
 	github.com/google/btree v1.1.2 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/stretchr/testify v1.8.1 // indirect
-	golang.org/x/net v0.30.0 // indirect
+	github.com/quic-go/qpack v0.5.1 // indirect
+	go.uber.org/mock v0.5.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
-	golang.org/x/sys v0.26.0 // indirect
+	golang.org/x/text v0.19.0 // indirect
 	golang.org/x/time v0.7.0 // indirect
 )
 
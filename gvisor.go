@@ -9,10 +9,16 @@ package netem
 //
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"net"
 	"net/netip"
+	"os"
 	"sync"
+	"syscall"
+	"time"
 
 	"gvisor.dev/gvisor/pkg/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip"
@@ -23,44 +29,41 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/raw"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
 )
 
 // gvisorStack is a TCP/IP stack in userspace. Seen from above this
 // stack allows creating TCP and UDP connections. Seen from below, it
-// allows one to read and write IP packets. The zero value of this
-// structure is invalid; please, use [newGVisorStack] to instantiate.
+// allows one to read and write IP packets using its NICs. The zero value
+// of this structure is invalid; please, use [newGVisorStack] to instantiate.
 type gvisorStack struct {
 	// closeOnce ensures that Close has once semantics.
 	closeOnce sync.Once
 
-	// closed is closed by Close and signals that we should
-	// not perform any further TCP/IP operation.
-	closed chan any
-
-	// endpoint is the endpoint receiving gvisor notifications.
-	endpoint *channel.Endpoint
+	// logger is the logger to use.
+	logger Logger
 
-	// incomingPacket is the channel posted by GVisor
-	// when there is an incoming IP packet.
-	incomingPacket chan any
+	// mss is the OPTIONAL MSS to use for TCP endpoints.
+	mss int
 
-	// ipAddress is the IP address we're using.
-	ipAddress netip.Addr
+	// mtu is the MTU we use for all the NICs.
+	mtu uint32
 
-	// logger is the logger to use.
-	logger Logger
+	// mu protects nics.
+	mu sync.Mutex
 
-	// name is the interface name.
-	name string
+	// nics contains the stack NICs; the first entry is the primary NIC.
+	nics []*gvisorNIC
 
 	// stack is the network stack in userspace.
 	stack *stack.Stack
 }
 
 // newGVisorStack creates a new [gvisorStack] instance.
-func newGVisorStack(logger Logger, A netip.Addr, MTU uint32) (*gvisorStack, error) {
+func newGVisorStack(logger Logger, A netip.Addr, MTU uint32, config *UNetStackConfig) (*gvisorStack, error) {
 
 	// create options for the new stack
 	stackOptions := stack.Options{
@@ -75,26 +78,137 @@ func newGVisorStack(logger Logger, A netip.Addr, MTU uint32) (*gvisorStack, erro
 			icmp.NewProtocol6,
 		},
 		HandleLocal: true,
+		RawFactory:  raw.EndpointFactory{},
 	}
 
 	// create the stack instance
-	name := newNICName()
 	gvs := &gvisorStack{
+		closeOnce: sync.Once{},
+		logger:    logger,
+		mss:       config.MSS,
+		mtu:       MTU,
+		mu:        sync.Mutex{},
+		nics:      []*gvisorNIC{},
+		stack:     stack.New(stackOptions),
+	}
+
+	// configure the TCP protocol
+	if err := gvs.configureTCP(config); err != nil {
+		gvs.stack.Destroy() // don't leak the stack goroutines and timers
+		return nil, err
+	}
+
+	// create the primary NIC, which is also the default route
+	if _, err := gvs.addNIC(A); err != nil {
+		gvs.stack.Destroy() // ditto
+		return nil, err
+	}
+	return gvs, nil
+}
+
+// configureTCP applies the TCP protocol settings in the given config.
+func (gvs *gvisorStack) configureTCP(config *UNetStackConfig) error {
+	var options []tcpip.SettableTransportProtocolOption
+
+	if config.CongestionControl != "" {
+		opt := tcpip.CongestionControlOption(config.CongestionControl)
+		options = append(options, &opt)
+		gvs.logger.Debugf("netem: sysctl net.ipv4.tcp_congestion_control=%s", config.CongestionControl)
+	}
+
+	if config.DisableSACK {
+		opt := tcpip.TCPSACKEnabled(false)
+		options = append(options, &opt)
+		gvs.logger.Debugf("netem: sysctl net.ipv4.tcp_sack=0")
+	}
+
+	if config.EnableNagle {
+		opt := tcpip.TCPDelayEnabled(true)
+		options = append(options, &opt)
+		gvs.logger.Debugf("netem: sysctl net.ipv4.tcp_nagle=1")
+	}
+
+	if config.DisableReceiveBufferAutoTuning {
+		opt := tcpip.TCPModerateReceiveBufferOption(false)
+		options = append(options, &opt)
+		gvs.logger.Debugf("netem: sysctl net.ipv4.tcp_moderate_rcvbuf=0")
+	}
+
+	if config.ReceiveBufferSize > 0 {
+		opt := tcpip.TCPReceiveBufferSizeRangeOption{
+			Min:     tcp.MinBufferSize,
+			Default: config.ReceiveBufferSize,
+			Max:     max(config.ReceiveBufferSize, tcp.MaxBufferSize),
+		}
+		options = append(options, &opt)
+		gvs.logger.Debugf("netem: sysctl net.ipv4.tcp_rmem='%d %d %d'", opt.Min, opt.Default, opt.Max)
+	}
+
+	if config.SendBufferSize > 0 {
+		opt := tcpip.TCPSendBufferSizeRangeOption{
+			Min:     tcp.MinBufferSize,
+			Default: config.SendBufferSize,
+			Max:     max(config.SendBufferSize, tcp.MaxBufferSize),
+		}
+		options = append(options, &opt)
+		gvs.logger.Debugf("netem: sysctl net.ipv4.tcp_wmem='%d %d %d'", opt.Min, opt.Default, opt.Max)
+	}
+
+	for _, opt := range options {
+		if err := gvs.stack.SetTransportProtocolOption(tcp.ProtocolNumber, opt); err != nil {
+			return errors.New(err.String())
+		}
+	}
+	return nil
+}
+
+// newTCPEndpoint creates a new TCP endpoint honouring the configured MSS.
+func (gvs *gvisorStack) newTCPEndpoint(
+	network tcpip.NetworkProtocolNumber, wq *waiter.Queue) (tcpip.Endpoint, error) {
+	ep, err := gvs.stack.NewEndpoint(tcp.ProtocolNumber, network, wq)
+	if err != nil {
+		return nil, errors.New(err.String())
+	}
+	if gvs.mss > 0 {
+		if err := ep.SetSockOptInt(tcpip.MaxSegOption, gvs.mss); err != nil {
+			ep.Close()
+			return nil, errors.New(err.String())
+		}
+	}
+	return ep, nil
+}
+
+// addNIC creates a new [gvisorNIC] using the given IPv4 address and installs
+// a default route using such a NIC. The first NIC we add is the primary NIC
+// and its default route takes precedence over the ones of other NICs.
+func (gvs *gvisorStack) addNIC(A netip.Addr) (*gvisorNIC, error) {
+	defer gvs.mu.Unlock()
+	gvs.mu.Lock()
+
+	// refuse adding the same address more than once
+	for _, nic := range gvs.nics {
+		if nic.ipAddress == A {
+			return nil, syscall.EADDRINUSE
+		}
+	}
+
+	// create the NIC instance
+	nic := &gvisorNIC{
 		closeOnce:      sync.Once{},
 		closed:         make(chan any),
-		endpoint:       channel.New(1024, MTU, ""),
-		name:           name,
-		ipAddress:      A,
+		endpoint:       channel.New(1024, gvs.mtu, ""),
+		id:             tcpip.NICID(len(gvs.nics) + 1),
 		incomingPacket: make(chan any, 1024),
-		logger:         logger,
-		stack:          stack.New(stackOptions),
+		ipAddress:      A,
+		logger:         gvs.logger,
+		name:           newNICName(),
 	}
 
-	// register network as the notification target for gvisor
-	gvs.endpoint.AddNotify(gvs)
+	// register the NIC as the notification target for gvisor
+	nic.endpoint.AddNotify(nic)
 
-	// create a NIC to attach to this stack
-	if err := gvs.stack.CreateNIC(1, gvs.endpoint); err != nil {
+	// attach the NIC to this stack
+	if err := gvs.stack.CreateNIC(nic.id, nic.endpoint); err != nil {
 		return nil, errors.New(err.String())
 	}
 
@@ -103,29 +217,83 @@ func newGVisorStack(logger Logger, A netip.Addr, MTU uint32) (*gvisorStack, erro
 		Protocol:          ipv4.ProtocolNumber,
 		AddressWithPrefix: tcpip.AddrFromSlice(A.AsSlice()).WithPrefix(),
 	}
-	if err := gvs.stack.AddProtocolAddress(1, protoAddr, stack.AddressProperties{}); err != nil {
+	if err := gvs.stack.AddProtocolAddress(nic.id, protoAddr, stack.AddressProperties{}); err != nil {
 		return nil, errors.New(err.String())
 	}
 
-	// install the IPv4 address in the routing table
-	gvs.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: 1})
+	// install the default route using this NIC (note that gvisor appends routes with
+	// the same prefix length, so the primary NIC's default route comes first)
+	gvs.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: nic.id})
 
-	logger.Debugf("netem: ifconfig %s mtu %d", name, MTU)
-	logger.Debugf("netem: ifconfig %s %s up", name, A)
-	logger.Debugf("netem: ip route add default dev %s", name)
-	return gvs, nil
+	gvs.logger.Debugf("netem: ifconfig %s mtu %d", nic.name, gvs.mtu)
+	gvs.logger.Debugf("netem: ifconfig %s %s up", nic.name, A)
+	gvs.logger.Debugf("netem: ip route add default dev %s", nic.name)
+	gvs.nics = append(gvs.nics, nic)
+	return nic, nil
+}
+
+// primaryNIC returns the primary NIC.
+func (gvs *gvisorStack) primaryNIC() *gvisorNIC {
+	defer gvs.mu.Unlock()
+	gvs.mu.Lock()
+	return gvs.nics[0]
+}
+
+// findNIC returns the first NIC for which the given predicate is true.
+func (gvs *gvisorStack) findNIC(predicate func(nic *gvisorNIC) bool) (*gvisorNIC, bool) {
+	defer gvs.mu.Unlock()
+	gvs.mu.Lock()
+	for _, nic := range gvs.nics {
+		if predicate(nic) {
+			return nic, true
+		}
+	}
+	return nil, false
+}
+
+// nicByName returns the NIC with the given interface name.
+func (gvs *gvisorStack) nicByName(name string) (*gvisorNIC, bool) {
+	return gvs.findNIC(func(nic *gvisorNIC) bool {
+		return nic.name == name
+	})
+}
+
+// nicByAddress returns the NIC with the given IP address.
+func (gvs *gvisorStack) nicByAddress(addr netip.Addr) (*gvisorNIC, bool) {
+	return gvs.findNIC(func(nic *gvisorNIC) bool {
+		return nic.ipAddress == addr
+	})
+}
+
+// addRoute routes the given destination prefix using the given NIC. Because
+// gvisor sorts the routing table by prefix length, more specific routes
+// take precedence over the default route.
+func (gvs *gvisorStack) addRoute(destination netip.Prefix, nic *gvisorNIC) error {
+	if !destination.Addr().Is4() {
+		return syscall.EAFNOSUPPORT
+	}
+	subnet, err := tcpip.NewSubnet(
+		tcpip.AddrFromSlice(destination.Masked().Addr().AsSlice()),
+		tcpip.MaskFromBytes(net.CIDRMask(destination.Bits(), 32)),
+	)
+	if err != nil {
+		return err
+	}
+	gvs.stack.AddRoute(tcpip.Route{Destination: subnet, NIC: nic.id})
+	gvs.logger.Debugf("netem: ip route add %s dev %s", destination.Masked(), nic.name)
+	return nil
 }
 
 var _ NIC = &gvisorStack{}
 
 // IPAddress implements NIC
 func (gvs *gvisorStack) IPAddress() string {
-	return gvs.ipAddress.String()
+	return gvs.primaryNIC().IPAddress()
 }
 
 // FrameAvailable implements NIC
 func (gvs *gvisorStack) FrameAvailable() <-chan any {
-	return gvs.incomingPacket
+	return gvs.primaryNIC().FrameAvailable()
 }
 
 // ErrStackClosed indicates the network stack has been closed.
@@ -136,15 +304,91 @@ var ErrNoPacket = errors.New("netem: no packet in buffer")
 
 // ReadFrameNonblocking implements NIC
 func (gvs *gvisorStack) ReadFrameNonblocking() (*Frame, error) {
+	return gvs.primaryNIC().ReadFrameNonblocking()
+}
+
+// InterfaceName implements NIC.
+func (gvs *gvisorStack) InterfaceName() string {
+	return gvs.primaryNIC().InterfaceName()
+}
+
+// StackClosed implements NIC
+func (gvs *gvisorStack) StackClosed() <-chan any {
+	return gvs.primaryNIC().StackClosed()
+}
+
+// WriteFrame implements NIC
+func (gvs *gvisorStack) WriteFrame(frame *Frame) error {
+	return gvs.primaryNIC().WriteFrame(frame)
+}
+
+// Close ensures that we cannot send and recv additional packets using
+// any of the NICs and that we cannot establish new TCP/UDP connections.
+func (gvs *gvisorStack) Close() error {
+	gvs.closeOnce.Do(func() {
+		gvs.mu.Lock()
+		nics := append([]*gvisorNIC{}, gvs.nics...)
+		gvs.mu.Unlock()
+		for _, nic := range nics {
+			nic.Close()
+		}
+	})
+	return nil
+}
+
+// gvisorNIC is a NIC attached to a [gvisorStack]. The zero value is
+// invalid; please, use [gvisorStack.addNIC] to instantiate.
+type gvisorNIC struct {
+	// closeOnce ensures that Close has once semantics.
+	closeOnce sync.Once
+
+	// closed is closed by Close and signals that we should
+	// not send or receive packets using this NIC.
+	closed chan any
+
+	// endpoint is the endpoint receiving gvisor notifications.
+	endpoint *channel.Endpoint
+
+	// id is the gvisor NIC ID.
+	id tcpip.NICID
+
+	// incomingPacket is the channel posted by GVisor
+	// when there is an incoming IP packet.
+	incomingPacket chan any
+
+	// ipAddress is the IP address we're using.
+	ipAddress netip.Addr
+
+	// logger is the logger to use.
+	logger Logger
+
+	// name is the interface name.
+	name string
+}
+
+var _ NIC = &gvisorNIC{}
+
+// IPAddress implements NIC
+func (nic *gvisorNIC) IPAddress() string {
+	return nic.ipAddress.String()
+}
+
+// FrameAvailable implements NIC
+func (nic *gvisorNIC) FrameAvailable() <-chan any {
+	return nic.incomingPacket
+}
+
+// ReadFrameNonblocking implements NIC
+func (nic *gvisorNIC) ReadFrameNonblocking() (*Frame, error) {
 	// avoid reading if we've been closed
 	select {
-	case <-gvs.closed:
+	case <-nic.closed:
 		return nil, ErrStackClosed
 	default:
 	}
 
 	// obtain the packet buffer from the endpoint
-	pktbuf := gvs.endpoint.Read()
+	pktbuf := nic.endpoint.Read()
 	if pktbuf == nil {
 		return nil, ErrNoPacket
 	}
@@ -152,7 +396,7 @@ func (gvs *gvisorStack) ReadFrameNonblocking() (*Frame, error) {
 	pktbuf.DecRef()
 
 	// read the actual packet payload
-	buffer := make([]byte, gvs.endpoint.MTU())
+	buffer := make([]byte, nic.endpoint.MTU())
 	count, err := view.Read(buffer)
 	if err != nil {
 		return nil, err
@@ -165,30 +409,30 @@ func (gvs *gvisorStack) ReadFrameNonblocking() (*Frame, error) {
 }
 
 // InterfaceName implements NIC.
-func (gvs *gvisorStack) InterfaceName() string {
-	return gvs.name
+func (nic *gvisorNIC) InterfaceName() string {
+	return nic.name
 }
 
 // StackClosed implements NIC
-func (gvs *gvisorStack) StackClosed() <-chan any {
-	return gvs.closed
+func (nic *gvisorNIC) StackClosed() <-chan any {
+	return nic.closed
 }
 
 // WriteNotify implements channel.Notification. GVisor will call this
 // callback function everytime there's a new readable packet.
-func (gvs *gvisorStack) WriteNotify() {
+func (nic *gvisorNIC) WriteNotify() {
 	select {
-	case gvs.incomingPacket <- true:
-	case <-gvs.closed:
+	case nic.incomingPacket <- true:
+	case <-nic.closed:
 	}
 }
 
 // WriteFrame implements NIC
-func (gvs *gvisorStack) WriteFrame(frame *Frame) error {
+func (nic *gvisorNIC) WriteFrame(frame *Frame) error {
 	// there is clearly a race condition with closing but the intent is just
 	// to behave and return ErrClose long after we've been closed
 	select {
-	case <-gvs.closed:
+	case <-nic.closed:
 		return ErrStackClosed
 	default:
 	}
@@ -199,51 +443,254 @@ func (gvs *gvisorStack) WriteFrame(frame *Frame) error {
 	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(packet)})
 	switch packet[0] >> 4 {
 	case 4:
-		gvs.endpoint.InjectInbound(header.IPv4ProtocolNumber, pkb)
+		nic.endpoint.InjectInbound(header.IPv4ProtocolNumber, pkb)
 	case 6:
-		gvs.endpoint.InjectInbound(header.IPv6ProtocolNumber, pkb)
+		nic.endpoint.InjectInbound(header.IPv6ProtocolNumber, pkb)
 	}
 
 	return nil
 }
 
-// Close ensures that we cannot send and recv additional packets and
-// that we cannot establish new TCP/UDP connections.
-func (gvs *gvisorStack) Close() error {
-	gvs.closeOnce.Do(func() {
+// Close ensures that we cannot send and recv additional packets using this NIC.
+func (nic *gvisorNIC) Close() error {
+	nic.closeOnce.Do(func() {
 		// synchronize with other users (MUST be first)
-		close(gvs.closed)
+		close(nic.closed)
 
 		// tell the user this interface has been closed
-		gvs.logger.Debugf("netem: ifconfig %s down", gvs.name)
-		gvs.logger.Debugf("netem: ip route del default")
+		nic.logger.Debugf("netem: ifconfig %s down", nic.name)
+		nic.logger.Debugf("netem: ip route del default dev %s", nic.name)
 	})
 	return nil
 }
 
-// DialContextTCPAddrPort establishes a new TCP connection.
+// DialContextTCPAddrPort establishes a new TCP connection. When laddr
+// is valid, we bind the socket to such a local address before connecting.
 func (gvs *gvisorStack) DialContextTCPAddrPort(
-	ctx context.Context, addr netip.AddrPort) (*gonet.TCPConn, error) {
-	fa, pn := gvisorConvertToFullAddr(addr)
-	return gonet.DialContextTCP(ctx, gvs.stack, fa, pn)
+	ctx context.Context, laddr, raddr netip.AddrPort) (*gvisorTCPConn, error) {
+	var lfa tcpip.FullAddress
+	if laddr.IsValid() {
+		lfa, _ = gvs.convertToLocalFullAddr(laddr)
+	}
+	rfa, pn := gvisorConvertToFullAddr(raddr)
+	return gvs.dialTCPWithBind(ctx, lfa, rfa, pn)
 }
 
+// gvisorTCPConn is a [gonet.TCPConn] that also allows accessing
+// the underlying endpoint to get and set socket options.
+type gvisorTCPConn struct {
+	*gonet.TCPConn
+
+	// ep is the underlying endpoint.
+	ep tcpip.Endpoint
+}
+
+// dialTCPWithBind is like [gonet.DialTCPWithBind] except that it
+// returns a [gvisorTCPConn] wrapping the underlying endpoint.
+//
+// Adapted from gvisor.dev/gvisor/pkg/tcpip/adapters/gonet
+//
+// SPDX-License-Identifier: Apache-2.0
+func (gvs *gvisorStack) dialTCPWithBind(ctx context.Context, localAddr,
+	remoteAddr tcpip.FullAddress, network tcpip.NetworkProtocolNumber) (*gvisorTCPConn, error) {
+	// create TCP endpoint, then connect
+	var wq waiter.Queue
+	ep, err := gvs.newTCPEndpoint(network, &wq)
+	if err != nil {
+		return nil, err
+	}
+
+	// create wait queue entry that notifies a channel
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.WritableEvents)
+	wq.EventRegister(&waitEntry)
+	defer wq.EventUnregister(&waitEntry)
+
+	select {
+	case <-ctx.Done():
+		ep.Close()
+		return nil, ctx.Err()
+	default:
+	}
+
+	// bind before connect if requested
+	if localAddr != (tcpip.FullAddress{}) {
+		if err := ep.Bind(localAddr); err != nil {
+			ep.Close()
+			return nil, fmt.Errorf("ep.Bind(%+v) = %s", localAddr, err)
+		}
+	}
+
+	terr := ep.Connect(remoteAddr)
+	if _, ok := terr.(*tcpip.ErrConnectStarted); ok {
+		select {
+		case <-ctx.Done():
+			ep.Close()
+			return nil, ctx.Err()
+		case <-notifyCh:
+		}
+
+		terr = ep.LastError()
+	}
+	if terr != nil {
+		ep.Close()
+		return nil, &net.OpError{
+			Op:   "connect",
+			Net:  "tcp",
+			Addr: &net.TCPAddr{IP: net.IP(remoteAddr.Addr.AsSlice()), Port: int(remoteAddr.Port)},
+			Err:  errors.New(terr.String()),
+		}
+	}
+
+	conn := &gvisorTCPConn{
+		TCPConn: gonet.NewTCPConn(&wq, ep),
+		ep:      ep,
+	}
+	return conn, nil
+}
+
+// gvisorMaxListenBacklog is the listen backlog used by [gonet.ListenTCP].
+const gvisorMaxListenBacklog = 4096
+
 // ListenTCPAddrPort creates a new listening TCP socket.
-func (gvs *gvisorStack) ListenTCPAddrPort(addr netip.AddrPort) (*gonet.TCPListener, error) {
-	fa, pn := gvisorConvertToFullAddr(addr)
-	return gonet.ListenTCP(gvs.stack, fa, pn)
+//
+// Adapted from gvisor.dev/gvisor/pkg/tcpip/adapters/gonet
+//
+// SPDX-License-Identifier: Apache-2.0
+func (gvs *gvisorStack) ListenTCPAddrPort(addr netip.AddrPort) (*gvisorTCPListener, error) {
+	fa, pn := gvs.convertToLocalFullAddr(addr)
+
+	// create a TCP endpoint, bind it, then start listening
+	var wq waiter.Queue
+	ep, err := gvs.newTCPEndpoint(pn, &wq)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ep.Bind(fa); err != nil {
+		ep.Close()
+		return nil, &net.OpError{
+			Op:   "bind",
+			Net:  "tcp",
+			Addr: net.TCPAddrFromAddrPort(addr),
+			Err:  errors.New(err.String()),
+		}
+	}
+
+	if err := ep.Listen(gvisorMaxListenBacklog); err != nil {
+		ep.Close()
+		return nil, &net.OpError{
+			Op:   "listen",
+			Net:  "tcp",
+			Addr: net.TCPAddrFromAddrPort(addr),
+			Err:  errors.New(err.String()),
+		}
+	}
+
+	listener := &gvisorTCPListener{
+		cancel:     make(chan struct{}),
+		cancelOnce: sync.Once{},
+		ep:         ep,
+		wq:         &wq,
+	}
+	return listener, nil
+}
+
+// gvisorTCPListener is like [gonet.TCPListener] except that it
+// returns [gvisorTCPConn] instances wrapping the accepted endpoints.
+//
+// Adapted from gvisor.dev/gvisor/pkg/tcpip/adapters/gonet
+//
+// SPDX-License-Identifier: Apache-2.0
+type gvisorTCPListener struct {
+	// cancel is closed to interrupt pending Accept calls.
+	cancel chan struct{}
+
+	// cancelOnce provides "once" semantics for closing cancel.
+	cancelOnce sync.Once
+
+	// ep is the listening endpoint.
+	ep tcpip.Endpoint
+
+	// wq is the endpoint's wait queue.
+	wq *waiter.Queue
+}
+
+// errGVisorListenerClosed is returned when accepting using a closed listener.
+var errGVisorListenerClosed = errors.New("operation canceled")
+
+// Accept is like [gonet.TCPListener.Accept].
+func (l *gvisorTCPListener) Accept() (*gvisorTCPConn, error) {
+	n, wq, err := l.ep.Accept(nil)
+
+	if _, ok := err.(*tcpip.ErrWouldBlock); ok {
+		// create wait queue entry that notifies a channel
+		waitEntry, notifyCh := waiter.NewChannelEntry(waiter.ReadableEvents)
+		l.wq.EventRegister(&waitEntry)
+		defer l.wq.EventUnregister(&waitEntry)
+
+		for {
+			n, wq, err = l.ep.Accept(nil)
+
+			if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+				break
+			}
+
+			select {
+			case <-l.cancel:
+				return nil, errGVisorListenerClosed
+			case <-notifyCh:
+			}
+		}
+	}
+
+	if err != nil {
+		return nil, &net.OpError{
+			Op:   "accept",
+			Net:  "tcp",
+			Addr: l.Addr(),
+			Err:  errors.New(err.String()),
+		}
+	}
+
+	conn := &gvisorTCPConn{
+		TCPConn: gonet.NewTCPConn(wq, n),
+		ep:      n,
+	}
+	return conn, nil
+}
+
+// Addr is like [gonet.TCPListener.Addr].
+func (l *gvisorTCPListener) Addr() net.Addr {
+	fa, err := l.ep.GetLocalAddress()
+	if err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: net.IP(fa.Addr.AsSlice()), Port: int(fa.Port)}
+}
+
+// Close closes the listener and interrupts pending Accept calls.
+func (l *gvisorTCPListener) Close() error {
+	l.ep.Close()
+	l.cancelOnce.Do(func() {
+		close(l.cancel) // broadcast cancellation
+	})
+	return nil
 }
 
 // DialUDPAddrPort allows to create UDP sockets. Using a nil
 // raddr is equivalent to [net.ListenUDP]. Using nil laddr instead
 // is equivalent to [net.DialContext] with an "udp" network.
-func (gvs *gvisorStack) DialUDPAddrPort(laddr, raddr netip.AddrPort) (*gonet.UDPConn, error) {
+//
+// Adapted from gvisor.dev/gvisor/pkg/tcpip/adapters/gonet
+//
+// SPDX-License-Identifier: Apache-2.0
+func (gvs *gvisorStack) DialUDPAddrPort(laddr, raddr netip.AddrPort) (*gvisorUDPConn, error) {
 	var lfa, rfa *tcpip.FullAddress
 	var pn tcpip.NetworkProtocolNumber
 
 	if laddr.IsValid() || laddr.Port() > 0 {
 		var addr tcpip.FullAddress
-		addr, pn = gvisorConvertToFullAddr(laddr)
+		addr, pn = gvs.convertToLocalFullAddr(laddr)
 		lfa = &addr
 	}
 
@@ -253,11 +700,436 @@ func (gvs *gvisorStack) DialUDPAddrPort(laddr, raddr netip.AddrPort) (*gonet.UDP
 		rfa = &addr
 	}
 
-	return gonet.DialUDP(gvs.stack, lfa, rfa, pn)
+	var wq waiter.Queue
+	ep, err := gvs.stack.NewEndpoint(udp.ProtocolNumber, pn, &wq)
+	if err != nil {
+		return nil, errors.New(err.String())
+	}
+
+	// make sure we can report the TOS and the destination address of
+	// incoming datagrams when reading with ReadMsgUDP
+	ep.SocketOptions().SetReceiveTOS(true)
+	ep.SocketOptions().SetReceivePacketInfo(true)
+
+	if lfa != nil {
+		if err := ep.Bind(*lfa); err != nil {
+			ep.Close()
+			return nil, &net.OpError{
+				Op:   "bind",
+				Net:  "udp",
+				Addr: net.UDPAddrFromAddrPort(laddr),
+				Err:  errors.New(err.String()),
+			}
+		}
+	}
+
+	if rfa != nil {
+		if err := ep.Connect(*rfa); err != nil {
+			ep.Close()
+			return nil, &net.OpError{
+				Op:   "connect",
+				Net:  "udp",
+				Addr: net.UDPAddrFromAddrPort(raddr),
+				Err:  errors.New(err.String()),
+			}
+		}
+	}
+
+	conn := &gvisorUDPConn{
+		UDPConn: gonet.NewUDPConn(&wq, ep),
+		ep:      ep,
+		rd:      newGVisorReadDeadline(),
+		wq:      &wq,
+		writeMu: sync.Mutex{},
+	}
+	return conn, nil
+}
+
+// gvisorUDPConn is a [gonet.UDPConn] that also allows reading and writing
+// datagrams along with their IPv4 TOS, and reading the destination address
+// of each incoming datagram, using the underlying endpoint.
+type gvisorUDPConn struct {
+	*gonet.UDPConn
+
+	// ep is the underlying endpoint.
+	ep tcpip.Endpoint
+
+	// rd allows blocking reads to honour the read deadline.
+	rd *gvisorReadDeadline
+
+	// wq is the endpoint's wait queue.
+	wq *waiter.Queue
+
+	// writeMu serializes writing datagrams with a specific TOS.
+	writeMu sync.Mutex
+}
+
+// gvisorDatagram is a datagram read by [gvisorUDPConn.ReadDatagram].
+type gvisorDatagram struct {
+	// Count is the number of bytes we copied into the buffer.
+	Count int
+
+	// Truncated indicates that the buffer was too small.
+	Truncated bool
+
+	// RemoteAddr is the address of the peer.
+	RemoteAddr netip.AddrPort
+
+	// LocalAddr is the destination address of the datagram.
+	LocalAddr netip.Addr
+
+	// IfIndex is the index of the NIC that received the datagram.
+	IfIndex int
+
+	// TOS is the IPv4 TOS of the datagram.
+	TOS uint8
+}
+
+// Close closes the conn and interrupts pending ReadDatagram calls.
+func (c *gvisorUDPConn) Close() error {
+	c.rd.close()
+	return c.UDPConn.Close()
+}
+
+// SetDeadline is like [gonet.UDPConn.SetDeadline].
+func (c *gvisorUDPConn) SetDeadline(t time.Time) error {
+	c.rd.set(t)
+	return c.UDPConn.SetDeadline(t)
+}
+
+// SetReadDeadline is like [gonet.UDPConn.SetReadDeadline].
+func (c *gvisorUDPConn) SetReadDeadline(t time.Time) error {
+	c.rd.set(t)
+	return c.UDPConn.SetReadDeadline(t)
+}
+
+// errGVisorWouldBlock indicates that a nonblocking read would block.
+var errGVisorWouldBlock = errors.New("operation would block")
+
+// ReadDatagram reads a datagram into the given buffer. When block is false, this
+// method returns [errGVisorWouldBlock] rather than waiting for a datagram.
+func (c *gvisorUDPConn) ReadDatagram(buffer []byte, block bool) (*gvisorDatagram, error) {
+	// create wait queue entry that notifies a channel
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.ReadableEvents)
+	c.wq.EventRegister(&waitEntry)
+	defer c.wq.EventUnregister(&waitEntry)
+
+	for {
+		writer := tcpip.SliceWriter(buffer)
+		res, err := c.ep.Read(&writer, tcpip.ReadOptions{NeedRemoteAddr: true})
+		if _, ok := err.(*tcpip.ErrWouldBlock); ok {
+			if !block {
+				return nil, errGVisorWouldBlock
+			}
+			if err := c.rd.waitReadable(notifyCh); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, errors.New(err.String())
+		}
+
+		remoteAddr, _ := netip.AddrFromSlice(res.RemoteAddr.Addr.AsSlice())
+		dgram := &gvisorDatagram{
+			Count:      res.Count,
+			Truncated:  res.Total > res.Count,
+			RemoteAddr: netip.AddrPortFrom(remoteAddr, res.RemoteAddr.Port),
+			LocalAddr:  netip.Addr{},
+			IfIndex:    0,
+			TOS:        0,
+		}
+		if cm := res.ControlMessages; cm.HasIPPacketInfo {
+			dgram.LocalAddr, _ = netip.AddrFromSlice(cm.PacketInfo.DestinationAddr.AsSlice())
+			dgram.IfIndex = int(cm.PacketInfo.NIC)
+		}
+		if cm := res.ControlMessages; cm.HasTOS {
+			dgram.TOS = cm.TOS
+		}
+		return dgram, nil
+	}
+}
+
+// WriteDatagram writes a datagram to the given address using the given IPv4
+// TOS. A zero TOS means using the TOS configured for the endpoint.
+func (c *gvisorUDPConn) WriteDatagram(data []byte, addr netip.AddrPort, tos uint8) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	// temporarily override the TOS if needed
+	if tos != 0 {
+		prev, err := c.ep.GetSockOptInt(tcpip.IPv4TOSOption)
+		if err != nil {
+			return 0, errors.New(err.String())
+		}
+		if err := c.ep.SetSockOptInt(tcpip.IPv4TOSOption, int(tos)); err != nil {
+			return 0, errors.New(err.String())
+		}
+		defer c.ep.SetSockOptInt(tcpip.IPv4TOSOption, prev)
+	}
+
+	var opts tcpip.WriteOptions
+	if addr.IsValid() {
+		fa, _ := gvisorConvertToFullAddr(netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()))
+		opts.To = &fa
+	}
+	count, err := c.ep.Write(bytes.NewReader(data), opts)
+	if err != nil {
+		return 0, errors.New(err.String())
+	}
+	return int(count), nil
+}
+
+// ListenICMPAddr creates a raw ICMPv4 socket bound to the given local address,
+// which may be the unspecified address to receive from all the NICs.
+func (gvs *gvisorStack) ListenICMPAddr(laddr netip.Addr) (*gvisorICMPConn, error) {
+	if !laddr.Is4() {
+		return nil, syscall.EAFNOSUPPORT
+	}
+
+	var wq waiter.Queue
+	ep, err := gvs.stack.NewRawEndpoint(header.ICMPv4ProtocolNumber, ipv4.ProtocolNumber, &wq, true)
+	if err != nil {
+		return nil, errors.New(err.String())
+	}
+
+	if !laddr.IsUnspecified() {
+		fa, _ := gvs.convertToLocalFullAddr(netip.AddrPortFrom(laddr, 0))
+		if err := ep.Bind(fa); err != nil {
+			ep.Close()
+			return nil, &net.OpError{
+				Op:   "bind",
+				Net:  "ip4:icmp",
+				Addr: &net.IPAddr{IP: net.IP(laddr.AsSlice())},
+				Err:  errors.New(err.String()),
+			}
+		}
+	}
+
+	conn := &gvisorICMPConn{
+		closeOnce: sync.Once{},
+		ep:        ep,
+		rd:        newGVisorReadDeadline(),
+		wq:        &wq,
+	}
+	return conn, nil
+}
+
+// gvisorICMPConn is a raw ICMPv4 socket behaving like the [net.PacketConn]
+// returned by [net.ListenPacket] when using the "ip4:icmp" network: we read
+// and write ICMP messages without the IPv4 header and the caller is responsible
+// for computing the ICMP checksum of the messages it sends.
+type gvisorICMPConn struct {
+	// closeOnce provides "once" semantics for Close.
+	closeOnce sync.Once
+
+	// ep is the raw endpoint.
+	ep tcpip.Endpoint
+
+	// rd allows blocking reads to honour the read deadline.
+	rd *gvisorReadDeadline
+
+	// wq is the endpoint's wait queue.
+	wq *waiter.Queue
+}
+
+var _ net.PacketConn = &gvisorICMPConn{}
+
+// Close implements net.PacketConn
+func (c *gvisorICMPConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.rd.close()
+		c.ep.Close()
+	})
+	return nil
+}
+
+// LocalAddr implements net.PacketConn
+func (c *gvisorICMPConn) LocalAddr() net.Addr {
+	fa, err := c.ep.GetLocalAddress()
+	if err != nil {
+		return nil
+	}
+	return &net.IPAddr{IP: net.IP(fa.Addr.AsSlice())}
+}
+
+// ReadFrom implements net.PacketConn
+func (c *gvisorICMPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	// create wait queue entry that notifies a channel
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.ReadableEvents)
+	c.wq.EventRegister(&waitEntry)
+	defer c.wq.EventUnregister(&waitEntry)
+
+	for {
+		var buf bytes.Buffer
+		res, err := c.ep.Read(&buf, tcpip.ReadOptions{NeedRemoteAddr: true})
+		if _, ok := err.(*tcpip.ErrWouldBlock); ok {
+			if err := c.rd.waitReadable(notifyCh); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return 0, nil, &net.OpError{Op: "read", Net: "ip4:icmp", Err: errors.New(err.String())}
+		}
+
+		// raw IPv4 endpoints return the IPv4 header, which we strip
+		packet := header.IPv4(buf.Bytes())
+		if !packet.IsValid(len(packet)) {
+			continue
+		}
+		count := copy(p, packet.Payload())
+		return count, &net.IPAddr{IP: net.IP(res.RemoteAddr.Addr.AsSlice())}, nil
+	}
+}
+
+// SetDeadline implements net.PacketConn
+func (c *gvisorICMPConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn
+func (c *gvisorICMPConn) SetReadDeadline(t time.Time) error {
+	c.rd.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements net.PacketConn
+func (c *gvisorICMPConn) SetWriteDeadline(t time.Time) error {
+	// writing to a raw endpoint never blocks
+	return nil
+}
+
+// SetTTL sets the TTL of the IPv4 packets we send.
+func (c *gvisorICMPConn) SetTTL(ttl int) error {
+	if err := c.ep.SetSockOptInt(tcpip.IPv4TTLOption, ttl); err != nil {
+		return errors.New(err.String())
+	}
+	return nil
+}
+
+// WriteTo implements net.PacketConn
+func (c *gvisorICMPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	ipAddr, good := addr.(*net.IPAddr)
+	if !good {
+		return 0, syscall.EINVAL
+	}
+	destAddr, good := netip.AddrFromSlice(ipAddr.IP)
+	if !good {
+		return 0, syscall.EINVAL
+	}
+	fa, _ := gvisorConvertToFullAddr(netip.AddrPortFrom(destAddr.Unmap(), 0))
+	count, err := c.ep.Write(bytes.NewReader(p), tcpip.WriteOptions{To: &fa})
+	if err != nil {
+		return 0, &net.OpError{Op: "write", Net: "ip4:icmp", Addr: addr, Err: errors.New(err.String())}
+	}
+	return int(count), nil
+}
+
+// gvisorReadDeadline allows blocking reads from gvisor endpoints to honour
+// a read deadline and to be interrupted when the conn is closed. The zero
+// value is invalid; please, use [newGVisorReadDeadline] to instantiate.
+type gvisorReadDeadline struct {
+	// changed is posted when the read deadline changes.
+	changed chan any
+
+	// closeOnce provides "once" semantics for close.
+	closeOnce sync.Once
+
+	// closed is closed by close.
+	closed chan any
+
+	// deadline is the read deadline.
+	deadline time.Time
+
+	// mu protects deadline.
+	mu sync.Mutex
+}
+
+// newGVisorReadDeadline creates a new [gvisorReadDeadline].
+func newGVisorReadDeadline() *gvisorReadDeadline {
+	return &gvisorReadDeadline{
+		changed:   make(chan any, 1),
+		closeOnce: sync.Once{},
+		closed:    make(chan any),
+		deadline:  time.Time{},
+		mu:        sync.Mutex{},
+	}
+}
+
+// close interrupts pending and future blocking reads.
+func (rd *gvisorReadDeadline) close() {
+	rd.closeOnce.Do(func() {
+		close(rd.closed)
+	})
+}
+
+// set sets the read deadline.
+func (rd *gvisorReadDeadline) set(t time.Time) {
+	rd.mu.Lock()
+	rd.deadline = t
+	rd.mu.Unlock()
+	select {
+	case rd.changed <- true:
+	default:
+	}
+}
+
+// waitReadable blocks until the endpoint is readable, the
+// read deadline expires, or the conn is closed.
+func (rd *gvisorReadDeadline) waitReadable(notifyCh <-chan struct{}) error {
+	for {
+		rd.mu.Lock()
+		deadline := rd.deadline
+		rd.mu.Unlock()
+
+		var (
+			timeoutCh <-chan time.Time
+			timer     *time.Timer
+		)
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeoutCh = timer.C
+		}
+
+		var err error
+		select {
+		case <-rd.closed:
+			err = net.ErrClosed
+		case <-timeoutCh:
+			err = os.ErrDeadlineExceeded
+		case <-rd.changed:
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		case <-notifyCh:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		return err
+	}
+}
+
+// convertToLocalFullAddr is like [gvisorConvertToFullAddr] but additionally
+// binds the address to the NIC owning the given local address, if any, and
+// maps the unspecified address to the empty address, which means "any".
+func (gvs *gvisorStack) convertToLocalFullAddr(
+	endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
+	fa, pn := gvisorConvertToFullAddr(endpoint)
+	if endpoint.Addr().IsUnspecified() {
+		fa.Addr = tcpip.Address{}
+	}
+	if nic, found := gvs.nicByAddress(endpoint.Addr()); found {
+		fa.NIC = nic.id
+	}
+	return fa, pn
 }
 
 // gvisorConvertToFullAddr is a convenience function for converting
-// a [netip.AddrPort] to the kind of addrs used by GVisor.
+// a [netip.AddrPort] to the kind of addrs used by GVisor. The returned
+// address is not bound to any NIC, such that we use the routing table.
 func gvisorConvertToFullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
 	var protoNumber tcpip.NetworkProtocolNumber
 
@@ -270,7 +1142,7 @@ func gvisorConvertToFullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.
 	}
 
 	fa := tcpip.FullAddress{
-		NIC:  1,
+		NIC:  0,
 		Addr: tcpip.AddrFromSlice(endpoint.Addr().AsSlice()),
 		Port: endpoint.Port(),
 	}
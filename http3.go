@@ -0,0 +1,184 @@
+package netem
+
+//
+// HTTP/3 client and server
+//
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// DialQUIC establishes a QUIC connection with the given address, which may
+// contain a domain name, using a new UDP socket created with [UnderlyingNetwork.ListenUDP]
+// that we close when the QUIC connection is closed. We automatically use the
+// stack's [CertificationAuthority] when the config RootCAs field is nil and the
+// hostname in the address when the config ServerName field is empty.
+func (n *Net) DialQUIC(
+	ctx context.Context,
+	address string,
+	tlsConfig *tls.Config,
+	quicConfig *quic.Config,
+) (*quic.Conn, error) {
+	// determine the domain or IP address we're connecting to
+	hostname, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portnum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+
+	// make sure we have IP addresses to try
+	var addresses []string
+	switch v := net.ParseIP(hostname); v {
+	default:
+		addresses = append(addresses, hostname)
+	case nil:
+		addresses, err = n.LookupHost(ctx, hostname)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// fill the TLS config fields we automatically manage
+	tlsConfig = n.newTLSClientConfig(tlsConfig, hostname)
+
+	// try each available address
+	errlist := &ErrDial{}
+	for _, ip := range addresses {
+		endpoint := &net.UDPAddr{IP: net.ParseIP(ip), Port: portnum}
+		qconn, err := n.dialQUIC(ctx, endpoint, tlsConfig, quicConfig)
+		if err != nil {
+			errlist.Errors = append(errlist.Errors, fmt.Errorf("%s: %w", endpoint.String(), err))
+			continue
+		}
+		return qconn, nil
+	}
+
+	return nil, errlist
+}
+
+// dialQUIC dials a QUIC connection with the given endpoint using a new socket.
+func (n *Net) dialQUIC(
+	ctx context.Context,
+	endpoint *net.UDPAddr,
+	tlsConfig *tls.Config,
+	quicConfig *quic.Config,
+) (*quic.Conn, error) {
+	pconn, err := n.Stack.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	transport := &quic.Transport{Conn: pconn}
+	qconn, err := transport.DialEarly(ctx, endpoint, tlsConfig, quicConfig)
+	if err != nil {
+		transport.Close()
+		pconn.Close()
+		return nil, err
+	}
+
+	// the transport and the socket are only used by this connection
+	go func() {
+		<-qconn.Context().Done()
+		transport.Close()
+		pconn.Close()
+	}()
+	return qconn, nil
+}
+
+// NewHTTP3Transport creates a new [*http3.Transport] using an [UnderlyingNetwork].
+//
+// We fill the following fields of the transport:
+//
+// - Dial to call [Net.DialQUIC], which creates a new socket using [stack.ListenUDP];
+//
+// - TLSClientConfig to use the stack's [CertificationAuthority].
+//
+// Remember to call the transport Close method when you are done using it.
+func NewHTTP3Transport(stack HTTPUnderlyingNetwork) *http3.Transport {
+	ns := &Net{stack}
+	return &http3.Transport{
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+			return ns.DialQUIC(ctx, addr, tlsCfg, cfg)
+		},
+		TLSClientConfig: &tls.Config{
+			RootCAs: stack.DefaultCertPool(),
+		},
+	}
+}
+
+// HTTP3Server is an HTTP/3 server. The zero value is invalid,
+// please construct using [NewHTTP3Server].
+type HTTP3Server struct {
+	done   chan struct{}
+	once   sync.Once
+	pconn  UDPLikeConn
+	server *http3.Server
+}
+
+// NewHTTP3Server creates a new [HTTP3Server] instance listening on the given
+// UDP address and serving the given handler. Remember to call [HTTP3Server.Close]
+// when you are done using this server.
+//
+// The tlsConfig argument is OPTIONAL: when nil, we use a certificate for the
+// given IP address generated by the stack's [CertificationAuthority]. When you
+// need a certificate for domain names, use [CertificationAuthority.MustNewServerTLSConfig].
+func NewHTTP3Server(
+	stack UnderlyingNetwork,
+	addr *net.UDPAddr,
+	tlsConfig *tls.Config,
+	handler http.Handler,
+) (*HTTP3Server, error) {
+	if tlsConfig == nil {
+		tlsConfig = stack.MustNewServerTLSConfig(addr.IP.String())
+	}
+
+	// create listening socket
+	pconn, err := stack.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &HTTP3Server{
+		done:  make(chan struct{}),
+		once:  sync.Once{},
+		pconn: pconn,
+		server: &http3.Server{
+			Handler:   handler,
+			TLSConfig: tlsConfig,
+		},
+	}
+
+	// serve in the background
+	go func() {
+		defer close(srv.done)
+		srv.server.Serve(pconn)
+	}()
+
+	return srv, nil
+}
+
+// Addr returns the address where the server is listening.
+func (srv *HTTP3Server) Addr() net.Addr {
+	return srv.pconn.LocalAddr()
+}
+
+// Close shuts down the HTTP/3 server.
+func (srv *HTTP3Server) Close() error {
+	srv.once.Do(func() {
+		srv.server.Close()
+		srv.pconn.Close()
+	})
+	<-srv.done
+	return nil
+}
@@ -0,0 +1,74 @@
+package netem
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestHTTP3(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write(body)
+	})
+	server, err := NewHTTP3Server(topology.Server, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}, nil, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	t.Run("we can perform HTTP/3 round trips", func(t *testing.T) {
+		txp := NewHTTP3Transport(topology.Client)
+		defer txp.Close()
+		for idx := 0; idx < 3; idx++ {
+			req := Must1(http.NewRequest("GET", "https://10.0.0.1/", nil))
+			resp, err := txp.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != 200 || !bytes.Equal(data, body) {
+				t.Fatal("unexpected response", resp.StatusCode, len(data))
+			}
+		}
+	})
+
+	t.Run("DialQUIC uses the stack's CA and the h3 ALPN", func(t *testing.T) {
+		ns := &Net{topology.Client}
+		config := &tls.Config{NextProtos: []string{"h3"}}
+		qconn, err := ns.DialQUIC(context.Background(), "10.0.0.1:443", config, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer qconn.CloseWithError(0, "")
+		<-qconn.HandshakeComplete()
+		if proto := qconn.ConnectionState().TLS.NegotiatedProtocol; proto != "h3" {
+			t.Fatal("unexpected ALPN", proto)
+		}
+	})
+
+	t.Run("DialQUIC fails with an untrusted certificate", func(t *testing.T) {
+		ns := &Net{topology.Client}
+		config := &tls.Config{NextProtos: []string{"h3"}, ServerName: "example.com"}
+		qconn, err := ns.DialQUIC(context.Background(), "10.0.0.1:443", config, nil)
+		if err == nil {
+			qconn.CloseWithError(0, "")
+			t.Fatal("expected an error")
+		}
+	})
+}
@@ -5,6 +5,9 @@ package netem
 //
 
 import (
+	"context"
+	"crypto/tls"
+	"net"
 	"net/http"
 )
 
@@ -21,14 +24,26 @@ type HTTPUnderlyingNetwork interface {
 //
 // - DialContext to call a dialing function that will eventually use [stack.DialContext];
 //
-// - DialTLSContext to use the stack's [MITMConfig];
+// - DialTLSContext to use the stack's [MITMConfig] and to offer the
+// "h2" and "http/1.1" protocols using ALPN;
 //
 // - ForceAttemptHTTP2 to force enabling the HTTP/2 protocol.
+//
+// Note that [CertificationAuthority.MustNewServerTLSConfig] returns a config
+// forcing "http/1.1", so you need to modify the server config NextProtos to
+// also include "h2" if you want the client and the server to use HTTP/2.
 func NewHTTPTransport(stack HTTPUnderlyingNetwork) *http.Transport {
 	ns := &Net{stack}
 	return &http.Transport{
-		DialContext:       ns.DialContext,
-		DialTLSContext:    ns.DialTLSContext,
+		DialContext: ns.DialContext,
+		DialTLSContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return ns.DialTLSContextWithConfig(ctx, network, address, httpClientTLSConfig)
+		},
 		ForceAttemptHTTP2: true,
 	}
 }
+
+// httpClientTLSConfig is the TLS config template used by [NewHTTPTransport].
+var httpClientTLSConfig = &tls.Config{
+	NextProtos: []string{"h2", "http/1.1"},
+}
@@ -7,6 +7,7 @@ package netem_test
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
@@ -14,6 +15,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
@@ -24,6 +26,7 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
+	"github.com/miekg/dns"
 	"github.com/montanaflynn/stats"
 	"github.com/ooni/netem"
 )
@@ -734,6 +737,133 @@ func TestDPITCPThrottleForTCPEndpoint(t *testing.T) {
 	}
 }
 
+// TestDPITCPThrottleBandwidthForTCPEndpoint verifies we can use the DPI
+// to limit the bandwidth of flows regardless of the RTT.
+func TestDPITCPThrottleBandwidthForTCPEndpoint(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip test in short mode")
+	}
+
+	// testcase describes a test case
+	type testcase struct {
+		// name is the name of the test case
+		name string
+
+		// oneWayDelay is the link one-way delay
+		oneWayDelay time.Duration
+	}
+
+	var testcases = []testcase{{
+		name:        "with a short RTT",
+		oneWayDelay: 100 * time.Microsecond,
+	}, {
+		name:        "with a long RTT",
+		oneWayDelay: 20 * time.Millisecond,
+	}}
+
+	// bandwidth is the per-flow bandwidth in Mbit/s
+	const bandwidth = 1
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			// limit the bandwidth of the flows towards the endpoint
+			dpiEngine := netem.NewDPIEngine(log.Log)
+			dpiEngine.AddRule(&netem.DPIThrottleTrafficForTCPEndpoint{
+				Bandwidth:       bandwidth * 1000 * 1000,
+				Logger:          log.Log,
+				ServerIPAddress: "10.0.0.1",
+				ServerPort:      443,
+			})
+			lc := &netem.LinkConfig{
+				DPIEngine:        dpiEngine,
+				LeftToRightDelay: tc.oneWayDelay,
+				RightToLeftDelay: tc.oneWayDelay,
+			}
+
+			// create a point-to-point topology, which consists of a single
+			// [Link] connecting two userspace network stacks.
+			topology := netem.MustNewPPPTopology(
+				"10.0.0.2",
+				"10.0.0.1",
+				log.Log,
+				lc,
+			)
+			defer topology.Close()
+
+			// make sure we have a deadline bound context
+			ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+			defer cancel()
+
+			// add DNS server to resolve the server domain
+			dnsConfig := netem.NewDNSConfig()
+			dnsConfig.AddRecord("ndt0.local", "", "10.0.0.1")
+			dnsServer, err := netem.NewDNSServer(log.Log, topology.Server, "10.0.0.1", dnsConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dnsServer.Close()
+
+			// start an NDT0 server in the background
+			ready, serverErrorCh := make(chan net.Listener, 1), make(chan error, 1)
+			go netem.RunNDT0Server(
+				ctx,
+				topology.Server,
+				net.ParseIP("10.0.0.1"),
+				443,
+				log.Log,
+				ready,
+				serverErrorCh,
+				true,
+				"ndt0.local",
+			)
+
+			// await for the NDT0 server to be listening
+			listener := <-ready
+			defer listener.Close()
+
+			// run NDT0 client in the background and measure speed
+			clientErrorCh := make(chan error, 1)
+			perfch := make(chan *netem.NDT0PerformanceSample)
+			go netem.RunNDT0Client(
+				ctx,
+				topology.Client,
+				net.JoinHostPort("ndt0.local", "443"),
+				log.Log,
+				true,
+				clientErrorCh,
+				perfch,
+			)
+
+			// collect the average speed
+			var avgSpeed float64
+			for p := range perfch {
+				if p.Final {
+					avgSpeed = p.AvgSpeedMbps()
+				}
+			}
+
+			// make sure that neither the client nor the server
+			// reported a fundamental error
+			if err := <-clientErrorCh; err != nil {
+				t.Fatal(err)
+			}
+			if err := <-serverErrorCh; err != nil {
+				t.Fatal(err)
+			}
+
+			t.Log("measured goodput", avgSpeed)
+
+			// make sure the goodput is close to the configured bandwidth
+			if avgSpeed > bandwidth*1.1 {
+				t.Fatal("goodput", avgSpeed, "above the bandwidth", bandwidth)
+			}
+			if avgSpeed < bandwidth*0.25 {
+				t.Fatal("goodput", avgSpeed, "too far below the bandwidth", bandwidth)
+			}
+		})
+	}
+}
+
 // TestDPITCPResetForSNI verifies we can use the DPI to reset TCP
 // connections using specific TLS SNI values.
 func TestDPITCPResetForSNI(t *testing.T) {
@@ -1347,6 +1477,330 @@ func TestDPISpoofDNSResponse(t *testing.T) {
 	}
 }
 
+// TestDPIInjectDNSResponses verifies we can use the DPI to inject several
+// forged DNS responses racing with the legitimate response.
+func TestDPIInjectDNSResponses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip test in short mode")
+	}
+
+	// testcase describes a test case
+	type testcase struct {
+		// name is the name of the test case
+		name string
+
+		// dropQuery indicates whether the DPI should drop the query
+		dropQuery bool
+
+		// queryTypes contains the types of the queries that the client
+		// sends, one after the other, using the same socket
+		queryTypes []uint16
+
+		// expectAddrs contains the addresses we expect to see in the
+		// responses in the order in which they should arrive, where "nodata"
+		// indicates a response without answers (our DNS server does not
+		// support AAAA queries)
+		expectAddrs []string
+	}
+
+	var testcases = []testcase{{
+		name:        "when the DPI lets the legitimate response through",
+		dropQuery:   false,
+		queryTypes:  []uint16{dns.TypeA},
+		expectAddrs: []string{"10.10.34.34", "10.10.34.35", "10.10.34.34", "8.8.8.8"},
+	}, {
+		name:        "when the DPI drops the query",
+		dropQuery:   true,
+		queryTypes:  []uint16{dns.TypeA},
+		expectAddrs: []string{"10.10.34.34", "10.10.34.35", "10.10.34.34"},
+	}, {
+		name:        "when the client retransmits a dropped query",
+		dropQuery:   true,
+		queryTypes:  []uint16{dns.TypeA, dns.TypeA},
+		expectAddrs: []string{"10.10.34.34", "10.10.34.35", "10.10.34.34", "10.10.34.34", "10.10.34.35", "10.10.34.34"},
+	}, {
+		name:        "when the client also sends a query the DPI does not match",
+		dropQuery:   true,
+		queryTypes:  []uint16{dns.TypeA, dns.TypeAAAA},
+		expectAddrs: []string{"10.10.34.34", "10.10.34.35", "10.10.34.34", "nodata"},
+	}}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			// make sure that the offending domain causes DNS injection
+			dpiEngine := netem.NewDPIEngine(log.Log)
+			dpiEngine.AddRule(&netem.DPIInjectDNSResponses{
+				AddressSets: [][]string{{"10.10.34.34"}, {"10.10.34.35"}},
+				Count:       3,
+				Delay:       0,
+				Domains:     []string{".google"},
+				DropQuery:   tc.dropQuery,
+				Interval:    5 * time.Millisecond,
+				Logger:      log.Log,
+				QueryTypes:  []uint16{dns.TypeA},
+				TTLs:        []uint32{60, 300},
+			})
+			clientLinkConfig := &netem.LinkConfig{
+				DPIEngine:        dpiEngine,
+				LeftToRightDelay: 10 * time.Millisecond,
+				RightToLeftDelay: 10 * time.Millisecond,
+			}
+
+			// Create a star topology. We MUST create such a topology because
+			// the rule we're using REQUIRES a router in the path.
+			topology := netem.MustNewStarTopology(log.Log)
+			defer topology.Close()
+
+			// make sure the legitimate response arrives after the forged ones
+			serverLinkConfig := &netem.LinkConfig{
+				LeftToRightDelay: 20 * time.Millisecond,
+				RightToLeftDelay: 20 * time.Millisecond,
+			}
+
+			// create a client and a server stacks
+			clientStack, err := topology.AddHost("10.0.0.2", "10.0.0.1", clientLinkConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			serverStack, err := topology.AddHost("10.0.0.1", "10.0.0.1", serverLinkConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// add DNS server to resolve the domains
+			dnsConfig := netem.NewDNSConfig()
+			dnsConfig.AddRecord("dns.google", "", "8.8.8.8")
+			dnsServer, err := netem.NewDNSServer(log.Log, serverStack, "10.0.0.1", dnsConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dnsServer.Close()
+
+			// send the query using a UDP socket
+			pconn, err := clientStack.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pconn.Close()
+			serverAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 53}
+
+			// send each query and read all its responses until the deadline
+			// expires, where retransmissions reuse the original query
+			queries := map[uint16]*dns.Msg{}
+			var addrs []string
+			for _, qtype := range tc.queryTypes {
+				query := queries[qtype]
+				if query == nil {
+					query = &dns.Msg{}
+					query.SetQuestion("dns.google.", qtype)
+					queries[qtype] = query
+				}
+				if _, err := pconn.WriteTo(netem.Must1(query.Pack()), serverAddr); err != nil {
+					t.Fatal(err)
+				}
+				pconn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+				for {
+					buffer := make([]byte, 1024)
+					count, _, err := pconn.ReadFrom(buffer)
+					if err != nil {
+						break
+					}
+					resp := &dns.Msg{}
+					if err := resp.Unpack(buffer[:count]); err != nil {
+						t.Fatal(err)
+					}
+					if resp.Id != query.Id || len(resp.Answer) > 1 {
+						t.Fatal("unexpected response", resp)
+					}
+					if len(resp.Answer) <= 0 {
+						addrs = append(addrs, "nodata")
+						continue
+					}
+					addrs = append(addrs, resp.Answer[0].(*dns.A).A.String())
+				}
+			}
+
+			t.Log("got", addrs)
+			if diff := cmp.Diff(tc.expectAddrs, addrs); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+// TestDPIDNSOverTCP verifies we can use the DPI to reset, drop, and
+// spoof DNS over TCP queries containing offending names.
+func TestDPIDNSOverTCP(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip test in short mode")
+	}
+
+	// testcase describes a test case
+	type testcase struct {
+		// name is the name of the test case
+		name string
+
+		// newRule creates the DPI rule to use
+		newRule func() netem.DPIRule
+
+		// domain is the domain the client should query for
+		domain string
+
+		// expectErr is the error we expect
+		expectErr error
+
+		// expectTimeout indicates that we expect a timeout
+		expectTimeout bool
+
+		// expectAddrs are the addresses we expect to see
+		expectAddrs []string
+	}
+
+	offending := []string{".example.com"}
+
+	var testcases = []testcase{{
+		name: "when the client is not querying for a blocked domain",
+		newRule: func() netem.DPIRule {
+			return &netem.DPIResetTrafficForDNSOverTCP{Domains: offending, Logger: log.Log}
+		},
+		domain:        "dns.google",
+		expectErr:     nil,
+		expectTimeout: false,
+		expectAddrs:   []string{"8.8.8.8"},
+	}, {
+		name: "when the DPI resets the connection",
+		newRule: func() netem.DPIRule {
+			return &netem.DPIResetTrafficForDNSOverTCP{Domains: offending, Logger: log.Log}
+		},
+		domain:        "www.example.com",
+		expectErr:     syscall.ECONNRESET,
+		expectTimeout: false,
+		expectAddrs:   nil,
+	}, {
+		name: "when the DPI drops the traffic",
+		newRule: func() netem.DPIRule {
+			return &netem.DPIDropTrafficForDNSOverTCP{Domains: offending, Logger: log.Log}
+		},
+		domain:        "www.example.com",
+		expectErr:     nil,
+		expectTimeout: true,
+		expectAddrs:   nil,
+	}, {
+		name: "when the DPI spoofs the response",
+		newRule: func() netem.DPIRule {
+			return &netem.DPISpoofDNSOverTCPResponse{
+				Addresses: []string{"10.10.34.35"},
+				Domains:   offending,
+				Logger:    log.Log,
+			}
+		},
+		domain:        "www.example.com",
+		expectErr:     nil,
+		expectTimeout: false,
+		expectAddrs:   []string{"10.10.34.35"},
+	}}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dpiEngine := netem.NewDPIEngine(log.Log)
+			dpiEngine.AddRule(tc.newRule())
+			clientLinkConfig := &netem.LinkConfig{
+				DPIEngine:        dpiEngine,
+				LeftToRightDelay: 10 * time.Millisecond,
+				RightToLeftDelay: 10 * time.Millisecond,
+			}
+
+			// Create a star topology. We MUST create such a topology because
+			// the rules we're using REQUIRE a router in the path.
+			topology := netem.MustNewStarTopology(log.Log)
+			defer topology.Close()
+
+			// make sure we add delay to the router<->server link because
+			// the DPI rules we're testing rely on a race condition.
+			serverLinkConfig := &netem.LinkConfig{
+				LeftToRightDelay: 10 * time.Millisecond,
+				RightToLeftDelay: 10 * time.Millisecond,
+			}
+
+			// create a client and a server stacks
+			clientStack, err := topology.AddHost("10.0.0.2", "10.0.0.1", clientLinkConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			serverStack, err := topology.AddHost("10.0.0.1", "10.0.0.1", serverLinkConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// run a DNS over TCP server answering a single query
+			dnsConfig := netem.NewDNSConfig()
+			dnsConfig.AddRecord("dns.google", "", "8.8.8.8")
+			dnsConfig.AddRecord("www.example.com", "", "93.184.216.34")
+			listener, err := serverStack.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 53})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				dnsConn := &dns.Conn{Conn: conn}
+				rawQuery, err := dnsConn.ReadMsgHeader(nil)
+				if err != nil {
+					return
+				}
+				rawResponse, err := netem.DNSServerRoundTrip(dnsConfig, rawQuery)
+				if err != nil {
+					return
+				}
+				dnsConn.Write(rawResponse)
+			}()
+
+			// make sure we have a deadline bound context
+			ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+			defer cancel()
+
+			// perform the DNS over TCP round trip
+			conn, err := clientStack.DialContext(ctx, "tcp", "10.0.0.1:53")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+			dnsConn := &dns.Conn{Conn: conn}
+			query := &dns.Msg{}
+			query.SetQuestion(dns.Fqdn(tc.domain), dns.TypeA)
+			var addrs []string
+			err = dnsConn.WriteMsg(query)
+			if err == nil {
+				var resp *dns.Msg
+				if resp, err = dnsConn.ReadMsg(); err == nil {
+					for _, answer := range resp.Answer {
+						if record, ok := answer.(*dns.A); ok {
+							addrs = append(addrs, record.A.String())
+						}
+					}
+				}
+			}
+
+			t.Log("got", addrs, err, "for", tc.domain)
+			var netErr net.Error
+			switch {
+			case tc.expectTimeout && (!errors.As(err, &netErr) || !netErr.Timeout()):
+				t.Fatal("expected a timeout, got", err)
+			case !tc.expectTimeout && !errors.Is(err, tc.expectErr):
+				t.Fatal("expected", tc.expectErr, "got", err)
+			}
+			if diff := cmp.Diff(tc.expectAddrs, addrs); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
 // TestDPITCPDropForSNI verifies we can use the DPI to drop traffic
 // for connections using specific TLS SNIs.
 func TestDPITCPDropForSNI(t *testing.T) {
@@ -1665,6 +2119,479 @@ func TestDPITCPDropForEndpoint(t *testing.T) {
 	}
 }
 
+// TestDPIHTTPRequestRules verifies we can use the DPI to block HTTP
+// requests using the Host header, the method, and the path.
+func TestDPIHTTPRequestRules(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip test in short mode")
+	}
+
+	// testcase describes a test case
+	type testcase struct {
+		// name is the name of the test case
+		name string
+
+		// rule is the rule to use
+		rule netem.DPIRule
+
+		// path is the request path
+		path string
+
+		// expectStatus is the status code we expect or zero
+		expectStatus int
+
+		// expectBody is the body we expect
+		expectBody string
+
+		// expectLocation is the redirect location we expect
+		expectLocation string
+
+		// expectClientErrChecker checks the error
+		expectClientErrChecker func(t *testing.T, err error)
+
+		// expectServerRequests is the number of requests we expect the server to see
+		expectServerRequests int
+	}
+
+	matcher := netem.DPIHTTPRequestMatcher{
+		Host:       "www.example.com",
+		Method:     "GET",
+		PathPrefix: "/blocked",
+	}
+
+	expectNoError := func(t *testing.T, err error) {
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	}
+
+	var testcases = []testcase{{
+		name:                   "when the request does not match",
+		rule:                   &netem.DPIResetTrafficForHTTPRequest{Logger: log.Log, Matcher: matcher},
+		path:                   "/allowed",
+		expectStatus:           200,
+		expectBody:             "Bonsoir, Elliot!",
+		expectClientErrChecker: expectNoError,
+		expectServerRequests:   1,
+	}, {
+		name: "when we drop matching requests",
+		rule: &netem.DPIDropTrafficForHTTPRequest{Logger: log.Log, Matcher: matcher},
+		path: "/blocked/page",
+		expectClientErrChecker: func(t *testing.T, err error) {
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatal("unexpected error", err)
+			}
+		},
+		expectServerRequests: 0,
+	}, {
+		name: "when we reset matching requests",
+		rule: &netem.DPIResetTrafficForHTTPRequest{Logger: log.Log, Matcher: matcher},
+		path: "/blocked/page",
+		expectClientErrChecker: func(t *testing.T, err error) {
+			if !errors.Is(err, syscall.ECONNRESET) {
+				t.Fatal("unexpected error", err)
+			}
+		},
+		expectServerRequests: 0,
+	}, {
+		name: "when we spoof a blockpage",
+		rule: &netem.DPISpoofHTTPResponseForHTTPRequest{
+			HTTPResponse: netem.DPIFormatHTTPResponse([]byte("Blocked!")),
+			Logger:       log.Log,
+			Matcher:      matcher,
+		},
+		path:                   "/blocked/page",
+		expectStatus:           200,
+		expectBody:             "Blocked!",
+		expectClientErrChecker: expectNoError,
+		expectServerRequests:   0,
+	}, {
+		name: "when we spoof a redirect",
+		rule: &netem.DPISpoofHTTPResponseForHTTPRequest{
+			HTTPResponse: netem.DPIFormatHTTPRedirect("http://blocked.example/"),
+			Logger:       log.Log,
+			Matcher:      matcher,
+		},
+		path:                   "/blocked/page",
+		expectStatus:           302,
+		expectLocation:         "http://blocked.example/",
+		expectClientErrChecker: expectNoError,
+		expectServerRequests:   0,
+	}}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dpiEngine := netem.NewDPIEngine(log.Log)
+			dpiEngine.AddRule(tc.rule)
+
+			// Create a star topology. We MUST create such a topology because
+			// the rules we're using REQUIRE a router in the path.
+			topology := netem.MustNewStarTopology(log.Log)
+			defer topology.Close()
+
+			clientStack, err := topology.AddHost("10.0.0.2", "10.0.0.1", &netem.LinkConfig{
+				DPIEngine:        dpiEngine,
+				LeftToRightDelay: 10 * time.Millisecond,
+				RightToLeftDelay: 10 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("Bonsoir, Elliot!"))
+			})
+			server, err := topology.AddHTTPServer("10.0.0.1", &netem.LinkConfig{
+				LeftToRightDelay: 10 * time.Millisecond,
+				RightToLeftDelay: 10 * time.Millisecond,
+			}, map[string]http.Handler{"www.example.com": handler})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, "GET", "http://10.0.0.1"+tc.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "www.example.com"
+			client := &http.Client{
+				Transport: netem.NewHTTPTransport(clientStack),
+				CheckRedirect: func(req *http.Request, via []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+			resp, err := client.Do(req)
+			tc.expectClientErrChecker(t, err)
+			if err == nil {
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != tc.expectStatus {
+					t.Fatal("unexpected status", resp.StatusCode)
+				}
+				if string(body) != tc.expectBody {
+					t.Fatal("unexpected body", string(body))
+				}
+				if location := resp.Header.Get("Location"); location != tc.expectLocation {
+					t.Fatal("unexpected location", location)
+				}
+			}
+
+			// the server should not see blocked requests
+			if count := len(server.Requests()); count != tc.expectServerRequests {
+				t.Fatal("unexpected number of server requests", count)
+			}
+		})
+	}
+}
+
+// TestDPIServerToClientRules verifies we can use the DPI to drop flows
+// based on the server's TLS certificate or on the HTTP response.
+func TestDPIServerToClientRules(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip test in short mode")
+	}
+
+	// testcase describes a test case
+	type testcase struct {
+		// name is the name of the test case
+		name string
+
+		// rule is the rule to use
+		rule netem.DPIRule
+
+		// fetch uses the client stack to fetch from the servers
+		fetch func(ctx context.Context, clientStack *netem.UNetStack) error
+
+		// expectErr indicates whether we expect fetch to fail
+		expectErr bool
+	}
+
+	// handshake performs a TLS handshake with the HTTPS server using the given max version
+	handshake := func(maxVersion uint16) func(ctx context.Context, clientStack *netem.UNetStack) error {
+		return func(ctx context.Context, clientStack *netem.UNetStack) error {
+			ns := &netem.Net{Stack: clientStack}
+			conn, err := ns.DialTLSContextWithConfig(ctx, "tcp", "10.0.0.1:443", &tls.Config{
+				MaxVersion: maxVersion,
+				ServerName: "www.example.com",
+			})
+			if err != nil {
+				return err
+			}
+			conn.Close()
+			return nil
+		}
+	}
+
+	// get fetches a page from the HTTP server
+	get := func(ctx context.Context, clientStack *netem.UNetStack) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://10.0.0.3/", nil)
+		if err != nil {
+			return err
+		}
+		req.Host = "www.example.com"
+		resp, err := (&http.Client{Transport: netem.NewHTTPTransport(clientStack)}).Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+		return err
+	}
+
+	var testcases = []testcase{{
+		name:      "when the TLS 1.2 certificate matches",
+		rule:      &netem.DPIDropTrafficForTLSCertificate{Logger: log.Log, Name: "www.example.com"},
+		fetch:     handshake(tls.VersionTLS12),
+		expectErr: true,
+	}, {
+		name:      "when the TLS 1.2 certificate does not match",
+		rule:      &netem.DPIDropTrafficForTLSCertificate{Logger: log.Log, Name: "www.example.org"},
+		fetch:     handshake(tls.VersionTLS12),
+		expectErr: false,
+	}, {
+		name:      "when the certificate is encrypted by TLS 1.3",
+		rule:      &netem.DPIDropTrafficForTLSCertificate{Logger: log.Log, Name: "www.example.com"},
+		fetch:     handshake(tls.VersionTLS13),
+		expectErr: false,
+	}, {
+		name: "when the HTTP response matches",
+		rule: &netem.DPIDropTrafficForHTTPResponse{
+			Logger:  log.Log,
+			Matcher: netem.DPIHTTPResponseMatcher{BodyRegexp: regexp.MustCompile(`Elliot`)},
+		},
+		fetch:     get,
+		expectErr: true,
+	}, {
+		name: "when the HTTP response does not match",
+		rule: &netem.DPIDropTrafficForHTTPResponse{
+			Logger:  log.Log,
+			Matcher: netem.DPIHTTPResponseMatcher{StatusCode: 404},
+		},
+		fetch:     get,
+		expectErr: false,
+	}}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dpiEngine := netem.NewDPIEngine(log.Log)
+			dpiEngine.AddRule(tc.rule)
+
+			topology := netem.MustNewStarTopology(log.Log)
+			defer topology.Close()
+
+			clientStack, err := topology.AddHost("10.0.0.2", "10.0.0.1", &netem.LinkConfig{
+				DPIEngine:        dpiEngine,
+				LeftToRightDelay: 10 * time.Millisecond,
+				RightToLeftDelay: 10 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("Bonsoir, Elliot!"))
+			})
+			vhosts := map[string]http.Handler{"www.example.com": handler}
+			if _, err := topology.AddHTTPSServer("10.0.0.1", &netem.LinkConfig{}, vhosts); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := topology.AddHTTPServer("10.0.0.3", &netem.LinkConfig{}, vhosts); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			err = tc.fetch(ctx, clientStack)
+			var netErr net.Error
+			switch {
+			case tc.expectErr && (!errors.As(err, &netErr) || !netErr.Timeout()):
+				t.Fatal("expected a timeout, got", err)
+			case !tc.expectErr && err != nil:
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestDPIResidualCensorship verifies that, after a rule matches, we block
+// new flows towards the same endpoint until the residual block expires.
+func TestDPIResidualCensorship(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip test in short mode")
+	}
+
+	const duration = 500 * time.Millisecond
+	dpiEngine := netem.NewDPIEngine(log.Log)
+	dpiEngine.AddRule(&netem.DPIResidualCensorship{
+		Duration: duration,
+		Logger:   log.Log,
+		Reset:    true,
+		Rule: &netem.DPIResetTrafficForHTTPRequest{
+			Logger:  log.Log,
+			Matcher: netem.DPIHTTPRequestMatcher{PathPrefix: "/blocked"},
+		},
+		Tuple: netem.DPIResidualTuple3,
+	})
+
+	// Create a star topology. We MUST create such a topology because
+	// resetting flows REQUIRES a router in the path.
+	topology := netem.MustNewStarTopology(log.Log)
+	defer topology.Close()
+
+	clientStack, err := topology.AddHost("10.0.0.2", "10.0.0.1", &netem.LinkConfig{
+		DPIEngine:        dpiEngine,
+		LeftToRightDelay: 10 * time.Millisecond,
+		RightToLeftDelay: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Bonsoir, Elliot!"))
+	})
+	_, err = topology.AddHTTPServer("10.0.0.1", &netem.LinkConfig{
+		LeftToRightDelay: 10 * time.Millisecond,
+		RightToLeftDelay: 10 * time.Millisecond,
+	}, map[string]http.Handler{"www.example.com": handler})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fetch fetches the given path using a new connection
+	fetch := func(path string) (int, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://10.0.0.1"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "www.example.com"
+		txp := netem.NewHTTPTransport(clientStack)
+		defer txp.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: txp}).Do(req)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, nil
+	}
+
+	// the first request triggers the residual block
+	if _, err := fetch("/blocked"); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// while the block is active, we reset the SYN segment of new flows
+	// that would otherwise succeed, so connecting fails
+	if _, err := fetch("/allowed"); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// once the block expires, these requests succeed again, so we poll
+	// until a request succeeds or we reach a generous deadline
+	deadline := time.Now().Add(10 * duration)
+	for {
+		status, err := fetch("/allowed")
+		if err == nil && status == 200 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the residual block did not expire", status, err)
+		}
+	}
+}
+
+// TestDPIQUICDropForSNI verifies we can use the DPI to drop
+// traffic for QUIC connections using specific SNIs.
+func TestDPIQUICDropForSNI(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip test in short mode")
+	}
+
+	// testcase describes a test case
+	type testcase struct {
+		// name is the name of the test case
+		name string
+
+		// clientSNI is the SNI used by the client
+		clientSNI string
+
+		// offendingSNI is the SNI that would cause dropping
+		offendingSNI string
+
+		// expectErr indicates whether we expect the handshake to fail
+		expectErr bool
+	}
+
+	var testcases = []testcase{{
+		name:         "when the client is using a blocked SNI",
+		clientSNI:    "www.example.com",
+		offendingSNI: "www.example.com",
+		expectErr:    true,
+	}, {
+		name:         "when the client is not using a blocked SNI",
+		clientSNI:    "www.example.org",
+		offendingSNI: "www.example.com",
+		expectErr:    false,
+	}}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Log("checking for SNI based QUIC traffic dropping", tc.name)
+
+			// make sure that the offending SNI causes dropping
+			dpiEngine := netem.NewDPIEngine(log.Log)
+			dpiEngine.AddRule(&netem.DPIDropTrafficForQUICSNI{
+				Logger: log.Log,
+				SNI:    tc.offendingSNI,
+			})
+			lc := &netem.LinkConfig{
+				DPIEngine:        dpiEngine,
+				LeftToRightDelay: 10 * time.Millisecond,
+				RightToLeftDelay: 10 * time.Millisecond,
+			}
+
+			// create a point-to-point topology, which consists of a single
+			// [Link] connecting two userspace network stacks.
+			topology := netem.MustNewPPPTopology(
+				"10.0.0.2",
+				"10.0.0.1",
+				log.Log,
+				lc,
+			)
+			defer topology.Close()
+
+			// start an HTTP/3 server valid for both SNIs
+			tlsConfig := topology.Server.MustNewServerTLSConfig("www.example.com", "www.example.org")
+			addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			server, err := netem.NewHTTP3Server(topology.Server, addr, tlsConfig, handler)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+
+			// make sure we have a deadline bound context
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			// perform the QUIC handshake
+			ns := &netem.Net{Stack: topology.Client}
+			config := &tls.Config{NextProtos: []string{"h3"}, ServerName: tc.clientSNI}
+			qconn, err := ns.DialQUIC(ctx, "10.0.0.1:443", config, nil)
+			if err == nil {
+				qconn.CloseWithError(0, "")
+			}
+
+			t.Log("got", err, "with tc.expectErr=", tc.expectErr)
+			if (err != nil) != tc.expectErr {
+				t.Fatal("unexpected error", err)
+			}
+		})
+	}
+}
+
 // TestDPITCPResetForString verifies we can use the DPI to reset
 // traffic for connections containing specific strings.
 func TestDPITCPResetForString(t *testing.T) {
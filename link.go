@@ -20,6 +20,10 @@ type LinkConfig struct {
 	// DPIEngine is the OPTIONAL [DPIEngine].
 	DPIEngine *DPIEngine
 
+	// LeftToRightBandwidth is the OPTIONAL bandwidth in bit/s in the
+	// left->right direction. See [LinkFwdConfig] for more details.
+	LeftToRightBandwidth int64
+
 	// LeftNICWrapper is the OPTIONAL [LinkNICWrapper] for the left NIC.
 	LeftNICWrapper LinkNICWrapper
 
@@ -32,6 +36,10 @@ type LinkConfig struct {
 	// RightNICWrapper is the OPTIONAL [LinkNICWrapper] for the right NIC.
 	RightNICWrapper LinkNICWrapper
 
+	// RightToLeftBandwidth is the OPTIONAL bandwidth in bit/s in the
+	// right->left direction. See [LinkFwdConfig] for more details.
+	RightToLeftBandwidth int64
+
 	// RightToLeftDelay is the OPTIONAL delay in the right->left direction.
 	RightToLeftDelay time.Duration
 
@@ -100,6 +108,7 @@ func NewLink(logger Logger, left, right NIC, config *LinkConfig) *Link {
 		config.DPIEngine,
 		config.LeftToRightPLR,
 		config.LeftToRightDelay,
+		config.LeftToRightBandwidth,
 	)
 
 	// forward traffic from right to left
@@ -112,6 +121,7 @@ func NewLink(logger Logger, left, right NIC, config *LinkConfig) *Link {
 		config.DPIEngine,
 		config.RightToLeftPLR,
 		config.RightToLeftDelay,
+		config.RightToLeftBandwidth,
 	)
 
 	link := &Link{
@@ -25,6 +25,12 @@ var _ LinkFwdRNG = &rand.Rand{}
 // LinkFwdConfig contains config for frame forwarding algorithms. Make sure
 // you initialize all the fields marked as MANDATORY.
 type LinkFwdConfig struct {
+	// Bandwidth is the OPTIONAL link bandwidth in bit/s. Only [LinkFwdFull]
+	// honours this setting. We accept any value, but [LinkFwdFull] sends at most
+	// one frame every 120µs (i.e., ~100 Mbit/s with 1500-byte frames), so larger
+	// values do not make the link any faster than that.
+	Bandwidth int64
+
 	// DPIEngine is the OPTIONAL DPI engine.
 	DPIEngine *DPIEngine
 
@@ -89,8 +95,10 @@ func linkForwardChooseBest(
 	dpiEngine *DPIEngine,
 	plr float64,
 	oneWayDelay time.Duration,
+	bandwidth int64,
 ) {
 	cfg := &LinkFwdConfig{
+		Bandwidth:     bandwidth,
 		DPIEngine:     dpiEngine,
 		Logger:        logger,
 		NewLinkFwdRNG: nil,
@@ -100,11 +108,11 @@ func linkForwardChooseBest(
 		Writer:        writer,
 		Wg:            wg,
 	}
-	if dpiEngine == nil && plr <= 0 && oneWayDelay <= 0 {
+	if dpiEngine == nil && plr <= 0 && oneWayDelay <= 0 && bandwidth <= 0 {
 		LinkFwdFast(cfg)
 		return
 	}
-	if dpiEngine == nil && plr <= 0 {
+	if dpiEngine == nil && plr <= 0 && bandwidth <= 0 {
 		LinkFwdWithDelay(cfg)
 		return
 	}
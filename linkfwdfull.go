@@ -10,7 +10,7 @@ import (
 )
 
 // LinkFwdFull is a full implementation of link forwarding that
-// deals with delays, packet losses, and DPI.
+// deals with delays, packet losses, bandwidth, and DPI.
 //
 // The kind of half-duplex link modeled by this function will
 // look much more like a shared geographical link than an
@@ -63,7 +63,8 @@ func LinkFwdFull(cfg *LinkFwdConfig) {
 
 	// We assume that we can send 100 bit/µs (i.e., 100 Mbit/s). We also assume
 	// that a packet is 1500 bytes (i.e., 12000 bits). The constant TX rate
-	// is 120µs, and our code wakes up every 120µs to check for I/O.
+	// is 120µs, and our code wakes up every 120µs to check for I/O. When the
+	// config specifies a lower bandwidth, we use it to compute TX deadlines.
 	const bitsPerMicrosecond = 100
 	const constantRate = 120 * time.Microsecond
 
@@ -77,6 +78,9 @@ func LinkFwdFull(cfg *LinkFwdConfig) {
 	// random number generator for jitter and PLR
 	rng := cfg.newLinkgFwdRNG()
 
+	// shaper enforcing the per-flow bandwidth set by the DPI
+	shaper := newLinkFwdShaper()
+
 	for {
 		select {
 		case <-cfg.Reader.StackClosed():
@@ -105,6 +109,9 @@ func LinkFwdFull(cfg *LinkFwdConfig) {
 			// create frame TX deadline accounting for time to send all the
 			// previously queued frames in the outgoing buffer
 			d := time.Now().Add(time.Duration(queuedBytes*8) / bitsPerMicrosecond)
+			if cfg.Bandwidth > 0 {
+				d = time.Now().Add(time.Duration(queuedBytes*8) * time.Second / time.Duration(cfg.Bandwidth))
+			}
 			frame.Deadline = d
 
 			// add to queue and wait for the TX to wakeup
@@ -142,8 +149,18 @@ func LinkFwdFull(cfg *LinkFwdConfig) {
 				if match {
 					frame.Flags |= policy.Flags
 					frame.Spoofed = policy.Spoofed
+					frame.SpoofedDelays = policy.SpoofedDelays
 					framePLR += policy.PLR
 					flowDelay += policy.Delay
+
+					// allow the DPI to limit a flow's bandwidth
+					if policy.Bandwidth > 0 {
+						shaperDelay, ok := shaper.delay(time.Now(), policy, len(frame.Payload))
+						if !ok {
+							frame.Flags |= FrameFlagDrop
+						}
+						flowDelay += shaperDelay
+					}
 				}
 
 				// check whether we need to drop this frame (we will drop it
@@ -17,6 +17,9 @@ func TestLinkFwdFull(t *testing.T) {
 		// name is the name of this test case
 		name string
 
+		// bandwidth is the link bandwidth in bit/s.
+		bandwidth int64
+
 		// delay is the one-way delay to use for forwarding frames.
 		delay time.Duration
 
@@ -59,6 +62,13 @@ func TestLinkFwdFull(t *testing.T) {
 			Payload:  []byte("ghi"),
 		}},
 		expectRuntimeAtLeast: time.Second,
+	}, {
+		name:                 "when we limit the bandwidth",
+		bandwidth:            100000,
+		delay:                0,
+		emit:                 linkFwdFullTestFrames(10, 1250),
+		expect:               linkFwdFullTestFrames(10, 1250),
+		expectRuntimeAtLeast: 800 * time.Millisecond,
 	}}
 
 	for _, tc := range testcases {
@@ -71,6 +81,7 @@ func TestLinkFwdFull(t *testing.T) {
 
 			// create the link configuration
 			cfg := &LinkFwdConfig{
+				Bandwidth:   tc.bandwidth,
 				DPIEngine:   nil,
 				Logger:      &NullLogger{},
 				OneWayDelay: tc.delay,
@@ -124,3 +135,15 @@ func TestLinkFwdFull(t *testing.T) {
 		})
 	}
 }
+
+// linkFwdFullTestFrames returns count frames with distinct payloads of the given size.
+func linkFwdFullTestFrames(count, size int) (frames []*Frame) {
+	for idx := 0; idx < count; idx++ {
+		frames = append(frames, &Frame{
+			Deadline: time.Time{},
+			Flags:    0,
+			Payload:  bytes.Repeat([]byte{byte('a' + idx)}, size),
+		})
+	}
+	return
+}
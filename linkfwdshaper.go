@@ -0,0 +1,70 @@
+package netem
+
+//
+// Link frame forwarding: per-flow shaping
+//
+
+import "time"
+
+// linkFwdShaperMaxBacklog is the maximum number of bytes that a shaped
+// flow may have queued before we start dropping its frames.
+const linkFwdShaperMaxBacklog = 1 << 15
+
+// linkFwdShaperMaxFlows is the number of shaped flows above which we
+// try to forget about the flows whose queue is empty.
+const linkFwdShaperMaxFlows = 1024
+
+// linkFwdShaper shapes the flows whose [DPIPolicy] specifies a bandwidth. Each
+// flow has a virtual drop-tail queue drained at the policy's bandwidth. Because
+// the [DPIEngine] returns the same policy for all the packets in a flow and each
+// link direction has its own forwarding goroutine, using the policy as the key
+// gives us a queue for each flow and direction without any locking.
+//
+// The zero value is invalid; construct using [newLinkFwdShaper].
+type linkFwdShaper struct {
+	// flows maps each flow's policy to the time when its queue becomes empty.
+	flows map[*DPIPolicy]time.Time
+}
+
+// newLinkFwdShaper creates a new [linkFwdShaper] instance.
+func newLinkFwdShaper() *linkFwdShaper {
+	return &linkFwdShaper{
+		flows: map[*DPIPolicy]time.Time{},
+	}
+}
+
+// delay returns the extra delay required to send a frame with the given size
+// belonging to the flow using the given policy without exceeding the policy's
+// bandwidth. The boolean return value is false when the flow's queue is full
+// and we should drop the frame. The policy's bandwidth MUST be positive.
+func (s *linkFwdShaper) delay(now time.Time, policy *DPIPolicy, size int) (time.Duration, bool) {
+	// the frame starts being sent once the previous frames have been sent
+	start := s.flows[policy]
+	if start.Before(now) {
+		start = now
+	}
+
+	// drop the frame when there are too many queued bytes
+	backlog := int64(start.Sub(now)) * policy.Bandwidth / 8 / int64(time.Second)
+	if backlog+int64(size) > linkFwdShaperMaxBacklog {
+		return 0, false
+	}
+
+	// account for the time required to send the frame
+	end := start.Add(time.Duration(size*8) * time.Second / time.Duration(policy.Bandwidth))
+	s.flows[policy] = end
+	s.gc(now)
+	return end.Sub(now), true
+}
+
+// gc forgets about flows whose queue is empty when there are too many flows.
+func (s *linkFwdShaper) gc(now time.Time) {
+	if len(s.flows) <= linkFwdShaperMaxFlows {
+		return
+	}
+	for policy, end := range s.flows {
+		if end.Before(now) {
+			delete(s.flows, policy)
+		}
+	}
+}
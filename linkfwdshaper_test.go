@@ -0,0 +1,67 @@
+package netem
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLinkFwdShaper(t *testing.T) {
+	// with 80 kbit/s sending 1000 bytes takes 100 ms
+	const bandwidth = 80000
+	const size = 1000
+	now := time.Now()
+
+	t.Run("we delay frames according to the bandwidth", func(t *testing.T) {
+		shaper := newLinkFwdShaper()
+		policy := &DPIPolicy{Bandwidth: bandwidth}
+		for idx := 1; idx <= 3; idx++ {
+			delay, ok := shaper.delay(now, policy, size)
+			if !ok {
+				t.Fatal("unexpected drop")
+			}
+			if expect := time.Duration(idx) * 100 * time.Millisecond; delay != expect {
+				t.Fatal("expected", expect, "got", delay)
+			}
+		}
+	})
+
+	t.Run("each flow has its own queue", func(t *testing.T) {
+		shaper := newLinkFwdShaper()
+		first, second := &DPIPolicy{Bandwidth: bandwidth}, &DPIPolicy{Bandwidth: bandwidth}
+		shaper.delay(now, first, size)
+		delay, _ := shaper.delay(now, second, size)
+		if delay != 100*time.Millisecond {
+			t.Fatal("unexpected delay", delay)
+		}
+	})
+
+	t.Run("the queue drains over time", func(t *testing.T) {
+		shaper := newLinkFwdShaper()
+		policy := &DPIPolicy{Bandwidth: bandwidth}
+		shaper.delay(now, policy, size)
+		delay, _ := shaper.delay(now.Add(time.Second), policy, size)
+		if delay != 100*time.Millisecond {
+			t.Fatal("unexpected delay", delay)
+		}
+	})
+
+	t.Run("we drop frames when the queue is full", func(t *testing.T) {
+		shaper := newLinkFwdShaper()
+		policy := &DPIPolicy{Bandwidth: bandwidth}
+		var accepted int
+		for {
+			if _, ok := shaper.delay(now, policy, size); !ok {
+				break
+			}
+			accepted++
+		}
+		if expect := linkFwdShaperMaxBacklog / size; accepted != expect {
+			t.Fatal("expected", expect, "accepted frames, got", accepted)
+		}
+
+		// once some frames have been sent, we accept frames again
+		if _, ok := shaper.delay(now.Add(time.Second), policy, size); !ok {
+			t.Fatal("unexpected drop")
+		}
+	})
+}
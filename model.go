@@ -22,6 +22,12 @@ const (
 	// dropped rather than forwarded, to emulate a loss occurring
 	// on the link while the frame was in flight.
 	FrameFlagDrop
+
+	// FrameFlagSpoofOnly tells the router that it should drop the
+	// frame after sending the spoofed frames, to emulate an on-path
+	// injector that also prevents the packet from reaching its
+	// destination. We honor this flag iff FrameFlagSpoof is set.
+	FrameFlagSpoofOnly
 )
 
 // CertificationAuthority is a TLS certification authority.
@@ -65,15 +71,22 @@ type Frame struct {
 	// spoof when processing this packet. We honor this field iff the
 	// FrameFlagSpoof flag is set in the Flags field.
 	Spoofed [][]byte
+
+	// SpoofedDelays OPTIONALLY contains, for each packet in the
+	// Spoofed field, the delay after which the router should spoof
+	// it. Missing or zero delays cause the router to spoof the
+	// corresponding packet immediately.
+	SpoofedDelays []time.Duration
 }
 
 // NewFrame constructs a [Frame] for the given [Payload].
 func NewFrame(payload []byte) *Frame {
 	return &Frame{
-		Deadline: time.Now(),
-		Flags:    0,
-		Payload:  payload,
-		Spoofed:  nil,
+		Deadline:      time.Now(),
+		Flags:         0,
+		Payload:       payload,
+		Spoofed:       nil,
+		SpoofedDelays: nil,
 	}
 }
 
@@ -81,13 +94,22 @@ func NewFrame(payload []byte) *Frame {
 // us to modify its [Deadline] without data races risks.
 func (f *Frame) ShallowCopy() *Frame {
 	return &Frame{
-		Deadline: f.Deadline,
-		Flags:    f.Flags,
-		Payload:  f.Payload,
-		Spoofed:  f.Spoofed,
+		Deadline:      f.Deadline,
+		Flags:         f.Flags,
+		Payload:       f.Payload,
+		Spoofed:       f.Spoofed,
+		SpoofedDelays: f.SpoofedDelays,
 	}
 }
 
+// spoofedDelay returns the delay for the spoofed packet at the given index.
+func (f *Frame) spoofedDelay(idx int) time.Duration {
+	if idx < len(f.SpoofedDelays) {
+		return f.SpoofedDelays[idx]
+	}
+	return 0
+}
+
 // FrameReader allows one to read incoming frames.
 type FrameReader interface {
 	// FrameAvailable returns a channel that becomes readable
@@ -154,15 +176,11 @@ type NIC interface {
 // required to convince the QUIC library (lucas-clemente/quic-go)
 // to inflate the receive buffer of the connection.
 //
-// The QUIC library will treat this connection as a "dumb"
-// net.PacketConn, calling its ReadFrom and WriteTo methods
-// as opposed to more efficient methods that are available
-// under Linux and (maybe?) FreeBSD.
-//
-// It seems fine to avoid performance optimizations, because
-// they would complicate the implementation on our side and
-// our use cases (blocking and heavy throttling) do not seem
-// to require such optimizations.
+// The [UDPLikeConn] returned by [UNetStack] additionally implements
+// the ReadMsgUDP, WriteMsgUDP, and ReadBatch methods using the Linux
+// control messages format, such that the QUIC library uses the same
+// code paths (ECN, packet info, and segmentation offload) it uses
+// with a Linux [*net.UDPConn]. You need a type assertion to use them.
 //
 // See https://github.com/ooni/probe/issues/1754 for a more
 // comprehensive discussion of UDPLikeConn.
@@ -178,6 +196,70 @@ type UDPLikeConn interface {
 	SyscallConn() (syscall.RawConn, error)
 }
 
+// IPLikeConn is a [net.Conn] exposing the IP-level per-socket options. The
+// TCP and UDP [net.Conn] returned by [UNetStack] implement this interface.
+type IPLikeConn interface {
+	// An IPLikeConn is a net.Conn.
+	net.Conn
+
+	// SetTOS sets the IPv4 type-of-service field of outgoing packets.
+	SetTOS(tos int) error
+
+	// SetTTL sets the IPv4 time-to-live field of outgoing packets.
+	SetTTL(ttl int) error
+}
+
+// TCPLikeConn is an [IPLikeConn] also exposing the TCP per-socket options and
+// the statistics that measurement code typically uses with a [*net.TCPConn]. Only
+// the TCP conns returned by [UNetStack] implement this interface.
+type TCPLikeConn interface {
+	// A TCPLikeConn is an IPLikeConn.
+	IPLikeConn
+
+	// CloseWrite is like [net.TCPConn.CloseWrite].
+	CloseWrite() error
+
+	// SetKeepAlive is like [net.TCPConn.SetKeepAlive].
+	SetKeepAlive(keepalive bool) error
+
+	// SetKeepAlivePeriod is like [net.TCPConn.SetKeepAlivePeriod].
+	SetKeepAlivePeriod(d time.Duration) error
+
+	// SetLinger is like [net.TCPConn.SetLinger].
+	SetLinger(sec int) error
+
+	// SetNoDelay is like [net.TCPConn.SetNoDelay].
+	SetNoDelay(noDelay bool) error
+
+	// TCPInfo returns TCP_INFO-like statistics about the conn.
+	TCPInfo() (*TCPInfo, error)
+}
+
+// TCPInfo contains TCP_INFO-like statistics about a [TCPLikeConn].
+type TCPInfo struct {
+	// RTT is the smoothed round trip time.
+	RTT time.Duration
+
+	// RTTVar is the round trip time variation.
+	RTTVar time.Duration
+
+	// RTO is the retransmission timeout.
+	RTO time.Duration
+
+	// SndCwnd is the congestion window, in packets.
+	SndCwnd uint32
+
+	// SndSsthresh is the slow start threshold, in packets.
+	SndSsthresh uint32
+
+	// Retransmits is the number of retransmitted segments.
+	Retransmits uint64
+
+	// FastRetransmits is the number of segments retransmitted
+	// in fast recovery.
+	FastRetransmits uint64
+}
+
 // UnderlyingNetwork replaces for functions in the [net] package.
 type UnderlyingNetwork interface {
 	// CertificationAuthority allows accessing the certification authority
@@ -203,3 +285,14 @@ type UnderlyingNetwork interface {
 	// works with the github.com/lucas-clemente/quic-go library.
 	ListenUDP(network string, addr *net.UDPAddr) (UDPLikeConn, error)
 }
+
+// ICMPListener is the OPTIONAL interface implemented by an [UnderlyingNetwork]
+// that can create ICMP sockets, which [Net.Ping] requires. We don't include this
+// method into [UnderlyingNetwork] to avoid breaking existing implementations.
+type ICMPListener interface {
+	// ListenICMP creates a new ICMP socket. This function behaves like [net.ListenPacket]
+	// with the "ip4:icmp" network: the returned [net.PacketConn] reads and writes ICMP
+	// messages without the IP header and allows sending ICMP echo requests. Use an
+	// unspecified addr to receive the ICMP messages reaching any local address.
+	ListenICMP(network string, addr *net.IPAddr) (net.PacketConn, error)
+}
@@ -10,7 +10,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -54,6 +56,15 @@ func (e *ErrDial) Is(target error) bool {
 
 // DialContext is a drop-in replacement for [net.Dialer.DialContext].
 func (n *Net) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return n.dialContextWith(ctx, network, address, n.Stack.DialContext)
+}
+
+// netDialFunc is the type of the function dialing a specific endpoint.
+type netDialFunc func(ctx context.Context, network, endpoint string) (net.Conn, error)
+
+// dialContextWith resolves the domain in the address, if needed, and
+// then tries dialing each resolved endpoint using the dial func.
+func (n *Net) dialContextWith(ctx context.Context, network, address string, dial netDialFunc) (net.Conn, error) {
 	// determine the domain or IP address we're connecting to
 	domain, port, err := net.SplitHostPort(address)
 	if err != nil {
@@ -72,11 +83,16 @@ func (n *Net) DialContext(ctx context.Context, network, address string) (net.Con
 		}
 	}
 
+	// honour family-qualified networks (e.g., "tcp4")
+	if addresses = netFilterAddresses(network, addresses); len(addresses) <= 0 {
+		return nil, syscall.EAFNOSUPPORT
+	}
+
 	// try each available address
 	errlist := &ErrDial{}
 	for _, ip := range addresses {
 		endpoint := net.JoinHostPort(ip, port)
-		conn, err := n.Stack.DialContext(ctx, network, endpoint)
+		conn, err := dial(ctx, network, endpoint)
 		if err != nil {
 			errlist.Errors = append(errlist.Errors, fmt.Errorf("%s: %w", endpoint, err))
 			continue
@@ -87,8 +103,40 @@ func (n *Net) DialContext(ctx context.Context, network, address string) (net.Con
 	return nil, errlist
 }
 
+// netFilterAddresses only keeps the addresses belonging to the family
+// of the given network, when the network is family-qualified.
+func netFilterAddresses(network string, addresses []string) []string {
+	var want func(addr netip.Addr) bool
+	switch {
+	case strings.HasSuffix(network, "4"):
+		want = netip.Addr.Is4
+	case strings.HasSuffix(network, "6"):
+		want = netip.Addr.Is6
+	default:
+		return addresses
+	}
+	var out []string
+	for _, address := range addresses {
+		if addr, err := netip.ParseAddr(address); err == nil && want(addr.Unmap()) {
+			out = append(out, address)
+		}
+	}
+	return out
+}
+
 // DialTLSContext is like [Net.DialContext] but also performs a TLS handshake.
 func (n *Net) DialTLSContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return n.DialTLSContextWithConfig(ctx, network, address, nil)
+}
+
+// DialTLSContextWithConfig is like [Net.DialTLSContext] but uses the given
+// config as a template for the TLS handshake, which allows, e.g., to configure
+// the ALPN, the TLS versions, the cipher suites, and the session cache. We clone
+// the config and fill the RootCAs field with the stack's [CertificationAuthority]
+// when it is nil and the ServerName field with the hostname in the address when it
+// is empty. A nil config is equivalent to using an empty config.
+func (n *Net) DialTLSContextWithConfig(
+	ctx context.Context, network, address string, config *tls.Config) (net.Conn, error) {
 	hostname, _, err := net.SplitHostPort(address)
 	if err != nil {
 		return nil, err
@@ -97,12 +145,7 @@ func (n *Net) DialTLSContext(ctx context.Context, network, address string) (net.
 	if err != nil {
 		return nil, err
 	}
-	config := &tls.Config{
-		RootCAs:    n.Stack.DefaultCertPool(),
-		NextProtos: nil, // TODO(bassosimone): automatically generate the right ALPN
-		ServerName: hostname,
-	}
-	tc := tls.Client(conn, config)
+	tc := tls.Client(conn, n.newTLSClientConfig(config, hostname))
 	if err := n.tlsHandshake(ctx, tc); err != nil {
 		conn.Close() // closing the conn here unblocks the background goroutine
 		return nil, err
@@ -110,6 +153,22 @@ func (n *Net) DialTLSContext(ctx context.Context, network, address string) (net.
 	return tc, nil
 }
 
+// newTLSClientConfig returns a copy of the config where we have filled
+// the RootCAs and ServerName fields, if they were not already set.
+func (n *Net) newTLSClientConfig(config *tls.Config, hostname string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	if config.RootCAs == nil {
+		config.RootCAs = n.Stack.DefaultCertPool()
+	}
+	if config.ServerName == "" {
+		config.ServerName = hostname
+	}
+	return config
+}
+
 // tlsHandshake ensures we honour the context's deadline and cancellation
 func (n *Net) tlsHandshake(ctx context.Context, tc *tls.Conn) error {
 	if deadline, ok := ctx.Deadline(); ok {
@@ -140,11 +199,98 @@ func (n *Net) LookupCNAME(ctx context.Context, domain string) (string, error) {
 	return cname, err
 }
 
+// Listen is a drop-in replacement for [net.Listen]. The network MUST be one
+// of "tcp", "tcp4", and "tcp6". Like [net.Listen], an empty host means listening
+// on all the local addresses and a zero port means using a random port.
+func (n *Net) Listen(network, address string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		ip, port, err := n.resolveListenAddress(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return n.ListenTCP(network, &net.TCPAddr{IP: ip, Port: port})
+	default:
+		return nil, syscall.EPROTOTYPE
+	}
+}
+
+// ListenPacket is a drop-in replacement for [net.ListenPacket]. The network
+// MUST be one of "udp", "udp4", "udp6", and "ip4:icmp". Like [net.ListenPacket],
+// an empty host means listening on all the local addresses and a zero port
+// means using a random port.
+func (n *Net) ListenPacket(network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+		ip, port, err := n.resolveListenAddress(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return n.ListenUDP(network, &net.UDPAddr{IP: ip, Port: port})
+	case "ip4:icmp":
+		// like [net.ListenPacket], the address does not contain a port
+		ip, err := n.resolveListenHost(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return n.ListenICMP(network, &net.IPAddr{IP: ip})
+	default:
+		return nil, syscall.EPROTOTYPE
+	}
+}
+
+// resolveListenAddress parses the "host:port" address to listen on.
+func (n *Net) resolveListenAddress(network, address string) (net.IP, int, error) {
+	host, service, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := net.LookupPort(network, service)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip, err := n.resolveListenHost(network, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ip, port, nil
+}
+
+// resolveListenHost resolves the host to listen on, where an empty host
+// means all the local addresses and a domain is resolved using the stack.
+func (n *Net) resolveListenHost(network, host string) (net.IP, error) {
+	if host == "" {
+		return nil, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	addresses, err := n.LookupHost(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	addresses = netFilterAddresses(network, addresses)
+	if len(addresses) <= 0 {
+		return nil, syscall.EADDRNOTAVAIL
+	}
+	return net.ParseIP(addresses[0]), nil
+}
+
 // ListenTCP is a drop-in replacement for [net.ListenTCP].
 func (n *Net) ListenTCP(network string, addr *net.TCPAddr) (net.Listener, error) {
 	return n.Stack.ListenTCP(network, addr)
 }
 
+// ListenICMP is a replacement for [net.ListenPacket] with the "ip4:icmp" network,
+// which fails with [syscall.EPROTONOSUPPORT] unless the Stack is an [ICMPListener].
+func (n *Net) ListenICMP(network string, addr *net.IPAddr) (net.PacketConn, error) {
+	listener, good := n.Stack.(ICMPListener)
+	if !good {
+		return nil, syscall.EPROTONOSUPPORT
+	}
+	return listener.ListenICMP(network, addr)
+}
+
 // ListenUDP is a drop-in replacement for [net.ListenUDP].
 func (n *Net) ListenUDP(network string, addr *net.UDPAddr) (UDPLikeConn, error) {
 	return n.Stack.ListenUDP(network, addr)
@@ -0,0 +1,223 @@
+package netem
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+)
+
+func TestNetListen(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+	clientNet := &Net{topology.Client}
+	serverNet := &Net{topology.Server}
+
+	t.Run("we can use family-qualified TCP networks", func(t *testing.T) {
+		for _, network := range []string{"tcp", "tcp4"} {
+			t.Run(network, func(t *testing.T) {
+				// note: use a distinct port for each network because the
+				// previous connection may still be in TIME_WAIT
+				port := map[string]string{"tcp": "80", "tcp4": "8080"}[network]
+				listener, err := serverNet.Listen(network, net.JoinHostPort("", port))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer listener.Close()
+				go func() {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					conn.Close()
+				}()
+
+				conn, err := clientNet.DialContext(context.Background(), network, net.JoinHostPort("10.0.0.1", port))
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.Close()
+			})
+		}
+	})
+
+	t.Run("we can use family-qualified UDP networks", func(t *testing.T) {
+		for _, network := range []string{"udp", "udp4"} {
+			t.Run(network, func(t *testing.T) {
+				pconn, err := serverNet.ListenPacket(network, "10.0.0.1:53")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer pconn.Close()
+				if got := pconn.LocalAddr().String(); got != "10.0.0.1:53" {
+					t.Fatal("unexpected local address", got)
+				}
+
+				conn, err := clientNet.DialContext(context.Background(), network, "10.0.0.1:53")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				Must1(conn.Write([]byte("antani")))
+
+				buffer := make([]byte, 128)
+				count, addr, err := pconn.ReadFrom(buffer)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(buffer[:count]) != "antani" || addr.String() != conn.LocalAddr().String() {
+					t.Fatal("unexpected datagram", string(buffer[:count]), addr)
+				}
+			})
+		}
+	})
+
+	t.Run("we can listen for ICMP messages", func(t *testing.T) {
+		pconn, err := serverNet.ListenPacket("ip4:icmp", "10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pconn.Close()
+	})
+
+	t.Run("we cannot dial IPv4 addresses using IPv6 networks", func(t *testing.T) {
+		for _, network := range []string{"tcp6", "udp6"} {
+			_, err := clientNet.DialContext(context.Background(), network, "10.0.0.1:80")
+			if !errors.Is(err, syscall.EAFNOSUPPORT) {
+				t.Fatal("unexpected error", err)
+			}
+		}
+	})
+
+	t.Run("we cannot listen on IPv4 addresses using IPv6 networks", func(t *testing.T) {
+		_, err := serverNet.Listen("tcp6", "10.0.0.1:80")
+		if !errors.Is(err, syscall.EAFNOSUPPORT) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("we reject unsupported networks", func(t *testing.T) {
+		if _, err := serverNet.Listen("udp", ":53"); !errors.Is(err, syscall.EPROTOTYPE) {
+			t.Fatal("unexpected error", err)
+		}
+		if _, err := serverNet.ListenPacket("tcp", ":80"); !errors.Is(err, syscall.EPROTOTYPE) {
+			t.Fatal("unexpected error", err)
+		}
+		if _, err := serverNet.ListenTCP("udp4", nil); !errors.Is(err, syscall.EPROTOTYPE) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("a nil address means a random port", func(t *testing.T) {
+		listener, err := serverNet.ListenTCP("tcp4", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		if listener.Addr().(*net.TCPAddr).Port == 0 {
+			t.Fatal("expected a random port")
+		}
+	})
+}
+
+func TestNetDialTLSContextWithConfig(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+	clientNet := &Net{topology.Client}
+
+	serverConfig := topology.Server.MustNewServerTLSConfig("example.local", "10.0.0.1")
+	serverConfig.NextProtos = []string{"h2", "http/1.1"}
+	listener, err := (&Net{topology.Server}).ListenTLS("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		listener.Close()
+	}()
+	go func() {
+		for {
+			// note: Accept fails when the TLS handshake fails
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-done:
+					return
+				default:
+					continue
+				}
+			}
+			conn.Close()
+		}
+	}()
+
+	t.Run("we honour the config template", func(t *testing.T) {
+		config := &tls.Config{
+			NextProtos: []string{"http/1.1"},
+			MaxVersion: tls.VersionTLS12,
+		}
+		conn, err := clientNet.DialTLSContextWithConfig(context.Background(), "tcp", "10.0.0.1:443", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		state := conn.(*tls.Conn).ConnectionState()
+		if state.NegotiatedProtocol != "http/1.1" || state.Version != tls.VersionTLS12 {
+			t.Fatal("unexpected connection state", state.NegotiatedProtocol, state.Version)
+		}
+		if config.RootCAs != nil || config.ServerName != "" {
+			t.Fatal("we should not modify the config template")
+		}
+	})
+
+	t.Run("we verify the certificate unless told otherwise", func(t *testing.T) {
+		config := &tls.Config{ServerName: "www.example.com"}
+		conn, err := clientNet.DialTLSContextWithConfig(context.Background(), "tcp", "10.0.0.1:443", config)
+		if err == nil {
+			conn.Close()
+			t.Fatal("expected an error")
+		}
+		config.InsecureSkipVerify = true
+		conn, err = clientNet.DialTLSContextWithConfig(context.Background(), "tcp", "10.0.0.1:443", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	})
+}
+
+func TestNewHTTPTransportNegotiatesHTTP2(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+
+	listener, err := topology.Server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// note: the default server config forces http/1.1
+	serverConfig := topology.Server.MustNewServerTLSConfig("10.0.0.1")
+	serverConfig.NextProtos = []string{"h2", "http/1.1"}
+	server := &http.Server{
+		TLSConfig: serverConfig,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	txp := NewHTTPTransport(topology.Client)
+	defer txp.CloseIdleConnections()
+	resp, err := txp.RoundTrip(Must1(http.NewRequest("GET", "https://10.0.0.1/", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatal("unexpected protocol", resp.Proto)
+	}
+}
@@ -0,0 +1,316 @@
+package netem
+
+//
+// ICMP echo (ping)
+//
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PingConfig contains config for [Net.Ping]. The zero value is valid and
+// causes [Net.Ping] to send a single echo request with default settings.
+type PingConfig struct {
+	// Count is the OPTIONAL number of echo requests to send. If zero
+	// or negative, we send a single echo request.
+	Count int
+
+	// Interval is the OPTIONAL interval between sending successive
+	// echo requests. If zero or negative, we use one second.
+	Interval time.Duration
+
+	// Payload is the OPTIONAL payload of the echo requests. If nil, we
+	// generate a payload containing Size bytes.
+	Payload []byte
+
+	// Size is the OPTIONAL size of the generated payload. If zero
+	// or negative, we use 56 bytes like ping(8) does.
+	Size int
+
+	// Timeout is the OPTIONAL maximum time to wait for each reply. If
+	// zero or negative, we wait for one second.
+	Timeout time.Duration
+
+	// TTL is the OPTIONAL TTL of the echo requests. If zero or
+	// negative, we use the stack's default TTL.
+	TTL int
+}
+
+// PingReply is the result of sending an ICMP echo request.
+type PingReply struct {
+	// Seq is the sequence number of the echo request.
+	Seq int
+
+	// Source is the IP address that sent the reply or the ICMP error.
+	Source string
+
+	// Size is the size of the reply payload.
+	Size int
+
+	// RTT is the time elapsed between sending the echo request
+	// and receiving the reply or the ICMP error.
+	RTT time.Duration
+
+	// Err is nil on success. Otherwise, it is [ErrPingTimeout] if we
+	// did not receive any reply or an [*ICMPError] if we received an
+	// ICMP error in response to our echo request.
+	Err error
+}
+
+// ErrPingTimeout indicates that an ICMP echo request timed out.
+var ErrPingTimeout = errors.New("netem: ping: request timed out")
+
+// ICMPError is an ICMP error received in response to an echo request.
+type ICMPError struct {
+	// Type is the ICMP type (e.g., 3 for destination unreachable).
+	Type uint8
+
+	// Code is the ICMP code.
+	Code uint8
+
+	// Source is the IP address that sent the ICMP error.
+	Source string
+}
+
+var _ error = &ICMPError{}
+
+// Error implements error.
+func (e *ICMPError) Error() string {
+	typeCode := layers.CreateICMPv4TypeCode(e.Type, e.Code)
+	return fmt.Sprintf("netem: ping: %s from %s", typeCode.String(), e.Source)
+}
+
+// pingDefaultPayloadSize is the default payload size used by [Net.Ping].
+const pingDefaultPayloadSize = 56
+
+// Ping sends ICMP echo requests to the given IPv4 address using a socket
+// created with [ICMPListener.ListenICMP] and returns one [PingReply] for
+// each request we sent, in the order in which we sent them. This function only
+// returns an error when it cannot send echo requests or when the context is
+// done; the errors of each echo request are inside the [PingReply] Err field.
+// A nil config is equivalent to using the zero value [PingConfig].
+func (n *Net) Ping(ctx context.Context, address string, config *PingConfig) ([]*PingReply, error) {
+	if config == nil {
+		config = &PingConfig{}
+	}
+
+	// parse the destination address
+	destAddr, err := netip.ParseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	if !destAddr.Is4() {
+		return nil, syscall.EAFNOSUPPORT
+	}
+
+	// create the ICMP socket
+	pconn, err := n.ListenICMP("ip4:icmp", &net.IPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	defer pconn.Close()
+
+	// configure the TTL if needed
+	if config.TTL > 0 {
+		ttlSetter, good := pconn.(interface{ SetTTL(ttl int) error })
+		if !good {
+			return nil, syscall.ENOPROTOOPT
+		}
+		if err := ttlSetter.SetTTL(config.TTL); err != nil {
+			return nil, err
+		}
+	}
+
+	// make sure a done context interrupts reading
+	stop := context.AfterFunc(ctx, func() {
+		pconn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	p := &pinger{
+		config: config,
+		dest:   &net.IPAddr{IP: net.IP(destAddr.AsSlice())},
+		id:     uint16(rand.Uint32()),
+		pconn:  pconn,
+	}
+	return p.run(ctx)
+}
+
+// pinger sends echo requests using a [Net.Ping] socket.
+type pinger struct {
+	// config is the ping config.
+	config *PingConfig
+
+	// dest is the destination address.
+	dest *net.IPAddr
+
+	// id is the echo requests identifier.
+	id uint16
+
+	// pconn is the ICMP socket.
+	pconn net.PacketConn
+}
+
+// run sends all the echo requests and collects the replies.
+func (p *pinger) run(ctx context.Context) ([]*PingReply, error) {
+	count := max(p.config.Count, 1)
+	interval := p.config.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	replies := []*PingReply{}
+	for seq := 1; seq <= count; seq++ {
+		t0 := time.Now()
+		reply, err := p.once(ctx, seq)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply)
+
+		// wait for the next request if needed
+		if seq < count {
+			timer := time.NewTimer(time.Until(t0.Add(interval)))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
+		}
+	}
+	return replies, nil
+}
+
+// once sends a single echo request and waits for the corresponding reply.
+func (p *pinger) once(ctx context.Context, seq int) (*PingReply, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	payload := p.config.Payload
+	if payload == nil {
+		size := p.config.Size
+		if size <= 0 {
+			size = pingDefaultPayloadSize
+		}
+		payload = make([]byte, size)
+		for idx := range payload {
+			payload[idx] = byte(idx)
+		}
+	}
+
+	// serialize the echo request
+	request := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0),
+		Id:       p.id,
+		Seq:      uint16(seq),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, request, gopacket.Payload(payload)); err != nil {
+		return nil, err
+	}
+
+	// send the echo request
+	timeout := p.config.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	t0 := time.Now()
+	if _, err := p.pconn.WriteTo(buf.Bytes(), p.dest); err != nil {
+		return nil, err
+	}
+	p.pconn.SetReadDeadline(t0.Add(timeout))
+
+	// wait for the reply or an ICMP error
+	reply := &PingReply{Seq: seq}
+	buffer := make([]byte, 1<<16)
+	for {
+		count, addr, err := p.pconn.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if pingIsTimeout(err) {
+				reply.RTT = time.Since(t0)
+				reply.Err = ErrPingTimeout
+				return reply, nil
+			}
+			return nil, err
+		}
+		if p.handleMessage(buffer[:count], addr, seq, reply) {
+			reply.RTT = time.Since(t0)
+			return reply, nil
+		}
+	}
+}
+
+// pingIsTimeout returns whether the error is a [net.Error] timeout.
+func pingIsTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// handleMessage processes an ICMP message and returns true if the message
+// is the reply to, or an ICMP error caused by, the given echo request.
+func (p *pinger) handleMessage(message []byte, addr net.Addr, seq int, reply *PingReply) bool {
+	packet := gopacket.NewPacket(message, layers.LayerTypeICMPv4, gopacket.Default)
+	icmpLayer, good := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if !good {
+		return false
+	}
+
+	switch icmpLayer.TypeCode.Type() {
+	case layers.ICMPv4TypeEchoReply:
+		if icmpLayer.Id != p.id || icmpLayer.Seq != uint16(seq) {
+			return false
+		}
+		reply.Source = addr.String()
+		reply.Size = len(icmpLayer.Payload)
+		return true
+
+	case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeTimeExceeded:
+		if !pingIsQuotedEchoRequest(icmpLayer.Payload, p.id, uint16(seq)) {
+			return false
+		}
+		reply.Source = addr.String()
+		reply.Err = &ICMPError{
+			Type:   icmpLayer.TypeCode.Type(),
+			Code:   icmpLayer.TypeCode.Code(),
+			Source: addr.String(),
+		}
+		return true
+
+	default:
+		return false
+	}
+}
+
+// pingIsQuotedEchoRequest returns whether the body of an ICMP error, which
+// contains the IPv4 header and the first 8 bytes of the original datagram,
+// quotes the echo request having the given identifier and sequence number.
+func pingIsQuotedEchoRequest(body []byte, id, seq uint16) bool {
+	if len(body) < 1 {
+		return false
+	}
+	headerLength := int(body[0]&0x0f) * 4
+	if len(body) < headerLength+8 {
+		return false
+	}
+	quoted := body[headerLength:]
+	return quoted[0] == layers.ICMPv4TypeEchoRequest &&
+		binary.BigEndian.Uint16(quoted[4:6]) == id &&
+		binary.BigEndian.Uint16(quoted[6:8]) == seq
+}
@@ -0,0 +1,188 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestPing(t *testing.T) {
+	t.Run("we receive replies from a reachable host", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+
+		config := &PingConfig{
+			Count:    3,
+			Interval: 10 * time.Millisecond,
+			Size:     100,
+			TTL:      4,
+		}
+		replies, err := topology.Client.Ping(context.Background(), "10.0.0.1", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(replies) != 3 {
+			t.Fatal("unexpected number of replies", len(replies))
+		}
+		for idx, reply := range replies {
+			if reply.Err != nil {
+				t.Fatal(reply.Err)
+			}
+			if reply.Seq != idx+1 {
+				t.Fatal("unexpected seq", reply.Seq)
+			}
+			if reply.Source != "10.0.0.1" {
+				t.Fatal("unexpected source", reply.Source)
+			}
+			if reply.Size != 100 {
+				t.Fatal("unexpected size", reply.Size)
+			}
+			if reply.RTT <= 0 {
+				t.Fatal("unexpected RTT", reply.RTT)
+			}
+		}
+	})
+
+	t.Run("the RTT depends on the link delay", func(t *testing.T) {
+		lc := &LinkConfig{LeftToRightDelay: 50 * time.Millisecond}
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, lc)
+		defer topology.Close()
+
+		replies, err := topology.Client.Ping(context.Background(), "10.0.0.1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if replies[0].Err != nil {
+			t.Fatal(replies[0].Err)
+		}
+		if replies[0].RTT < 50*time.Millisecond {
+			t.Fatal("unexpected RTT", replies[0].RTT)
+		}
+	})
+
+	t.Run("we can ping through a router", func(t *testing.T) {
+		topology := MustNewStarTopology(&NullLogger{})
+		defer topology.Close()
+		client := Must1(topology.AddHost("10.0.0.2", "0.0.0.0", &LinkConfig{}))
+		Must1(topology.AddHost("10.0.0.1", "0.0.0.0", &LinkConfig{}))
+
+		replies, err := client.Ping(context.Background(), "10.0.0.1", &PingConfig{Timeout: 100 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if replies[0].Err != nil {
+			t.Fatal(replies[0].Err)
+		}
+
+	})
+
+	t.Run("the router reports when the TTL expires", func(t *testing.T) {
+		topology := MustNewStarTopology(&NullLogger{})
+		defer topology.Close()
+		client := Must1(topology.AddHost("10.0.0.2", "0.0.0.0", &LinkConfig{}))
+		Must1(topology.AddHost("10.0.0.1", "0.0.0.0", &LinkConfig{}))
+
+		config := &PingConfig{Timeout: time.Second, TTL: 1}
+		replies, err := client.Ping(context.Background(), "10.0.0.1", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var icmpErr *ICMPError
+		if !errors.As(replies[0].Err, &icmpErr) {
+			t.Fatal("unexpected error", replies[0].Err)
+		}
+		if icmpErr.Type != layers.ICMPv4TypeTimeExceeded || icmpErr.Source != RouterIPAddress {
+			t.Fatal("unexpected ICMP error", icmpErr)
+		}
+	})
+
+	t.Run("DPI can block ICMP traffic", func(t *testing.T) {
+		dpi := NewDPIEngine(&NullLogger{})
+		dpi.AddRule(&DPIDropTrafficForServerEndpoint{
+			Logger:          &NullLogger{},
+			ServerIPAddress: "10.0.0.1",
+			ServerPort:      0,
+			ServerProtocol:  layers.IPProtocolICMPv4,
+		})
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{DPIEngine: dpi})
+		defer topology.Close()
+
+		replies, err := topology.Client.Ping(context.Background(), "10.0.0.1", &PingConfig{Timeout: 100 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !errors.Is(replies[0].Err, ErrPingTimeout) {
+			t.Fatal("unexpected error", replies[0].Err)
+		}
+	})
+
+	t.Run("we need a stack that can create ICMP sockets", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+
+		// embedding the interface hides the ListenICMP method
+		ns := &Net{struct{ UnderlyingNetwork }{topology.Client}}
+		replies, err := ns.Ping(context.Background(), "10.0.0.1", nil)
+		if !errors.Is(err, syscall.EPROTONOSUPPORT) {
+			t.Fatal("unexpected error", err)
+		}
+		if len(replies) != 0 {
+			t.Fatal("expected no replies")
+		}
+	})
+
+	t.Run("a done context interrupts ping", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		replies, err := topology.Client.Ping(ctx, "10.0.0.1", &PingConfig{Count: 10})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("unexpected error", err)
+		}
+		if len(replies) != 0 {
+			t.Fatal("expected no replies")
+		}
+	})
+
+	t.Run("we report ICMP errors quoting our echo request", func(t *testing.T) {
+		p := &pinger{id: 0x1234}
+		body := []byte{
+			// IPv4 header (20 bytes)
+			0x45, 0x00, 0x00, 0x54, 0x00, 0x00, 0x40, 0x00, 0x01, 0x01, 0x00, 0x00,
+			10, 0, 0, 2, 10, 0, 0, 1,
+			// first 8 bytes of the echo request
+			0x08, 0x00, 0x00, 0x00, 0x12, 0x34, 0x00, 0x07,
+		}
+		message := append([]byte{0x0b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, body...)
+		reply := &PingReply{Seq: 7}
+		addr := &net.IPAddr{IP: net.IPv4(10, 0, 0, 254)}
+		if !p.handleMessage(message, addr, 7, reply) {
+			t.Fatal("expected the message to match")
+		}
+		var icmpErr *ICMPError
+		if !errors.As(reply.Err, &icmpErr) {
+			t.Fatal("unexpected error", reply.Err)
+		}
+		if icmpErr.Type != layers.ICMPv4TypeTimeExceeded || icmpErr.Source != "10.0.0.254" {
+			t.Fatal("unexpected ICMP error", icmpErr)
+		}
+		if p.handleMessage(message, addr, 8, &PingReply{Seq: 8}) {
+			t.Fatal("expected the message to not match")
+		}
+	})
+
+	t.Run("we fail with an IPv6 address", func(t *testing.T) {
+		topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+		defer topology.Close()
+		if _, err := topology.Client.Ping(context.Background(), "::1", nil); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
@@ -0,0 +1,299 @@
+package netem
+
+//
+// Port forwarding between the host network and an emulated network
+//
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// PortForwarder forwards TCP connections or UDP datagrams received on a
+// listening address to a target address. Use [NewHostToEmulatedForwarder]
+// to expose an emulated server on the host network and
+// [NewEmulatedToHostForwarder] to allow emulated hosts to reach a
+// service running on the host network.
+type PortForwarder struct {
+	// addr is the listening address.
+	addr net.Addr
+
+	// closeOnce ensures we close just once.
+	closeOnce sync.Once
+
+	// closed indicates whether we have been closed.
+	closed bool
+
+	// closers contains the conns and sockets we should close on Close.
+	closers map[io.Closer]bool
+
+	// dial dials connections to the target.
+	dial netDialFunc
+
+	// logger is the logger to use.
+	logger Logger
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// network is the network we're forwarding.
+	network string
+
+	// target is the target address.
+	target string
+}
+
+// portForwarderDialTimeout is the maximum time for connecting to the target.
+const portForwarderDialTimeout = 30 * time.Second
+
+// portForwarderUDPIdleTimeout is the time after which we forget about
+// a UDP client that did not send or receive any datagram.
+const portForwarderUDPIdleTimeout = 60 * time.Second
+
+// NewHostToEmulatedForwarder creates a new [PortForwarder] listening on the given
+// address of the host network (e.g., "127.0.0.1:8443") and forwarding to the given
+// address (e.g., "10.0.0.1:443") using the emulated stack. The network MUST be
+// either "tcp" or "udp". This allows inspecting emulated servers using real tools.
+func NewHostToEmulatedForwarder(
+	logger Logger,
+	stack UnderlyingNetwork,
+	network string,
+	hostAddress string,
+	emulatedAddress string,
+) (*PortForwarder, error) {
+	emulated := &Net{stack}
+	return newPortForwarder(
+		logger,
+		network,
+		hostAddress,
+		emulatedAddress,
+		net.Listen,
+		net.ListenPacket,
+		emulated.DialContext,
+	)
+}
+
+// NewEmulatedToHostForwarder creates a new [PortForwarder] listening on the given
+// address of the emulated stack (e.g., "10.0.0.254:443") and forwarding to the given
+// address of the host network (e.g., "127.0.0.1:8443"). The network MUST be either
+// "tcp" or "udp". Typically, the stack is a gateway host added to the topology for
+// this purpose, which allows replacing emulated servers with real servers.
+func NewEmulatedToHostForwarder(
+	logger Logger,
+	stack UnderlyingNetwork,
+	network string,
+	emulatedAddress string,
+	hostAddress string,
+) (*PortForwarder, error) {
+	emulated := &Net{stack}
+	return newPortForwarder(
+		logger,
+		network,
+		emulatedAddress,
+		hostAddress,
+		emulated.Listen,
+		emulated.ListenPacket,
+		(&net.Dialer{}).DialContext,
+	)
+}
+
+// newPortForwarder creates a [PortForwarder] using the given functions to
+// listen and to dial connections to the target address.
+func newPortForwarder(
+	logger Logger,
+	network string,
+	address string,
+	target string,
+	listen func(network, address string) (net.Listener, error),
+	listenPacket func(network, address string) (net.PacketConn, error),
+	dial netDialFunc,
+) (*PortForwarder, error) {
+	pf := &PortForwarder{
+		addr:      nil,
+		closeOnce: sync.Once{},
+		closed:    false,
+		closers:   map[io.Closer]bool{},
+		dial:      dial,
+		logger:    logger,
+		mu:        sync.Mutex{},
+		network:   network,
+		target:    target,
+	}
+	switch network {
+	case "tcp":
+		listener, err := listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		pf.addr = listener.Addr()
+		pf.track(listener)
+		go pf.serveStream(listener)
+	case "udp":
+		pconn, err := listenPacket(network, address)
+		if err != nil {
+			return nil, err
+		}
+		pf.addr = pconn.LocalAddr()
+		pf.track(pconn)
+		go pf.serveDatagrams(pconn)
+	default:
+		return nil, syscall.EPROTOTYPE
+	}
+	logger.Debugf("netem: forward %s %s => %s", network, pf.addr.String(), target)
+	return pf, nil
+}
+
+// Addr returns the listening address.
+func (pf *PortForwarder) Addr() net.Addr {
+	return pf.addr
+}
+
+// Close stops forwarding and closes all the forwarded connections.
+func (pf *PortForwarder) Close() error {
+	pf.closeOnce.Do(func() {
+		pf.mu.Lock()
+		pf.closed = true
+		for closer := range pf.closers {
+			closer.Close()
+		}
+		pf.mu.Unlock()
+		pf.logger.Debugf("netem: forward %s %s => %s stopped", pf.network, pf.addr.String(), pf.target)
+	})
+	return nil
+}
+
+// track registers a closer to close on Close and returns false
+// if the forwarder has already been closed.
+func (pf *PortForwarder) track(closer io.Closer) bool {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.closed {
+		return false
+	}
+	pf.closers[closer] = true
+	return true
+}
+
+// untrack closes a closer and unregisters it.
+func (pf *PortForwarder) untrack(closer io.Closer) {
+	closer.Close()
+	pf.mu.Lock()
+	delete(pf.closers, closer)
+	pf.mu.Unlock()
+}
+
+// serveStream accepts and forwards TCP connections.
+func (pf *PortForwarder) serveStream(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		if !pf.track(conn) {
+			conn.Close()
+			return
+		}
+		go pf.forwardStream(conn)
+	}
+}
+
+// forwardStream forwards a single TCP connection.
+func (pf *PortForwarder) forwardStream(conn net.Conn) {
+	defer pf.untrack(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), portForwarderDialTimeout)
+	defer cancel()
+	remote, err := pf.dial(ctx, pf.network, pf.target)
+	if err != nil {
+		pf.logger.Warnf("netem: forward %s: %s", pf.target, err.Error())
+		return
+	}
+	if !pf.track(remote) {
+		remote.Close()
+		return
+	}
+	defer pf.untrack(remote)
+	proxyConns(conn, remote)
+}
+
+// serveDatagrams forwards UDP datagrams using a distinct connection
+// to the target for each client address.
+func (pf *PortForwarder) serveDatagrams(pconn net.PacketConn) {
+	sessions := &sync.Map{}
+	buffer := make([]byte, 1<<16)
+	for {
+		count, addr, err := pconn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		session, found := sessions.Load(addr.String())
+		if !found {
+			ctx, cancel := context.WithTimeout(context.Background(), portForwarderDialTimeout)
+			remote, err := pf.dial(ctx, pf.network, pf.target)
+			cancel()
+			if err != nil {
+				pf.logger.Warnf("netem: forward %s: %s", pf.target, err.Error())
+				continue
+			}
+			if !pf.track(remote) {
+				remote.Close()
+				return
+			}
+			sessions.Store(addr.String(), remote)
+			go pf.forwardDatagramReplies(pconn, addr, remote, sessions)
+			session = remote
+		}
+		remote := session.(net.Conn)
+		_ = remote.SetReadDeadline(time.Now().Add(portForwarderUDPIdleTimeout))
+		_, _ = remote.Write(buffer[:count])
+	}
+}
+
+// forwardDatagramReplies forwards the datagrams sent by the target to the
+// client until the session has been idle for too much time.
+func (pf *PortForwarder) forwardDatagramReplies(
+	pconn net.PacketConn,
+	addr net.Addr,
+	remote net.Conn,
+	sessions *sync.Map,
+) {
+	defer func() {
+		sessions.Delete(addr.String())
+		pf.untrack(remote)
+	}()
+	buffer := make([]byte, 1<<16)
+	for {
+		count, err := remote.Read(buffer)
+		if err != nil {
+			return
+		}
+		_ = remote.SetReadDeadline(time.Now().Add(portForwarderUDPIdleTimeout))
+		if _, err := pconn.WriteTo(buffer[:count], addr); err != nil {
+			return
+		}
+	}
+}
+
+// proxyConns copies data between the two conns until both directions are
+// done and propagates EOF using CloseWrite, when available.
+func proxyConns(left, right net.Conn) {
+	wg := &sync.WaitGroup{}
+	copyAndCloseWrite := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok && err == nil {
+			_ = cw.CloseWrite()
+			return
+		}
+		// without half-close, make sure the other direction also stops
+		left.Close()
+		right.Close()
+	}
+	wg.Add(2)
+	go copyAndCloseWrite(left, right)
+	go copyAndCloseWrite(right, left)
+	wg.Wait()
+}
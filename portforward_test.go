@@ -0,0 +1,100 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPortForwarder(t *testing.T) {
+	topology := MustNewStarTopology(&NullLogger{})
+	defer topology.Close()
+
+	client := Must1(topology.AddHost("10.0.0.1", "10.0.0.1", &LinkConfig{}))
+	gateway := Must1(topology.AddHost("10.0.0.254", "10.0.0.254", &LinkConfig{}))
+	Must1(topology.AddEchoServer("10.0.0.7", &LinkConfig{}, 7))
+
+	// echo checks whether the conn echoes back what we write
+	echo := func(t *testing.T, conn net.Conn) {
+		defer conn.Close()
+		Must1(conn.Write([]byte("antani")))
+		buffer := make([]byte, 16)
+		Must0(conn.SetReadDeadline(time.Now().Add(time.Second)))
+		count, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buffer[:count]) != "antani" {
+			t.Fatal("unexpected response", string(buffer[:count]))
+		}
+	}
+
+	t.Run("we can reach emulated servers from the host", func(t *testing.T) {
+		for _, network := range []string{"tcp", "udp"} {
+			pf := Must1(NewHostToEmulatedForwarder(&NullLogger{}, client, network, "127.0.0.1:0", "10.0.0.7:7"))
+			echo(t, Must1(net.Dial(network, pf.Addr().String())))
+			pf.Close()
+		}
+	})
+
+	t.Run("we can reach host servers from the emulated network", func(t *testing.T) {
+		listener := Must1(net.Listen("tcp", "127.0.0.1:0"))
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					io.Copy(conn, conn)
+				}()
+			}
+		}()
+		pconn := Must1(net.ListenPacket("udp", "127.0.0.1:0"))
+		defer pconn.Close()
+		go func() {
+			buffer := make([]byte, 1024)
+			for {
+				count, addr, err := pconn.ReadFrom(buffer)
+				if err != nil {
+					return
+				}
+				pconn.WriteTo(buffer[:count], addr)
+			}
+		}()
+
+		targets := map[string]string{"tcp": listener.Addr().String(), "udp": pconn.LocalAddr().String()}
+		for network, target := range targets {
+			pf := Must1(NewEmulatedToHostForwarder(&NullLogger{}, gateway, network, "10.0.0.254:7", target))
+			echo(t, Must1(client.DialContext(context.Background(), network, "10.0.0.254:7")))
+			pf.Close()
+		}
+	})
+
+	t.Run("closing a forwarder stops it", func(t *testing.T) {
+		pf := Must1(NewHostToEmulatedForwarder(&NullLogger{}, client, "tcp", "127.0.0.1:0", "10.0.0.7:7"))
+		conn := Must1(net.Dial("tcp", pf.Addr().String()))
+		defer conn.Close()
+		pf.Close()
+		Must0(conn.SetReadDeadline(time.Now().Add(time.Second)))
+		if _, err := conn.Read(make([]byte, 16)); err != io.EOF {
+			t.Fatal("unexpected error", err)
+		}
+		if _, err := net.Dial("tcp", pf.Addr().String()); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("we only support TCP and UDP", func(t *testing.T) {
+		_, err := NewHostToEmulatedForwarder(&NullLogger{}, client, "unix", "/tmp/netem.sock", "10.0.0.7:7")
+		if !errors.Is(err, syscall.EPROTOTYPE) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
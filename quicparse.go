@@ -0,0 +1,382 @@
+package netem
+
+//
+// References:
+//
+// - https://datatracker.ietf.org/doc/html/rfc9000
+//
+// - https://datatracker.ietf.org/doc/html/rfc9001
+//
+// - https://datatracker.ietf.org/doc/html/rfc9369
+//
+// - https://quic.xargs.org/#client-initial-packet
+//
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ErrQUICParse is the error returned in case there is a QUIC parse error.
+var ErrQUICParse = errors.New("quicparse: parse error")
+
+// newErrQUICParse returns a new [ErrQUICParse].
+func newErrQUICParse(message string) error {
+	return fmt.Errorf("%w: %s", ErrQUICParse, message)
+}
+
+// quicVersion contains the parameters to decrypt the
+// Initial packets of a specific QUIC version.
+type quicVersion struct {
+	// initialType is the long header packet type of Initial packets.
+	initialType uint8
+
+	// labelPrefix is the prefix of the HKDF labels.
+	labelPrefix string
+
+	// salt is the salt used to derive the initial secret.
+	salt []byte
+}
+
+var (
+	// quicSaltV1 is the salt used by QUIC v1 and by drafts 33 and 34.
+	quicSaltV1 = []byte{
+		0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+		0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+	}
+
+	// quicSaltV2 is the salt used by QUIC v2.
+	quicSaltV2 = []byte{
+		0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93,
+		0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9,
+	}
+
+	// quicSaltDraft29 is the salt used by drafts from 29 to 32.
+	quicSaltDraft29 = []byte{
+		0xaf, 0xbf, 0xec, 0x28, 0x99, 0x93, 0xd2, 0x4c, 0x9e, 0x97,
+		0x86, 0xf1, 0x9c, 0x61, 0x11, 0xe0, 0x43, 0x90, 0xa8, 0x99,
+	}
+
+	// quicSaltDraft23 is the salt used by drafts from 23 to 28.
+	quicSaltDraft23 = []byte{
+		0xc3, 0xee, 0xf7, 0x12, 0xc7, 0x2e, 0xbb, 0x5a, 0x11, 0xa7,
+		0xd2, 0x43, 0x2b, 0xb4, 0x63, 0x65, 0xbe, 0xf9, 0xf5, 0x02,
+	}
+)
+
+// QUICVersionV1 is QUIC version 1 (RFC 9000).
+const QUICVersionV1 = 0x00000001
+
+// QUICVersionV2 is QUIC version 2 (RFC 9369).
+const QUICVersionV2 = 0x6b3343cf
+
+// QUICVersionDraft29 is the draft-29 QUIC version.
+const QUICVersionDraft29 = 0xff00001d
+
+// getQUICVersion returns the parameters of the given version.
+func getQUICVersion(version uint32) (*quicVersion, bool) {
+	switch {
+	case version == QUICVersionV1:
+		return &quicVersion{initialType: 0, labelPrefix: "quic", salt: quicSaltV1}, true
+	case version == QUICVersionV2:
+		return &quicVersion{initialType: 1, labelPrefix: "quicv2", salt: quicSaltV2}, true
+	case version >= 0xff000021 && version <= 0xff000022:
+		return &quicVersion{initialType: 0, labelPrefix: "quic", salt: quicSaltV1}, true
+	case version >= 0xff00001d && version <= 0xff000020:
+		return &quicVersion{initialType: 0, labelPrefix: "quic", salt: quicSaltDraft29}, true
+	case version >= 0xff000017 && version <= 0xff00001c:
+		return &quicVersion{initialType: 0, labelPrefix: "quic", salt: quicSaltDraft23}, true
+	default:
+		return nil, false
+	}
+}
+
+// QUICInitialPacket is a decrypted client QUIC Initial packet.
+type QUICInitialPacket struct {
+	// Version is the QUIC version.
+	Version uint32
+
+	// DestinationConnectionID is the destination connection ID.
+	DestinationConnectionID []byte
+
+	// SourceConnectionID is the source connection ID.
+	SourceConnectionID []byte
+
+	// PacketNumber is the truncated packet number.
+	PacketNumber uint64
+
+	// Payload contains the decrypted frames.
+	Payload []byte
+}
+
+// DecryptQUICInitialPackets parses the QUIC packets coalesced in a UDP
+// datagram sent by a client and decrypts the Initial packets using the
+// keys derived from their destination connection ID, which works as long
+// as the client is still using the original destination connection ID.
+//
+// Return value:
+//
+// 1. the decrypted Initial packets, which may be empty when the datagram
+// contains other long header packets (e.g., 0-RTT packets);
+//
+// 2. the error that occurred, if any, wrapping [ErrQUICParse].
+func DecryptQUICInitialPackets(datagram []byte) ([]*QUICInitialPacket, error) {
+	packets := []*QUICInitialPacket{}
+	for len(datagram) > 0 {
+		packet, size, err := decryptQUICInitialPacket(datagram)
+		if err != nil {
+			return nil, err
+		}
+		if packet != nil {
+			packets = append(packets, packet)
+		}
+		datagram = datagram[size:]
+	}
+	return packets, nil
+}
+
+// decryptQUICInitialPacket parses the first packet in the datagram and
+// returns the decrypted packet, if it is an Initial packet, or nil, along
+// with the size of the packet within the datagram.
+func decryptQUICInitialPacket(datagram []byte) (*QUICInitialPacket, int, error) {
+	cursor := cryptobyte.String(datagram)
+
+	// we only accept long header packets with the fixed bit set
+	var firstByte uint8
+	if !cursor.ReadUint8(&firstByte) {
+		return nil, 0, newErrQUICParse("long header: cannot read first byte")
+	}
+	if firstByte&0xc0 != 0xc0 {
+		return nil, 0, newErrQUICParse("long header: not a long header packet")
+	}
+
+	packet := &QUICInitialPacket{}
+	if !cursor.ReadUint32(&packet.Version) {
+		return nil, 0, newErrQUICParse("long header: cannot read version")
+	}
+	version, found := getQUICVersion(packet.Version)
+	if !found {
+		return nil, 0, newErrQUICParse("long header: unsupported version")
+	}
+
+	var dcid, scid cryptobyte.String
+	if !cursor.ReadUint8LengthPrefixed(&dcid) || len(dcid) > 20 {
+		return nil, 0, newErrQUICParse("long header: cannot read destination connection ID")
+	}
+	packet.DestinationConnectionID = []byte(dcid)
+	if !cursor.ReadUint8LengthPrefixed(&scid) || len(scid) > 20 {
+		return nil, 0, newErrQUICParse("long header: cannot read source connection ID")
+	}
+	packet.SourceConnectionID = []byte(scid)
+
+	// only Initial packets contain a token
+	isInitial := (firstByte>>4)&0x03 == version.initialType
+	if isInitial {
+		tokenLength, ok := quicReadVarint(&cursor)
+		if !ok || tokenLength > uint64(len(cursor)) {
+			return nil, 0, newErrQUICParse("long header: cannot read token")
+		}
+		cursor.Skip(int(tokenLength))
+	}
+
+	// the length field covers the packet number and the payload
+	length, ok := quicReadVarint(&cursor)
+	if !ok || length > uint64(len(cursor)) {
+		return nil, 0, newErrQUICParse("long header: cannot read length")
+	}
+	pnOffset := len(datagram) - len(cursor)
+	size := pnOffset + int(length)
+	if !isInitial {
+		return nil, size, nil
+	}
+
+	payload, err := quicOpenInitialPacket(version, packet, datagram[:size], pnOffset)
+	if err != nil {
+		return nil, 0, err
+	}
+	packet.Payload = payload
+	return packet, size, nil
+}
+
+// quicOpenInitialPacket removes header protection and decrypts the payload of
+// the given Initial packet, and sets the packet number of the packet.
+func quicOpenInitialPacket(
+	version *quicVersion, packet *QUICInitialPacket, raw []byte, pnOffset int) ([]byte, error) {
+	// derive the client keys (see RFC 9001 Section 5.2)
+	initialSecret := hkdf.Extract(crypto.SHA256.New, packet.DestinationConnectionID, version.salt)
+	clientSecret := quicExpandLabel(initialSecret, "client in", crypto.SHA256.Size())
+	key := quicExpandLabel(clientSecret, version.labelPrefix+" key", 16)
+	iv := quicExpandLabel(clientSecret, version.labelPrefix+" iv", 12)
+	hp := quicExpandLabel(clientSecret, version.labelPrefix+" hp", 16)
+
+	// remove header protection (see RFC 9001 Section 5.4)
+	const sampleSize = 16
+	if len(raw) < pnOffset+4+sampleSize {
+		return nil, newErrQUICParse("initial: packet too short")
+	}
+	hpCipher, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, err
+	}
+	mask := make([]byte, aes.BlockSize)
+	hpCipher.Encrypt(mask, raw[pnOffset+4:pnOffset+4+sampleSize])
+	header := append([]byte{}, raw[:pnOffset+4]...)
+	header[0] ^= mask[0] & 0x0f
+	pnLength := int(header[0]&0x03) + 1
+	for idx := 0; idx < pnLength; idx++ {
+		header[pnOffset+idx] ^= mask[1+idx]
+		packet.PacketNumber = packet.PacketNumber<<8 | uint64(header[pnOffset+idx])
+	}
+	header = header[:pnOffset+pnLength]
+
+	// decrypt the payload (see RFC 9001 Section 5.3)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := append([]byte{}, iv...)
+	var pn [8]byte
+	binary.BigEndian.PutUint64(pn[:], packet.PacketNumber)
+	for idx := range pn {
+		nonce[len(nonce)-len(pn)+idx] ^= pn[idx]
+	}
+	payload, err := aead.Open(nil, nonce, raw[pnOffset+pnLength:], header)
+	if err != nil {
+		return nil, newErrQUICParse("initial: cannot decrypt payload")
+	}
+	return payload, nil
+}
+
+// quicExpandLabel implements HKDF-Expand-Label as defined in RFC 8446
+// Section 7.1 using SHA-256 and an empty context.
+func quicExpandLabel(secret []byte, label string, length int) []byte {
+	var info cryptobyte.Builder
+	info.AddUint16(uint16(length))
+	info.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte("tls13 "))
+		b.AddBytes([]byte(label))
+	})
+	info.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	out := make([]byte, length)
+	// note: reading fewer than 255*32 bytes from HKDF cannot fail
+	_, _ = hkdf.Expand(crypto.SHA256.New, secret, info.BytesOrPanic()).Read(out)
+	return out
+}
+
+// quicReadVarint reads a variable-length integer (see RFC 9000 Section 16).
+func quicReadVarint(cursor *cryptobyte.String) (uint64, bool) {
+	var first uint8
+	if !cursor.ReadUint8(&first) {
+		return 0, false
+	}
+	value := uint64(first & 0x3f)
+	for idx := 1; idx < 1<<(first>>6); idx++ {
+		var next uint8
+		if !cursor.ReadUint8(&next) {
+			return 0, false
+		}
+		value = value<<8 | uint64(next)
+	}
+	return value, true
+}
+
+// QUICCryptoFrame is a QUIC CRYPTO frame.
+type QUICCryptoFrame struct {
+	// Offset is the offset of the data within the crypto stream.
+	Offset uint64
+
+	// Data contains the crypto stream data.
+	Data []byte
+}
+
+// ExtractQUICCryptoFrames returns the CRYPTO frames contained by the decrypted
+// payload of a QUIC Initial packet. We only support the frames that RFC 9000
+// allows inside Initial packets (i.e., PADDING, PING, ACK, CRYPTO, and
+// CONNECTION_CLOSE) and return an error wrapping [ErrQUICParse] otherwise.
+func ExtractQUICCryptoFrames(payload []byte) ([]*QUICCryptoFrame, error) {
+	frames := []*QUICCryptoFrame{}
+	cursor := cryptobyte.String(payload)
+	for len(cursor) > 0 {
+		frameType, ok := quicReadVarint(&cursor)
+		if !ok {
+			return nil, newErrQUICParse("frames: cannot read frame type")
+		}
+		switch frameType {
+		case 0x00, 0x01: // PADDING, PING
+			// nothing to skip
+
+		case 0x02, 0x03: // ACK
+			if !quicSkipACKFrame(&cursor, frameType == 0x03) {
+				return nil, newErrQUICParse("frames: cannot read ACK frame")
+			}
+
+		case 0x06: // CRYPTO
+			frame := &QUICCryptoFrame{}
+			offset, ok := quicReadVarint(&cursor)
+			if !ok {
+				return nil, newErrQUICParse("frames: cannot read CRYPTO offset")
+			}
+			length, ok := quicReadVarint(&cursor)
+			if !ok || length > uint64(len(cursor)) {
+				return nil, newErrQUICParse("frames: cannot read CRYPTO length")
+			}
+			frame.Offset = offset
+			frame.Data = append([]byte{}, cursor[:length]...)
+			cursor.Skip(int(length))
+			frames = append(frames, frame)
+
+		case 0x1c: // CONNECTION_CLOSE
+			var reason uint64
+			for idx := 0; idx < 3; idx++ { // error code, frame type, reason length
+				if reason, ok = quicReadVarint(&cursor); !ok {
+					return nil, newErrQUICParse("frames: cannot read CONNECTION_CLOSE frame")
+				}
+			}
+			if reason > uint64(len(cursor)) || !cursor.Skip(int(reason)) {
+				return nil, newErrQUICParse("frames: cannot read CONNECTION_CLOSE reason")
+			}
+
+		default:
+			return nil, newErrQUICParse("frames: unexpected frame type")
+		}
+	}
+	return frames, nil
+}
+
+// quicSkipACKFrame skips the body of an ACK frame.
+func quicSkipACKFrame(cursor *cryptobyte.String, withECN bool) bool {
+	// largest acknowledged, ACK delay, ACK range count, first ACK range
+	var fields [4]uint64
+	for idx := range fields {
+		value, ok := quicReadVarint(cursor)
+		if !ok {
+			return false
+		}
+		fields[idx] = value
+	}
+	rangeCount := fields[2]
+	if rangeCount > uint64(len(*cursor)) {
+		return false
+	}
+	extra := 2 * rangeCount // gap and ACK range length for each range
+	if withECN {
+		extra += 3 // ECT0, ECT1, and ECN-CE counts
+	}
+	for idx := uint64(0); idx < extra; idx++ {
+		if _, ok := quicReadVarint(cursor); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,204 @@
+package netem
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+)
+
+// quicSealInitialPacket is the inverse of decryptQUICInitialPacket and
+// creates a client Initial packet with a two-byte packet number.
+func quicSealInitialPacket(t *testing.T, version uint32, dcid []byte, pn uint16, frames []byte) []byte {
+	params, found := getQUICVersion(version)
+	if !found {
+		t.Fatal("unsupported version")
+	}
+	initialSecret := hkdf.Extract(sha256.New, dcid, params.salt)
+	clientSecret := quicExpandLabel(initialSecret, "client in", sha256.Size)
+	key := quicExpandLabel(clientSecret, params.labelPrefix+" key", 16)
+	iv := quicExpandLabel(clientSecret, params.labelPrefix+" iv", 12)
+	hp := quicExpandLabel(clientSecret, params.labelPrefix+" hp", 16)
+
+	// pad the frames like clients do
+	for len(frames) < 1162 {
+		frames = append(frames, 0)
+	}
+
+	var builder cryptobyte.Builder
+	builder.AddUint8(0xc0 | params.initialType<<4 | 0x01) // two-byte packet number
+	builder.AddUint32(version)
+	builder.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(dcid) })
+	builder.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte{0x01, 0x02}) })
+	builder.AddUint8(0)                                  // token length
+	builder.AddUint16(0x4000 | uint16(2+len(frames)+16)) // length
+	builder.AddUint16(pn)                                // packet number
+	header := builder.BytesOrPanic()
+	pnOffset := len(header) - 2
+
+	block := Must1(aes.NewCipher(key))
+	aead := Must1(cipher.NewGCM(block))
+	nonce := append([]byte{}, iv...)
+	binary.BigEndian.PutUint16(nonce[10:], binary.BigEndian.Uint16(nonce[10:])^pn)
+	packet := aead.Seal(append([]byte{}, header...), nonce, frames, header)
+
+	mask := make([]byte, aes.BlockSize)
+	Must1(aes.NewCipher(hp)).Encrypt(mask, packet[pnOffset+4:pnOffset+20])
+	packet[0] ^= mask[0] & 0x0f
+	packet[pnOffset] ^= mask[1]
+	packet[pnOffset+1] ^= mask[2]
+	return packet
+}
+
+// quicCryptoFrame serializes a CRYPTO frame.
+func quicCryptoFrame(offset uint64, data []byte) []byte {
+	var builder cryptobyte.Builder
+	builder.AddUint8(0x06)
+	builder.AddUint8(0x80 | uint8(offset>>24)) // four-byte varint
+	builder.AddUint8(uint8(offset >> 16))
+	builder.AddUint16(uint16(offset))
+	builder.AddUint16(0x4000 | uint16(len(data))) // two-byte varint
+	builder.AddBytes(data)
+	return builder.BytesOrPanic()
+}
+
+func TestDecryptQUICInitialPackets(t *testing.T) {
+	clientHello := TLSHandshakeBytes13[5:]
+	dcid := []byte{0x83, 0x94, 0xc8, 0xf0, 0x3e, 0x51, 0x57, 0x08}
+
+	for _, version := range []uint32{QUICVersionV1, QUICVersionV2, QUICVersionDraft29, 0xff000017, 0xff000022} {
+		t.Run(fmt.Sprintf("we can decrypt Initial packets for version %#x", version), func(t *testing.T) {
+			frames := append([]byte{0x01}, quicCryptoFrame(0, clientHello)...) // PING + CRYPTO
+			datagram := quicSealInitialPacket(t, version, dcid, 7, frames)
+			packets, err := DecryptQUICInitialPackets(datagram)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(packets) != 1 {
+				t.Fatal("expected one packet, got", len(packets))
+			}
+			if packets[0].Version != version || packets[0].PacketNumber != 7 {
+				t.Fatal("unexpected version or packet number", packets[0].Version, packets[0].PacketNumber)
+			}
+			if diff := cmp.Diff(dcid, packets[0].DestinationConnectionID); diff != "" {
+				t.Fatal(diff)
+			}
+			cryptoFrames, err := ExtractQUICCryptoFrames(packets[0].Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cryptoFrames) != 1 || cryptoFrames[0].Offset != 0 {
+				t.Fatal("unexpected CRYPTO frames", cryptoFrames)
+			}
+			sni, err := ExtractTLServerName(cryptoFrames[0].Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sni != "example.ulfheim.net" {
+				t.Fatal("unexpected SNI", sni)
+			}
+		})
+	}
+
+	t.Run("we can decrypt coalesced Initial packets", func(t *testing.T) {
+		first := quicSealInitialPacket(t, QUICVersionV1, dcid, 0, quicCryptoFrame(0, clientHello[:100]))
+		second := quicSealInitialPacket(t, QUICVersionV1, dcid, 1, quicCryptoFrame(100, clientHello[100:]))
+		packets, err := DecryptQUICInitialPackets(append(first, second...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(packets) != 2 || packets[1].PacketNumber != 1 {
+			t.Fatal("unexpected packets", packets)
+		}
+	})
+
+	t.Run("we reject short header packets", func(t *testing.T) {
+		_, err := DecryptQUICInitialPackets([]byte{0x40, 0x01, 0x02, 0x03})
+		if !errors.Is(err, ErrQUICParse) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("we reject unsupported versions", func(t *testing.T) {
+		datagram := quicSealInitialPacket(t, QUICVersionV1, dcid, 0, quicCryptoFrame(0, clientHello))
+		binary.BigEndian.PutUint32(datagram[1:], 0x0a0a0a0a)
+		_, err := DecryptQUICInitialPackets(datagram)
+		if !errors.Is(err, ErrQUICParse) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("we reject tampered packets", func(t *testing.T) {
+		datagram := quicSealInitialPacket(t, QUICVersionV1, dcid, 0, quicCryptoFrame(0, clientHello))
+		datagram[len(datagram)-1] ^= 0xff
+		_, err := DecryptQUICInitialPackets(datagram)
+		if !errors.Is(err, ErrQUICParse) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
+
+func TestExtractQUICCryptoFrames(t *testing.T) {
+	t.Run("we skip ACK and CONNECTION_CLOSE frames", func(t *testing.T) {
+		payload := []byte{
+			0x03, 0x05, 0x00, 0x01, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, // ACK_ECN with one range
+			0x1c, 0x00, 0x06, 0x02, 'h', 'i', // CONNECTION_CLOSE with a reason
+		}
+		payload = append(payload, quicCryptoFrame(5, []byte("abc"))...)
+		frames, err := ExtractQUICCryptoFrames(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := []*QUICCryptoFrame{{Offset: 5, Data: []byte("abc")}}
+		if diff := cmp.Diff(expect, frames); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("we reject unexpected frames", func(t *testing.T) {
+		_, err := ExtractQUICCryptoFrames([]byte{0x08}) // STREAM
+		if !errors.Is(err, ErrQUICParse) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("we reject truncated CRYPTO frames", func(t *testing.T) {
+		_, err := ExtractQUICCryptoFrames([]byte{0x06, 0x00, 0x10, 'a'})
+		if !errors.Is(err, ErrQUICParse) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
+
+func TestDPIStreamQUIC(t *testing.T) {
+	clientHello := TLSHandshakeBytes13[5:]
+	dcid := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+
+	// the ClientHello spans two datagrams that we deliver out of order,
+	// with a retransmission, and with CRYPTO frames out of order
+	first := quicSealInitialPacket(t, QUICVersionV1, dcid, 0, append(
+		quicCryptoFrame(60, clientHello[60:100]), quicCryptoFrame(0, clientHello[:60])...))
+	second := quicSealInitialPacket(t, QUICVersionV1, dcid, 1, quicCryptoFrame(100, clientHello[100:]))
+
+	ds := newDPIStream(dpiParseQUICClientHello)
+	if hello := ds.addQUICDatagram(second); hello != nil {
+		t.Fatal("expected nil ClientHello")
+	}
+	if hello := ds.addQUICDatagram(second); hello != nil {
+		t.Fatal("expected nil ClientHello")
+	}
+	if hello := ds.addQUICDatagram([]byte("not QUIC")); hello != nil {
+		t.Fatal("expected nil ClientHello")
+	}
+	hello := ds.addQUICDatagram(first)
+	if diff := cmp.Diff(clientHello, hello); diff != "" {
+		t.Fatal(diff)
+	}
+}
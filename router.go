@@ -6,7 +6,12 @@ package netem
 
 import (
 	"errors"
+	"net"
 	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
 // RouterPort is a port of a [Router]. The zero value is invalid, use
@@ -138,6 +143,10 @@ func (sp *RouterPort) WriteFrame(frame *Frame) error {
 	return sp.router.tryRoute(frame)
 }
 
+// RouterIPAddress is the IPv4 address a [Router] uses as the source
+// address of the ICMP errors it generates (e.g., time exceeded).
+const RouterIPAddress = "10.255.255.254"
+
 // Router routes traffic between [RouterPort]s. The zero value of this
 // structure isn't invalid; construct using [NewRouter].
 type Router struct {
@@ -168,6 +177,17 @@ func (r *Router) AddRoute(destIP string, destPort *RouterPort) {
 	r.mu.Unlock()
 }
 
+// spoof routes the given spoofed packet after the given delay.
+func (r *Router) spoof(spoofed []byte, delay time.Duration) {
+	if delay <= 0 {
+		_ = r.tryRoute(NewFrame(spoofed))
+		return
+	}
+	time.AfterFunc(delay, func() {
+		_ = r.tryRoute(NewFrame(spoofed))
+	})
+}
+
 // tryRoute attempts to route a raw packet.
 func (r *Router) tryRoute(frame *Frame) error {
 	// parse the packet
@@ -177,17 +197,22 @@ func (r *Router) tryRoute(frame *Frame) error {
 		return err
 	}
 
-	// check whether we should drop this packet
-	if ttl := packet.TimeToLive(); ttl <= 0 {
+	// check whether we should drop this packet, in which case we tell
+	// the sender the TTL expired like a real router would do
+	if ttl := packet.TimeToLive(); ttl <= 1 {
 		r.logger.Warn("netem: tryRoute: TTL exceeded in transit")
+		r.sendTimeExceeded(packet)
 		return ErrPacketDropped
 	}
 	packet.DecrementTimeToLive()
 
 	// check whether we should spoof packets
 	if frame.Flags&FrameFlagSpoof != 0 {
-		for _, spoofed := range frame.Spoofed {
-			_ = r.tryRoute(NewFrame(spoofed))
+		for idx, spoofed := range frame.Spoofed {
+			r.spoof(spoofed, frame.spoofedDelay(idx))
+		}
+		if frame.Flags&FrameFlagSpoofOnly != 0 {
+			return ErrPacketDropped
 		}
 		// fallthrough
 	}
@@ -202,7 +227,7 @@ func (r *Router) tryRoute(frame *Frame) error {
 		return ErrPacketDropped
 	}
 
-	// serialize a TCP or UDP packet while ignoring other protocols
+	// serialize a TCP, UDP, or ICMP packet while ignoring other protocols
 	rawOutput, err := packet.Serialize()
 	if err != nil {
 		r.logger.Warnf("netem: tryRoute: %s", err.Error())
@@ -211,3 +236,44 @@ func (r *Router) tryRoute(frame *Frame) error {
 
 	return destPort.writeOutgoingPacket(rawOutput)
 }
+
+// sendTimeExceeded routes an ICMPv4 time exceeded message back to the sender
+// of the given packet. Like real routers, we quote the original IPv4 header
+// and the first eight bytes of its payload, and we never generate errors in
+// response to other ICMP errors. We don't generate ICMPv6 errors yet.
+func (r *Router) sendTimeExceeded(packet *DissectedPacket) {
+	ipv4, ok := packet.IP.(*layers.IPv4)
+	if !ok {
+		return
+	}
+	if packet.ICMPv4 != nil && packet.ICMPv4.TypeCode.Type() != layers.ICMPv4TypeEchoRequest &&
+		packet.ICMPv4.TypeCode.Type() != layers.ICMPv4TypeEchoReply {
+		return
+	}
+
+	// quote the original header and the first eight bytes of the payload
+	quoted := append([]byte{}, ipv4.Contents...)
+	quoted = append(quoted, ipv4.Payload[:min(len(ipv4.Payload), 8)]...)
+
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    net.ParseIP(RouterIPAddress).To4(),
+		DstIP:    ipv4.SrcIP,
+	}
+	icmp := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(
+			layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeTTLExceeded),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	if err := gopacket.SerializeLayers(buf, opts, ip, icmp, gopacket.Payload(quoted)); err != nil {
+		r.logger.Warnf("netem: sendTimeExceeded: %s", err.Error())
+		return
+	}
+	_ = r.tryRoute(NewFrame(buf.Bytes()))
+}
@@ -0,0 +1,1121 @@
+package netem
+
+//
+// Declarative scenarios
+//
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario describes a network topology consisting of routers, hosts,
+// servers, and links with their delay, losses, bandwidth and DPI rules. Use
+// [ParseScenario] or [LoadScenarioFile] to read a scenario from YAML or
+// JSON and [NewScenarioTopology] to create the corresponding topology.
+type Scenario struct {
+	// Name is the OPTIONAL name of the scenario.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// Description is the OPTIONAL description of the scenario.
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+
+	// Routers contains the OPTIONAL routers. Each router is the center of a
+	// [StarTopology] and routers are not connected to each other; use multi-homed
+	// hosts to connect to more than one router. When empty, we create a single
+	// router named "default". All the routers share the same [CA].
+	Routers []*ScenarioRouter `json:"routers,omitempty" yaml:"routers,omitempty"`
+
+	// Hosts contains the OPTIONAL hosts (e.g., clients).
+	Hosts []*ScenarioHost `json:"hosts,omitempty" yaml:"hosts,omitempty"`
+
+	// Servers contains the OPTIONAL ready-made servers.
+	Servers []*ScenarioServer `json:"servers,omitempty" yaml:"servers,omitempty"`
+
+	// Measurements contains the OPTIONAL measurements to run once the topology
+	// is up. [NewScenarioTopology] ignores them and cmd/netemctl runs them.
+	Measurements []*ScenarioMeasurement `json:"measurements,omitempty" yaml:"measurements,omitempty"`
+}
+
+// ScenarioRouter describes a router.
+type ScenarioRouter struct {
+	// Name is the MANDATORY name of the router.
+	Name string `json:"name" yaml:"name"`
+}
+
+// ScenarioLink describes the link connecting a host to a router. The uplink
+// direction is from the host to the router and the downlink direction is from
+// the router to the host. The zero value is a link without delay, losses,
+// bandwidth limitations, or DPI rules.
+type ScenarioLink struct {
+	// Delay is the OPTIONAL one-way delay in both directions (e.g., "50ms").
+	Delay string `json:"delay,omitempty" yaml:"delay,omitempty"`
+
+	// PLR is the OPTIONAL packet-loss rate in both directions.
+	PLR float64 `json:"plr,omitempty" yaml:"plr,omitempty"`
+
+	// Bandwidth is the OPTIONAL bandwidth in both directions using bit/s or
+	// a suffix among "kbit", "Mbit", and "Gbit" (e.g., "10Mbit").
+	Bandwidth string `json:"bandwidth,omitempty" yaml:"bandwidth,omitempty"`
+
+	// Uplink OPTIONALLY overrides delay, PLR, and bandwidth for the uplink.
+	Uplink *ScenarioLinkDirection `json:"uplink,omitempty" yaml:"uplink,omitempty"`
+
+	// Downlink OPTIONALLY overrides delay, PLR, and bandwidth for the downlink.
+	Downlink *ScenarioLinkDirection `json:"downlink,omitempty" yaml:"downlink,omitempty"`
+
+	// DPI contains the OPTIONAL DPI rules to apply to the link.
+	DPI []*ScenarioDPIRule `json:"dpi,omitempty" yaml:"dpi,omitempty"`
+
+	// PCAP is the OPTIONAL file where to write the packets seen by the host.
+	PCAP string `json:"pcap,omitempty" yaml:"pcap,omitempty"`
+}
+
+// ScenarioLinkDirection describes a single direction of a [ScenarioLink].
+type ScenarioLinkDirection struct {
+	// Delay is like [ScenarioLink.Delay].
+	Delay string `json:"delay,omitempty" yaml:"delay,omitempty"`
+
+	// PLR is like [ScenarioLink.PLR].
+	PLR float64 `json:"plr,omitempty" yaml:"plr,omitempty"`
+
+	// Bandwidth is like [ScenarioLink.Bandwidth].
+	Bandwidth string `json:"bandwidth,omitempty" yaml:"bandwidth,omitempty"`
+}
+
+// ScenarioDPIRule describes a DPI rule. The Action field selects the
+// rule and the other fields select the traffic to which the rule applies:
+//
+// - "drop" drops traffic for the given SNI, HTTP request, endpoint, or string
+// (the latter requires also specifying the endpoint); with the "udp" Protocol,
+// the SNI matches the ClientHello inside the client's QUIC Initial packets;
+// "drop" also inspects the server-to-client direction and drops the whole flow
+// when the server's TLS 1.2 Certificate matches or when the HTTP response
+// matches ResponseStatus and ResponseBodyRegexp;
+//
+// - "reset" resets connections for the given SNI, HTTP request, or string and endpoint;
+//
+// - "drop" and "reset" also block DNS over TCP queries for the given Domains
+// and, when EncryptedDNS is true, DNS over TLS and the DoH servers selected by
+// DoHServerNames and DoHServerAddresses (see [DPIBlockEncryptedDNS]);
+//
+// - "close" closes connections for the given SNI, endpoint, or string and endpoint;
+//
+// - "throttle" throttles traffic for the given SNI or TCP endpoint using the
+// rule's Delay, PLR, and Bandwidth, optionally starting only after the flow has
+// transferred AfterBytes or AfterPackets or has lasted AfterDuration; like for
+// "drop", Protocol selects QUIC SNI matching;
+//
+// - "spoof-dns" spoofs DNS responses for the given Domain using Addresses; with
+// the "tcp" Protocol, it spoofs DNS over TCP responses for Domain and Domains;
+//
+// - "inject-dns" injects Count forged DNS responses for the given Domains (which
+// may also use the "*.example.com" and ".example.com" syntax) and QueryTypes,
+// where each response uses the next entry of AddressSets and TTLs, the first
+// response is delayed by Delay and the following ones by Interval, and DropQuery
+// prevents the legitimate response (see [DPIInjectDNSResponses]);
+//
+// - "blockpage" responds with the given Blockpage for the given HTTP request or
+// string and endpoint;
+//
+// - "redirect" redirects the given HTTP request to the given Location.
+//
+// The Host, Method, PathPrefix, and PathRegexp fields select HTTP/1.x requests
+// to any destination (see [DPIHTTPRequestMatcher]). Each rule uses a single
+// selector among SNI, HTTP request, Certificate, HTTP response, Endpoint (with
+// or without String), Domain and Domains, and EncryptedDNS, and we reject rules
+// combining selectors or using a Protocol that the rule does not support.
+type ScenarioDPIRule struct {
+	// Action is the MANDATORY action.
+	Action string `json:"action" yaml:"action"`
+
+	// SNI is the OPTIONAL SNI to match.
+	SNI string `json:"sni,omitempty" yaml:"sni,omitempty"`
+
+	// Endpoint is the OPTIONAL server endpoint to match (e.g., "10.0.0.1:443").
+	Endpoint string `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+
+	// Protocol is the OPTIONAL protocol for "drop" with an endpoint and for
+	// "drop" and "throttle" with an SNI: either "tcp" or "udp", where the latter
+	// means QUIC for SNI rules. When empty, we use "tcp".
+	Protocol string `json:"protocol,omitempty" yaml:"protocol,omitempty"`
+
+	// String is the OPTIONAL string to match.
+	String string `json:"string,omitempty" yaml:"string,omitempty"`
+
+	// Domain is the domain for "spoof-dns".
+	Domain string `json:"domain,omitempty" yaml:"domain,omitempty"`
+
+	// Addresses contains the addresses for "spoof-dns".
+	Addresses []string `json:"addresses,omitempty" yaml:"addresses,omitempty"`
+
+	// Domains contains the domains for "inject-dns" and for the
+	// rules matching DNS over TCP queries.
+	Domains []string `json:"domains,omitempty" yaml:"domains,omitempty"`
+
+	// EncryptedDNS selects DNS over TLS and DoH traffic for "drop" and "reset".
+	EncryptedDNS bool `json:"encrypted_dns,omitempty" yaml:"encrypted_dns,omitempty"`
+
+	// DoHServerNames contains the OPTIONAL DoH server names for EncryptedDNS.
+	DoHServerNames []string `json:"doh_server_names,omitempty" yaml:"doh_server_names,omitempty"`
+
+	// DoHServerAddresses contains the OPTIONAL DoH server addresses for EncryptedDNS.
+	DoHServerAddresses []string `json:"doh_server_addresses,omitempty" yaml:"doh_server_addresses,omitempty"`
+
+	// QueryTypes contains the OPTIONAL query types (e.g., "A") for "inject-dns".
+	QueryTypes []string `json:"query_types,omitempty" yaml:"query_types,omitempty"`
+
+	// AddressSets contains the addresses of each response for "inject-dns".
+	AddressSets [][]string `json:"address_sets,omitempty" yaml:"address_sets,omitempty"`
+
+	// Count is the number of forged responses for "inject-dns".
+	Count int `json:"count,omitempty" yaml:"count,omitempty"`
+
+	// Interval is the interval between forged responses for "inject-dns".
+	Interval string `json:"interval,omitempty" yaml:"interval,omitempty"`
+
+	// TTLs contains the TTLs of each response for "inject-dns".
+	TTLs []uint32 `json:"ttls,omitempty" yaml:"ttls,omitempty"`
+
+	// DropQuery prevents the legitimate response for "inject-dns".
+	DropQuery bool `json:"drop_query,omitempty" yaml:"drop_query,omitempty"`
+
+	// Delay is the extra delay for "throttle" (e.g., "300ms") and
+	// the delay of the first forged response for "inject-dns".
+	Delay string `json:"delay,omitempty" yaml:"delay,omitempty"`
+
+	// PLR is the extra packet-loss rate for "throttle".
+	PLR float64 `json:"plr,omitempty" yaml:"plr,omitempty"`
+
+	// Bandwidth is the per-flow bandwidth for "throttle" using the same
+	// syntax of [ScenarioLink.Bandwidth] (e.g., "130kbit").
+	Bandwidth string `json:"bandwidth,omitempty" yaml:"bandwidth,omitempty"`
+
+	// AfterBytes OPTIONALLY defers "throttle" until the flow has
+	// transferred this number of bytes (see [DPITrigger]).
+	AfterBytes int64 `json:"after_bytes,omitempty" yaml:"after_bytes,omitempty"`
+
+	// AfterDuration OPTIONALLY defers "throttle" until the flow has
+	// lasted this long (e.g., "15s").
+	AfterDuration string `json:"after_duration,omitempty" yaml:"after_duration,omitempty"`
+
+	// AfterPackets OPTIONALLY defers "throttle" until the flow has
+	// transferred this number of packets.
+	AfterPackets int64 `json:"after_packets,omitempty" yaml:"after_packets,omitempty"`
+
+	// Blockpage is the body of the blockpage for "blockpage".
+	Blockpage string `json:"blockpage,omitempty" yaml:"blockpage,omitempty"`
+
+	// Host is the OPTIONAL HTTP Host header to match.
+	Host string `json:"host,omitempty" yaml:"host,omitempty"`
+
+	// Method is the OPTIONAL HTTP method to match.
+	Method string `json:"method,omitempty" yaml:"method,omitempty"`
+
+	// PathPrefix is the OPTIONAL prefix of the HTTP request path to match.
+	PathPrefix string `json:"path_prefix,omitempty" yaml:"path_prefix,omitempty"`
+
+	// PathRegexp is the OPTIONAL regular expression matching
+	// the HTTP request target (i.e., the path and the query).
+	PathRegexp string `json:"path_regexp,omitempty" yaml:"path_regexp,omitempty"`
+
+	// Location is the URL for "redirect".
+	Location string `json:"location,omitempty" yaml:"location,omitempty"`
+
+	// Certificate is the OPTIONAL name to match against the server's
+	// TLS 1.2 certificate (see [DPIDropTrafficForTLSCertificate]).
+	Certificate string `json:"certificate,omitempty" yaml:"certificate,omitempty"`
+
+	// ResponseStatus is the OPTIONAL HTTP response status code to match.
+	ResponseStatus int `json:"response_status,omitempty" yaml:"response_status,omitempty"`
+
+	// ResponseBodyRegexp is the OPTIONAL regular expression
+	// matching the beginning of the HTTP response body.
+	ResponseBodyRegexp string `json:"response_body_regexp,omitempty" yaml:"response_body_regexp,omitempty"`
+
+	// Residual is the OPTIONAL duration (e.g., "90s") of the residual
+	// censorship that blocks new flows after the rule matches (see
+	// [DPIResidualCensorship]). We reset blocked TCP flows when the
+	// action is "reset" and otherwise drop their packets.
+	Residual string `json:"residual,omitempty" yaml:"residual,omitempty"`
+
+	// ResidualTuple is the OPTIONAL tuple used by residual censorship: either
+	// "3-tuple" (i.e., server address, port, and protocol), which is the default,
+	// or "4-tuple" (i.e., also the client address).
+	ResidualTuple string `json:"residual_tuple,omitempty" yaml:"residual_tuple,omitempty"`
+}
+
+// ScenarioHost describes a host.
+type ScenarioHost struct {
+	// Name is the OPTIONAL name of the host. When empty, we use the address.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// Address is the MANDATORY IPv4 address of the host.
+	Address string `json:"address" yaml:"address"`
+
+	// Resolver is the OPTIONAL IPv4 address of the resolver. When empty,
+	// the host cannot perform DNS lookups.
+	Resolver string `json:"resolver,omitempty" yaml:"resolver,omitempty"`
+
+	// Router is the OPTIONAL name of the router. When empty, we use the first router.
+	Router string `json:"router,omitempty" yaml:"router,omitempty"`
+
+	// Link describes the link connecting the host to the router.
+	Link ScenarioLink `json:"link,omitempty" yaml:"link,omitempty"`
+
+	// Interfaces contains the OPTIONAL additional interfaces of the host.
+	Interfaces []*ScenarioInterface `json:"interfaces,omitempty" yaml:"interfaces,omitempty"`
+}
+
+// ScenarioInterface describes an additional interface of a multi-homed host.
+type ScenarioInterface struct {
+	// Address is the MANDATORY IPv4 address of the interface.
+	Address string `json:"address" yaml:"address"`
+
+	// Router is like [ScenarioHost.Router].
+	Router string `json:"router,omitempty" yaml:"router,omitempty"`
+
+	// Link is like [ScenarioHost.Link].
+	Link ScenarioLink `json:"link,omitempty" yaml:"link,omitempty"`
+}
+
+// ScenarioServer describes a ready-made server (see [StarServer]).
+type ScenarioServer struct {
+	// Name is the OPTIONAL name of the server. When empty, we use the address.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// Type is the MANDATORY server type: "dns", "http", "https", "echo", or "discard".
+	Type string `json:"type" yaml:"type"`
+
+	// Address is the MANDATORY IPv4 address of the server.
+	Address string `json:"address" yaml:"address"`
+
+	// Port is the port for "echo" and "discard" servers.
+	Port uint16 `json:"port,omitempty" yaml:"port,omitempty"`
+
+	// Router is like [ScenarioHost.Router].
+	Router string `json:"router,omitempty" yaml:"router,omitempty"`
+
+	// Link is like [ScenarioHost.Link].
+	Link ScenarioLink `json:"link,omitempty" yaml:"link,omitempty"`
+
+	// Zone contains the records of "dns" servers.
+	Zone []*ScenarioDNSRecord `json:"zone,omitempty" yaml:"zone,omitempty"`
+
+	// VirtualHosts contains the virtual hosts of "http" and "https" servers.
+	VirtualHosts []*ScenarioVirtualHost `json:"virtual_hosts,omitempty" yaml:"virtual_hosts,omitempty"`
+}
+
+// ScenarioDNSRecord is a DNS record (see [DNSConfig.AddRecord]).
+type ScenarioDNSRecord struct {
+	// Domain is the MANDATORY domain.
+	Domain string `json:"domain" yaml:"domain"`
+
+	// CNAME is the OPTIONAL CNAME.
+	CNAME string `json:"cname,omitempty" yaml:"cname,omitempty"`
+
+	// Addresses contains the IP addresses.
+	Addresses []string `json:"addresses,omitempty" yaml:"addresses,omitempty"`
+}
+
+// ScenarioVirtualHost describes a virtual host responding with a static response.
+type ScenarioVirtualHost struct {
+	// Host is the virtual host name. When empty, this is the default virtual host.
+	Host string `json:"host,omitempty" yaml:"host,omitempty"`
+
+	// Status is the OPTIONAL status code. When zero, we use 200.
+	Status int `json:"status,omitempty" yaml:"status,omitempty"`
+
+	// Headers contains the OPTIONAL response headers.
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+
+	// Body is the OPTIONAL response body.
+	Body string `json:"body,omitempty" yaml:"body,omitempty"`
+}
+
+// ScenarioMeasurement describes a measurement that a host runs once the
+// topology described by a [Scenario] is up. The Type field selects the
+// measurement and the other fields configure it:
+//
+// - "dns" resolves the given Domain using the host's resolver;
+//
+// - "http" fetches the given URL using HTTP/1.1, HTTP/2, or HTTP/3;
+//
+// - "ndt0" runs an NDT0 download from the given Server.
+type ScenarioMeasurement struct {
+	// Name is the OPTIONAL name of the measurement.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// Type is the MANDATORY measurement type.
+	Type string `json:"type" yaml:"type"`
+
+	// Host is the MANDATORY name of the host or server running the measurement.
+	Host string `json:"host" yaml:"host"`
+
+	// Domain is the domain to resolve for "dns".
+	Domain string `json:"domain,omitempty" yaml:"domain,omitempty"`
+
+	// URL is the URL to fetch for "http".
+	URL string `json:"url,omitempty" yaml:"url,omitempty"`
+
+	// HTTP3 indicates whether "http" should use HTTP/3.
+	HTTP3 bool `json:"http3,omitempty" yaml:"http3,omitempty"`
+
+	// Server is the name of the host or server running the NDT0 server for "ndt0".
+	Server string `json:"server,omitempty" yaml:"server,omitempty"`
+
+	// Address is the OPTIONAL address that "ndt0" should connect to, which
+	// may contain a domain name. When empty, we use the server address.
+	Address string `json:"address,omitempty" yaml:"address,omitempty"`
+
+	// Port is the OPTIONAL port used by "ndt0". When zero, we use 54321.
+	Port uint16 `json:"port,omitempty" yaml:"port,omitempty"`
+
+	// TLS indicates whether "ndt0" should use TLS.
+	TLS bool `json:"tls,omitempty" yaml:"tls,omitempty"`
+
+	// Duration is the OPTIONAL duration of "ndt0" (e.g., "5s").
+	Duration string `json:"duration,omitempty" yaml:"duration,omitempty"`
+
+	// Timeout is the OPTIONAL timeout of "dns" and "http" (e.g., "10s").
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+
+	// Expect contains the OPTIONAL expectations about the results.
+	Expect *ScenarioExpectation `json:"expect,omitempty" yaml:"expect,omitempty"`
+}
+
+// ScenarioExpectation contains the expectations about the results of a
+// [ScenarioMeasurement]. Empty fields are not checked.
+type ScenarioExpectation struct {
+	// Success indicates whether the measurement should succeed.
+	Success *bool `json:"success,omitempty" yaml:"success,omitempty"`
+
+	// Error is a string that the measurement error should contain.
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+
+	// Addresses contains the addresses that "dns" should return in any order.
+	Addresses []string `json:"addresses,omitempty" yaml:"addresses,omitempty"`
+
+	// Status is the status code that "http" should return.
+	Status int `json:"status,omitempty" yaml:"status,omitempty"`
+
+	// BodyContains is a string that the "http" body should contain.
+	BodyContains string `json:"body_contains,omitempty" yaml:"body_contains,omitempty"`
+
+	// MinGoodput is the minimum goodput of "ndt0" in Mbit/s.
+	MinGoodput float64 `json:"min_goodput,omitempty" yaml:"min_goodput,omitempty"`
+
+	// MaxGoodput is the maximum goodput of "ndt0" in Mbit/s.
+	MaxGoodput float64 `json:"max_goodput,omitempty" yaml:"max_goodput,omitempty"`
+}
+
+// ErrInvalidScenario indicates that a [Scenario] is not valid.
+var ErrInvalidScenario = errors.New("netem: invalid scenario")
+
+// ParseScenario parses a [Scenario] serialized as YAML or JSON. We
+// reject scenarios containing unknown fields to catch typos.
+func ParseScenario(data []byte) (*Scenario, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	scenario := &Scenario{}
+	if err := decoder.Decode(scenario); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidScenario, err.Error())
+	}
+	return scenario, nil
+}
+
+// LoadScenarioFile is like [ParseScenario] but reads the given file.
+func LoadScenarioFile(filename string) (*Scenario, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseScenario(data)
+}
+
+// ScenarioTopology is the topology created by [NewScenarioTopology]. The
+// zero value is invalid; please, construct using [NewScenarioTopology].
+type ScenarioTopology struct {
+	// Hosts maps the name of each host to its [UNetStack].
+	Hosts map[string]*UNetStack
+
+	// Routers maps the name of each router to its [StarTopology].
+	Routers map[string]*StarTopology
+
+	// Servers maps the name of each server to its [StarServer].
+	Servers map[string]*StarServer
+
+	// closeOnce allows to have a "once" semantics for Close.
+	closeOnce sync.Once
+}
+
+// NewScenarioTopology creates the routers, the servers, and the hosts described
+// by the given [Scenario]. Remember to call [ScenarioTopology.Close] when you
+// are done using the topology. This function returns an error wrapping
+// [ErrInvalidScenario] when the scenario is not valid.
+func NewScenarioTopology(logger Logger, scenario *Scenario) (*ScenarioTopology, error) {
+	st := &ScenarioTopology{
+		Hosts:     map[string]*UNetStack{},
+		Routers:   map[string]*StarTopology{},
+		Servers:   map[string]*StarServer{},
+		closeOnce: sync.Once{},
+	}
+	if err := st.build(logger, scenario); err != nil {
+		st.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// Close closes all the routers, servers, and hosts.
+func (st *ScenarioTopology) Close() error {
+	st.closeOnce.Do(func() {
+		for _, router := range st.Routers {
+			router.Close()
+		}
+	})
+	return nil
+}
+
+// build creates the topology described by the scenario.
+func (st *ScenarioTopology) build(logger Logger, scenario *Scenario) error {
+	// create the routers, which share the same CA
+	routers := scenario.Routers
+	if len(routers) <= 0 {
+		routers = []*ScenarioRouter{{Name: "default"}}
+	}
+	var defaultRouter string
+	for _, sr := range routers {
+		if sr.Name == "" {
+			return fmt.Errorf("%w: router without name", ErrInvalidScenario)
+		}
+		if st.Routers[sr.Name] != nil {
+			return fmt.Errorf("%w: duplicate router: %s", ErrInvalidScenario, sr.Name)
+		}
+		router := MustNewStarTopology(logger)
+		if defaultRouter != "" {
+			router.ca = st.Routers[defaultRouter].ca
+		} else {
+			defaultRouter = sr.Name
+		}
+		st.Routers[sr.Name] = router
+	}
+
+	// create the servers first, such that they are ready when hosts start
+	for _, ss := range scenario.Servers {
+		name := scenarioNameOrAddress(ss.Name, ss.Address)
+		if st.Servers[name] != nil {
+			return fmt.Errorf("%w: duplicate server: %s", ErrInvalidScenario, name)
+		}
+		server, err := st.newServer(logger, st.router(ss.Router, defaultRouter), ss)
+		if err != nil {
+			return fmt.Errorf("server %s: %w", name, err)
+		}
+		st.Servers[name] = server
+	}
+
+	// create the hosts
+	for _, sh := range scenario.Hosts {
+		name := scenarioNameOrAddress(sh.Name, sh.Address)
+		if st.Hosts[name] != nil {
+			return fmt.Errorf("%w: duplicate host: %s", ErrInvalidScenario, name)
+		}
+		host, err := st.newHost(logger, defaultRouter, sh)
+		if err != nil {
+			return fmt.Errorf("host %s: %w", name, err)
+		}
+		st.Hosts[name] = host
+	}
+
+	return nil
+}
+
+// scenarioNameOrAddress returns the name, if not empty, or the address.
+func scenarioNameOrAddress(name, address string) string {
+	if name != "" {
+		return name
+	}
+	return address
+}
+
+// router returns the router with the given name, if not empty, or
+// the default router. It returns nil if the router does not exist.
+func (st *ScenarioTopology) router(name, defaultRouter string) *StarTopology {
+	if name == "" {
+		name = defaultRouter
+	}
+	return st.Routers[name]
+}
+
+// newHost creates a host and its additional interfaces.
+func (st *ScenarioTopology) newHost(logger Logger, defaultRouter string, sh *ScenarioHost) (*UNetStack, error) {
+	router := st.router(sh.Router, defaultRouter)
+	if router == nil {
+		return nil, fmt.Errorf("%w: no such router: %s", ErrInvalidScenario, sh.Router)
+	}
+	lc, err := sh.Link.newLinkConfig(logger)
+	if err != nil {
+		return nil, err
+	}
+	resolver := sh.Resolver
+	if resolver == "" {
+		resolver = "0.0.0.0"
+	}
+	host, err := router.AddHost(sh.Address, resolver, lc)
+	if err != nil {
+		return nil, err
+	}
+	for _, si := range sh.Interfaces {
+		router := st.router(si.Router, defaultRouter)
+		if router == nil {
+			return nil, fmt.Errorf("%w: no such router: %s", ErrInvalidScenario, si.Router)
+		}
+		lc, err := si.Link.newLinkConfig(logger)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := router.AddNIC(host, si.Address, lc); err != nil {
+			return nil, err
+		}
+	}
+	return host, nil
+}
+
+// newServer creates a ready-made server.
+func (st *ScenarioTopology) newServer(logger Logger, router *StarTopology, ss *ScenarioServer) (*StarServer, error) {
+	if router == nil {
+		return nil, fmt.Errorf("%w: no such router: %s", ErrInvalidScenario, ss.Router)
+	}
+	lc, err := ss.Link.newLinkConfig(logger)
+	if err != nil {
+		return nil, err
+	}
+	switch ss.Type {
+	case "dns":
+		config := NewDNSConfig()
+		for _, record := range ss.Zone {
+			if err := config.AddRecord(record.Domain, record.CNAME, record.Addresses...); err != nil {
+				return nil, fmt.Errorf("%w: record %s: %s", ErrInvalidScenario, record.Domain, err.Error())
+			}
+		}
+		return router.AddDNSServer(ss.Address, lc, config)
+
+	case "http", "https":
+		vhosts := map[string]http.Handler{}
+		for _, vhost := range ss.VirtualHosts {
+			vhosts[vhost.Host] = vhost.newHandler()
+		}
+		if ss.Type == "http" {
+			return router.AddHTTPServer(ss.Address, lc, vhosts)
+		}
+		return router.AddHTTPSServer(ss.Address, lc, vhosts)
+
+	case "echo":
+		return router.AddEchoServer(ss.Address, lc, ss.Port)
+
+	case "discard":
+		return router.AddDiscardServer(ss.Address, lc, ss.Port)
+
+	default:
+		return nil, fmt.Errorf("%w: unknown server type: %s", ErrInvalidScenario, ss.Type)
+	}
+}
+
+// newHandler creates the [http.Handler] for a virtual host.
+func (vh *ScenarioVirtualHost) newHandler() http.Handler {
+	status := vh.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key, value := range vh.Headers {
+			w.Header().Set(key, value)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(vh.Body))
+	})
+}
+
+// newLinkConfig creates the [LinkConfig] for a link. Note that the left
+// side of a link created by a [StarTopology] is the host.
+func (sl *ScenarioLink) newLinkConfig(logger Logger) (*LinkConfig, error) {
+	uplink := &ScenarioLinkDirection{Delay: sl.Delay, PLR: sl.PLR, Bandwidth: sl.Bandwidth}
+	uplink.override(sl.Uplink)
+	downlink := &ScenarioLinkDirection{Delay: sl.Delay, PLR: sl.PLR, Bandwidth: sl.Bandwidth}
+	downlink.override(sl.Downlink)
+
+	lc := &LinkConfig{
+		LeftToRightPLR: uplink.PLR,
+		RightToLeftPLR: downlink.PLR,
+	}
+	var err error
+	if lc.LeftToRightDelay, err = scenarioParseDuration(uplink.Delay); err != nil {
+		return nil, err
+	}
+	if lc.RightToLeftDelay, err = scenarioParseDuration(downlink.Delay); err != nil {
+		return nil, err
+	}
+	if lc.LeftToRightBandwidth, err = scenarioParseBandwidth(uplink.Bandwidth); err != nil {
+		return nil, err
+	}
+	if lc.RightToLeftBandwidth, err = scenarioParseBandwidth(downlink.Bandwidth); err != nil {
+		return nil, err
+	}
+
+	if sl.PCAP != "" {
+		lc.LeftNICWrapper = NewPCAPDumper(sl.PCAP, logger)
+	}
+
+	if len(sl.DPI) > 0 {
+		lc.DPIEngine = NewDPIEngine(logger)
+		for _, sr := range sl.DPI {
+			rule, err := sr.newDPIRule(logger)
+			if err != nil {
+				return nil, err
+			}
+			lc.DPIEngine.AddRule(rule)
+		}
+	}
+	return lc, nil
+}
+
+// override overrides the settings using the non-zero settings of other.
+func (sld *ScenarioLinkDirection) override(other *ScenarioLinkDirection) {
+	if other == nil {
+		return
+	}
+	if other.Delay != "" {
+		sld.Delay = other.Delay
+	}
+	if other.PLR != 0 {
+		sld.PLR = other.PLR
+	}
+	if other.Bandwidth != "" {
+		sld.Bandwidth = other.Bandwidth
+	}
+}
+
+// scenarioParseDuration parses an OPTIONAL duration.
+func scenarioParseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidScenario, err.Error())
+	}
+	return d, nil
+}
+
+// scenarioParseBandwidth parses an OPTIONAL bandwidth.
+func scenarioParseBandwidth(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{"kbit": 1e3, "Mbit": 1e6, "Gbit": 1e9} {
+		if strings.HasSuffix(value, suffix) {
+			value, multiplier = strings.TrimSuffix(value, suffix), m
+			break
+		}
+	}
+	bandwidth, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || bandwidth <= 0 {
+		return 0, fmt.Errorf("%w: invalid bandwidth: %s", ErrInvalidScenario, value)
+	}
+	return int64(bandwidth * float64(multiplier)), nil
+}
+
+// scenarioParseEndpoint parses the endpoint of a DPI rule.
+func scenarioParseEndpoint(endpoint string) (string, uint16, error) {
+	address, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: %s", ErrInvalidScenario, err.Error())
+	}
+	if net.ParseIP(address) == nil {
+		return "", 0, fmt.Errorf("%w: %w: %s", ErrInvalidScenario, ErrNotIPAddress, address)
+	}
+	portnum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: invalid port: %s", ErrInvalidScenario, port)
+	}
+	return address, uint16(portnum), nil
+}
+
+// httpRequestMatcher returns the [DPIHTTPRequestMatcher] described by
+// a [ScenarioDPIRule] or nil if the rule does not select HTTP requests.
+func (sr *ScenarioDPIRule) httpRequestMatcher() (*DPIHTTPRequestMatcher, error) {
+	if sr.Host == "" && sr.Method == "" && sr.PathPrefix == "" && sr.PathRegexp == "" {
+		return nil, nil
+	}
+	matcher := &DPIHTTPRequestMatcher{
+		Host:       sr.Host,
+		Method:     sr.Method,
+		PathPrefix: sr.PathPrefix,
+		PathRegexp: nil,
+	}
+	if sr.PathRegexp != "" {
+		re, err := regexp.Compile(sr.PathRegexp)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid path regexp: %s", ErrInvalidScenario, err.Error())
+		}
+		matcher.PathRegexp = re
+	}
+	return matcher, nil
+}
+
+// httpResponseMatcher returns the [DPIHTTPResponseMatcher] described by
+// a [ScenarioDPIRule] or nil if the rule does not select HTTP responses.
+func (sr *ScenarioDPIRule) httpResponseMatcher() (*DPIHTTPResponseMatcher, error) {
+	if sr.ResponseStatus == 0 && sr.ResponseBodyRegexp == "" {
+		return nil, nil
+	}
+	matcher := &DPIHTTPResponseMatcher{
+		BodyRegexp: nil,
+		StatusCode: sr.ResponseStatus,
+	}
+	if sr.ResponseBodyRegexp != "" {
+		re, err := regexp.Compile(sr.ResponseBodyRegexp)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid response body regexp: %s", ErrInvalidScenario, err.Error())
+		}
+		matcher.BodyRegexp = re
+	}
+	return matcher, nil
+}
+
+// trigger returns the [DPITrigger] described by a [ScenarioDPIRule]
+// or nil if the rule does not defer its policy.
+func (sr *ScenarioDPIRule) trigger() (*DPITrigger, error) {
+	if sr.AfterBytes == 0 && sr.AfterDuration == "" && sr.AfterPackets == 0 {
+		return nil, nil
+	}
+	if sr.AfterBytes < 0 || sr.AfterPackets < 0 {
+		return nil, fmt.Errorf("%w: negative after_bytes or after_packets", ErrInvalidScenario)
+	}
+	duration, err := scenarioParseDuration(sr.AfterDuration)
+	if err != nil {
+		return nil, err
+	}
+	trigger := &DPITrigger{
+		Bytes:    sr.AfterBytes,
+		Duration: duration,
+		Packets:  sr.AfterPackets,
+	}
+	return trigger, nil
+}
+
+// injectDNSRule returns the [DPIInjectDNSResponses] described by a [ScenarioDPIRule].
+func (sr *ScenarioDPIRule) injectDNSRule(logger Logger) (DPIRule, error) {
+	delay, err := scenarioParseDuration(sr.Delay)
+	if err != nil {
+		return nil, err
+	}
+	interval, err := scenarioParseDuration(sr.Interval)
+	if err != nil {
+		return nil, err
+	}
+	if sr.Count < 0 {
+		return nil, fmt.Errorf("%w: negative count", ErrInvalidScenario)
+	}
+	var queryTypes []uint16
+	for _, name := range sr.QueryTypes {
+		qtype, found := dns.StringToType[strings.ToUpper(name)]
+		if !found {
+			return nil, fmt.Errorf("%w: invalid query type: %s", ErrInvalidScenario, name)
+		}
+		queryTypes = append(queryTypes, qtype)
+	}
+	rule := &DPIInjectDNSResponses{
+		AddressSets: sr.AddressSets,
+		Count:       sr.Count,
+		Delay:       delay,
+		Domains:     sr.Domains,
+		DropQuery:   sr.DropQuery,
+		Interval:    interval,
+		Logger:      logger,
+		QueryTypes:  queryTypes,
+		TTLs:        sr.TTLs,
+	}
+	return rule, nil
+}
+
+// newDPIRule creates the [DPIRule] described by a [ScenarioDPIRule],
+// including residual censorship, if configured.
+func (sr *ScenarioDPIRule) newDPIRule(logger Logger) (DPIRule, error) {
+	rule, err := sr.newBaseDPIRule(logger)
+	if err != nil || sr.Residual == "" {
+		return rule, err
+	}
+	duration, err := scenarioParseDuration(sr.Residual)
+	if err != nil {
+		return nil, err
+	}
+	residual := &DPIResidualCensorship{
+		Duration: duration,
+		Logger:   logger,
+		Reset:    sr.Action == "reset",
+		Rule:     rule,
+		Tuple:    DPIResidualTuple3,
+	}
+	switch sr.ResidualTuple {
+	case "", "3-tuple":
+	case "4-tuple":
+		residual.Tuple = DPIResidualTuple4
+	default:
+		return nil, fmt.Errorf("%w: invalid residual tuple: %s", ErrInvalidScenario, sr.ResidualTuple)
+	}
+	return residual, nil
+}
+
+// newBaseDPIRule creates the [DPIRule] described by a [ScenarioDPIRule]
+// without considering residual censorship.
+func (sr *ScenarioDPIRule) newBaseDPIRule(logger Logger) (DPIRule, error) {
+	// parse the endpoint, if needed
+	var (
+		address string
+		port    uint16
+		err     error
+	)
+	if sr.Endpoint != "" {
+		if address, port, err = scenarioParseEndpoint(sr.Endpoint); err != nil {
+			return nil, err
+		}
+	}
+	protocol := layers.IPProtocolTCP
+	switch sr.Protocol {
+	case "", "tcp":
+	case "udp":
+		protocol = layers.IPProtocolUDP
+	default:
+		return nil, fmt.Errorf("%w: invalid protocol: %s", ErrInvalidScenario, sr.Protocol)
+	}
+	matcher, err := sr.httpRequestMatcher()
+	if err != nil {
+		return nil, err
+	}
+	responseMatcher, err := sr.httpResponseMatcher()
+	if err != nil {
+		return nil, err
+	}
+	hasCertificate := sr.Certificate != ""
+	hasDomains := len(sr.Domains) > 0
+	hasEndpoint := sr.Endpoint != ""
+	hasHTTP := matcher != nil
+	hasHTTPResponse := responseMatcher != nil
+	hasSNI := sr.SNI != ""
+	hasString := sr.String != "" && hasEndpoint
+	isQUIC := protocol == layers.IPProtocolUDP
+
+	// reject selectors that the rule we would create would silently ignore
+	if sr.String != "" && !hasEndpoint {
+		return nil, fmt.Errorf("%w: string requires an endpoint: %+v", ErrInvalidScenario, *sr)
+	}
+	var selectors int
+	for _, selected := range []bool{
+		hasCertificate,
+		hasDomains || sr.Domain != "",
+		hasEndpoint,
+		hasHTTP,
+		hasHTTPResponse,
+		hasSNI,
+		sr.EncryptedDNS,
+	} {
+		if selected {
+			selectors++
+		}
+	}
+	if selectors > 1 {
+		return nil, fmt.Errorf("%w: conflicting DPI rule selectors: %+v", ErrInvalidScenario, *sr)
+	}
+	if sr.Domain != "" && sr.Action != "spoof-dns" {
+		return nil, fmt.Errorf("%w: domain requires the spoof-dns action: %+v", ErrInvalidScenario, *sr)
+	}
+	switch {
+	case sr.Action == "spoof-dns":
+		if sr.Protocol != "tcp" && hasDomains {
+			return nil, fmt.Errorf("%w: domains requires the tcp protocol: %+v", ErrInvalidScenario, *sr)
+		}
+	case sr.Action == "inject-dns":
+		if sr.Protocol == "tcp" {
+			return nil, fmt.Errorf("%w: inject-dns only supports udp: %+v", ErrInvalidScenario, *sr)
+		}
+	case isQUIC && !((sr.Action == "drop" || sr.Action == "throttle") && hasSNI) &&
+		!(sr.Action == "drop" && hasEndpoint && !hasString):
+		return nil, fmt.Errorf("%w: protocol not supported by this DPI rule: %+v", ErrInvalidScenario, *sr)
+	}
+
+	switch {
+	case sr.Action == "drop" && hasSNI && isQUIC:
+		return &DPIDropTrafficForQUICSNI{Logger: logger, SNI: sr.SNI}, nil
+
+	case sr.Action == "drop" && hasSNI:
+		return &DPIDropTrafficForTLSSNI{Logger: logger, SNI: sr.SNI}, nil
+
+	case sr.Action == "drop" && hasHTTP:
+		return &DPIDropTrafficForHTTPRequest{Logger: logger, Matcher: *matcher}, nil
+
+	case sr.Action == "drop" && hasCertificate:
+		return &DPIDropTrafficForTLSCertificate{Logger: logger, Name: sr.Certificate}, nil
+
+	case sr.Action == "drop" && hasHTTPResponse:
+		return &DPIDropTrafficForHTTPResponse{Logger: logger, Matcher: *responseMatcher}, nil
+
+	case sr.Action == "drop" && hasString:
+		return &DPIDropTrafficForString{
+			Logger:          logger,
+			ServerIPAddress: address,
+			ServerPort:      port,
+			String:          sr.String,
+		}, nil
+
+	case sr.Action == "drop" && hasEndpoint:
+		return &DPIDropTrafficForServerEndpoint{
+			Logger:          logger,
+			ServerIPAddress: address,
+			ServerPort:      port,
+			ServerProtocol:  protocol,
+		}, nil
+
+	case (sr.Action == "drop" || sr.Action == "reset") && sr.EncryptedDNS:
+		return &DPIBlockEncryptedDNS{
+			DoHServerAddresses: sr.DoHServerAddresses,
+			DoHServerNames:     sr.DoHServerNames,
+			Logger:             logger,
+			Reset:              sr.Action == "reset",
+		}, nil
+
+	case sr.Action == "drop" && hasDomains:
+		return &DPIDropTrafficForDNSOverTCP{Domains: sr.Domains, Logger: logger}, nil
+
+	case sr.Action == "reset" && hasDomains:
+		return &DPIResetTrafficForDNSOverTCP{Domains: sr.Domains, Logger: logger}, nil
+
+	case sr.Action == "reset" && hasSNI:
+		return &DPIResetTrafficForTLSSNI{Logger: logger, SNI: sr.SNI}, nil
+
+	case sr.Action == "reset" && hasHTTP:
+		return &DPIResetTrafficForHTTPRequest{Logger: logger, Matcher: *matcher}, nil
+
+	case sr.Action == "reset" && hasString:
+		return &DPIResetTrafficForString{
+			Logger:          logger,
+			ServerIPAddress: address,
+			ServerPort:      port,
+			String:          sr.String,
+		}, nil
+
+	case sr.Action == "close" && hasSNI:
+		return &DPICloseConnectionForTLSSNI{Logger: logger, SNI: sr.SNI}, nil
+
+	case sr.Action == "close" && hasString:
+		return &DPICloseConnectionForString{
+			Logger:          logger,
+			ServerIPAddress: address,
+			ServerPort:      port,
+			String:          sr.String,
+		}, nil
+
+	case sr.Action == "close" && hasEndpoint:
+		return &DPICloseConnectionForServerEndpoint{
+			Logger:          logger,
+			ServerIPAddress: address,
+			ServerPort:      port,
+		}, nil
+
+	case sr.Action == "throttle" && (hasSNI || hasEndpoint):
+		delay, err := scenarioParseDuration(sr.Delay)
+		if err != nil {
+			return nil, err
+		}
+		bandwidth, err := scenarioParseBandwidth(sr.Bandwidth)
+		if err != nil {
+			return nil, err
+		}
+		trigger, err := sr.trigger()
+		if err != nil {
+			return nil, err
+		}
+		if hasSNI && isQUIC {
+			return &DPIThrottleTrafficForQUICSNI{
+				Bandwidth: bandwidth,
+				Delay:     delay,
+				Logger:    logger,
+				PLR:       sr.PLR,
+				SNI:       sr.SNI,
+				Trigger:   trigger,
+			}, nil
+		}
+		if hasSNI {
+			return &DPIThrottleTrafficForTLSSNI{
+				Bandwidth: bandwidth,
+				Delay:     delay,
+				Logger:    logger,
+				PLR:       sr.PLR,
+				SNI:       sr.SNI,
+				Trigger:   trigger,
+			}, nil
+		}
+		return &DPIThrottleTrafficForTCPEndpoint{
+			Bandwidth:       bandwidth,
+			Delay:           delay,
+			Logger:          logger,
+			PLR:             sr.PLR,
+			ServerIPAddress: address,
+			ServerPort:      port,
+			Trigger:         trigger,
+		}, nil
+
+	case sr.Action == "spoof-dns" && sr.Protocol == "tcp" && (sr.Domain != "" || hasDomains):
+		domains := sr.Domains
+		if sr.Domain != "" {
+			domains = append([]string{sr.Domain}, domains...)
+		}
+		return &DPISpoofDNSOverTCPResponse{Addresses: sr.Addresses, Domains: domains, Logger: logger}, nil
+
+	case sr.Action == "spoof-dns" && sr.Domain != "":
+		return &DPISpoofDNSResponse{Addresses: sr.Addresses, Logger: logger, Domain: sr.Domain}, nil
+
+	case sr.Action == "inject-dns" && len(sr.Domains) > 0:
+		return sr.injectDNSRule(logger)
+
+	case sr.Action == "blockpage" && hasHTTP:
+		return &DPISpoofHTTPResponseForHTTPRequest{
+			HTTPResponse: DPIFormatHTTPResponse([]byte(sr.Blockpage)),
+			Logger:       logger,
+			Matcher:      *matcher,
+		}, nil
+
+	case sr.Action == "redirect" && hasHTTP && sr.Location != "":
+		return &DPISpoofHTTPResponseForHTTPRequest{
+			HTTPResponse: DPIFormatHTTPRedirect(sr.Location),
+			Logger:       logger,
+			Matcher:      *matcher,
+		}, nil
+
+	case sr.Action == "blockpage" && hasString:
+		return &DPISpoofBlockpageForString{
+			HTTPResponse:    DPIFormatHTTPResponse([]byte(sr.Blockpage)),
+			Logger:          logger,
+			ServerIPAddress: address,
+			ServerPort:      port,
+			String:          sr.String,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: invalid DPI rule: %+v", ErrInvalidScenario, *sr)
+	}
+}
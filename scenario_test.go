@@ -0,0 +1,191 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// scenarioTestYAML is the YAML scenario used by [TestScenario].
+const scenarioTestYAML = `
+name: example
+description: a scenario where the censor spoofs DNS responses for www.example.org
+routers:
+  - name: isp
+  - name: vpn
+servers:
+  - name: resolver
+    type: dns
+    address: 8.8.8.8
+    link:
+      delay: 50ms
+    zone:
+      - domain: www.example.com
+        addresses: [93.184.216.34]
+      - domain: www.example.org
+        addresses: [93.184.216.34]
+  - name: web
+    type: https
+    address: 93.184.216.34
+    link:
+      delay: 10ms
+    virtual_hosts:
+      - host: www.example.com
+        status: 202
+        headers:
+          X-Scenario: example
+        body: Bonsoir, Elliot!
+      - host: www.example.org
+        body: Hello, world!
+hosts:
+  - name: client
+    address: 10.0.0.1
+    resolver: 8.8.8.8
+    router: isp
+    link:
+      delay: 5ms
+      bandwidth: 20Mbit
+      downlink:
+        delay: 10ms
+      dpi:
+        - action: spoof-dns
+          domain: www.example.org
+          addresses: [10.10.34.35]
+    interfaces:
+      - address: 10.0.1.1
+        router: vpn
+`
+
+func TestScenario(t *testing.T) {
+	t.Run("we can load a YAML scenario", func(t *testing.T) {
+		scenario, err := ParseScenario([]byte(scenarioTestYAML))
+		if err != nil {
+			t.Fatal(err)
+		}
+		topology, err := NewScenarioTopology(&NullLogger{}, scenario)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer topology.Close()
+
+		if len(topology.Routers) != 2 || len(topology.Servers) != 2 || len(topology.Hosts) != 1 {
+			t.Fatal("unexpected topology")
+		}
+		client := topology.Hosts["client"]
+		txp := NewHTTPTransport(client)
+		defer txp.CloseIdleConnections()
+
+		// the web server is reachable and uses the topology CA
+		resp, err := txp.RoundTrip(Must1(http.NewRequest("GET", "https://www.example.com/", nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := Must1(io.ReadAll(resp.Body))
+		resp.Body.Close()
+		if resp.StatusCode != 202 || resp.Header.Get("X-Scenario") != "example" || string(body) != "Bonsoir, Elliot!" {
+			t.Fatal("unexpected response", resp.StatusCode, string(body))
+		}
+		if requests := topology.Servers["web"].Requests(); len(requests) != 1 {
+			t.Fatal("unexpected number of requests", len(requests))
+		}
+
+		// the DPI rule applies to the client link
+		addrs, err := (&Net{client}).LookupHost(context.Background(), "www.example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 || addrs[0] != "10.10.34.35" {
+			t.Fatal("unexpected addresses", addrs)
+		}
+
+		// the client is multi-homed so we can bind the second address
+		pconn, err := client.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(10, 0, 1, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pconn.Close()
+	})
+
+	t.Run("we can load a JSON scenario", func(t *testing.T) {
+		data := []byte(`{"servers": [{"type": "echo", "address": "10.0.0.7", "port": 7}],
+			"hosts": [{"address": "10.0.0.1", "link": {"delay": "1ms", "plr": 0.01}}]}`)
+		scenario, err := ParseScenario(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		topology, err := NewScenarioTopology(&NullLogger{}, scenario)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer topology.Close()
+		if topology.Routers["default"] == nil || topology.Servers["10.0.0.7"] == nil || topology.Hosts["10.0.0.1"] == nil {
+			t.Fatal("unexpected topology")
+		}
+	})
+
+	t.Run("we reject invalid scenarios", func(t *testing.T) {
+		inputs := []string{
+			"hosts: [{address: 10.0.0.1, lnk: {}}]",
+			"hosts: [{address: 10.0.0.1, router: nonexistent}]",
+			"hosts: [{address: 10.0.0.1, link: {delay: 10}}]",
+			"hosts: [{address: 10.0.0.1, link: {bandwidth: 10Xbit}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: drop}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: drop, endpoint: 10.0.0.2}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: drop, sni: x.org, protocol: sctp}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: redirect, host: x.org}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: reset, path_regexp: '('}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: drop, response_body_regexp: '('}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: reset, certificate: x.org}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: throttle, sni: x.org, bandwidth: fast}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: throttle, sni: x.org, after_bytes: -1}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: throttle, sni: x.org, after_duration: 15}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {after_bytes: 100000}}]",
+			"hosts: [{address: 10.0.0.1, link: {uplink: {after_packets: 10}}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: reset, host: x.org, residual: 10}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: reset, host: x.org, residual: 10s, residual_tuple: 5-tuple}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: inject-dns}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: spoof-dns, protocol: tcp}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: close, encrypted_dns: true}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: inject-dns, domains: [x.org], query_types: [XYZ]}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: inject-dns, domains: [x.org], interval: 10}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: inject-dns, domains: [x.org], count: -1}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: drop, sni: x.org, endpoint: '10.0.0.2:443'}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: drop, sni: x.org, encrypted_dns: true}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: reset, host: x.org, domains: [x.org]}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: drop, string: x.org}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: reset, sni: x.org, protocol: udp}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: close, endpoint: '10.0.0.2:443', protocol: udp}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: drop, endpoint: '10.0.0.2:443', string: x, protocol: udp}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: spoof-dns, domain: x.org, domains: [y.org]}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: inject-dns, domains: [x.org], protocol: tcp}]}}]",
+			"hosts: [{address: 10.0.0.1, link: {dpi: [{action: drop, domain: x.org}]}}]",
+			"servers: [{type: ftp, address: 10.0.0.1}]",
+			"routers: [{name: isp}, {name: isp}]",
+		}
+		for _, input := range inputs {
+			scenario, err := ParseScenario([]byte(input))
+			if err == nil {
+				var topology *ScenarioTopology
+				topology, err = NewScenarioTopology(&NullLogger{}, scenario)
+				if err == nil {
+					topology.Close()
+				}
+			}
+			if !errors.Is(err, ErrInvalidScenario) {
+				t.Fatal("unexpected error", input, err)
+			}
+		}
+	})
+
+	t.Run("we parse bandwidths", func(t *testing.T) {
+		expect := map[string]int64{"": 0, "1000": 1000, "1.5Mbit": 1500000, "10kbit": 10000, "1Gbit": 1e9}
+		for input, value := range expect {
+			if got := Must1(scenarioParseBandwidth(input)); got != value {
+				t.Fatal("unexpected bandwidth", input, got)
+			}
+		}
+	})
+}
@@ -0,0 +1,459 @@
+package netem
+
+//
+// SOCKS5 proxy exposing an emulated network to host programs
+//
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// SOCKS5Server is a SOCKS5 proxy listening on the host network that
+// forwards requests using an emulated network stack. It implements the
+// CONNECT and UDP ASSOCIATE commands without authentication and resolves
+// domain names using the resolver of the emulated stack.
+//
+// This allows running unmodified programs (e.g., curl) through an emulated
+// network, including its delays, losses, and DPI rules. For example:
+//
+//	curl --socks5-hostname 127.0.0.1:1080 https://www.example.com/
+//
+// Note that programs would need to trust the [CertificationAuthority]
+// of the emulated stack to successfully perform TLS handshakes.
+type SOCKS5Server struct {
+	// closeOnce ensures we close just once.
+	closeOnce sync.Once
+
+	// closed indicates whether we have been closed.
+	closed bool
+
+	// closers contains the conns and sockets we should close on Close.
+	closers map[io.Closer]bool
+
+	// listener is the host listener.
+	listener net.Listener
+
+	// logger is the logger to use.
+	logger Logger
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// stack is the emulated stack.
+	stack UnderlyingNetwork
+}
+
+// NewSOCKS5Server creates a new [SOCKS5Server] listening on the given TCP
+// address of the host network (e.g., "127.0.0.1:1080" or "127.0.0.1:0") and
+// forwarding requests using the given emulated stack.
+func NewSOCKS5Server(logger Logger, stack UnderlyingNetwork, address string) (*SOCKS5Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	srv := &SOCKS5Server{
+		closeOnce: sync.Once{},
+		closed:    false,
+		closers:   map[io.Closer]bool{},
+		listener:  listener,
+		logger:    logger,
+		mu:        sync.Mutex{},
+		stack:     stack,
+	}
+	logger.Debugf("netem: socks5 server %s up", listener.Addr().String())
+	go srv.serve()
+	return srv, nil
+}
+
+// Addr returns the address where the server is listening.
+func (s *SOCKS5Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops the server and interrupts the pending requests.
+func (s *SOCKS5Server) Close() error {
+	s.closeOnce.Do(func() {
+		s.listener.Close()
+		s.mu.Lock()
+		s.closed = true
+		for closer := range s.closers {
+			closer.Close()
+		}
+		s.mu.Unlock()
+		s.logger.Debugf("netem: socks5 server %s down", s.listener.Addr().String())
+	})
+	return nil
+}
+
+// track registers a closer to close on Close and returns false
+// if the server has already been closed.
+func (s *SOCKS5Server) track(closer io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.closers[closer] = true
+	return true
+}
+
+// untrack closes a closer and unregisters it.
+func (s *SOCKS5Server) untrack(closer io.Closer) {
+	closer.Close()
+	s.mu.Lock()
+	delete(s.closers, closer)
+	s.mu.Unlock()
+}
+
+// serve accepts and handles incoming client conns.
+func (s *SOCKS5Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// SOCKS5 constants (see RFC 1928).
+const (
+	socks5Version = 5
+
+	socks5MethodNoAuth       = 0
+	socks5MethodNoAcceptable = 0xff
+
+	socks5CmdConnect      = 1
+	socks5CmdUDPAssociate = 3
+
+	socks5AtypIPv4   = 1
+	socks5AtypDomain = 3
+	socks5AtypIPv6   = 4
+
+	socks5ReplySucceeded           = 0
+	socks5ReplyGeneralFailure      = 1
+	socks5ReplyNetworkUnreachable  = 3
+	socks5ReplyHostUnreachable     = 4
+	socks5ReplyConnectionRefused   = 5
+	socks5ReplyCommandNotSupported = 7
+	socks5ReplyAtypNotSupported    = 8
+)
+
+// socks5HandshakeTimeout is the maximum time for reading the client's request.
+const socks5HandshakeTimeout = 10 * time.Second
+
+// socks5DialTimeout is the maximum time for resolving and connecting.
+const socks5DialTimeout = 30 * time.Second
+
+// errSOCKS5 indicates a SOCKS5 protocol error.
+var errSOCKS5 = errors.New("netem: socks5: protocol error")
+
+// handle handles a client conn.
+func (s *SOCKS5Server) handle(conn net.Conn) {
+	defer s.untrack(conn)
+
+	// read the method selection and the request
+	_ = conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != socks5Version {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if !slices.Contains(methods, socks5MethodNoAuth) {
+		_, _ = conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+		return
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5MethodNoAuth}); err != nil {
+		return
+	}
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(conn, request); err != nil || request[0] != socks5Version {
+		return
+	}
+	host, port, err := socks5ReadAddress(conn)
+	if err != nil {
+		socks5WriteReply(conn, socks5ReplyAtypNotSupported, netip.AddrPort{})
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	switch request[1] {
+	case socks5CmdConnect:
+		s.connect(conn, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	case socks5CmdUDPAssociate:
+		s.udpAssociate(conn)
+	default:
+		socks5WriteReply(conn, socks5ReplyCommandNotSupported, netip.AddrPort{})
+	}
+}
+
+// connect implements the CONNECT command.
+func (s *SOCKS5Server) connect(conn net.Conn, address string) {
+	s.logger.Infof("netem: socks5: CONNECT %s", address)
+	ctx, cancel := context.WithTimeout(context.Background(), socks5DialTimeout)
+	defer cancel()
+	remote, err := (&Net{s.stack}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		s.logger.Warnf("netem: socks5: CONNECT %s: %s", address, err.Error())
+		socks5WriteReply(conn, socks5ReplyCode(err), netip.AddrPort{})
+		return
+	}
+	if !s.track(remote) {
+		remote.Close()
+		return
+	}
+	defer s.untrack(remote)
+	if err := socks5WriteReply(conn, socks5ReplySucceeded, socks5AddrPort(remote.LocalAddr())); err != nil {
+		return
+	}
+	proxyConns(conn, remote)
+}
+
+// udpAssociate implements the UDP ASSOCIATE command. The association
+// lasts until the client closes the control conn.
+func (s *SOCKS5Server) udpAssociate(conn net.Conn) {
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	s.logger.Infof("netem: socks5: UDP ASSOCIATE %s", clientIP.String())
+
+	// the relay socket uses the same host address of the control conn
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: conn.LocalAddr().(*net.TCPAddr).IP})
+	if err != nil {
+		socks5WriteReply(conn, socks5ReplyGeneralFailure, netip.AddrPort{})
+		return
+	}
+	if !s.track(relay) {
+		relay.Close()
+		return
+	}
+	defer s.untrack(relay)
+
+	remote, err := s.stack.ListenUDP("udp", nil)
+	if err != nil {
+		socks5WriteReply(conn, socks5ReplyGeneralFailure, netip.AddrPort{})
+		return
+	}
+	if !s.track(remote) {
+		remote.Close()
+		return
+	}
+	defer s.untrack(remote)
+
+	if err := socks5WriteReply(conn, socks5ReplySucceeded, socks5AddrPort(relay.LocalAddr())); err != nil {
+		return
+	}
+
+	clientAddr := &atomic.Pointer[net.UDPAddr]{}
+	go s.relayToRemote(relay, remote, clientIP, clientAddr)
+	go s.relayToClient(relay, remote, clientAddr)
+	_, _ = io.Copy(io.Discard, conn)
+}
+
+// relayToRemote forwards datagrams from the client to the emulated network.
+func (s *SOCKS5Server) relayToRemote(
+	relay *net.UDPConn,
+	remote UDPLikeConn,
+	clientIP net.IP,
+	clientAddr *atomic.Pointer[net.UDPAddr],
+) {
+	resolved := map[string]*socks5Resolution{}
+	buffer := make([]byte, 1<<16)
+	for {
+		count, addr, err := relay.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if !addr.IP.Equal(clientIP) {
+			continue // not from the client that requested the association
+		}
+		clientAddr.Store(addr)
+
+		// we do not support fragmentation
+		datagram := buffer[:count]
+		if len(datagram) < 4 || datagram[0] != 0 || datagram[1] != 0 || datagram[2] != 0 {
+			continue
+		}
+		reader := bytes.NewReader(datagram[3:])
+		host, port, err := socks5ReadAddress(reader)
+		if err != nil {
+			continue
+		}
+
+		// resolve each host once and off this goroutine, such that a slow
+		// lookup does not stall the datagrams sent to other hosts
+		resolution := resolved[host]
+		if resolution == nil {
+			resolution = &socks5Resolution{done: make(chan any), ip: nil}
+			resolved[host] = resolution
+			go func() {
+				resolution.ip = s.resolve(host)
+				close(resolution.done)
+			}()
+		}
+		payload := datagram[len(datagram)-reader.Len():]
+		select {
+		case <-resolution.done:
+			resolution.writeTo(remote, payload, port)
+		default:
+			payload = append([]byte{}, payload...)
+			go func() {
+				<-resolution.done
+				resolution.writeTo(remote, payload, port)
+			}()
+		}
+	}
+}
+
+// socks5Resolution is the result of resolving a host for the UDP relay. We
+// cache failures as well, such that we do not retry resolving for each datagram.
+type socks5Resolution struct {
+	// done is closed when we know the result
+	done chan any
+
+	// ip is the resolved IP address or nil on failure
+	ip net.IP
+}
+
+// writeTo writes the payload to the resolved IP address and the given port.
+func (sr *socks5Resolution) writeTo(remote UDPLikeConn, payload []byte, port uint16) {
+	if sr.ip != nil {
+		_, _ = remote.WriteTo(payload, &net.UDPAddr{IP: sr.ip, Port: int(port)})
+	}
+}
+
+// resolve returns the IP address of the given host or nil on failure.
+func (s *SOCKS5Server) resolve(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), socks5DialTimeout)
+	defer cancel()
+	addrs, err := (&Net{s.stack}).LookupHost(ctx, host)
+	if err != nil || len(addrs) <= 0 {
+		s.logger.Warnf("netem: socks5: cannot resolve %s", host)
+		return nil
+	}
+	return net.ParseIP(addrs[0])
+}
+
+// relayToClient forwards datagrams from the emulated network to the client.
+func (s *SOCKS5Server) relayToClient(
+	relay *net.UDPConn,
+	remote UDPLikeConn,
+	clientAddr *atomic.Pointer[net.UDPAddr],
+) {
+	buffer := make([]byte, 1<<16)
+	for {
+		count, addr, err := remote.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		destination := clientAddr.Load()
+		if destination == nil {
+			continue // the client did not send anything yet
+		}
+		datagram := socks5AppendAddrPort([]byte{0, 0, 0}, socks5AddrPort(addr))
+		datagram = append(datagram, buffer[:count]...)
+		_, _ = relay.WriteToUDP(datagram, destination)
+	}
+}
+
+// socks5ReadAddress reads ATYP, DST.ADDR and DST.PORT.
+func socks5ReadAddress(reader io.Reader) (string, uint16, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(reader, atyp); err != nil {
+		return "", 0, err
+	}
+	var host string
+	switch atyp[0] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		size := map[byte]int{socks5AtypIPv4: 4, socks5AtypIPv6: 16}[atyp[0]]
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case socks5AtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(reader, length); err != nil {
+			return "", 0, err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return "", 0, err
+		}
+		host = string(domain)
+	default:
+		return "", 0, fmt.Errorf("%w: unsupported address type %d", errSOCKS5, atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", 0, err
+	}
+	return host, binary.BigEndian.Uint16(port), nil
+}
+
+// socks5AddrPort converts a TCP or UDP address to a [netip.AddrPort].
+func socks5AddrPort(addr net.Addr) netip.AddrPort {
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap
+}
+
+// socks5AppendAddrPort appends ATYP, ADDR, and PORT to the given slice.
+func socks5AppendAddrPort(b []byte, ap netip.AddrPort) []byte {
+	addr := ap.Addr().Unmap()
+	switch {
+	case addr.Is6():
+		b = append(b, socks5AtypIPv6)
+		b = append(b, addr.AsSlice()...)
+	case addr.Is4():
+		b = append(b, socks5AtypIPv4)
+		b = append(b, addr.AsSlice()...)
+	default:
+		b = append(b, socks5AtypIPv4, 0, 0, 0, 0)
+	}
+	return binary.BigEndian.AppendUint16(b, ap.Port())
+}
+
+// socks5WriteReply writes a reply with the given code and bound address.
+func socks5WriteReply(conn net.Conn, code byte, bound netip.AddrPort) error {
+	_, err := conn.Write(socks5AppendAddrPort([]byte{socks5Version, code, 0}, bound))
+	return err
+}
+
+// socks5ReplyCode maps a dial error to a SOCKS5 reply code.
+func socks5ReplyCode(err error) byte {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, ErrDNSNoSuchHost),
+		errors.Is(err, ErrDNSNoAnswer),
+		errors.Is(err, syscall.ETIMEDOUT),
+		errors.Is(err, context.DeadlineExceeded):
+		return socks5ReplyHostUnreachable
+	default:
+		return socks5ReplyGeneralFailure
+	}
+}
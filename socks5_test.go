@@ -0,0 +1,128 @@
+package netem
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func TestSOCKS5Server(t *testing.T) {
+	topology := MustNewStarTopology(&NullLogger{})
+	defer topology.Close()
+
+	client := Must1(topology.AddHost("10.0.0.1", "8.8.8.8", &LinkConfig{}))
+	dnsConfig := NewDNSConfig()
+	Must0(dnsConfig.AddRecord("www.example.com", "", "93.184.216.34"))
+	Must0(dnsConfig.AddRecord("echo.example.com", "", "10.0.0.7"))
+	Must1(topology.AddDNSServer("8.8.8.8", &LinkConfig{}, dnsConfig))
+	vhosts := map[string]http.Handler{
+		"www.example.com": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Bonsoir, Elliot!"))
+		}),
+	}
+	Must1(topology.AddHTTPSServer("93.184.216.34", &LinkConfig{}, vhosts))
+	Must1(topology.AddEchoServer("10.0.0.7", &LinkConfig{}, 7))
+
+	srv := Must1(NewSOCKS5Server(&NullLogger{}, client, "127.0.0.1:0"))
+	defer srv.Close()
+
+	dialer := Must1(proxy.SOCKS5("tcp", srv.Addr().String(), nil, proxy.Direct))
+
+	t.Run("CONNECT works with remote DNS", func(t *testing.T) {
+		txp := &http.Transport{
+			DialContext: dialer.(proxy.ContextDialer).DialContext,
+			TLSClientConfig: &tls.Config{
+				RootCAs: client.DefaultCertPool(),
+			},
+		}
+		defer txp.CloseIdleConnections()
+		resp, err := txp.RoundTrip(Must1(http.NewRequest("GET", "https://www.example.com/", nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if body := string(Must1(io.ReadAll(resp.Body))); body != "Bonsoir, Elliot!" {
+			t.Fatal("unexpected body", body)
+		}
+	})
+
+	t.Run("CONNECT reports failures", func(t *testing.T) {
+		for _, address := range []string{"10.0.0.7:8", "www.example.org:443"} {
+			if _, err := dialer.Dial("tcp", address); err == nil {
+				t.Fatal("expected an error", address)
+			}
+		}
+	})
+
+	t.Run("UDP ASSOCIATE works", func(t *testing.T) {
+		control := Must1(net.Dial("tcp", srv.Addr().String()))
+		defer control.Close()
+		Must1(control.Write([]byte{5, 1, 0, 5, 3, 0, 1, 0, 0, 0, 0, 0, 0}))
+		reply := make([]byte, 12)
+		Must1(io.ReadFull(control, reply))
+		if !bytes.Equal(reply[:6], []byte{5, 0, 5, 0, 0, socks5AtypIPv4}) {
+			t.Fatal("unexpected reply", reply)
+		}
+		relay := netip.AddrPortFrom(netip.AddrFrom4([4]byte(reply[6:10])), uint16(reply[10])<<8|uint16(reply[11]))
+
+		pconn := Must1(net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+		defer pconn.Close()
+		datagram := socks5AppendAddrPort([]byte{0, 0, 0}, netip.MustParseAddrPort("10.0.0.7:7"))
+		datagram = append(datagram, "antani"...)
+		Must1(pconn.WriteToUDPAddrPort(datagram, relay))
+
+		Must0(pconn.SetReadDeadline(time.Now().Add(time.Second)))
+		buffer := make([]byte, 1024)
+		count, err := pconn.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buffer[:count], datagram) {
+			t.Fatal("unexpected datagram", buffer[:count])
+		}
+
+		// the first datagram waits for the resolution and the second one uses the cache
+		domain := "echo.example.com"
+		datagram = append([]byte{0, 0, 0, socks5AtypDomain, byte(len(domain))}, domain...)
+		datagram = append(datagram, 0, 7)
+		for _, payload := range []string{"mascetti", "perozzi"} {
+			Must1(pconn.WriteToUDPAddrPort(append(datagram, payload...), relay))
+			count, err := pconn.Read(buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasSuffix(buffer[:count], []byte(payload)) {
+				t.Fatal("unexpected datagram", buffer[:count])
+			}
+		}
+	})
+
+	t.Run("unsupported commands are rejected", func(t *testing.T) {
+		conn := Must1(net.Dial("tcp", srv.Addr().String()))
+		defer conn.Close()
+		Must1(conn.Write([]byte{5, 1, 0, 5, 2, 0, 1, 0, 0, 0, 0, 0, 0}))
+		reply := make([]byte, 12)
+		Must1(io.ReadFull(conn, reply))
+		if reply[1] != 0 || reply[3] != socks5ReplyCommandNotSupported {
+			t.Fatal("unexpected reply", reply)
+		}
+	})
+
+	t.Run("Close interrupts pending conns", func(t *testing.T) {
+		conn := Must1(dialer.(proxy.ContextDialer).DialContext(context.Background(), "tcp", "10.0.0.7:7"))
+		defer conn.Close()
+		srv.Close()
+		Must0(conn.SetReadDeadline(time.Now().Add(time.Second)))
+		if _, err := conn.Read(make([]byte, 16)); err != io.EOF {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
@@ -0,0 +1,433 @@
+package netem
+
+//
+// Ready-made servers for the star topology
+//
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// StarServerRequest is an entry in the requests log of a [StarServer].
+type StarServerRequest struct {
+	// Bytes is the number of bytes received by echo and discard servers. For
+	// TCP, we log the connection when it has been closed.
+	Bytes int64
+
+	// Host is the HTTP Host header without the port or the DNS query name.
+	Host string
+
+	// Method is the HTTP method or the DNS query type (e.g., "AAAA").
+	Method string
+
+	// Path is the HTTP request path.
+	Path string
+
+	// Protocol is "DNS", "TCP", "UDP", or the HTTP protocol version (e.g., "HTTP/2.0").
+	Protocol string
+
+	// RemoteAddr is the endpoint of the client.
+	RemoteAddr string
+
+	// ServerName is the SNI used by HTTPS clients.
+	ServerName string
+
+	// Time is the time when we received the request.
+	Time time.Time
+}
+
+// StarServer is a server created by a [StarTopology] using methods such as
+// [StarTopology.AddHTTPSServer]. Each [StarServer] runs in its own [UNetStack]
+// and logs the requests it receives. The zero value is invalid; please, use
+// the [StarTopology] methods to construct. Calling the [StarTopology] Close
+// method also closes all the servers created by the topology.
+type StarServer struct {
+	// closeOnce allows to have a "once" semantics for Close.
+	closeOnce sync.Once
+
+	// closed indicates that we have closed the server.
+	closed bool
+
+	// closers contains the listeners and the servers to close.
+	closers []io.Closer
+
+	// conns contains the connections accepted by echo and discard servers.
+	conns map[net.Conn]bool
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// requests contains the requests log.
+	requests []*StarServerRequest
+
+	// stack is the server stack.
+	stack *UNetStack
+}
+
+// newStarServer creates a new [StarServer] instance.
+func newStarServer(stack *UNetStack) *StarServer {
+	return &StarServer{
+		closeOnce: sync.Once{},
+		closed:    false,
+		closers:   []io.Closer{},
+		conns:     map[net.Conn]bool{},
+		mu:        sync.Mutex{},
+		requests:  []*StarServerRequest{},
+		stack:     stack,
+	}
+}
+
+// Close shuts down the server. The server's [UNetStack] remains
+// open until you close the [StarTopology] that created it.
+func (ss *StarServer) Close() error {
+	ss.closeOnce.Do(func() {
+		for _, closer := range ss.closers {
+			closer.Close()
+		}
+		ss.mu.Lock()
+		ss.closed = true
+		for conn := range ss.conns {
+			conn.Close()
+		}
+		ss.mu.Unlock()
+	})
+	return nil
+}
+
+// Requests returns a copy of the requests log.
+func (ss *StarServer) Requests() []*StarServerRequest {
+	defer ss.mu.Unlock()
+	ss.mu.Lock()
+	return append([]*StarServerRequest{}, ss.requests...) // copy
+}
+
+// Stack returns the [UNetStack] used by the server.
+func (ss *StarServer) Stack() *UNetStack {
+	return ss.stack
+}
+
+// logRequest appends an entry to the requests log.
+func (ss *StarServer) logRequest(entry *StarServerRequest) {
+	ss.mu.Lock()
+	ss.requests = append(ss.requests, entry)
+	ss.mu.Unlock()
+}
+
+// trackConn tracks an accepted conn and returns false if the server is closed.
+func (ss *StarServer) trackConn(conn net.Conn) bool {
+	defer ss.mu.Unlock()
+	ss.mu.Lock()
+	if ss.closed {
+		return false
+	}
+	ss.conns[conn] = true
+	return true
+}
+
+// untrackConn stops tracking an accepted conn.
+func (ss *StarServer) untrackConn(conn net.Conn) {
+	ss.mu.Lock()
+	delete(ss.conns, conn)
+	ss.mu.Unlock()
+}
+
+// AddDNSServer creates a new host using [StarTopology.AddHost] and runs
+// a [DNSServer] using the given config on port 53 of the host. The host uses
+// itself as the resolver. Arguments:
+//
+// - hostAddress is the IPv4 address to assign to the DNS server;
+//
+// - lc contains config for the [Link] connecting the DNS server to the [Router];
+//
+// - config contains the DNS records.
+func (t *StarTopology) AddDNSServer(
+	hostAddress string,
+	lc *LinkConfig,
+	config *DNSConfig,
+) (*StarServer, error) {
+	stack, err := t.AddHost(hostAddress, hostAddress, lc)
+	if err != nil {
+		return nil, err
+	}
+	ss := newStarServer(stack)
+	observer := func(addr net.Addr, rawQuery []byte) {
+		entry := &StarServerRequest{
+			Protocol:   "DNS",
+			RemoteAddr: addr.String(),
+			Time:       time.Now(),
+		}
+		query := &dns.Msg{}
+		if err := query.Unpack(rawQuery); err == nil && len(query.Question) > 0 {
+			entry.Host = query.Question[0].Name
+			entry.Method = dns.TypeToString[query.Question[0].Qtype]
+		}
+		ss.logRequest(entry)
+	}
+	server, err := newDNSServer(t.logger, stack, hostAddress, config, observer)
+	if err != nil {
+		return nil, err
+	}
+	ss.closers = append(ss.closers, server)
+	t.servers = append(t.servers, ss)
+	return ss, nil
+}
+
+// AddHTTPServer creates a new host using [StarTopology.AddHost] and runs a
+// cleartext HTTP server on port 80 of the host. Arguments:
+//
+// - hostAddress is the IPv4 address to assign to the HTTP server;
+//
+// - lc contains config for the [Link] connecting the HTTP server to the [Router];
+//
+// - vhosts maps each virtual host to its handler; we route requests using the
+// TLS SNI, when available, or the Host header and we use the handler for the empty
+// string, if any, when there is no handler for the requested host, otherwise
+// we respond with 404.
+func (t *StarTopology) AddHTTPServer(
+	hostAddress string,
+	lc *LinkConfig,
+	vhosts map[string]http.Handler,
+) (*StarServer, error) {
+	return t.addHTTPServer(hostAddress, lc, vhosts, false)
+}
+
+// AddHTTPSServer is like [StarTopology.AddHTTPServer] but runs an HTTPS server
+// on port 443 of the host using a certificate generated by the topology's [CA] for
+// the host address and for all the virtual hosts. The HTTPS server supports
+// "h2" and "http/1.1" and we also serve HTTP/3 on UDP port 443.
+func (t *StarTopology) AddHTTPSServer(
+	hostAddress string,
+	lc *LinkConfig,
+	vhosts map[string]http.Handler,
+) (*StarServer, error) {
+	return t.addHTTPServer(hostAddress, lc, vhosts, true)
+}
+
+// addHTTPServer implements AddHTTPServer and AddHTTPSServer.
+func (t *StarTopology) addHTTPServer(
+	hostAddress string,
+	lc *LinkConfig,
+	vhosts map[string]http.Handler,
+	useTLS bool,
+) (*StarServer, error) {
+	stack, err := t.AddHost(hostAddress, "0.0.0.0", lc)
+	if err != nil {
+		return nil, err
+	}
+	ss := newStarServer(stack)
+	handler := newStarServerVirtualHosts(ss, vhosts)
+
+	// create the TCP listener
+	port := 80
+	if useTLS {
+		port = 443
+	}
+	ipAddr := net.ParseIP(hostAddress)
+	listener, err := stack.ListenTCP("tcp", &net.TCPAddr{IP: ipAddr, Port: port})
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{
+		Handler:  handler,
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	ss.closers = append(ss.closers, server, listener)
+
+	// cleartext HTTP only requires serving in the background
+	if !useTLS {
+		go server.Serve(listener)
+		t.servers = append(t.servers, ss)
+		return ss, nil
+	}
+
+	// for HTTPS, generate a certificate valid for all the virtual hosts and
+	// also serve HTTP/3 using the same certificate
+	var names []string
+	for name := range handler.vhosts {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	tlsConfig := t.ca.MustNewServerTLSConfig(hostAddress, names...)
+	tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	server.TLSConfig = tlsConfig
+	h3server, err := NewHTTP3Server(stack, &net.UDPAddr{IP: ipAddr, Port: port}, tlsConfig.Clone(), handler)
+	if err != nil {
+		ss.Close()
+		return nil, err
+	}
+	ss.closers = append(ss.closers, h3server)
+	go server.ServeTLS(listener, "", "") // empty strings mean: use TLSConfig
+
+	t.servers = append(t.servers, ss)
+	return ss, nil
+}
+
+// starServerVirtualHosts is the [http.Handler] implementing virtual hosts.
+type starServerVirtualHosts struct {
+	server *StarServer
+	vhosts map[string]http.Handler
+}
+
+// newStarServerVirtualHosts creates a new [starServerVirtualHosts] instance.
+func newStarServerVirtualHosts(ss *StarServer, vhosts map[string]http.Handler) *starServerVirtualHosts {
+	handler := &starServerVirtualHosts{
+		server: ss,
+		vhosts: map[string]http.Handler{},
+	}
+	for name, h := range vhosts {
+		handler.vhosts[strings.ToLower(name)] = h
+	}
+	return handler
+}
+
+var _ http.Handler = &starServerVirtualHosts{}
+
+// ServeHTTP implements http.Handler.
+func (vh *starServerVirtualHosts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(host)
+
+	entry := &StarServerRequest{
+		Host:       host,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Protocol:   r.Proto,
+		RemoteAddr: r.RemoteAddr,
+		Time:       time.Now(),
+	}
+	if r.TLS != nil {
+		entry.ServerName = r.TLS.ServerName
+	}
+	vh.server.logRequest(entry)
+
+	// like an SNI-based front end, prefer the SNI to the Host header, which
+	// matters when testing clients using a SNI different from the Host
+	vhost := host
+	if entry.ServerName != "" {
+		vhost = strings.ToLower(entry.ServerName)
+	}
+	handler := vh.vhosts[vhost]
+	if handler == nil {
+		handler = vh.vhosts[""]
+	}
+	if handler == nil {
+		handler = http.NotFoundHandler()
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// AddEchoServer creates a new host using [StarTopology.AddHost] and runs a server
+// that echoes back what it receives using both TCP and UDP on the given port of
+// the host. The arguments are like the ones of [StarTopology.AddDNSServer] except
+// that there is no DNS config and you need to specify the port.
+func (t *StarTopology) AddEchoServer(hostAddress string, lc *LinkConfig, port uint16) (*StarServer, error) {
+	return t.addStreamServer(hostAddress, lc, port, true)
+}
+
+// AddDiscardServer is like [StarTopology.AddEchoServer] except that the
+// server discards what it receives using both TCP and UDP.
+func (t *StarTopology) AddDiscardServer(hostAddress string, lc *LinkConfig, port uint16) (*StarServer, error) {
+	return t.addStreamServer(hostAddress, lc, port, false)
+}
+
+// addStreamServer implements AddEchoServer and AddDiscardServer.
+func (t *StarTopology) addStreamServer(
+	hostAddress string,
+	lc *LinkConfig,
+	port uint16,
+	echo bool,
+) (*StarServer, error) {
+	stack, err := t.AddHost(hostAddress, "0.0.0.0", lc)
+	if err != nil {
+		return nil, err
+	}
+	ss := newStarServer(stack)
+
+	// create the listening sockets
+	ipAddr := net.ParseIP(hostAddress)
+	listener, err := stack.ListenTCP("tcp", &net.TCPAddr{IP: ipAddr, Port: int(port)})
+	if err != nil {
+		return nil, err
+	}
+	ss.closers = append(ss.closers, listener)
+	pconn, err := stack.ListenUDP("udp", &net.UDPAddr{IP: ipAddr, Port: int(port)})
+	if err != nil {
+		ss.Close()
+		return nil, err
+	}
+	ss.closers = append(ss.closers, pconn)
+
+	// serve in the background
+	go ss.serveStream(listener, echo)
+	go ss.serveDatagrams(pconn, echo)
+
+	t.servers = append(t.servers, ss)
+	return ss, nil
+}
+
+// serveStream serves TCP connections for echo and discard servers.
+func (ss *StarServer) serveStream(listener net.Listener, echo bool) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		if !ss.trackConn(conn) {
+			conn.Close()
+			return
+		}
+		go ss.handleStreamConn(conn, echo)
+	}
+}
+
+// handleStreamConn handles a TCP connection for echo and discard servers.
+func (ss *StarServer) handleStreamConn(conn net.Conn, echo bool) {
+	defer func() {
+		ss.untrackConn(conn)
+		conn.Close()
+	}()
+	t0 := time.Now()
+	var writer io.Writer = io.Discard
+	if echo {
+		writer = conn
+	}
+	count, _ := io.Copy(writer, conn)
+	ss.logRequest(&StarServerRequest{
+		Bytes:      count,
+		Protocol:   "TCP",
+		RemoteAddr: conn.RemoteAddr().String(),
+		Time:       t0,
+	})
+}
+
+// serveDatagrams serves UDP datagrams for echo and discard servers.
+func (ss *StarServer) serveDatagrams(pconn UDPLikeConn, echo bool) {
+	buffer := make([]byte, 1<<16)
+	for {
+		count, addr, err := pconn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		ss.logRequest(&StarServerRequest{
+			Bytes:      int64(count),
+			Protocol:   "UDP",
+			RemoteAddr: addr.String(),
+			Time:       time.Now(),
+		})
+		if echo {
+			_, _ = pconn.WriteTo(buffer[:count], addr)
+		}
+	}
+}
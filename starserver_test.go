@@ -0,0 +1,183 @@
+package netem
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStarTopologyServers(t *testing.T) {
+	topology := MustNewStarTopology(&NullLogger{})
+	defer topology.Close()
+
+	client := Must1(topology.AddHost("10.0.0.1", "8.8.8.8", &LinkConfig{}))
+
+	dnsConfig := NewDNSConfig()
+	Must0(dnsConfig.AddRecord("example.com", "", "93.184.216.34"))
+	Must0(dnsConfig.AddRecord("example.org", "", "93.184.216.34"))
+	dnsServer := Must1(topology.AddDNSServer("8.8.8.8", &LinkConfig{}, dnsConfig))
+
+	newHandler := func(message string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(message))
+		})
+	}
+	vhosts := map[string]http.Handler{
+		"example.com": newHandler("example.com"),
+		"":            newHandler("default"),
+	}
+	httpsServer := Must1(topology.AddHTTPSServer("93.184.216.34", &LinkConfig{}, vhosts))
+	httpServer := Must1(topology.AddHTTPServer("93.184.216.35", &LinkConfig{}, vhosts))
+	echoServer := Must1(topology.AddEchoServer("10.0.0.7", &LinkConfig{}, 7))
+	discardServer := Must1(topology.AddDiscardServer("10.0.0.9", &LinkConfig{}, 9))
+
+	// fetch returns the response body or fails the test
+	fetch := func(t *testing.T, txp http.RoundTripper, URL string) string {
+		resp, err := txp.RoundTrip(Must1(http.NewRequest("GET", URL, nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		return string(Must1(io.ReadAll(resp.Body)))
+	}
+
+	t.Run("HTTPS servers route virtual hosts and log requests", func(t *testing.T) {
+		txp := NewHTTPTransport(client)
+		defer txp.CloseIdleConnections()
+		if body := fetch(t, txp, "https://example.com/foo"); body != "example.com" {
+			t.Fatal("unexpected body", body)
+		}
+		if body := fetch(t, txp, "https://93.184.216.34/"); body != "default" {
+			t.Fatal("unexpected body", body)
+		}
+		requests := httpsServer.Requests()
+		if len(requests) != 2 {
+			t.Fatal("unexpected number of requests", len(requests))
+		}
+		if r := requests[0]; r.Host != "example.com" || r.Path != "/foo" ||
+			r.ServerName != "example.com" || r.Protocol != "HTTP/2.0" {
+			t.Fatalf("unexpected request %+v", r)
+		}
+	})
+
+	t.Run("HTTPS servers route virtual hosts using the SNI", func(t *testing.T) {
+		ns := &Net{client}
+		txp := &http.Transport{
+			DialTLSContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				config := &tls.Config{RootCAs: client.DefaultCertPool(), ServerName: "example.com"}
+				return ns.DialTLSContextWithConfig(ctx, network, address, config)
+			},
+		}
+		defer txp.CloseIdleConnections()
+		req := Must1(http.NewRequest("GET", "https://93.184.216.34/", nil))
+		req.Host = "www.example.org"
+		resp, err := txp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if body := string(Must1(io.ReadAll(resp.Body))); body != "example.com" {
+			t.Fatal("unexpected body", body)
+		}
+	})
+
+	t.Run("HTTPS servers also serve HTTP/3", func(t *testing.T) {
+		txp := NewHTTP3Transport(client)
+		defer txp.Close()
+		if body := fetch(t, txp, "https://example.com/"); body != "example.com" {
+			t.Fatal("unexpected body", body)
+		}
+		requests := httpsServer.Requests()
+		if r := requests[len(requests)-1]; r.Protocol != "HTTP/3.0" {
+			t.Fatalf("unexpected request %+v", r)
+		}
+	})
+
+	t.Run("HTTPS servers only have certificates for the virtual hosts", func(t *testing.T) {
+		txp := NewHTTPTransport(client)
+		defer txp.CloseIdleConnections()
+		_, err := txp.RoundTrip(Must1(http.NewRequest("GET", "https://example.org/", nil)))
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("HTTP servers route virtual hosts", func(t *testing.T) {
+		txp := NewHTTPTransport(client)
+		defer txp.CloseIdleConnections()
+		if body := fetch(t, txp, "http://93.184.216.35/"); body != "default" {
+			t.Fatal("unexpected body", body)
+		}
+		if r := httpServer.Requests()[0]; r.Host != "93.184.216.35" || r.Protocol != "HTTP/1.1" {
+			t.Fatalf("unexpected request %+v", r)
+		}
+	})
+
+	t.Run("DNS servers log queries", func(t *testing.T) {
+		found := false
+		for _, r := range dnsServer.Requests() {
+			found = found || (r.Host == "example.com." && r.Method == "A" && r.Protocol == "DNS")
+		}
+		if !found {
+			t.Fatal("did not find the expected query")
+		}
+	})
+
+	t.Run("echo servers echo back using TCP and UDP", func(t *testing.T) {
+		for _, network := range []string{"tcp", "udp"} {
+			conn := Must1(client.DialContext(context.Background(), network, "10.0.0.7:7"))
+			Must1(conn.Write([]byte("antani")))
+			buffer := make([]byte, 16)
+			Must0(conn.SetReadDeadline(time.Now().Add(time.Second)))
+			count, err := conn.Read(buffer)
+			conn.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buffer[:count]) != "antani" {
+				t.Fatal("unexpected response", string(buffer[:count]))
+			}
+		}
+		// the server logs the TCP conn when it notices we closed it
+		requests := echoServer.Requests()
+		for deadline := time.Now().Add(time.Second); len(requests) < 2 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+			requests = echoServer.Requests()
+		}
+		if len(requests) != 2 || requests[0].Bytes != 6 || requests[1].Bytes != 6 {
+			t.Fatal("unexpected requests", len(requests))
+		}
+	})
+
+	t.Run("discard servers do not respond", func(t *testing.T) {
+		conn := Must1(client.DialContext(context.Background(), "udp", "10.0.0.9:9"))
+		defer conn.Close()
+		Must1(conn.Write([]byte("antani")))
+		Must0(conn.SetReadDeadline(time.Now().Add(250 * time.Millisecond)))
+		if _, err := conn.Read(make([]byte, 16)); err == nil {
+			t.Fatal("expected an error")
+		}
+		requests := discardServer.Requests()
+		if len(requests) != 1 || requests[0].Protocol != "UDP" || requests[0].Bytes != 6 {
+			t.Fatal("unexpected requests", len(requests))
+		}
+	})
+
+	t.Run("closing a server stops it", func(t *testing.T) {
+		Must0(echoServer.Close())
+		_, err := client.DialContext(context.Background(), "tcp", "10.0.0.7:7")
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("we cannot reuse an address", func(t *testing.T) {
+		if _, err := topology.AddEchoServer("10.0.0.7", &LinkConfig{}, 7); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
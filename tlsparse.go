@@ -7,6 +7,8 @@ package netem
 //
 // - https://datatracker.ietf.org/doc/html/rfc6066
 //
+// - https://datatracker.ietf.org/doc/html/rfc5246
+//
 // - https://pkg.go.dev/golang.org/x/crypto/cryptobyte
 //
 // - https://tls13.xargs.org/#client-hello
@@ -14,6 +16,7 @@ package netem
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 
@@ -110,6 +113,9 @@ type TLSHandshakeMsg struct {
 
 	// ClientHello is either nil or the parsed ClientHello.
 	ClientHello *TLSClientHello
+
+	// Certificate is either nil or the parsed Certificate.
+	Certificate *TLSCertificate
 }
 
 // UnmarshalTLSHandshakeMsg unmarshals an Handshake message.
@@ -160,6 +166,14 @@ func UnmarshalTLSHandshakeMsg(cursor cryptobyte.String) (*TLSHandshakeMsg, error
 		h.ClientHello = clientHello
 		return h, nil
 
+	case 11: // certificate
+		certificate, err := unmarshalTLSCertificate(rest)
+		if err != nil {
+			return nil, err
+		}
+		h.Certificate = certificate
+		return h, nil
+
 	default:
 		return nil, newErrTLSParse("handshake: unsupported type")
 	}
@@ -246,6 +260,56 @@ func unmarshalTLSClientHello(cursor cryptobyte.String) (*TLSClientHello, error)
 	return ch, nil
 }
 
+// TLSCertificate is the TLSCertificate message sent by TLS 1.2 servers, which
+// is not encrypted, unlike the one sent by TLS 1.3 servers.
+type TLSCertificate struct {
+	// CertificateList contains the ASN.1 DER encoded certificates
+	// starting with the server's certificate.
+	CertificateList [][]byte
+}
+
+// unmarshalTLSCertificate unmarshals a TLS 1.2 Certificate message.
+//
+// Return value:
+//
+// 1. the parsed Certificate (on success);
+//
+// 2. an error (nil on success).
+func unmarshalTLSCertificate(cursor cryptobyte.String) (*TLSCertificate, error) {
+	cert := &TLSCertificate{}
+
+	//
+	// RFC 5246 defines the Certificate as follows:
+	//
+	//	opaque ASN.1Cert<1..2^24-1>;
+	//
+	//	struct {
+	//		ASN.1Cert certificate_list<0..2^24-1>;
+	//	} Certificate;
+	//
+	// See https://datatracker.ietf.org/doc/html/rfc5246#section-7.4.2
+	//
+
+	var certificateList cryptobyte.String
+	if !cursor.ReadUint24LengthPrefixed(&certificateList) {
+		return nil, newErrTLSParse("certificate: cannot read certificate list field")
+	}
+
+	if !cursor.Empty() {
+		return nil, newErrTLSParse("certificate: unparsed trailing data")
+	}
+
+	for !certificateList.Empty() {
+		var entry cryptobyte.String
+		if !certificateList.ReadUint24LengthPrefixed(&entry) || entry.Empty() {
+			return nil, newErrTLSParse("certificate: cannot read certificate entry")
+		}
+		cert.CertificateList = append(cert.CertificateList, entry)
+	}
+
+	return cert, nil
+}
+
 // TLSExtension is a TLS extension.
 type TLSExtension struct {
 	// Type is the extension type.
@@ -374,3 +438,28 @@ func ExtractTLServerName(rawInput []byte) (string, error) {
 	}
 	return UnmarshalTLSServerNameExtension(snext.Data)
 }
+
+// ExtractTLSCertificates takes in input a TLS 1.2 Certificate handshake message,
+// including the message type and length, and returns the parsed certificates
+// starting with the server's certificate.
+func ExtractTLSCertificates(rawInput []byte) ([]*x509.Certificate, error) {
+	hx, err := UnmarshalTLSHandshakeMsg(cryptobyte.String(rawInput))
+	if err != nil {
+		return nil, err
+	}
+	if hx.Certificate == nil {
+		return nil, newErrTLSParse("no certificate")
+	}
+	if len(hx.Certificate.CertificateList) <= 0 {
+		return nil, newErrTLSParse("empty certificate list")
+	}
+	var certs []*x509.Certificate
+	for _, entry := range hx.Certificate.CertificateList {
+		cert, err := x509.ParseCertificate(entry)
+		if err != nil {
+			return nil, newErrTLSParse(fmt.Sprintf("certificate: %s", err.Error()))
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
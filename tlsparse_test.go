@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/cryptobyte"
 )
 
 // TLSHandshakeBytes13 contains a TLSv1.3 handshake obtained
@@ -444,3 +445,79 @@ func TestUnmarshalTLSServerNameExtension(t *testing.T) {
 		})
 	}
 }
+
+// tlsMarshalCertificateMsg marshals a TLS 1.2 Certificate handshake
+// message containing the given ASN.1 DER encoded certificates.
+func tlsMarshalCertificateMsg(certs ...[]byte) []byte {
+	builder := cryptobyte.NewBuilder(nil)
+	builder.AddUint8(11)
+	builder.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, cert := range certs {
+				b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(cert)
+				})
+			}
+		})
+	})
+	return builder.BytesOrPanic()
+}
+
+func TestExtractTLSCertificates(t *testing.T) {
+	ca := MustNewCA()
+	chain := ca.MustNewTLSCertificate("www.example.com", "example.com").Certificate
+
+	t.Run("on success", func(t *testing.T) {
+		certs, err := ExtractTLSCertificates(tlsMarshalCertificateMsg(chain...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(certs) != len(chain) {
+			t.Fatal("unexpected number of certificates", len(certs))
+		}
+		if certs[0].Subject.CommonName != "www.example.com" {
+			t.Fatal("unexpected common name", certs[0].Subject.CommonName)
+		}
+		if diff := cmp.Diff([]string{"www.example.com", "example.com"}, certs[0].DNSNames); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	// testcase is a test case run by this func
+	type testcase struct {
+		name     string
+		rawInput []byte
+	}
+
+	var testcases = []testcase{{
+		name:     "with a ClientHello",
+		rawInput: TLSHandshakeBytes13[5:],
+	}, {
+		name:     "with an empty certificate list",
+		rawInput: tlsMarshalCertificateMsg(),
+	}, {
+		name:     "with an invalid certificate",
+		rawInput: tlsMarshalCertificateMsg([]byte("not a certificate")),
+	}, {
+		name:     "with a truncated message",
+		rawInput: tlsMarshalCertificateMsg(chain...)[:100],
+	}, {
+		name: "with trailing data",
+		rawInput: func() []byte {
+			body := append(tlsMarshalCertificateMsg(chain...)[4:], 0)
+			return append([]byte{11, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+		}(),
+	}}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			certs, err := ExtractTLSCertificates(tc.rawInput)
+			if !errors.Is(err, ErrTLSParse) {
+				t.Fatal("unexpected error", err)
+			}
+			if certs != nil {
+				t.Fatal("expected nil certificates")
+			}
+		})
+	}
+}
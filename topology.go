@@ -116,11 +116,14 @@ type StarTopology struct {
 
 	// router is the topology's router
 	router *Router
+
+	// servers contains all the servers we have created
+	servers []*StarServer
 }
 
 // MustNewStarTopology constructs a new, empty [StarTopology] consisting
 // of a [Router] sitting in the middle. Once you have the [StarTopology]
-// you can now add hosts using [AddHost], [AddHTTPServer], etc.
+// you can now add hosts using [AddHost], [AddHTTPSServer], etc.
 func MustNewStarTopology(logger Logger) *StarTopology {
 	return &StarTopology{
 		addresses: map[string]int{},
@@ -130,6 +133,7 @@ func MustNewStarTopology(logger Logger) *StarTopology {
 		logger:    logger,
 		mtu:       1500,
 		router:    NewRouter(logger),
+		servers:   []*StarServer{},
 	}
 }
 
@@ -155,11 +159,22 @@ func (t *StarTopology) AddHost(
 	hostAddress string,
 	resolverAddress string,
 	lc *LinkConfig,
+) (*UNetStack, error) {
+	return t.AddHostWithConfig(hostAddress, resolverAddress, lc, &UNetStackConfig{})
+}
+
+// AddHostWithConfig is like [StarTopology.AddHost] but additionally allows
+// you to specify the [UNetStackConfig] to use for creating the [UNetStack].
+func (t *StarTopology) AddHostWithConfig(
+	hostAddress string,
+	resolverAddress string,
+	lc *LinkConfig,
+	sc *UNetStackConfig,
 ) (*UNetStack, error) {
 	if t.addresses[hostAddress] > 0 {
 		return nil, fmt.Errorf("%w: %s", ErrDuplicateAddr, hostAddress)
 	}
-	host, err := NewUNetStack(t.logger, t.mtu, hostAddress, t.ca, resolverAddress)
+	host, err := NewUNetStackWithConfig(t.logger, t.mtu, hostAddress, t.ca, resolverAddress, sc)
 	if err != nil {
 		return nil, err
 	}
@@ -171,10 +186,51 @@ func (t *StarTopology) AddHost(
 	return host, nil
 }
 
-// Close closes (a) the router and (b) all the links and
-// the hosts created using this [StarTopology].
+// AddNIC creates a new [NIC] for an existing [UNetStack] using [UNetStack.AddNIC],
+// creates a [RouterPort] and a [Link] to connect them, and attaches the port to
+// the topology's [Router]. Use this method to create multi-homed hosts whose
+// interfaces use links with different characteristics. The host may belong to
+// this [StarTopology] or to another one, in which case each of its interfaces
+// connects to a different [Router].
+//
+// Arguments:
+//
+// - host is the [UNetStack] to which we should add a [NIC];
+//
+// - address is the IPv4 address to assign to the new [NIC];
+//
+// - lc contains config for the [Link] connecting the new [NIC]
+// to the [Router] of the [StarTopology].
+//
+// The return value is the new [NIC], whose InterfaceName you can use
+// with [UNetStack.AddRoute] to route traffic using this [NIC].
+func (t *StarTopology) AddNIC(
+	host *UNetStack,
+	address string,
+	lc *LinkConfig,
+) (NIC, error) {
+	if t.addresses[address] > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrDuplicateAddr, address)
+	}
+	nic, err := host.AddNIC(address)
+	if err != nil {
+		return nil, err
+	}
+	port0 := NewRouterPort(t.router)
+	link := NewLink(t.logger, nic, port0, lc) // TAKES OWNERSHIP of nic and port0
+	t.links = append(t.links, link)
+	t.router.AddRoute(address, port0)
+	t.addresses[address]++
+	return nic, nil
+}
+
+// Close closes (a) the servers, (b) the router, and (c) all the
+// links and the hosts created using this [StarTopology].
 func (t *StarTopology) Close() error {
 	t.closeOnce.Do(func() {
+		for _, ss := range t.servers {
+			ss.Close()
+		}
 		for _, ln := range t.links {
 			// note: closing a [Link] also closes the
 			// two hosts using the [Link]
@@ -22,4 +22,25 @@ func TestStartTopology(t *testing.T) {
 			}
 		})
 	})
+	t.Run("AddNIC", func(t *testing.T) {
+		t.Run("we cannot add an address that is already in the topology", func(t *testing.T) {
+			topology := MustNewStarTopology(&NullLogger{})
+
+			host, err := topology.AddHost("1.2.3.4", "0.0.0.0", &LinkConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// it should be possible to add another NIC once
+			if _, err := topology.AddNIC(host, "1.2.3.5", &LinkConfig{}); err != nil {
+				t.Fatal(err)
+			}
+
+			// the second time, it should fail
+			_, err = topology.AddNIC(host, "1.2.3.5", &LinkConfig{})
+			if !errors.Is(err, ErrDuplicateAddr) {
+				t.Fatal("not the error we expected", err)
+			}
+		})
+	})
 }
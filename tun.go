@@ -0,0 +1,246 @@
+package netem
+
+//
+// NIC backed by a TUN device
+//
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrTUNNotSupported indicates that this system does not support [TUNNIC].
+var ErrTUNNotSupported = errors.New("netem: TUN devices are not supported on this system")
+
+// TUNNICConfig contains config for [NewTUNNIC].
+type TUNNICConfig struct {
+	// Address is the MANDATORY IPv4 address assigned to the TUN device.
+	Address string
+
+	// MTU is the OPTIONAL MTU. When zero, we use 1500.
+	MTU uint32
+
+	// Name is the OPTIONAL interface name. When empty, the
+	// kernel chooses a name such as "tun0".
+	Name string
+
+	// Namespace is the OPTIONAL name of a new network namespace
+	// where to create the TUN device. When empty, we create the TUN
+	// device in the current network namespace. Otherwise, we create
+	// the namespace such that you can run processes inside it using
+	// `ip netns exec NAMESPACE COMMAND`.
+	Namespace string
+
+	// Routes contains the OPTIONAL IPv4 destinations (e.g., "10.0.0.0/8")
+	// to route using the TUN device. When empty and Namespace is not empty,
+	// we route all the traffic (i.e., "0.0.0.0/0") using the TUN device.
+	Routes []string
+}
+
+// clone returns a copy of the config.
+func (c *TUNNICConfig) clone() *TUNNICConfig {
+	return &TUNNICConfig{
+		Address:   c.Address,
+		MTU:       c.MTU,
+		Name:      c.Name,
+		Namespace: c.Namespace,
+		Routes:    c.Routes,
+	}
+}
+
+// TUNNIC is a [NIC] backed by a Linux TUN device, which allows processes
+// using the kernel network stack to participate in a topology alongside
+// [UNetStack]s. Attach it to a [Link] like any other [NIC] or use
+// [StarTopology.AddTUNNIC]. Creating a TUNNIC requires CAP_NET_ADMIN and
+// creating a network namespace additionally requires CAP_SYS_ADMIN. The
+// zero value is invalid; construct using [NewTUNNIC].
+type TUNNIC struct {
+	// address is the IPv4 address.
+	address string
+
+	// cleanup releases the network namespace, if any.
+	cleanup func()
+
+	// closeOnce provides once semantics for Close.
+	closeOnce sync.Once
+
+	// closed is closed when we close this NIC.
+	closed chan any
+
+	// dev is the TUN device.
+	dev io.ReadWriteCloser
+
+	// logger is the logger to use.
+	logger Logger
+
+	// mu protects queue.
+	mu sync.Mutex
+
+	// name is the interface name.
+	name string
+
+	// namespace is the network namespace name.
+	namespace string
+
+	// notify is posted each time a new packet is queued.
+	notify chan any
+
+	// queue contains the packets read from the TUN device.
+	queue [][]byte
+}
+
+var _ NIC = &TUNNIC{}
+
+// tunQueueSize is the maximum number of packets we queue.
+const tunQueueSize = 1024
+
+// NewTUNNIC creates a new [TUNNIC] using the given config.
+func NewTUNNIC(logger Logger, config *TUNNICConfig) (*TUNNIC, error) {
+	config = config.clone() // avoid mutating the caller's config
+	if config.MTU == 0 {
+		config.MTU = 1500
+	}
+	if len(config.Routes) <= 0 && config.Namespace != "" {
+		config.Routes = []string{"0.0.0.0/0"}
+	}
+	dev, name, cleanup, err := tunCreate(config)
+	if err != nil {
+		return nil, err
+	}
+	nic := &TUNNIC{
+		address:   config.Address,
+		cleanup:   cleanup,
+		closeOnce: sync.Once{},
+		closed:    make(chan any),
+		dev:       dev,
+		logger:    logger,
+		mu:        sync.Mutex{},
+		name:      name,
+		namespace: config.Namespace,
+		notify:    make(chan any, tunQueueSize),
+		queue:     [][]byte{},
+	}
+	logger.Debugf("netem: ifconfig %s %s mtu %d up", name, config.Address, config.MTU)
+	go nic.readLoop(int(config.MTU))
+	return nic, nil
+}
+
+// readLoop reads packets from the TUN device until it is closed.
+func (n *TUNNIC) readLoop(mtu int) {
+	buffer := make([]byte, mtu)
+	for {
+		count, err := n.dev.Read(buffer)
+		if err != nil {
+			select {
+			case <-n.closed:
+			default:
+				n.logger.Warnf("netem: TUNNIC: read: %s", err.Error())
+			}
+			return
+		}
+		n.mu.Lock()
+		if len(n.queue) >= tunQueueSize {
+			n.mu.Unlock()
+			continue // the queue is full so we drop the packet
+		}
+		n.queue = append(n.queue, append([]byte{}, buffer[:count]...))
+		n.mu.Unlock()
+		select {
+		case n.notify <- true:
+		default:
+		}
+	}
+}
+
+// FrameAvailable implements NIC
+func (n *TUNNIC) FrameAvailable() <-chan any {
+	return n.notify
+}
+
+// ReadFrameNonblocking implements NIC
+func (n *TUNNIC) ReadFrameNonblocking() (*Frame, error) {
+	select {
+	case <-n.closed:
+		return nil, ErrStackClosed
+	default:
+	}
+	defer n.mu.Unlock()
+	n.mu.Lock()
+	if len(n.queue) <= 0 {
+		return nil, ErrNoPacket
+	}
+	packet := n.queue[0]
+	n.queue = n.queue[1:]
+	return NewFrame(packet), nil
+}
+
+// StackClosed implements NIC
+func (n *TUNNIC) StackClosed() <-chan any {
+	return n.closed
+}
+
+// Close implements NIC. This function also deletes the
+// network namespace, if any, created by [NewTUNNIC].
+func (n *TUNNIC) Close() error {
+	n.closeOnce.Do(func() {
+		n.logger.Debugf("netem: ifconfig %s down", n.name)
+		close(n.closed)
+		n.dev.Close()
+		if n.cleanup != nil {
+			n.cleanup()
+		}
+	})
+	return nil
+}
+
+// IPAddress implements NIC
+func (n *TUNNIC) IPAddress() string {
+	return n.address
+}
+
+// InterfaceName implements NIC
+func (n *TUNNIC) InterfaceName() string {
+	return n.name
+}
+
+// Namespace returns the name of the network namespace
+// containing the TUN device or an empty string.
+func (n *TUNNIC) Namespace() string {
+	return n.namespace
+}
+
+// WriteFrame implements NIC
+func (n *TUNNIC) WriteFrame(frame *Frame) error {
+	select {
+	case <-n.closed:
+		return ErrStackClosed
+	default:
+	}
+	_, err := n.dev.Write(frame.Payload)
+	return err
+}
+
+// AddTUNNIC creates a new [TUNNIC] using [NewTUNNIC], creates a [RouterPort] and
+// a [Link] to connect them, and attaches the port to the topology's [Router]. When
+// the config's MTU is zero, we use the topology's MTU.
+func (t *StarTopology) AddTUNNIC(config *TUNNICConfig, lc *LinkConfig) (*TUNNIC, error) {
+	if t.addresses[config.Address] > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrDuplicateAddr, config.Address)
+	}
+	config = config.clone() // avoid mutating the caller's config
+	if config.MTU == 0 {
+		config.MTU = t.mtu
+	}
+	nic, err := NewTUNNIC(t.logger, config)
+	if err != nil {
+		return nil, err
+	}
+	port0 := NewRouterPort(t.router)
+	link := NewLink(t.logger, nic, port0, lc) // TAKES OWNERSHIP of nic and port0
+	t.links = append(t.links, link)
+	t.router.AddRoute(config.Address, port0)
+	t.addresses[config.Address]++
+	return nic, nil
+}
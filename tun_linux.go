@@ -0,0 +1,257 @@
+//go:build linux
+
+package netem
+
+//
+// TUN devices (Linux)
+//
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// tunNamespacesDir is where we pin named network namespaces, which
+// is the same directory used by `ip netns`.
+const tunNamespacesDir = "/run/netns"
+
+// tunCreate creates and configures the TUN device and returns the device, the
+// interface name, and the function to release the network namespace, if any.
+func tunCreate(config *TUNNICConfig) (io.ReadWriteCloser, string, func(), error) {
+	address, err := netip.ParseAddr(config.Address)
+	if err != nil || !address.Is4() {
+		return nil, "", nil, fmt.Errorf("netem: TUNNIC: invalid IPv4 address: %q", config.Address)
+	}
+	var routes []netip.Prefix
+	for _, route := range config.Routes {
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil || !prefix.Addr().Is4() {
+			return nil, "", nil, fmt.Errorf("netem: TUNNIC: invalid IPv4 route: %q", route)
+		}
+		routes = append(routes, prefix.Masked())
+	}
+	if config.Namespace == "" {
+		dev, name, err := tunCreateInCurrentNamespace(config, address, routes)
+		return dev, name, nil, err
+	}
+	return tunCreateInNewNamespace(config, address, routes)
+}
+
+// tunCreateInNewNamespace creates a named network namespace and
+// creates the TUN device inside such a namespace.
+func tunCreateInNewNamespace(
+	config *TUNNICConfig,
+	address netip.Addr,
+	routes []netip.Prefix,
+) (io.ReadWriteCloser, string, func(), error) {
+	// network namespaces are per thread, so we lock this goroutine to the
+	// current thread, and we only unlock it when we're back to the original
+	// namespace, otherwise the runtime would terminate the thread
+	runtime.LockOSThread()
+	original, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, "", nil, err
+	}
+	defer original.Close()
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return nil, "", nil, err
+	}
+	defer func() {
+		if unix.Setns(int(original.Fd()), unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+
+	// pin the namespace like `ip netns add` does
+	if err := os.MkdirAll(tunNamespacesDir, 0755); err != nil {
+		return nil, "", nil, err
+	}
+	path := filepath.Join(tunNamespacesDir, config.Namespace)
+	filep, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	filep.Close()
+	if err := unix.Mount("/proc/thread-self/ns/net", path, "none", unix.MS_BIND, ""); err != nil {
+		os.Remove(path)
+		return nil, "", nil, err
+	}
+	cleanup := func() {
+		_ = unix.Unmount(path, unix.MNT_DETACH)
+		_ = os.Remove(path)
+	}
+
+	// the loopback interface of a new namespace is down
+	if err := tunSetUp("lo"); err != nil {
+		cleanup()
+		return nil, "", nil, err
+	}
+
+	dev, name, err := tunCreateInCurrentNamespace(config, address, routes)
+	if err != nil {
+		cleanup()
+		return nil, "", nil, err
+	}
+	return dev, name, cleanup, nil
+}
+
+// tunCreateInCurrentNamespace creates and configures the TUN device.
+func tunCreateInCurrentNamespace(
+	config *TUNNICConfig,
+	address netip.Addr,
+	routes []netip.Prefix,
+) (io.ReadWriteCloser, string, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	ifr, err := unix.NewIfreq(config.Name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, "", err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, "", err
+	}
+
+	// using a nonblocking file allows Close to interrupt Read
+	dev := os.NewFile(uintptr(fd), "/dev/net/tun")
+	name := ifr.Name()
+	if err := tunConfigure(name, config.MTU, address, routes); err != nil {
+		dev.Close()
+		return nil, "", err
+	}
+	return dev, name, nil
+}
+
+// tunConfigure assigns the address and the MTU, brings the interface up, and adds the routes.
+func tunConfigure(name string, mtu uint32, address netip.Addr, routes []netip.Prefix) error {
+	// we only emulate IPv4, so avoid emitting IPv6 router solicitations
+	_ = os.WriteFile(filepath.Join("/proc/sys/net/ipv6/conf", name, "disable_ipv6"), []byte("1"), 0644)
+
+	sock, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(sock)
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return err
+	}
+	if err := ifr.SetInet4Addr(address.AsSlice()); err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(sock, unix.SIOCSIFADDR, ifr); err != nil {
+		return err
+	}
+	ifr.SetUint32(mtu)
+	if err := unix.IoctlIfreq(sock, unix.SIOCSIFMTU, ifr); err != nil {
+		return err
+	}
+	if err := tunSetUp(name); err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(sock, unix.SIOCGIFINDEX, ifr); err != nil {
+		return err
+	}
+	index := ifr.Uint32()
+	for _, route := range routes {
+		if err := tunAddRoute(index, route); err != nil {
+			return fmt.Errorf("netem: TUNNIC: cannot add route %s: %w", route, err)
+		}
+	}
+	return nil
+}
+
+// tunSetUp brings the given interface up.
+func tunSetUp(name string) error {
+	sock, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(sock)
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(sock, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP | unix.IFF_RUNNING)
+	return unix.IoctlIfreq(sock, unix.SIOCSIFFLAGS, ifr)
+}
+
+// tunAddRoute adds a route using the interface with the given index
+// by sending an RTM_NEWROUTE message to the kernel using netlink.
+func tunAddRoute(index uint32, route netip.Prefix) error {
+	sock, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(sock)
+
+	// message body: rtmsg followed by the RTA_DST and RTA_OIF attributes
+	body := []byte{
+		unix.AF_INET,        // rtm_family
+		uint8(route.Bits()), // rtm_dst_len
+		0,                   // rtm_src_len
+		0,                   // rtm_tos
+		unix.RT_TABLE_MAIN,  // rtm_table
+		unix.RTPROT_BOOT,    // rtm_protocol
+		unix.RT_SCOPE_LINK,  // rtm_scope
+		unix.RTN_UNICAST,    // rtm_type
+		0, 0, 0, 0,          // rtm_flags
+	}
+	if route.Bits() > 0 {
+		body = binary.NativeEndian.AppendUint16(body, unix.SizeofRtAttr+4)
+		body = binary.NativeEndian.AppendUint16(body, unix.RTA_DST)
+		body = append(body, route.Addr().AsSlice()...)
+	}
+	body = binary.NativeEndian.AppendUint16(body, unix.SizeofRtAttr+4)
+	body = binary.NativeEndian.AppendUint16(body, unix.RTA_OIF)
+	body = binary.NativeEndian.AppendUint32(body, index)
+
+	// message header
+	message := binary.NativeEndian.AppendUint32(nil, uint32(unix.SizeofNlMsghdr+len(body)))
+	message = binary.NativeEndian.AppendUint16(message, unix.RTM_NEWROUTE)
+	message = binary.NativeEndian.AppendUint16(
+		message, unix.NLM_F_REQUEST|unix.NLM_F_ACK|unix.NLM_F_CREATE|unix.NLM_F_EXCL)
+	message = binary.NativeEndian.AppendUint32(message, 1) // sequence number
+	message = binary.NativeEndian.AppendUint32(message, 0) // port ID
+	message = append(message, body...)
+
+	if err := unix.Sendto(sock, message, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	// the kernel acknowledges using an NLMSG_ERROR message whose error is zero on success
+	buffer := make([]byte, 4096)
+	count, _, err := unix.Recvfrom(sock, buffer, 0)
+	if err != nil {
+		return err
+	}
+	if count < unix.SizeofNlMsghdr+4 {
+		return errors.New("netem: TUNNIC: short netlink response")
+	}
+	if binary.NativeEndian.Uint16(buffer[4:6]) != unix.NLMSG_ERROR {
+		return errors.New("netem: TUNNIC: unexpected netlink response")
+	}
+	if errno := int32(binary.NativeEndian.Uint32(buffer[16:20])); errno != 0 {
+		return syscall.Errno(-errno)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+//go:build linux
+
+package netem
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// tunRunInNamespace runs the given function inside the given network namespace.
+func tunRunInNamespace(t *testing.T, namespace string, fx func()) {
+	runtime.LockOSThread()
+	original := Must1(os.Open("/proc/thread-self/ns/net"))
+	defer original.Close()
+	target := Must1(os.Open(filepath.Join(tunNamespacesDir, namespace)))
+	defer target.Close()
+	Must0(unix.Setns(int(target.Fd()), unix.CLONE_NEWNET))
+	fx()
+	if err := unix.Setns(int(original.Fd()), unix.CLONE_NEWNET); err != nil {
+		t.Fatal(err) // the thread remains locked and the runtime will terminate it
+	}
+	runtime.UnlockOSThread()
+}
+
+func TestTUNNIC(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating TUN devices and network namespaces requires root")
+	}
+
+	topology := MustNewStarTopology(&NullLogger{})
+	defer topology.Close()
+
+	client := Must1(topology.AddHost("10.0.0.1", "10.0.0.1", &LinkConfig{}))
+	Must1(topology.AddEchoServer("10.0.0.7", &LinkConfig{}, 7))
+
+	namespace := fmt.Sprintf("netemtest%d", os.Getpid())
+	config := &TUNNICConfig{
+		Address:   "10.0.0.99",
+		Namespace: namespace,
+	}
+	tun, err := topology.AddTUNNIC(config, &LinkConfig{LeftToRightDelay: time.Millisecond})
+	if err != nil {
+		t.Skip("cannot create TUN device", err)
+	}
+	if tun.IPAddress() != "10.0.0.99" || tun.Namespace() != namespace || tun.InterfaceName() == "" {
+		t.Fatal("unexpected TUNNIC")
+	}
+	if config.MTU != 0 || config.Routes != nil {
+		t.Fatal("we should not modify the caller's config")
+	}
+
+	t.Run("kernel processes can reach emulated servers", func(t *testing.T) {
+		for _, network := range []string{"tcp", "udp"} {
+			var conn net.Conn
+			tunRunInNamespace(t, namespace, func() {
+				conn, err = net.DialTimeout(network, "10.0.0.7:7", time.Second)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			Must1(conn.Write([]byte("antani")))
+			buffer := make([]byte, 16)
+			Must0(conn.SetReadDeadline(time.Now().Add(time.Second)))
+			count, err := conn.Read(buffer)
+			conn.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buffer[:count]) != "antani" {
+				t.Fatal("unexpected response", string(buffer[:count]))
+			}
+		}
+	})
+
+	t.Run("emulated hosts can reach kernel processes", func(t *testing.T) {
+		var listener net.Listener
+		tunRunInNamespace(t, namespace, func() {
+			listener, err = net.Listen("tcp", "10.0.0.99:80")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("Bonsoir, Elliot!"))
+			conn.Close()
+		}()
+		conn, err := client.DialContext(context.Background(), "tcp", "10.0.0.99:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		Must0(conn.SetReadDeadline(time.Now().Add(time.Second)))
+		if data := string(Must1(io.ReadAll(conn))); data != "Bonsoir, Elliot!" {
+			t.Fatal("unexpected data", data)
+		}
+	})
+
+	t.Run("closing the topology deletes the namespace", func(t *testing.T) {
+		topology.Close()
+		if _, err := os.Stat(filepath.Join(tunNamespacesDir, namespace)); !os.IsNotExist(err) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package netem
+
+//
+// TUN devices (other systems)
+//
+
+import "io"
+
+// tunCreate fails because we only support Linux TUN devices.
+func tunCreate(config *TUNNICConfig) (io.ReadWriteCloser, string, func(), error) {
+	return nil, "", nil, ErrTUNNotSupported
+}
@@ -0,0 +1,112 @@
+//go:build linux
+
+package netem
+
+//
+// Socket control messages (Linux)
+//
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// unetMsgTrunc is the flag indicating that we truncated the datagram.
+	unetMsgTrunc = unix.MSG_TRUNC
+
+	// unetMsgCtrunc is the flag indicating that we truncated the control messages.
+	unetMsgCtrunc = unix.MSG_CTRUNC
+)
+
+// unetMarshalOOB writes the control messages describing an incoming datagram
+// into the oob buffer using the format used by Linux and returns the number of
+// bytes written and whether some control messages did not fit into the buffer.
+func unetMarshalOOB(oob []byte, info *unetOOB) (int, bool) {
+	var (
+		offset    int
+		truncated bool
+	)
+
+	// IP_TOS contains a single byte with the TOS of the datagram
+	if info.HasTOS {
+		if body, good := unetAppendCmsg(oob, &offset, unix.IPPROTO_IP, unix.IP_TOS, 1); good {
+			body[0] = info.TOS
+		} else {
+			truncated = true
+		}
+	}
+
+	// IP_PKTINFO contains a struct in_pktinfo
+	if info.LocalAddr.Is4() {
+		pktinfo := unix.Inet4Pktinfo{
+			Ifindex:  int32(info.IfIndex),
+			Spec_dst: info.LocalAddr.As4(),
+			Addr:     info.LocalAddr.As4(),
+		}
+		size := int(unsafe.Sizeof(pktinfo))
+		if body, good := unetAppendCmsg(oob, &offset, unix.IPPROTO_IP, unix.IP_PKTINFO, size); good {
+			copy(body, unsafe.Slice((*byte)(unsafe.Pointer(&pktinfo)), size))
+		} else {
+			truncated = true
+		}
+	}
+
+	return offset, truncated
+}
+
+// unetAppendCmsg appends a control message header to oob at the given offset,
+// updates the offset, and returns the slice where to write the message body.
+func unetAppendCmsg(oob []byte, offset *int, level, typ int32, size int) ([]byte, bool) {
+	space := unix.CmsgSpace(size)
+	if len(oob)-*offset < space {
+		return nil, false
+	}
+	buffer := oob[*offset : *offset+space]
+	clear(buffer)
+	hdr := (*unix.Cmsghdr)(unsafe.Pointer(&buffer[0]))
+	hdr.Level = level
+	hdr.Type = typ
+	hdr.SetLen(unix.CmsgLen(size))
+	*offset += space
+	return buffer[unix.CmsgLen(0):unix.CmsgLen(size)], true
+}
+
+// unetUnmarshalOOB parses the control messages of an outgoing datagram
+// assuming they have been written using the format used by Linux.
+func unetUnmarshalOOB(oob []byte) (*unetOOB, error) {
+	info := &unetOOB{}
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		switch {
+		case msg.Header.Level == unix.IPPROTO_IP && msg.Header.Type == unix.IP_TOS:
+			// the TOS may either be a byte or an int
+			if len(msg.Data) >= 1 {
+				info.HasTOS, info.TOS = true, msg.Data[0]
+			}
+			if len(msg.Data) == 4 {
+				info.TOS = uint8(binary.NativeEndian.Uint32(msg.Data))
+			}
+
+		case msg.Header.Level == unix.IPPROTO_IP && msg.Header.Type == unix.IP_PKTINFO:
+			var pktinfo unix.Inet4Pktinfo
+			if len(msg.Data) >= int(unsafe.Sizeof(pktinfo)) {
+				pktinfo = *(*unix.Inet4Pktinfo)(unsafe.Pointer(&msg.Data[0]))
+				info.LocalAddr = netip.AddrFrom4(pktinfo.Spec_dst)
+				info.IfIndex = int(pktinfo.Ifindex)
+			}
+
+		case msg.Header.Level == unix.IPPROTO_UDP && msg.Header.Type == unix.UDP_SEGMENT:
+			if len(msg.Data) >= 2 {
+				info.SegmentSize = int(binary.NativeEndian.Uint16(msg.Data))
+			}
+		}
+	}
+	return info, nil
+}
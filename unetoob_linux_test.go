@@ -0,0 +1,107 @@
+//go:build linux
+
+package netem
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+func TestUNetStackUDPLikeConnOOB(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+
+	server := Must1(topology.Server.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}))
+	defer server.Close()
+	client := Must1(topology.Client.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 0}))
+	defer client.Close()
+
+	sconn := server.(*unetPacketConnWrapper)
+	cconn := client.(*unetPacketConnWrapper)
+
+	// send three segments using GSO and setting the ECN CE bits
+	oob := make([]byte, unix.CmsgSpace(1)+unix.CmsgSpace(2))
+	offset := 0
+	body, _ := unetAppendCmsg(oob, &offset, unix.IPPROTO_IP, unix.IP_TOS, 1)
+	body[0] = 0x03
+	body, _ = unetAppendCmsg(oob, &offset, unix.IPPROTO_UDP, unix.UDP_SEGMENT, 2)
+	binary.NativeEndian.PutUint16(body, 4)
+	dest := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}
+	n, oobn, err := cconn.WriteMsgUDP([]byte("abcdefghij"), oob[:offset], dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 || oobn != offset {
+		t.Fatal("unexpected write result", n, oobn)
+	}
+
+	// make sure reading cannot block forever if segments get lost
+	if err := sconn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("ReadBatch returns all the queued segments", func(t *testing.T) {
+		ms := make([]ipv4.Message, 4)
+		for idx := range ms {
+			ms[idx].Buffers = [][]byte{make([]byte, 1500)}
+			ms[idx].OOB = make([]byte, 128)
+		}
+		// segments may still be in flight, so we read until we get two of them
+		count := 0
+		for count < 2 {
+			n, err := sconn.ReadBatch(ms[count:2], 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n <= 0 {
+				t.Fatal("unexpected number of messages", n)
+			}
+			count += n
+		}
+		for idx, expect := range []string{"abcd", "efgh"} {
+			msg := ms[idx]
+			if got := string(msg.Buffers[0][:msg.N]); got != expect {
+				t.Fatal("unexpected payload", got)
+			}
+			if got := msg.Addr.String(); got != cconn.LocalAddr().String() {
+				t.Fatal("unexpected source address", got)
+			}
+			info := unetTestParseIncomingOOB(t, msg.OOB[:msg.NN])
+			if info.TOS&0x03 != 0x03 {
+				t.Fatal("unexpected TOS", info.TOS)
+			}
+			if got := info.LocalAddr.String(); got != "10.0.0.1" {
+				t.Fatal("unexpected local address", got)
+			}
+		}
+	})
+
+	t.Run("ReadMsgUDP sets flags on truncation", func(t *testing.T) {
+		buffer := make([]byte, 1)
+		n, oobn, flags, addr, err := sconn.ReadMsgUDP(buffer, make([]byte, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 || string(buffer) != "i" || oobn != 0 || addr == nil {
+			t.Fatal("unexpected read result", n, string(buffer), oobn, addr)
+		}
+		if flags&unix.MSG_TRUNC == 0 || flags&unix.MSG_CTRUNC == 0 {
+			t.Fatal("unexpected flags", flags)
+		}
+	})
+}
+
+// unetTestParseIncomingOOB parses the IP_TOS and IP_PKTINFO control messages
+// of an incoming datagram, which use the same format as outgoing ones.
+func unetTestParseIncomingOOB(t *testing.T, oob []byte) *unetOOB {
+	info, err := unetUnmarshalOOB(oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
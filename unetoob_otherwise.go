@@ -0,0 +1,27 @@
+//go:build !linux
+
+package netem
+
+//
+// Socket control messages (other systems)
+//
+
+const (
+	// unetMsgTrunc is the flag indicating that we truncated the datagram.
+	unetMsgTrunc = 0
+
+	// unetMsgCtrunc is the flag indicating that we truncated the control messages.
+	unetMsgCtrunc = 0
+)
+
+// unetMarshalOOB does not write any control message because we only
+// emulate the control messages format used by Linux.
+func unetMarshalOOB(oob []byte, info *unetOOB) (int, bool) {
+	return 0, false
+}
+
+// unetUnmarshalOOB ignores the control messages because we only
+// emulate the control messages format used by Linux.
+func unetUnmarshalOOB(oob []byte) (*unetOOB, error) {
+	return &unetOOB{}, nil
+}
@@ -8,13 +8,17 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"fmt"
 	"net"
 	"net/netip"
 	"strings"
 	"syscall"
 	"time"
 
-	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"golang.org/x/net/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 )
 
 // UNetStack is a network stack in user space. The zero value is
@@ -33,6 +37,11 @@ import (
 //
 // Use [UNetStack.NIC] to obtain a [NIC] to read and write the [Frames]
 // produced by using the network stack as the [UnderlyingNetwork].
+//
+// A [UNetStack] may be multi-homed. Use [UNetStack.AddNIC] to create
+// additional NICs, [UNetStack.AddRoute] to route destinations through
+// a specific NIC, and [UNetStack.DialContextBind] to bind a dial to
+// the address (and hence the interface) of a specific NIC.
 type UNetStack struct {
 	// ca is the underlying CA.
 	ca *CA
@@ -47,11 +56,60 @@ type UNetStack struct {
 var (
 	_ CertificationAuthority = &UNetStack{}
 	_ HTTPUnderlyingNetwork  = &UNetStack{}
+	_ ICMPListener           = &UNetStack{}
 	_ NIC                    = &UNetStack{}
 	_ UnderlyingNetwork      = &UNetStack{}
 )
 
-// NewUNetStack constructs a new [UNetStack] instance.
+// UNetStackConfig contains OPTIONAL settings for the TCP implementation
+// of a [UNetStack]. The zero value is valid and means that we should use
+// the gvisor defaults, which are similar to the Linux defaults.
+type UNetStackConfig struct {
+	// CongestionControl is the OPTIONAL TCP congestion control algorithm
+	// to use, which is either "reno" or "cubic". The default is "reno".
+	CongestionControl string
+
+	// DisableReceiveBufferAutoTuning OPTIONALLY disables the automatic
+	// tuning of the receive buffer, which is otherwise enabled.
+	DisableReceiveBufferAutoTuning bool
+
+	// DisableSACK OPTIONALLY disables TCP selective acknowledgements
+	// (SACK), which are otherwise enabled.
+	DisableSACK bool
+
+	// EnableNagle OPTIONALLY enables Nagle's algorithm, which is otherwise
+	// disabled, as if all sockets were using TCP_NODELAY. Note that gvisor
+	// always ACKs immediately (i.e., it does not implement delayed ACKs),
+	// so this is the only knob controlling when small segments are sent.
+	EnableNagle bool
+
+	// MSS is the OPTIONAL maximum segment size to use for TCP sockets. When
+	// zero, we compute the MSS from the MTU. Values larger than the MSS
+	// implied by the MTU are silently clamped.
+	MSS int
+
+	// ReceiveBufferSize is the OPTIONAL default size in bytes of the TCP
+	// receive buffer. When zero, we use 1 MiB.
+	ReceiveBufferSize int
+
+	// SendBufferSize is the OPTIONAL default size in bytes of the TCP
+	// send buffer. When zero, we use 1 MiB.
+	SendBufferSize int
+}
+
+// NewUNetStack constructs a new [UNetStack] instance. This function is
+// equivalent to calling [NewUNetStackWithConfig] with an empty config.
+func NewUNetStack(
+	logger Logger,
+	MTU uint32,
+	stackAddress string,
+	ca *CA,
+	resolverAddress string,
+) (*UNetStack, error) {
+	return NewUNetStackWithConfig(logger, MTU, stackAddress, ca, resolverAddress, &UNetStackConfig{})
+}
+
+// NewUNetStackWithConfig constructs a new [UNetStack] instance.
 //
 // Arguments:
 //
@@ -64,13 +122,16 @@ var (
 //
 // - cfg contains TLS MITM configuration;
 //
-// - resolverAddress is the IPv4 address of the resolver.
-func NewUNetStack(
+// - resolverAddress is the IPv4 address of the resolver;
+//
+// - config contains the OPTIONAL TCP settings (nil means using the defaults).
+func NewUNetStackWithConfig(
 	logger Logger,
 	MTU uint32,
 	stackAddress string,
 	ca *CA,
 	resolverAddress string,
+	config *UNetStackConfig,
 ) (*UNetStack, error) {
 	// parse the stack address
 	stackAddr, err := netip.ParseAddr(stackAddress)
@@ -90,8 +151,13 @@ func NewUNetStack(
 		return nil, syscall.EAFNOSUPPORT
 	}
 
+	// a nil config means using the defaults
+	if config == nil {
+		config = &UNetStackConfig{}
+	}
+
 	// create userspace network stack
-	ns, err := newGVisorStack(logger, stackAddr, MTU)
+	ns, err := newGVisorStack(logger, stackAddr, MTU, config)
 	if err != nil {
 		return nil, err
 	}
@@ -174,36 +240,122 @@ func (gs *UNetStack) Close() error {
 // DialContext implements UnderlyingNetwork.
 func (gs *UNetStack) DialContext(
 	ctx context.Context, network string, address string) (net.Conn, error) {
-	var (
-		conn net.Conn
-		err  error
-	)
+	return gs.dialContext(ctx, network, netip.AddrPort{}, address)
+}
+
+// DialContextBind is like [UNetStack.DialContext] but binds the socket
+// to the given local address before connecting. The localAddress must
+// contain either one of the IP addresses assigned to the stack's NICs
+// or the unspecified address (i.e., 0.0.0.0) and a port, where zero
+// means that the stack should choose the port.
+//
+// Because each NIC owns a single IP address, binding to the address
+// of a NIC also forces the connection to use such a NIC, which is how
+// you select an interface when the stack is multi-homed.
+func (gs *UNetStack) DialContextBind(
+	ctx context.Context, network, localAddress, address string) (net.Conn, error) {
+	// parse the local address into a [netip.AddrPort]
+	laddr, err := netip.ParseAddrPort(localAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	// make sure the local address belongs to one of our NICs
+	if _, found := gs.ns.nicByAddress(laddr.Addr()); !found && !laddr.Addr().IsUnspecified() {
+		return nil, syscall.EADDRNOTAVAIL
+	}
+
+	return gs.dialContext(ctx, network, laddr, address)
+}
 
+// dialContext is the common implementation of the dialing methods.
+func (gs *UNetStack) dialContext(
+	ctx context.Context, network string, laddr netip.AddrPort, address string) (net.Conn, error) {
 	// parse the address into a [netip.Addr]
 	addrport, err := netip.ParseAddrPort(address)
 	if err != nil {
 		return nil, err
 	}
 
+	// map family-qualified networks to the corresponding protocol
+	proto, err := unetParseNetwork(network, addrport.Addr())
+	if err != nil {
+		return nil, err
+	}
+
 	// determine what "dial" actualls means in this context (sorry)
-	switch network {
+	switch proto {
 	case "tcp":
-		conn, err = gs.ns.DialContextTCPAddrPort(ctx, addrport)
+		conn, err := gs.ns.DialContextTCPAddrPort(ctx, laddr, addrport)
+		if err != nil {
+			return nil, mapUNetError(err)
+		}
+		return &unetConnWrapper{unetIPConnWrapper{c: conn, ep: conn.ep}}, nil
 
 	case "udp":
-		conn, err = gs.ns.DialUDPAddrPort(netip.AddrPort{}, addrport)
+		conn, err := gs.ns.DialUDPAddrPort(laddr, addrport)
+		if err != nil {
+			return nil, mapUNetError(err)
+		}
+		return &unetIPConnWrapper{c: conn, ep: conn.ep}, nil
 
 	default:
 		return nil, syscall.EPROTOTYPE
 	}
+}
+
+// ErrNoSuchInterface indicates that a stack does not have the given interface.
+var ErrNoSuchInterface = errors.New("netem: no such network interface")
+
+// AddNIC creates an additional [NIC] attached to this stack and using the given
+// IPv4 address. Use a [Link] to connect the returned [NIC] to another [NIC],
+// exactly as you would do with the [NIC] implemented by [UNetStack] itself.
+//
+// Each [NIC] has its own default route, but the default route of the primary
+// [NIC] takes precedence. To use the returned [NIC], either bind a dial to its
+// address using [UNetStack.DialContextBind] or route specific destinations
+// through it using [UNetStack.AddRoute].
+//
+// You do not need to close the returned [NIC] because closing the [UNetStack]
+// also closes all its NICs. Closing the returned [NIC] only brings down such
+// an interface, while the rest of the stack keeps working.
+func (gs *UNetStack) AddNIC(address string) (NIC, error) {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	if !addr.Is4() {
+		return nil, syscall.EAFNOSUPPORT
+	}
+	return gs.ns.addNIC(addr)
+}
 
-	// make sure we return an error on failure
+// AddRoute routes the given destination through the [NIC] with the given
+// interface name. The destination is either an IPv4 address or an IPv4
+// network in CIDR notation (e.g., 10.0.0.0/8). More specific routes take
+// precedence over less specific ones, including the default route.
+func (gs *UNetStack) AddRoute(destination string, ifaceName string) error {
+	nic, found := gs.ns.nicByName(ifaceName)
+	if !found {
+		return fmt.Errorf("%w: %s", ErrNoSuchInterface, ifaceName)
+	}
+	prefix, err := unetParsePrefix(destination)
 	if err != nil {
-		return nil, mapUNetError(err)
+		return err
 	}
+	return gs.ns.addRoute(prefix, nic)
+}
 
-	// wrap returned connection to correctly map errors
-	return &unetConnWrapper{conn}, nil
+// unetParsePrefix parses an IP address or a network in CIDR notation.
+func unetParsePrefix(destination string) (netip.Prefix, error) {
+	if !strings.Contains(destination, "/") {
+		addr, err := netip.ParseAddr(destination)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	return netip.ParsePrefix(destination)
 }
 
 // GetaddrinfoLookupANY implements UnderlyingNetwork.
@@ -233,14 +385,22 @@ func (gs *UNetStack) GetaddrinfoResolverNetwork() string {
 
 // ListenUDP implements UnderlyingNetwork.
 func (gs *UNetStack) ListenUDP(network string, addr *net.UDPAddr) (UDPLikeConn, error) {
-	if network != "udp" {
-		return nil, syscall.EPROTOTYPE
+	// like [net.ListenUDP], a nil addr means listening on a random port
+	if addr == nil {
+		addr = &net.UDPAddr{}
 	}
 
 	// convert addr to [netip.AddrPort]
-	ipaddr, good := netip.AddrFromSlice(addr.IP)
-	if !good {
-		return nil, syscall.EADDRNOTAVAIL
+	ipaddr, err := unetListenAddr(network, addr.IP)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := unetParseNetwork(network, ipaddr)
+	if err != nil {
+		return nil, err
+	}
+	if proto != "udp" {
+		return nil, syscall.EPROTOTYPE
 	}
 	addrport := netip.AddrPortFrom(ipaddr, uint16(addr.Port))
 
@@ -252,16 +412,55 @@ func (gs *UNetStack) ListenUDP(network string, addr *net.UDPAddr) (UDPLikeConn,
 	return &unetPacketConnWrapper{pconn}, nil
 }
 
+// ListenICMP implements ICMPListener.
+func (gs *UNetStack) ListenICMP(network string, addr *net.IPAddr) (net.PacketConn, error) {
+	if network != "ip4:icmp" {
+		return nil, syscall.EPROTOTYPE
+	}
+
+	// like [net.ListenIP], a nil addr means listening on any address
+	if addr == nil {
+		addr = &net.IPAddr{}
+	}
+
+	// convert addr to [netip.Addr]
+	ipaddr, err := unetListenAddr(network, addr.IP)
+	if err != nil {
+		return nil, err
+	}
+
+	pconn, err := gs.ns.ListenICMPAddr(ipaddr)
+	if err != nil {
+		return nil, mapUNetError(err)
+	}
+	return pconn, nil
+}
+
+// Ping sends ICMP echo requests to the given IPv4 address and returns the
+// corresponding replies. See [Net.Ping] for more information.
+func (gs *UNetStack) Ping(ctx context.Context, address string, config *PingConfig) ([]*PingReply, error) {
+	ns := &Net{gs}
+	return ns.Ping(ctx, address, config)
+}
+
 // ListenTCP implements UnderlyingNetwork
 func (gs *UNetStack) ListenTCP(network string, addr *net.TCPAddr) (net.Listener, error) {
-	if network != "tcp" {
-		return nil, syscall.EPROTOTYPE
+	// like [net.ListenTCP], a nil addr means listening on a random port
+	if addr == nil {
+		addr = &net.TCPAddr{}
 	}
 
 	// convert addr to [netip.AddrPort]
-	ipaddr, good := netip.AddrFromSlice(addr.IP)
-	if !good {
-		return nil, syscall.EADDRNOTAVAIL
+	ipaddr, err := unetListenAddr(network, addr.IP)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := unetParseNetwork(network, ipaddr)
+	if err != nil {
+		return nil, err
+	}
+	if proto != "tcp" {
+		return nil, syscall.EPROTOTYPE
 	}
 	addrport := netip.AddrPortFrom(ipaddr, uint16(addr.Port))
 
@@ -273,6 +472,46 @@ func (gs *UNetStack) ListenTCP(network string, addr *net.TCPAddr) (net.Listener,
 	return &unetListenerWrapper{listener}, nil
 }
 
+// unetParseNetwork maps the given network, which may be family-qualified
+// (e.g., "tcp4"), to either "tcp" or "udp" and ensures that the given address
+// belongs to the network's family, if the network is family-qualified.
+func unetParseNetwork(network string, addr netip.Addr) (string, error) {
+	var proto, family string
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		proto, family = "tcp", network[len("tcp"):]
+	case "udp", "udp4", "udp6":
+		proto, family = "udp", network[len("udp"):]
+	default:
+		return "", syscall.EPROTOTYPE
+	}
+	switch {
+	case family == "4" && !addr.Is4():
+		return "", syscall.EAFNOSUPPORT
+	case family == "6" && !addr.Is6():
+		return "", syscall.EAFNOSUPPORT
+	default:
+		return proto, nil
+	}
+}
+
+// unetListenAddr converts the IP address to listen on to a [netip.Addr]. Like
+// the [net] package does, we treat a nil IP as the unspecified address of the
+// network's family, using IPv4 for networks that are not family-qualified.
+func unetListenAddr(network string, ip net.IP) (netip.Addr, error) {
+	if len(ip) <= 0 {
+		if strings.HasSuffix(network, "6") {
+			return netip.IPv6Unspecified(), nil
+		}
+		return netip.IPv4Unspecified(), nil
+	}
+	ipaddr, good := netip.AddrFromSlice(ip)
+	if !good {
+		return netip.Addr{}, syscall.EADDRNOTAVAIL
+	}
+	return ipaddr.Unmap(), nil
+}
+
 // unetSuffixToError maps a gvisor error suffix to an stdlib error.
 type unetSuffixToError struct {
 	// suffix is the unet err.Error() suffix.
@@ -337,61 +576,162 @@ func mapUNetError(err error) error {
 	return err
 }
 
-// unetConnWrapper wraps a [net.Conn] to remap unet errors
-// so that we can emulate stdlib errors.
-type unetConnWrapper struct {
+// unetIPConnWrapper wraps a TCP or UDP [net.Conn] to remap unet errors
+// so that we can emulate stdlib errors and to set IP-level socket options.
+type unetIPConnWrapper struct {
+	// c is the wrapped conn.
 	c net.Conn
+
+	// ep is the TCP or UDP endpoint.
+	ep tcpip.Endpoint
+}
+
+var _ IPLikeConn = &unetIPConnWrapper{}
+
+// unetConnWrapper is like [unetIPConnWrapper] but wraps a TCP
+// conn and therefore also allows setting TCP socket options.
+type unetConnWrapper struct {
+	unetIPConnWrapper
 }
 
-var _ net.Conn = &unetConnWrapper{}
+var _ TCPLikeConn = &unetConnWrapper{}
 
 // Close implements net.Conn
-func (gcw *unetConnWrapper) Close() error {
+func (gcw *unetIPConnWrapper) Close() error {
 	return gcw.c.Close()
 }
 
 // LocalAddr implements net.Conn
-func (gcw *unetConnWrapper) LocalAddr() net.Addr {
+func (gcw *unetIPConnWrapper) LocalAddr() net.Addr {
 	return gcw.c.LocalAddr()
 }
 
 // Read implements net.Conn
-func (gcw *unetConnWrapper) Read(b []byte) (n int, err error) {
+func (gcw *unetIPConnWrapper) Read(b []byte) (n int, err error) {
 	count, err := gcw.c.Read(b)
 	return count, mapUNetError(err)
 }
 
 // RemoteAddr implements net.Conn
-func (gcw *unetConnWrapper) RemoteAddr() net.Addr {
+func (gcw *unetIPConnWrapper) RemoteAddr() net.Addr {
 	return gcw.c.RemoteAddr()
 }
 
 // SetDeadline implements net.Conn
-func (gcw *unetConnWrapper) SetDeadline(t time.Time) error {
+func (gcw *unetIPConnWrapper) SetDeadline(t time.Time) error {
 	return gcw.c.SetDeadline(t)
 }
 
 // SetReadDeadline implements net.Conn
-func (gcw *unetConnWrapper) SetReadDeadline(t time.Time) error {
+func (gcw *unetIPConnWrapper) SetReadDeadline(t time.Time) error {
 	return gcw.c.SetReadDeadline(t)
 }
 
 // SetWriteDeadline implements net.Conn
-func (gcw *unetConnWrapper) SetWriteDeadline(t time.Time) error {
+func (gcw *unetIPConnWrapper) SetWriteDeadline(t time.Time) error {
 	return gcw.c.SetWriteDeadline(t)
 }
 
 // Write implements net.Conn
-func (gcw *unetConnWrapper) Write(b []byte) (n int, err error) {
+func (gcw *unetIPConnWrapper) Write(b []byte) (n int, err error) {
 	count, err := gcw.c.Write(b)
 	return count, mapUNetError(err)
 }
 
+// SetKeepAlive is like [net.TCPConn.SetKeepAlive].
+func (gcw *unetConnWrapper) SetKeepAlive(keepalive bool) error {
+	gcw.ep.SocketOptions().SetKeepAlive(keepalive)
+	return nil
+}
+
+// SetKeepAlivePeriod is like [net.TCPConn.SetKeepAlivePeriod].
+func (gcw *unetConnWrapper) SetKeepAlivePeriod(d time.Duration) error {
+	idle := tcpip.KeepaliveIdleOption(d)
+	if err := gcw.ep.SetSockOpt(&idle); err != nil {
+		return mapUNetError(errors.New(err.String()))
+	}
+	interval := tcpip.KeepaliveIntervalOption(d)
+	if err := gcw.ep.SetSockOpt(&interval); err != nil {
+		return mapUNetError(errors.New(err.String()))
+	}
+	return nil
+}
+
+// CloseWrite is like [net.TCPConn.CloseWrite].
+func (gcw *unetConnWrapper) CloseWrite() error {
+	cwc, good := gcw.c.(interface{ CloseWrite() error })
+	if !good {
+		return syscall.ENOPROTOOPT
+	}
+	return mapUNetError(cwc.CloseWrite())
+}
+
+// SetLinger is like [net.TCPConn.SetLinger].
+func (gcw *unetConnWrapper) SetLinger(sec int) error {
+	gcw.ep.SocketOptions().SetLinger(tcpip.LingerOption{
+		Enabled: sec >= 0,
+		Timeout: time.Duration(max(sec, 0)) * time.Second,
+	})
+	return nil
+}
+
+// SetNoDelay is like [net.TCPConn.SetNoDelay].
+func (gcw *unetConnWrapper) SetNoDelay(noDelay bool) error {
+	// note: the delay option is the inverse of TCP_NODELAY
+	gcw.ep.SocketOptions().SetDelayOption(!noDelay)
+	return nil
+}
+
+// SetTOS implements IPLikeConn
+func (gcw *unetIPConnWrapper) SetTOS(tos int) error {
+	return gcw.setSockOptInt(tcpip.IPv4TOSOption, tos)
+}
+
+// SetTTL implements IPLikeConn
+func (gcw *unetIPConnWrapper) SetTTL(ttl int) error {
+	return gcw.setSockOptInt(tcpip.IPv4TTLOption, ttl)
+}
+
+// setSockOptInt sets an integer socket option.
+func (gcw *unetIPConnWrapper) setSockOptInt(opt tcpip.SockOptInt, value int) error {
+	if err := gcw.ep.SetSockOptInt(opt, value); err != nil {
+		return mapUNetError(errors.New(err.String()))
+	}
+	return nil
+}
+
+// TCPInfo implements TCPLikeConn
+func (gcw *unetConnWrapper) TCPInfo() (*TCPInfo, error) {
+	var info tcpip.TCPInfoOption
+	if err := gcw.ep.GetSockOpt(&info); err != nil {
+		return nil, mapUNetError(errors.New(err.String()))
+	}
+	out := &TCPInfo{
+		RTT:             info.RTT,
+		RTTVar:          info.RTTVar,
+		RTO:             info.RTO,
+		SndCwnd:         info.SndCwnd,
+		SndSsthresh:     info.SndSsthresh,
+		Retransmits:     0,
+		FastRetransmits: 0,
+	}
+	if stats, good := gcw.ep.Stats().(*tcp.Stats); good {
+		out.Retransmits = stats.SendErrors.Retransmits.Value()
+		out.FastRetransmits = stats.SendErrors.FastRetransmit.Value()
+	}
+	return out, nil
+}
+
 // unetPacketConnWrapper wraps a [model.UDPLikeConn] such that we can use
 // this connection with lucas-clemente/quic-go and remaps unet errors to
 // emulate actual stdlib errors.
+//
+// Like [*net.UDPConn], this struct also implements ReadMsgUDP and WriteMsgUDP
+// using the format of Linux control messages (ECN via IP_TOS, packet info via
+// IP_PKTINFO, and segmentation offload via UDP_SEGMENT), and ReadBatch, such
+// that quic-go uses the same code paths it uses with Linux UDP sockets.
 type unetPacketConnWrapper struct {
-	c *gonet.UDPConn
+	c *gvisorUDPConn
 }
 
 var (
@@ -436,14 +776,120 @@ func (gpcw *unetPacketConnWrapper) WriteTo(p []byte, addr net.Addr) (int, error)
 	return count, mapUNetError(err)
 }
 
-// Implementation note: the following function calls are all stubs and they
-// should nonetheless work with lucas-clemente/quic-go.
+// unetOOB contains the information exchanged using control messages.
+type unetOOB struct {
+	// HasTOS indicates whether TOS is valid.
+	HasTOS bool
+
+	// IfIndex is the index of the interface (IP_PKTINFO).
+	IfIndex int
+
+	// LocalAddr is the local address (IP_PKTINFO).
+	LocalAddr netip.Addr
+
+	// SegmentSize is the segment size for outgoing datagrams (UDP_SEGMENT).
+	SegmentSize int
+
+	// TOS is the IPv4 TOS including the ECN bits (IP_TOS).
+	TOS uint8
+}
+
+// ReadMsgUDP is like [net.UDPConn.ReadMsgUDP].
+func (gpcw *unetPacketConnWrapper) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	return gpcw.readMsgUDP(b, oob, true)
+}
+
+// readMsgUDP implements ReadMsgUDP and ReadBatch.
+func (gpcw *unetPacketConnWrapper) readMsgUDP(
+	b, oob []byte, block bool) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	dgram, err := gpcw.c.ReadDatagram(b, block)
+	if err != nil {
+		return 0, 0, 0, nil, mapUNetError(err)
+	}
+	if dgram.Truncated {
+		flags |= unetMsgTrunc
+	}
+	info := &unetOOB{
+		HasTOS:      true,
+		IfIndex:     dgram.IfIndex,
+		LocalAddr:   dgram.LocalAddr.Unmap(),
+		SegmentSize: 0,
+		TOS:         dgram.TOS,
+	}
+	oobn, truncated := unetMarshalOOB(oob, info)
+	if truncated {
+		flags |= unetMsgCtrunc
+	}
+	return dgram.Count, oobn, flags, net.UDPAddrFromAddrPort(dgram.RemoteAddr), nil
+}
+
+// WriteMsgUDP is like [net.UDPConn.WriteMsgUDP]. When the control messages
+// contain UDP_SEGMENT, we split b into datagrams of the given size.
+func (gpcw *unetPacketConnWrapper) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	info, err := unetUnmarshalOOB(oob)
+	if err != nil {
+		return 0, 0, err
+	}
+	var dest netip.AddrPort
+	if addr != nil {
+		dest = addr.AddrPort()
+	}
+	segmentSize := len(b)
+	if info.SegmentSize > 0 {
+		segmentSize = info.SegmentSize
+	}
+	for {
+		segment := b[n:min(n+segmentSize, len(b))]
+		count, err := gpcw.c.WriteDatagram(segment, dest, info.TOS)
+		if err != nil {
+			return n, 0, mapUNetError(err)
+		}
+		n += count
+		if n >= len(b) {
+			return n, len(oob), nil
+		}
+	}
+}
+
+// ReadBatch is like [ipv4.PacketConn.ReadBatch]. We block until we can read
+// the first message and then we read as many queued messages as possible.
+func (gpcw *unetPacketConnWrapper) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	for idx := range ms {
+		msg := &ms[idx]
+		if len(msg.Buffers) < 1 {
+			return idx, syscall.EINVAL
+		}
+		count, oobn, mflags, addr, err := gpcw.readMsgUDP(msg.Buffers[0], msg.OOB, idx == 0)
+		if errors.Is(err, errGVisorWouldBlock) {
+			return idx, nil
+		}
+		if err != nil {
+			return idx, err
+		}
+		msg.N, msg.NN, msg.Flags, msg.Addr = count, oobn, mflags, addr
+	}
+	return len(ms), nil
+}
 
 // SetReadBuffer implements model.UDPLikeConn
 func (gpcw *unetPacketConnWrapper) SetReadBuffer(bytes int) error {
+	gpcw.c.ep.SocketOptions().SetReceiveBufferSize(int64(bytes), true)
 	return nil
 }
 
+// SetWriteBuffer is like [net.UDPConn.SetWriteBuffer].
+func (gpcw *unetPacketConnWrapper) SetWriteBuffer(bytes int) error {
+	gpcw.c.ep.SocketOptions().SetSendBufferSize(int64(bytes), true)
+	return nil
+}
+
+// Implementation note: the following syscall.RawConn methods do not invoke
+// the given function because there is no file descriptor. Because quic-go uses
+// these methods to set socket options and checks whether the operation failed
+// by looking at errors set by the function, not calling the function signals
+// quic-go that the socket supports ECN, DF, packet info, and segmentation
+// offload (GSO), which we implement in ReadMsgUDP and WriteMsgUDP.
+
 // SyscallConn implements model.UDPLikeConn
 func (gpcw *unetPacketConnWrapper) SyscallConn() (syscall.RawConn, error) {
 	return gpcw, nil
@@ -467,7 +913,7 @@ func (gpcw *unetPacketConnWrapper) Write(f func(fd uintptr) (done bool)) error {
 // unetListenerWrapper wraps a [net.Listener] and maps unet
 // errors to the corresponding stdlib errors.
 type unetListenerWrapper struct {
-	l *gonet.TCPListener
+	l *gvisorTCPListener
 }
 
 var _ net.Listener = &unetListenerWrapper{}
@@ -478,7 +924,7 @@ func (glw *unetListenerWrapper) Accept() (net.Conn, error) {
 	if err != nil {
 		return nil, mapUNetError(err)
 	}
-	return &unetConnWrapper{conn}, nil
+	return &unetConnWrapper{unetIPConnWrapper{c: conn, ep: conn.ep}}, nil
 }
 
 // Addr implements net.Listener
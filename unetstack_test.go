@@ -0,0 +1,339 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// unetTestAcceptRemoteAddrs accepts connections using the given listener
+// and posts the remote IP address of each connection on the returned channel.
+func unetTestAcceptRemoteAddrs(listener net.Listener) <-chan string {
+	addrs := make(chan string, 16)
+	go func() {
+		defer close(addrs)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			addr, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			conn.Close()
+			addrs <- addr
+		}
+	}()
+	return addrs
+}
+
+func TestUNetStackMultiHoming(t *testing.T) {
+	topology := MustNewStarTopology(&NullLogger{})
+	defer topology.Close()
+
+	client, err := topology.AddHost("10.0.0.2", "0.0.0.0", &LinkConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := topology.AddHost("10.0.0.1", "0.0.0.0", &LinkConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wifi, err := topology.AddNIC(client, "10.0.1.2", &LinkConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	addrs := unetTestAcceptRemoteAddrs(listener)
+
+	// dial and return the source address seen by the server
+	dial := func(t *testing.T, dialer func() (net.Conn, error)) string {
+		conn, err := dialer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return <-addrs
+	}
+
+	t.Run("by default we use the primary NIC", func(t *testing.T) {
+		got := dial(t, func() (net.Conn, error) {
+			return client.DialContext(context.Background(), "tcp", "10.0.0.1:80")
+		})
+		if got != "10.0.0.2" {
+			t.Fatal("unexpected source address", got)
+		}
+	})
+
+	t.Run("we can bind to the address of another NIC", func(t *testing.T) {
+		got := dial(t, func() (net.Conn, error) {
+			return client.DialContextBind(context.Background(), "tcp", "10.0.1.2:0", "10.0.0.1:80")
+		})
+		if got != "10.0.1.2" {
+			t.Fatal("unexpected source address", got)
+		}
+	})
+
+	t.Run("we cannot bind to an address we do not own", func(t *testing.T) {
+		conn, err := client.DialContextBind(context.Background(), "tcp", "10.0.2.2:0", "10.0.0.1:80")
+		if !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			t.Fatal("unexpected error", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("we cannot route using a nonexistent NIC", func(t *testing.T) {
+		err := client.AddRoute("10.0.0.0/24", "nonexistent0")
+		if !errors.Is(err, ErrNoSuchInterface) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("more specific routes take precedence over the default route", func(t *testing.T) {
+		if err := client.AddRoute("10.0.0.1", wifi.InterfaceName()); err != nil {
+			t.Fatal(err)
+		}
+		got := dial(t, func() (net.Conn, error) {
+			return client.DialContext(context.Background(), "tcp", "10.0.0.1:80")
+		})
+		if got != "10.0.1.2" {
+			t.Fatal("unexpected source address", got)
+		}
+	})
+
+	t.Run("we cannot add the same address twice", func(t *testing.T) {
+		if _, err := client.AddNIC("10.0.1.2"); !errors.Is(err, syscall.EADDRINUSE) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
+
+func TestUNetStackConfig(t *testing.T) {
+	t.Run("we apply the TCP settings", func(t *testing.T) {
+		config := &UNetStackConfig{
+			CongestionControl:              "cubic",
+			DisableReceiveBufferAutoTuning: true,
+			DisableSACK:                    true,
+			EnableNagle:                    true,
+			MSS:                            536,
+			ReceiveBufferSize:              1 << 16,
+			SendBufferSize:                 1 << 17,
+		}
+		stack, err := NewUNetStackWithConfig(&NullLogger{}, 1500, "10.0.0.1", MustNewCA(), "0.0.0.0", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stack.Close()
+
+		var cc tcpip.CongestionControlOption
+		Must0(unetTestTCPOption(stack, &cc))
+		if cc != "cubic" {
+			t.Fatal("unexpected congestion control", cc)
+		}
+
+		var sack tcpip.TCPSACKEnabled
+		Must0(unetTestTCPOption(stack, &sack))
+		if sack {
+			t.Fatal("expected SACK to be disabled")
+		}
+
+		var nagle tcpip.TCPDelayEnabled
+		Must0(unetTestTCPOption(stack, &nagle))
+		if !nagle {
+			t.Fatal("expected Nagle to be enabled")
+		}
+
+		var moderate tcpip.TCPModerateReceiveBufferOption
+		Must0(unetTestTCPOption(stack, &moderate))
+		if moderate {
+			t.Fatal("expected receive buffer auto tuning to be disabled")
+		}
+
+		var rcvbuf tcpip.TCPReceiveBufferSizeRangeOption
+		Must0(unetTestTCPOption(stack, &rcvbuf))
+		if rcvbuf.Default != 1<<16 {
+			t.Fatal("unexpected receive buffer size", rcvbuf.Default)
+		}
+
+		var sndbuf tcpip.TCPSendBufferSizeRangeOption
+		Must0(unetTestTCPOption(stack, &sndbuf))
+		if sndbuf.Default != 1<<17 {
+			t.Fatal("unexpected send buffer size", sndbuf.Default)
+		}
+
+		listener, err := stack.ns.ListenTCPAddrPort(netip.MustParseAddrPort("10.0.0.1:80"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+	})
+
+	t.Run("a nil config means using the defaults", func(t *testing.T) {
+		stack, err := NewUNetStackWithConfig(&NullLogger{}, 1500, "10.0.0.1", MustNewCA(), "0.0.0.0", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stack.Close()
+	})
+
+	t.Run("we fail with an unknown congestion control algorithm", func(t *testing.T) {
+		config := &UNetStackConfig{CongestionControl: "antani"}
+		stack, err := NewUNetStackWithConfig(&NullLogger{}, 1500, "10.0.0.1", MustNewCA(), "0.0.0.0", config)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if stack != nil {
+			t.Fatal("expected nil stack")
+		}
+	})
+
+	t.Run("we honour the configured MSS", func(t *testing.T) {
+		config := &UNetStackConfig{MSS: 536}
+		stack, err := NewUNetStackWithConfig(&NullLogger{}, 1500, "10.0.0.1", MustNewCA(), "0.0.0.0", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stack.Close()
+		var wq waiter.Queue
+		ep, err := stack.ns.newTCPEndpoint(ipv4.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ep.Close()
+		mss, terr := ep.GetSockOptInt(tcpip.MaxSegOption)
+		if terr != nil {
+			t.Fatal(terr)
+		}
+		if mss != 536 {
+			t.Fatal("unexpected MSS", mss)
+		}
+	})
+}
+
+// unetTestTCPOption reads a TCP protocol option from the given stack.
+func unetTestTCPOption(stack *UNetStack, option tcpip.GettableTransportProtocolOption) error {
+	if err := stack.ns.stack.TransportProtocolOption(tcp.ProtocolNumber, option); err != nil {
+		return errors.New(err.String())
+	}
+	return nil
+}
+
+func TestUNetStackTCPLikeConn(t *testing.T) {
+	topology := MustNewPPPTopology("10.0.0.2", "10.0.0.1", &NullLogger{}, &LinkConfig{})
+	defer topology.Close()
+
+	listener, err := topology.Server.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// the server echoes back data until the client closes the write side
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	conn, err := topology.Client.DialContext(context.Background(), "tcp", "10.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tconn, good := conn.(TCPLikeConn)
+	if !good {
+		t.Fatal("expected a TCPLikeConn")
+	}
+
+	t.Run("accepted conns are also TCPLikeConn", func(t *testing.T) {
+		sconn := <-accepted
+		if _, good := sconn.(TCPLikeConn); !good {
+			t.Fatal("expected a TCPLikeConn")
+		}
+	})
+
+	t.Run("we can set socket options", func(t *testing.T) {
+		ep := conn.(*unetConnWrapper).ep
+		Must0(tconn.SetNoDelay(false))
+		if !ep.SocketOptions().GetDelayOption() {
+			t.Fatal("expected Nagle to be enabled")
+		}
+		Must0(tconn.SetLinger(5))
+		if linger := ep.SocketOptions().GetLinger(); !linger.Enabled || linger.Timeout != 5*time.Second {
+			t.Fatal("unexpected linger", linger)
+		}
+		Must0(tconn.SetTTL(7))
+		if ttl, _ := ep.GetSockOptInt(tcpip.IPv4TTLOption); ttl != 7 {
+			t.Fatal("unexpected TTL", ttl)
+		}
+		Must0(tconn.SetTOS(0x10))
+		if tos, _ := ep.GetSockOptInt(tcpip.IPv4TOSOption); tos != 0x10 {
+			t.Fatal("unexpected TOS", tos)
+		}
+	})
+
+	t.Run("we can get TCP info and close the write side", func(t *testing.T) {
+		message := []byte("antani")
+		Must1(conn.Write(message))
+		Must0(tconn.CloseWrite())
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(message) {
+			t.Fatal("unexpected data", string(data))
+		}
+		info, err := tconn.TCPInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.RTT <= 0 || info.SndCwnd <= 0 {
+			t.Fatalf("unexpected TCP info %+v", info)
+		}
+	})
+
+	t.Run("UDP conns only support IP-level socket options", func(t *testing.T) {
+		uconn, err := topology.Client.DialContext(context.Background(), "udp", "10.0.0.1:53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer uconn.Close()
+		if _, good := uconn.(TCPLikeConn); good {
+			t.Fatal("expected UDP conns not to be TCPLikeConn")
+		}
+		iuconn, good := uconn.(IPLikeConn)
+		if !good {
+			t.Fatal("expected an IPLikeConn")
+		}
+		ep := uconn.(*unetIPConnWrapper).ep
+		Must0(iuconn.SetTTL(3))
+		if ttl, _ := ep.GetSockOptInt(tcpip.IPv4TTLOption); ttl != 3 {
+			t.Fatal("unexpected TTL", ttl)
+		}
+		Must0(iuconn.SetTOS(0x20))
+		if tos, _ := ep.GetSockOptInt(tcpip.IPv4TOSOption); tos != 0x20 {
+			t.Fatal("unexpected TOS", tos)
+		}
+	})
+}